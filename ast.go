@@ -3,6 +3,8 @@
 
 package mk
 
+import "fmt"
+
 // Node is the interface for all AST nodes.
 type Node interface {
 	node()
@@ -10,7 +12,24 @@ type Node interface {
 
 // File represents a parsed mkfile.
 type File struct {
-	Stmts []Node
+	Path      string // source path, set by the caller; "" if unknown
+	Stmts     []Node
+	Warnings  []Warning // suspicious but valid constructs
+	MKVersion string    // constraint from the mk-version directive, e.g. ">= 0.5"; "" if none
+}
+
+// Warning is a non-fatal diagnostic from parsing an mkfile.
+type Warning struct {
+	File string // "" if unknown
+	Line int
+	Msg  string
+}
+
+func (w Warning) String() string {
+	if w.File == "" {
+		return fmt.Sprintf("line %d: warning: %s", w.Line, w.Msg)
+	}
+	return fmt.Sprintf("%s:%d: warning: %s", w.File, w.Line, w.Msg)
 }
 
 // VarAssign represents a variable assignment: name = value, name += value, lazy name = value.
@@ -19,6 +38,7 @@ type VarAssign struct {
 	Op    AssignOp
 	Value string
 	Lazy  bool
+	Doc   string // the comment lines directly above, without #
 	Line  int
 }
 
@@ -36,9 +56,17 @@ type Rule struct {
 	Prereqs          []string
 	OrderOnlyPrereqs []string // after |
 	Recipe           []string
-	IsTask           bool   // ! prefix
-	Keep             bool   // [keep] annotation
-	Fingerprint      string // [fingerprint: command] for non-file artifacts
+	IsTask           bool     // ! prefix
+	Keep             bool     // [keep] annotation
+	Service          bool     // [service] annotation, for tasks
+	Fingerprint      string   // [fingerprint: command] for non-file artifacts
+	Provides         []string // [provides: globs], files the recipe also generates
+	Check            string   // [check: mtime|hash], how staleness is checked; "" for hash
+	Canonical        string   // [canonical: command], whose output is hashed in place of each target
+	Depfile          string   // [depfile: path], a Make-style .d file the recipe writes
+	Shell            string   // [shell: command], the interpreter the recipe runs with
+	Cwd              string   // [cwd: path], the directory the recipe runs in
+	Doc              string   // the comment lines directly above, without #
 	Line             int
 }
 
@@ -77,9 +105,38 @@ type ConfigDef struct {
 	Excludes []string    // mutually exclusive configs
 	Requires []string    // targets that must be built before any :config build
 	Vars     []VarAssign // variable overrides
+	Doc      string      // the comment lines directly above, without #
 	Line     int
 }
 
+// PluginDef represents a plugin directive: plugin fn1 fn2: command.
+type PluginDef struct {
+	Funcs   []string // function names provided by the plugin
+	Command string   // shell command that runs the plugin (unexpanded)
+	Line    int
+}
+
+// ToolDef represents a tool declaration: tool name = path. Recipes find
+// declared tools, and only those, on their PATH.
+type ToolDef struct {
+	Name string // command name recipes run the tool by
+	Path string // the tool's file: a target, or an existing file (unexpanded)
+	Line int
+}
+
+// CacheDef represents a remote cache declaration: cache <url>.
+type CacheDef struct {
+	URL  string // unexpanded
+	Line int
+}
+
+// Prelude represents a prelude block: shell lines, typically function
+// definitions, that run at the start of every recipe.
+type Prelude struct {
+	Lines []string // unexpanded, like recipe lines
+	Line  int
+}
+
 // Loop represents a for loop: for var in list: ... end
 type Loop struct {
 	Var  string // loop variable name
@@ -88,6 +145,13 @@ type Loop struct {
 	Line int
 }
 
+// Eval represents an eval statement: eval text. The expanded text is
+// parsed and evaluated as mkfile source.
+type Eval struct {
+	Text string // unexpanded
+	Line int
+}
+
 func (VarAssign) node()   {}
 func (Rule) node()        {}
 func (Include) node()     {}
@@ -95,3 +159,8 @@ func (Conditional) node() {}
 func (FuncDef) node()     {}
 func (ConfigDef) node()   {}
 func (Loop) node()        {}
+func (PluginDef) node()   {}
+func (ToolDef) node()     {}
+func (Prelude) node()     {}
+func (CacheDef) node()    {}
+func (Eval) node()        {}
@@ -0,0 +1,115 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditLog appends one JSON line per executed recipe to a file.
+type auditLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	base map[string]string // mk's own environment, for diffs
+	err  error             // first write error
+}
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Target     string            `json:"target"`
+	Targets    []string          `json:"targets,omitempty"`
+	Command    string            `json:"command"`             // expanded recipe, as run by the rule's interpreter
+	Dir        string            `json:"cwd"`                 // absolute directory the recipe ran in
+	EnvSet     map[string]string `json:"env_set,omitempty"`   // added or changed relative to mk's environment
+	EnvUnset   []string          `json:"env_unset,omitempty"` // removed relative to mk's environment
+	ExitStatus int               `json:"exit_status"`         // -1 if the command didn't exit normally
+	Error      string            `json:"error,omitempty"`
+}
+
+// openAuditLog opens path for appending, creating it and its directory
+// as needed.
+func openAuditLog(path string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	base := make(map[string]string)
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		base[k] = v
+	}
+	return &auditLog{f: f, base: base}, nil
+}
+
+// record logs an executed job and its outcome. Credential-like variables
+// are redacted.
+func (a *auditLog) record(job *Job, start, end time.Time, runErr error) {
+	entry := AuditEntry{
+		Start:   start.UTC(),
+		End:     end.UTC(),
+		Target:  job.Target,
+		Targets: job.Targets,
+		Command: job.Script,
+	}
+	entry.Dir, _ = filepath.Abs(job.workdir())
+	seen := make(map[string]bool, len(job.Env))
+	for _, kv := range job.Env {
+		k, v, _ := strings.Cut(kv, "=")
+		seen[k] = true
+		if old, ok := a.base[k]; !ok || old != v {
+			if entry.EnvSet == nil {
+				entry.EnvSet = make(map[string]string)
+			}
+			entry.EnvSet[k] = redactValue(k, v)
+		}
+	}
+	for k := range a.base {
+		if !seen[k] {
+			entry.EnvUnset = append(entry.EnvUnset, k)
+		}
+	}
+	sort.Strings(entry.EnvUnset)
+
+	if runErr != nil {
+		entry.ExitStatus = -1
+		var exitErr *exec.ExitError
+		if errors.As(runErr, &exitErr) {
+			entry.ExitStatus = exitErr.ExitCode()
+		}
+		entry.Error = runErr.Error()
+	}
+
+	data, err := json.Marshal(entry)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err == nil {
+		_, err = a.f.Write(append(data, '\n'))
+	}
+	if err != nil && a.err == nil {
+		a.err = err
+	}
+}
+
+// Close closes the log and returns the first error seen while writing it.
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.f.Close(); a.err == nil {
+		a.err = err
+	}
+	return a.err
+}
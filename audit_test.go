@@ -0,0 +1,93 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+flavour = mint
+
+out.txt: in.txt
+    cp $input $target
+
+!fail:
+    exit 3
+`), 0o644)
+	os.WriteFile("in.txt", []byte("data"), 0o644)
+
+	build := func(target string) error {
+		_, err := loadAndBuild(t, Options{Jobs: 1, Stderr: io.Discard, Audit: ".mk/audit.jsonl"}, target)
+		return err
+	}
+	if err := build("out.txt"); err != nil {
+		t.Fatal(err)
+	}
+	build("out.txt") // up to date: not logged
+	if err := build("fail"); err == nil {
+		t.Fatal("expected failure")
+	}
+
+	f, err := os.Open(".mk/audit.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if e := entries[0]; e.Target != "out.txt" || e.Command != "set -e\ncp in.txt out.txt" || e.ExitStatus != 0 || e.EnvSet["flavour"] != "mint" || e.Dir == "" {
+		t.Errorf("entry 0 = %+v", e)
+	}
+	if e := entries[1]; e.Target != "fail" || e.ExitStatus != 3 || e.Error == "" {
+		t.Errorf("entry 1 = %+v", e)
+	}
+}
+
+func TestAuditLogCwd(t *testing.T) {
+	dir, _ := filepath.EvalSymlinks(t.TempDir())
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+out.txt [cwd: sub]:
+    pwd > $target
+`), 0o644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+
+	mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard, Audit: ".mk/audit.jsonl"}, "out.txt")
+	data, err := os.ReadFile(filepath.Join(dir, ".mk", "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e AuditEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "sub"); e.Dir != want {
+		t.Errorf("cwd = %q, want %q", e.Dir, want)
+	}
+	if pwd, _ := os.ReadFile(filepath.Join(dir, "out.txt")); strings.TrimSpace(string(pwd)) != e.Dir {
+		t.Errorf("recipe ran in %q, logged as %q", pwd, e.Dir)
+	}
+}
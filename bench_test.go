@@ -0,0 +1,182 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// benchTree is the number of source files in the synthetic trees, spread
+// over directories of benchTreeDir files each.
+const (
+	benchTree    = 50000
+	benchTreeDir = 500
+)
+
+// writeBenchTree creates the synthetic source tree in the current
+// directory, as src/dN/fM.c, and returns its directories.
+func writeBenchTree(b *testing.B) []string {
+	b.Helper()
+	var dirs []string
+	for d := range benchTree / benchTreeDir {
+		dir := fmt.Sprintf("src/d%d", d)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			b.Fatal(err)
+		}
+		for f := range benchTreeDir {
+			if err := os.WriteFile(fmt.Sprintf("%s/f%d.c", dir, f), fmt.Appendf(nil, "int f%d_%d;\n", d, f), 0o644); err != nil {
+				b.Fatal(err)
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func benchChdir(b *testing.B) {
+	b.Helper()
+	dir := b.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	b.Cleanup(func() { os.Chdir(oldDir) })
+}
+
+// largeMkfile returns a synthetic mkfile with n explicit rules over
+// pattern-built objects, and variables that reference one another.
+func largeMkfile(n int) string {
+	var b strings.Builder
+	b.WriteString("cc = cc\ncflags = -O2 -Wall\nbuild = build\n")
+	for i := range 50 {
+		fmt.Fprintf(&b, "flags%d = $cflags -DN=%d\n", i, i)
+		fmt.Fprintf(&b, "$build/{name}.%d.o: src/{name}.%d.c\n    $cc $flags%d -c $input -o $target\n\n", i, i, i)
+	}
+	for i := range n {
+		fmt.Fprintf(&b, "$build/bin%d: $build/m%d.%d.o $build/n%d.%d.o\n    $cc -o $target $inputs\n\n", i, i, i%50, i, (i+1)%50)
+	}
+	return b.String()
+}
+
+func BenchmarkExpand(b *testing.B) {
+	vars := NewVars()
+	vars.Set("cc", "cc")
+	vars.Set("cflags", "-O2 -Wall -Iinclude")
+	vars.Set("build", "build/release")
+	vars.Set("srcs", "a.c b.c c.c d.c e.c f.c g.c h.c")
+	vars.Set("objs", "$[patsubst %.c,$build/%.o,$srcs]")
+	const recipe = "$cc $cflags -c $srcs -o $build/out && echo ${objs} $[words $srcs]"
+	b.ResetTimer()
+	for range b.N {
+		vars.Expand(recipe)
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	benchChdir(b)
+	if err := os.WriteFile("mkfile", []byte(largeMkfile(5000)), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for range b.N {
+		if _, err := Load(context.Background(), "mkfile", Options{Stderr: io.Discard}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResolveLarge(b *testing.B) {
+	f, err := Parse(strings.NewReader(largeMkfile(5000)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	graph, err := BuildGraph(f, NewVars(), &BuildState{Targets: make(map[string]*TargetState)}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := range b.N {
+		target := fmt.Sprintf("build/bin%d", i%5000)
+		if i%2 == 1 {
+			target = fmt.Sprintf("build/m%d.%d.o", i%5000, i%50)
+		}
+		if _, err := graph.resolve(target); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHashCacheCold(b *testing.B) {
+	benchChdir(b)
+	dirs := writeBenchTree(b)
+	b.ResetTimer()
+	for range b.N {
+		cache := NewHashCache()
+		for _, dir := range dirs {
+			for f := range benchTreeDir {
+				if _, err := cache.Hash(fmt.Sprintf("%s/f%d.c", dir, f)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkHashCacheWarm(b *testing.B) {
+	benchChdir(b)
+	dirs := writeBenchTree(b)
+	cache := NewHashCache()
+	paths := make([]string, 0, benchTree)
+	for _, dir := range dirs {
+		for f := range benchTreeDir {
+			paths = append(paths, fmt.Sprintf("%s/f%d.c", dir, f))
+		}
+	}
+	for _, p := range paths {
+		cache.Hash(p)
+	}
+	b.ResetTimer()
+	for range b.N {
+		for _, p := range paths {
+			if _, err := cache.Hash(p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkUpToDate measures a build that has nothing to do: loading the
+// mkfile and checking every target against the 50k-file tree.
+func BenchmarkUpToDate(b *testing.B) {
+	benchChdir(b)
+	dirs := writeBenchTree(b)
+	var mkfile strings.Builder
+	mkfile.WriteString("!all:")
+	for _, dir := range dirs {
+		fmt.Fprintf(&mkfile, " out/%s.list", filepath.Base(dir))
+	}
+	mkfile.WriteString("\n    true\n\n")
+	for _, dir := range dirs {
+		fmt.Fprintf(&mkfile, "out/%s.list:", filepath.Base(dir))
+		for f := range benchTreeDir {
+			fmt.Fprintf(&mkfile, " %s/f%d.c", dir, f)
+		}
+		mkfile.WriteString("\n    mkdir -p out && echo $inputs > $target\n\n")
+	}
+	if err := os.WriteFile("mkfile", []byte(mkfile.String()), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	build := func() {
+		mustBuild(b, Options{LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "all")
+	}
+	build()
+	b.ResetTimer()
+	for range b.N {
+		build()
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// actionCache stores the outputs of recipes by action digest — a hash of
+// the expanded recipe, the targets and the content of the prerequisites —
+// so a build can restore them instead of running the recipe again. Entries
+// name targets by their paths relative to the workspace, which are the
+// same in every checkout of a repository, so checkouts can share a cache.
+//
+// Layout: ac/<digest> holds a JSON actionEntry, and cas/<xx>/<hash> holds
+// each output's content, keyed by its SHA-256.
+type actionCache struct {
+	dir    string
+	root   workspace    // where the targets are
+	remote *remoteCache // consulted on a miss and given what is stored; nil if none
+}
+
+// actionEntry records the outputs of an action, in target order.
+type actionEntry struct {
+	Outputs []actionOutput `json:"outputs"`
+}
+
+type actionOutput struct {
+	Path string      `json:"path"`
+	Hash string      `json:"hash"`
+	Mode os.FileMode `json:"mode"`
+}
+
+// sharedCacheDir returns the cache directory for the repository containing
+// dir: $XDG_CACHE_HOME/mk/<repo-id>, or the platform's
+// user cache directory if XDG_CACHE_HOME is unset. Worktrees of one git
+// repository share an id; outside git, each directory has its own.
+func sharedCacheDir(ctx context.Context, dir workspace) (string, error) {
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		var err error
+		if base, err = os.UserCacheDir(); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(base, "mk", repoID(ctx, dir)), nil
+}
+
+// repoID identifies the repository and the directory within it that dir
+// is.
+func repoID(ctx context.Context, dir workspace) string {
+	out, err := dir.command(ctx, "git", "rev-parse", "--path-format=absolute", "--git-common-dir", "--show-prefix").Output()
+	if lines := strings.Split(string(out), "\n"); err == nil && len(lines) >= 2 {
+		return hashString("git\x00" + lines[0] + "\x00" + lines[1])[:16]
+	}
+	abs, _ := filepath.Abs(dir.path("."))
+	return hashString("dir\x00" + abs)[:16]
+}
+
+// actionDigest returns the digest of building targets with recipeText
+// from prereqs, or "" if a prerequisite can't be hashed (a directory, say).
+func actionDigest(targets, prereqs []string, recipeText string, cache *HashCache) string {
+	var b strings.Builder
+	b.WriteString("mk action v1\x00")
+	b.WriteString(recipeText)
+	for _, t := range targets {
+		b.WriteString("\x00target\x00" + t)
+	}
+	for _, p := range prereqs {
+		h, err := cache.Hash(p)
+		if err != nil {
+			return ""
+		}
+		b.WriteString("\x00input\x00" + p + "\x00" + h)
+	}
+	return hashString(b.String())
+}
+
+func (c *actionCache) entryPath(digest string) string {
+	return filepath.Join(c.dir, "ac", digest)
+}
+
+func (c *actionCache) blobPath(hash string) string {
+	return filepath.Join(c.dir, "cas", hash[:2], hash)
+}
+
+// restore writes the outputs recorded for digest to targets. It reports
+// whether there was a complete entry for exactly those targets.
+func (c *actionCache) restore(digest string, targets []string) bool {
+	data, err := os.ReadFile(c.entryPath(digest))
+	if err != nil {
+		if c.remote == nil || !c.fetch(digest) {
+			return false
+		}
+		if data, err = os.ReadFile(c.entryPath(digest)); err != nil {
+			return false
+		}
+	}
+	entry, ok := parseActionEntry(data)
+	if !ok || len(entry.Outputs) != len(targets) {
+		return false
+	}
+	for i, out := range entry.Outputs {
+		if out.Path != targets[i] {
+			return false
+		}
+		if _, err := os.Stat(c.blobPath(out.Hash)); err != nil {
+			return false
+		}
+	}
+	for _, out := range entry.Outputs {
+		if err := copyFileAtomic(c.blobPath(out.Hash), c.root.path(out.Path), out.Mode); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// store records targets, just built, as the outputs of digest. Targets
+// that aren't regular files make the action uncacheable.
+func (c *actionCache) store(digest string, targets []string, cache *HashCache) error {
+	var entry actionEntry
+	for _, t := range targets {
+		info, err := os.Stat(c.root.path(t))
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		h, err := cache.Hash(t)
+		if _, ok := cache.canonical[t]; ok {
+			h, err = hashFile(c.root.path(t)) // blobs are keyed by their content
+		}
+		if err != nil {
+			return err
+		}
+		blob := c.blobPath(h)
+		if _, err := os.Stat(blob); err != nil {
+			if err := copyFileAtomic(c.root.path(t), blob, 0o444); err != nil {
+				return err
+			}
+		}
+		entry.Outputs = append(entry.Outputs, actionOutput{Path: t, Hash: h, Mode: info.Mode().Perm()})
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.entryPath(digest), data); err != nil {
+		return err
+	}
+	if c.remote != nil {
+		if err := c.push(digest, data, entry); err != nil {
+			return fmt.Errorf("remote cache: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseActionEntry parses an ac/ entry, checking that its hashes are
+// SHA-256s, as they name files and, remotely, URLs.
+func parseActionEntry(data []byte) (actionEntry, bool) {
+	var entry actionEntry
+	if json.Unmarshal(data, &entry) != nil {
+		return entry, false
+	}
+	for _, out := range entry.Outputs {
+		if b, err := hex.DecodeString(out.Hash); err != nil || len(b) != sha256.Size {
+			return entry, false
+		}
+	}
+	return entry, true
+}
+
+// copyFileAtomic copies src to dst with the given permissions, replacing
+// dst in one step so concurrent readers never see a partial file.
+func copyFileAtomic(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".mk-tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// writeFileAtomic replaces the file at path with data in one step, so
+// concurrent readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	return replaceFile(path, data, false)
+}
+
+// writeFileDurable is writeFileAtomic, but also syncs the file and the
+// directory it's in before returning, so that after a crash or power
+// loss the file is either the old one or the new, never empty or torn.
+// It is for the files mk can't rebuild: the build state and manifests.
+func writeFileDurable(path string, data []byte) error {
+	return replaceFile(path, data, true)
+}
+
+func replaceFile(path string, data []byte, sync bool) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".mk-tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if sync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if sync {
+		syncDir(dir)
+	}
+	return nil
+}
+
+// syncDir makes a rename in dir durable. Not every platform can sync a
+// directory (Windows can't), and there the rename is as durable as the
+// file system makes it anyway, so errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Problem is an issue in the graph found by Check.
+type Problem struct {
+	Pos string `json:"pos,omitempty"` // source location of the rule concerned, if any
+	Msg string `json:"msg"`
+}
+
+func (p Problem) String() string {
+	if p.Pos == "" {
+		return p.Msg
+	}
+	return p.Pos + ": " + p.Msg
+}
+
+// Check validates the graph without building anything. It reports
+// prerequisites reachable from targets that are neither buildable nor
+// existing files, explicit rules that nothing reachable needs, targets
+// listed by more than one explicit rule, and pattern rules whose
+// prerequisites match no existing file or other rule. With no targets,
+// the default target, every task and the active configs' requirements
+// are the roots.
+func (g *Graph) Check(targets []string) []Problem {
+	var problems []Problem
+	if len(targets) == 0 {
+		if def := g.DefaultTarget(); def != "" {
+			targets = append(targets, def)
+		}
+		targets = append(targets, g.Tasks()...)
+		targets = append(targets, g.ConfigRequires()...)
+	}
+
+	reached := map[string]bool{}
+	var walk func(target string, parent *resolvedRule, chain *buildChain)
+	walk = func(target string, parent *resolvedRule, chain *buildChain) {
+		for c := chain; c != nil; c = c.parent {
+			if c.target == target {
+				path := append(chain.path(), target)
+				problems = append(problems, Problem{Pos: parent.pos, Msg: "dependency cycle: " + strings.Join(path, " -> ")})
+				return
+			}
+		}
+		if reached[target] {
+			return
+		}
+		reached[target] = true
+
+		rule, err := g.resolve(target)
+		if err != nil {
+			msg := fmt.Sprintf("no rule to build %q and no such file", target)
+			if parent != nil {
+				msg = fmt.Sprintf("%q, needed by %q, has no rule and is not a file", target, parent.target)
+				problems = append(problems, Problem{Pos: parent.pos, Msg: msg})
+			} else {
+				problems = append(problems, Problem{Msg: msg})
+			}
+			return
+		}
+		for _, t := range rule.targets {
+			reached[t] = true
+		}
+		link := &buildChain{target: target, pattern: rule.pattern, parent: chain}
+		if err := link.checkImplicit(); err != nil {
+			problems = append(problems, Problem{Pos: rule.pos, Msg: err.Error()})
+			return
+		}
+		for _, p := range slices.Concat(rule.prereqs, rule.orderOnlyPrereqs) {
+			if _, ok := rule.configs[p]; !ok { // else another config's graph builds it
+				walk(p, rule, link)
+			}
+		}
+	}
+	for _, t := range targets {
+		walk(t, nil, nil)
+	}
+
+	for _, r := range g.rules {
+		if r.aggregates() && len(r.prereqs)+len(r.orderOnlyPrereqs) == 0 {
+			problems = append(problems, Problem{Pos: r.pos, Msg: fmt.Sprintf("task %q has no recipe and no prerequisites; it does nothing", r.target)})
+		}
+		if !r.isTask && !slices.ContainsFunc(r.targets, func(t string) bool { return reached[t] }) {
+			problems = append(problems, Problem{Pos: r.pos, Msg: fmt.Sprintf("%s: unreachable from %s", quoteAll(r.targets), strings.Join(targets, ", "))})
+		}
+	}
+	problems = append(problems, g.checkGroupings()...)
+	problems = append(problems, g.checkPatternSources()...)
+	return problems
+}
+
+// checkGroupings reports targets listed by more than one explicit rule.
+// Only the first rule is ever used for such a target.
+func (g *Graph) checkGroupings() []Problem {
+	var problems []Problem
+	first := map[string]int{} // target → index of the first rule listing it
+	for i, r := range g.rules {
+		for _, t := range r.targets {
+			j, ok := first[t]
+			if !ok {
+				first[t] = i
+				continue
+			}
+			prev := g.rules[j]
+			var msg string
+			switch {
+			case len(prev.recipe) > 0 && len(r.recipe) > 0:
+				msg = fmt.Sprintf("%q also has a recipe at %s; this one is never used", t, prev.pos)
+			case !slices.Equal(prev.targets, r.targets):
+				msg = fmt.Sprintf("%q is grouped as %s here but as %s at %s, which takes precedence", t, quoteAll(r.targets), quoteAll(prev.targets), prev.pos)
+			default:
+				msg = fmt.Sprintf("%q is already a target at %s; these prerequisites are ignored", t, prev.pos)
+			}
+			problems = append(problems, Problem{Pos: r.pos, Msg: msg})
+		}
+	}
+	return problems
+}
+
+// checkPatternSources reports pattern rules whose first prerequisite
+// pattern matches no existing file, explicit target or other pattern
+// rule's target, so the rule can't build anything.
+func (g *Graph) checkPatternSources() []Problem {
+	var problems []Problem
+	for i, pr := range g.patterns {
+		if len(pr.prereqPatterns) == 0 {
+			continue
+		}
+		pp := pr.prereqPatterns[0]
+		if !pp.IsPattern() || g.patternSatisfiable(pp, i) {
+			continue
+		}
+		problems = append(problems, Problem{Pos: pr.pos,
+			Msg: fmt.Sprintf("pattern %s never matches: no file or rule provides %s", pr.targetPatterns[0].Raw, pp.Raw)})
+	}
+	return problems
+}
+
+func (g *Graph) patternSatisfiable(pp Pattern, self int) bool {
+	matches, _ := g.dir.glob(pp.Glob())
+	for _, m := range matches {
+		if _, ok := pp.Match(m); ok {
+			return true
+		}
+	}
+	for _, r := range g.rules {
+		for _, t := range r.targets {
+			if _, ok := pp.Match(t); ok {
+				return true
+			}
+		}
+	}
+	sample := map[string]string{}
+	for _, c := range pp.Captures {
+		sample[c] = "x"
+	}
+	for i, pr := range g.patterns {
+		if i == self {
+			continue
+		}
+		for _, tp := range pr.targetPatterns {
+			if _, ok := tp.Match(pp.Expand(sample)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// globEscape quotes the characters filepath.Glob treats specially.
+func globEscape(s string) string {
+	if os.PathSeparator == '\\' {
+		return s // no escaping on Windows; \ is the separator
+	}
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func quoteAll(ss []string) string {
+	q := make([]string, len(ss))
+	for i, s := range ss {
+		q[i] = fmt.Sprintf("%q", s)
+	}
+	return strings.Join(q, " ")
+}
@@ -0,0 +1,74 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+app: main.o missing.h
+    cc -o $target $inputs
+
+{name}.o: {name}.c
+    cc -c $input -o $target
+
+{name}.pb.go: {name}.proto
+    protoc $input
+
+orphan.txt:
+    touch $target
+
+gen.h gen.c: gen.def
+    gen $input
+gen.h: other.def
+    gen $input
+gen.c gen.x: gen.def
+
+!test: app
+    ./app
+`), 0o644)
+	os.WriteFile("main.c", nil, 0o644)
+	os.WriteFile("gen.def", nil, 0o644)
+
+	p, err := Load(context.Background(), "mkfile", Options{Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, pr := range p.Graph().Check(nil) {
+		got = append(got, pr.String())
+	}
+	want := []string{
+		`mkfile:2: "missing.h", needed by "app", has no rule and is not a file`,
+		`mkfile:11: "orphan.txt": unreachable from app, test`,
+		`mkfile:14: "gen.h" "gen.c": unreachable from app, test`,
+		`mkfile:16: "gen.h": unreachable from app, test`,
+		`mkfile:18: "gen.c" "gen.x": unreachable from app, test`,
+		`mkfile:16: "gen.h" also has a recipe at mkfile:14; this one is never used`,
+		`mkfile:18: "gen.c" is grouped as "gen.c" "gen.x" here but as "gen.h" "gen.c" at mkfile:14, which takes precedence`,
+		`mkfile:8: pattern {name}.pb.go never matches: no file or rule provides {name}.proto`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Check() =\n%q\nwant\n%q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("problem %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	if problems := p.Graph().Check([]string{"main.o"}); len(problems) == 0 || problems[0].String() != `mkfile:2: "app": unreachable from main.o` {
+		t.Errorf("Check(main.o) = %v, want app unreachable first", problems)
+	}
+}
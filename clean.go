@@ -0,0 +1,88 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Clean removes the outputs that the build state for opts.Configs records
+// and the mkfile at path still builds, with the files their recipes
+// wrote under $outdir, other than those of [keep] rules, then the
+// directories that removing them left empty, and forgets them.
+// A recorded file that no rule builds any more, such as a generated file
+// since checked in, is left alone. It returns the paths removed, or, if
+// opts.DryRun is set, the paths it would remove.
+func Clean(ctx context.Context, path string, opts Options) ([]string, error) {
+	p, err := Load(ctx, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	removed, err := p.cleanOutputs(opts.DryRun)
+	if opts.DryRun || len(removed) == 0 {
+		return removed, err
+	}
+	p.state.Forget(removed)
+	if saveErr := p.state.Save(strings.Join(opts.Configs, "-")); err == nil {
+		err = saveErr
+	}
+	return removed, err
+}
+
+// cleanOutputs removes the outputs Clean does, without forgetting them.
+func (p *Project) cleanOutputs(dryRun bool) ([]string, error) {
+	p.state.mu.RLock()
+	targets := slices.Sorted(maps.Keys(p.state.Targets))
+	p.state.mu.RUnlock()
+	var removed []string
+	seen := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, t := range targets {
+		if !filepath.IsLocal(t) {
+			continue
+		}
+		rule, err := p.graph.resolve(t)
+		if err != nil || rule.isTask || rule.keep || len(rule.recipe) == 0 {
+			continue
+		}
+		for _, f := range append([]string{t}, slices.Sorted(maps.Keys(p.state.GetTarget(t).Extra))...) {
+			if seen[f] {
+				continue // an extra output of each of a rule's targets
+			}
+			seen[f] = true
+			info, err := os.Lstat(p.dir().path(f))
+			if err != nil || info.IsDir() {
+				continue
+			}
+			if !dryRun {
+				if err := os.Remove(p.dir().path(f)); err != nil {
+					return removed, err
+				}
+			}
+			removed = append(removed, f)
+			for d := filepath.Dir(f); d != "."; d = filepath.Dir(d) {
+				dirs[d] = true
+			}
+		}
+	}
+	if dryRun {
+		return removed, nil
+	}
+	// Deepest first, so a parent is empty once its children are gone.
+	sep := string(filepath.Separator)
+	for _, d := range slices.SortedFunc(maps.Keys(dirs), func(a, b string) int {
+		return strings.Count(b, sep) - strings.Count(a, sep)
+	}) {
+		if entries, err := os.ReadDir(p.dir().path(d)); err == nil && len(entries) == 0 && os.Remove(p.dir().path(d)) == nil {
+			removed = append(removed, d+sep)
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestClean(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	}
+	write("in", "x\n")
+	write("mkfile", `
+out/sub/b.txt: out/a.txt
+    cp $input $target
+
+out/a.txt: in
+    cp $input $target
+
+data.db [keep]: in
+    cp $input $target
+
+gen.txt: in
+    cp $input $target
+
+!hello:
+    echo hello
+`)
+	ctx := context.Background()
+	opts := Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}
+	mustBuild(t, opts, "out/sub/b.txt", "data.db", "gen.txt", "hello")
+	// gen.txt is checked in now, and no rule builds it.
+	write("mkfile", `
+out/sub/b.txt: out/a.txt
+    cp $input $target
+
+out/a.txt: in
+    cp $input $target
+
+data.db [keep]: in
+    cp $input $target
+`)
+
+	dry := opts
+	dry.DryRun = true
+	removed, err := Clean(ctx, "mkfile", dry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"out/a.txt", "out/sub/b.txt"}; !slices.Equal(removed, want) {
+		t.Errorf("dry run would remove %v, want %v", removed, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out/a.txt")); err != nil {
+		t.Error("dry run removed out/a.txt")
+	}
+
+	removed, err = Clean(ctx, "mkfile", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"out/a.txt", "out/sub/b.txt", "out/sub/", "out/"}; !slices.Equal(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+	for _, f := range []string{"in", "data.db", "gen.txt", "mkfile"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("clean removed %s", f)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out")); err == nil {
+		t.Error("clean left the empty out directory")
+	}
+	if ts := loadState(workspace(dir), "").Targets; ts["out/a.txt"] != nil || ts["data.db"] == nil {
+		t.Errorf("state after clean records %v, want data.db and not out/a.txt", slices.Sorted(maps.Keys(ts)))
+	}
+}
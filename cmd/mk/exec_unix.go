@@ -0,0 +1,17 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// execProgram replaces mk with the program at path. It returns only if
+// that fails.
+func execProgram(path string, argv []string) error {
+	return syscall.Exec(path, argv, os.Environ())
+}
@@ -5,41 +5,104 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/marcelocantos/mk"
 )
 
+// version is set by release builds with -ldflags "-X main.version=...".
 var version = "dev"
 
+// pseudoVersion matches the versions Go stamps on builds of commits
+// that aren't tagged releases, and on builds of modified trees.
+var pseudoVersion = regexp.MustCompile(`-(0\.)?\d{14}-[0-9a-f]{12}|\+dirty$`)
+
+func init() {
+	// go install of a release records the module version instead.
+	if info, ok := debug.ReadBuildInfo(); ok && version == "dev" {
+		if v := info.Main.Version; strings.HasPrefix(v, "v") && !pseudoVersion.MatchString(v) {
+			version = v
+		}
+	}
+	mk.Version = version
+}
+
 func main() {
 	var (
 		dir         = flag.String("C", "", "change to directory before doing anything")
 		file        = flag.String("f", "mkfile", "mkfile to read")
 		verbose     = flag.Bool("v", false, "verbose output")
 		force       = flag.Bool("B", false, "unconditional rebuild (ignore state)")
+		downstream  = flag.Bool("downstream", false, "with --rebuild, also rebuild everything that depends on the targets")
 		dryRun      = flag.Bool("n", false, "dry run (print commands without executing)")
 		jobs        = flag.Int("j", -1, "parallel jobs (-1=auto, 0=unlimited)")
+		keepGoing   = flag.Bool("k", false, "keep going after a recipe fails, building everything that doesn't depend on it")
+		ordered     = flag.Bool("ordered", false, "build the targets given one after another, each finished before the next starts, instead of together")
+		timeout     = flag.Duration("timeout", 0, "abort the build after this long (0=no limit)")
+		serve       = flag.String("serve", "", "serve the JSON-RPC build API on `addr` (- for stdio, a path for a unix socket, or host:port)")
 		why         = flag.Bool("why", false, "explain why targets are stale")
-		graph       = flag.Bool("graph", false, "print dependency subgraph")
+		debugCats   = flag.String("debug", "", "trace decisions in the comma-separated `categories`: resolve, stale, vars, include or all")
+		traceGlobs  = flag.Bool("trace-globs", false, "report each pattern $[wildcard] globbed while building the graph: calls, file system calls, matches")
+		check       = flag.Bool("check", false, "validate the graph without building: missing prerequisites, unreachable rules, conflicting groupings, dead patterns")
+		graph       = flag.Bool("graph", false, "print dependency subgraph as DOT, with stale targets filled")
+		graphDepth  = flag.Int("graph-depth", 0, "with --graph, show at most `n` levels of prerequisites (0=all)")
+		graphDiff   = flag.Bool("graph-diff", false, "compare the graph across two --config sets, or against --against")
+		against     = flag.String("against", "", "with --graph-diff, compare against the mkfile at git:`rev`")
 		showState   = flag.Bool("state", false, "show build database entries")
+		stats       = flag.Bool("stats", false, "print build, phase timing and compiler cache statistics; with --graph, graph statistics instead of DOT")
+		cpuProfile  = flag.String("cpuprofile", "", "write a CPU profile of mk itself to `file`")
+		memProfile  = flag.String("memprofile", "", "write a heap profile of mk itself to `file` on exit")
+		provenance  = flag.String("provenance", "", "write SLSA provenance for each built artifact under `dir`")
+		provKey     = flag.String("provenance-key", "", "sign provenance with the PEM PKCS #8 private key in `file`")
+		containment = flag.Bool("containment", false, "fail if targets or scoped recipes write outside the workspace or their include scope")
+		sandbox     = flag.Bool("sandbox", false, "run each file rule's recipe with only its prerequisites, to catch inputs it doesn't declare")
+		strict      = flag.Bool("strict", false, "fail, rather than warn, when a recipe modifies its own prerequisites or two rules write the same target")
+		coarseMtime = flag.Bool("coarse-mtime", false, "don't trust file timestamps to change on every write (NFS, bind mounts)")
+		rehashBelow = flag.Int64("rehash-below", 0, "with --coarse-mtime, always re-hash files smaller than `bytes`")
+		localState  = flag.Bool("local-state", false, "keep the action cache in .mk/cache instead of sharing it across checkouts")
+		checkOuts   = flag.String("check-outputs", "rebuild", "what to do about targets modified since mk built them: rebuild, warn or off")
+		events      = flag.String("events", "", "write a JSON line for each build event to `file` (- for stdout, moving recipe output to stderr)")
+		audit       = flag.String("audit", "", "append a JSON line for every executed recipe to `file`")
+		manifest    = flag.Bool("manifest", false, "after a successful build, list produced artifacts in .mk/manifest.json")
+		reproduce   = flag.Bool("reproducible", false, "pin timestamps and environment, then verify by rebuilding a sampled target")
+		list        = flag.Bool("list", false, "list the tasks, targets and configs with their descriptions")
 		complete    = flag.Bool("complete", false, "output completions (targets and configs)")
+		compKinds   = flag.Bool("complete-kinds", false, "output completions as kind, name and description, tab-separated, including variables")
 		agentsGuide = flag.Bool("help-agent", false, "print the mk agents guide")
 		showVersion = flag.Bool("version", false, "print version and exit")
 	)
+	var rebuild, diffConfigs []string
+	flag.Func("rebuild", "rebuild `target` regardless of state, leaving the rest incremental; may be repeated", func(s string) error {
+		rebuild = append(rebuild, strings.Fields(s)...)
+		return nil
+	})
+	flag.Func("config", "with --graph-diff, the configs (`name[+name]`) for one side; give twice to compare two config sets", func(s string) error {
+		diffConfigs = append(diffConfigs, s)
+		return nil
+	})
 	flag.Parse()
 
 	args := flag.Args()
 
-	if *showVersion {
-		fmt.Println("mk", version)
-		return
-	}
-
 	if *agentsGuide {
 		var buf bytes.Buffer
 		flag.CommandLine.SetOutput(&buf)
@@ -51,29 +114,288 @@ func main() {
 		return
 	}
 
+	// Profiles are opened before -C, so their paths are relative to
+	// where mk was started.
+	stopProfiles, err := startProfiles(*cpuProfile, *memProfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mk: %s\n", err)
+		os.Exit(1)
+	}
+	defer stopProfiles()
+	eventsOut, err := openEvents(*events)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mk: --events: %s\n", err)
+		os.Exit(1)
+	}
+	if eventsOut != nil {
+		defer eventsOut.Close()
+	}
+
 	if *dir != "" {
 		if err := os.Chdir(*dir); err != nil {
 			fmt.Fprintf(os.Stderr, "mk: %s\n", err)
 			os.Exit(1)
 		}
 	}
+	// The mkfile's directory is the workspace: targets on the command
+	// line, the state that --state, diff-state and stop read, and the
+	// paths in the mkfile are all relative to it.
+	if d := filepath.Dir(*file); d != "." {
+		if err := os.Chdir(d); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: %s\n", err)
+			os.Exit(1)
+		}
+		*file = filepath.Base(*file)
+	}
+
+	// Interrupts and --timeout cancel the build: running recipes are
+	// killed and completed targets are still recorded.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	if len(args) > 0 && args[0] == "selfupdate" && !definesTarget(ctx, *file, mk.Options{}, "selfupdate") {
+		if len(args) > 2 {
+			fmt.Fprintf(os.Stderr, "usage: mk selfupdate [version]\n")
+			os.Exit(2)
+		}
+		if err := selfUpdate(ctx, strings.Join(args[1:], "")); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: selfupdate: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := usePinnedVersion(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "mk: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *showVersion {
+		fmt.Println("mk", version)
+		return
+	}
+
+	outputCheck, err := mk.ParseOutputCheck(*checkOuts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mk: --check-outputs: %s\n", err)
+		os.Exit(2)
+	}
+
+	if *downstream && len(rebuild) == 0 {
+		fmt.Fprintf(os.Stderr, "mk: --downstream needs --rebuild\n")
+		os.Exit(2)
+	}
+
+	var debugFlags mk.Debug
+	if *debugCats != "" {
+		if debugFlags, err = mk.ParseDebug(*debugCats); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: --debug: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	opts := mk.Options{
+		Verbose:       *verbose,
+		Force:         *force,
+		Rebuild:       rebuild,
+		Downstream:    *downstream,
+		DryRun:        *dryRun,
+		Jobs:          *jobs,
+		KeepGoing:     *keepGoing,
+		Ordered:       *ordered,
+		Stats:         *stats,
+		Reproducible:  *reproduce,
+		Provenance:    *provenance,
+		ProvenanceKey: *provKey,
+		Audit:         *audit,
+		Manifest:      *manifest,
+		Containment:   *containment,
+		Sandbox:       *sandbox,
+		Strict:        *strict,
+		CoarseMtime:   *coarseMtime,
+		RehashBelow:   *rehashBelow,
+		CheckOutputs:  outputCheck,
+		Debug:         debugFlags,
+		TraceGlobs:    *traceGlobs,
+		LocalState:    *localState,
+		Width:         ttyWidth(os.Stderr), // 0 unless stderr is a terminal
+	}
+	if eventsOut != nil {
+		opts.Progress = mk.JSONEvents(eventsOut)
+		if eventsOut == os.Stdout {
+			opts.Stdout = os.Stderr // stdout is the events'
+		}
+	}
+
+	if len(args) > 0 && args[0] == "stop" && !definesTarget(ctx, *file, opts, "stop") {
+		if err := stopServices(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: stop: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "diff-state" && !definesTarget(ctx, *file, opts, "diff-state") {
+		if err := diffState(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: diff-state: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "status" && !definesTarget(ctx, *file, opts, "status") {
+		if err := showStatus(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: status: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "doctor" && !definesTarget(ctx, *file, opts, "doctor") {
+		if err := doctor(ctx, *file, opts, args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: doctor: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "selftest" && !definesTarget(ctx, *file, opts, "selftest") {
+		if err := selftest(ctx, *file, opts, args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: selftest: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "state" && !definesTarget(ctx, *file, opts, "state") {
+		if err := stateCommand(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: state: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "configs" && !definesTarget(ctx, *file, opts, "configs") {
+		if err := configsStatus(ctx, *file, opts, args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: configs: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	// mk clean is the mkfile's clean rule if it has one.
+	if len(args) == 1 && args[0] == "clean" {
+		if ran, err := clean(ctx, *file, opts); ran {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "mk: clean: %s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	// mk clean :debug, unlike mk clean:debug, isn't the clean task.
+	if len(args) == 2 && args[0] == "clean" && strings.HasPrefix(args[1], ":") {
+		if err := cleanConfig(ctx, *file, opts, args[1][1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: clean: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "run" && !definesTarget(ctx, *file, opts, "run") {
+		if err := runProgram(ctx, *file, opts, args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: run: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *serve != "" {
+		if err := serveRPC(ctx, *serve, *file, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	if err := run(*file, *verbose, *force, *dryRun, *jobs, *why, *graph, *showState, *complete, args); err != nil {
+	if !*graphDiff && (*against != "" || len(diffConfigs) > 0) {
+		fmt.Fprintf(os.Stderr, "mk: --config and --against need --graph-diff\n")
+		os.Exit(2)
+	}
+	if *graphDiff {
+		if err := runGraphDiff(ctx, *file, opts, diffConfigs, *against, args); err != nil {
+			fmt.Fprintf(os.Stderr, "mk: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := run(ctx, *file, opts, *why, *check, *list, *graph, *graphDepth, *showState, *complete || *compKinds, *compKinds, args); err != nil {
 		fmt.Fprintf(os.Stderr, "mk: %s\n", err)
+		stopProfiles()
 		os.Exit(1)
 	}
 }
 
-func run(file string, verbose, force, dryRun bool, jobs int, why, graph, showState, complete bool, args []string) error {
+// openEvents opens the file --events names, or returns os.Stdout for
+// "-" and nil for "". Like the profiles, it's opened before -C, so the
+// path is relative to where mk was started.
+func openEvents(path string) (*os.File, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
+
+// startProfiles starts a CPU profile into cpu and arranges for a heap
+// profile to be written to mem, either of which may be empty. The
+// returned function finishes both; it is safe to call more than once.
+func startProfiles(cpu, mem string) (stop func(), err error) {
+	var cpuFile, memFile *os.File
+	if cpu != "" {
+		if cpuFile, err = os.Create(cpu); err != nil {
+			return nil, fmt.Errorf("--cpuprofile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			cpuFile.Close()
+			return nil, fmt.Errorf("--cpuprofile: %w", err)
+		}
+	}
+	if mem != "" {
+		if memFile, err = os.Create(mem); err != nil {
+			if cpuFile != nil {
+				pprof.StopCPUProfile()
+				cpuFile.Close()
+			}
+			return nil, fmt.Errorf("--memprofile: %w", err)
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if cpuFile != nil {
+				pprof.StopCPUProfile()
+				cpuFile.Close()
+			}
+			if memFile != nil {
+				runtime.GC() // for up-to-date allocation statistics
+				if err := pprof.WriteHeapProfile(memFile); err != nil {
+					fmt.Fprintf(os.Stderr, "mk: --memprofile: %s\n", err)
+				}
+				memFile.Close()
+			}
+		})
+	}, nil
+}
+
+func run(ctx context.Context, file string, opts mk.Options, why, check, list, graph bool, graphDepth int, showState, complete, completeKinds bool, args []string) error {
 	// Process command-line arguments: targets, configs, and variable overrides
-	vars := mk.NewVars()
+	opts.Vars = map[string]string{}
 	var buildTargets []string
-	var activeConfigs []string
 	configSeen := map[string]bool{}
 
 	for _, arg := range args {
 		if name, value, ok := strings.Cut(arg, "="); ok {
-			vars.Set(name, value)
+			opts.Vars[name] = value
 			continue
 		}
 		// Check for target:config1+config2 syntax
@@ -82,7 +404,7 @@ func run(file string, verbose, force, dryRun bool, jobs int, why, graph, showSta
 			for _, c := range strings.Split(configStr, "+") {
 				c = strings.TrimSpace(c)
 				if c != "" && !configSeen[c] {
-					activeConfigs = append(activeConfigs, c)
+					opts.Configs = append(opts.Configs, c)
 					configSeen[c] = true
 				}
 			}
@@ -92,69 +414,66 @@ func run(file string, verbose, force, dryRun bool, jobs int, why, graph, showSta
 	}
 
 	// Config suffix for state file isolation
-	configSuffix := strings.Join(activeConfigs, "-")
+	configSuffix := strings.Join(opts.Configs, "-")
 
-	// --complete: output target and config names for shell completion
+	// --complete: output target and config names, and target:config for
+	// each target under each config, for shell completion
 	if complete {
-		f, err := os.Open(file)
-		if err != nil {
-			return nil // silent failure for completion
-		}
-		defer f.Close()
-		ast, err := mk.Parse(f)
-		if err != nil {
-			return nil
-		}
-		g, err := mk.BuildGraph(ast, vars, &mk.BuildState{Targets: make(map[string]*mk.TargetState)}, nil)
-		if err != nil {
-			return nil
-		}
-		for _, t := range g.Targets() {
-			fmt.Println(t)
-		}
-		for _, c := range g.ConfigNames() {
-			fmt.Println(c)
-		}
+		fmt.Print(mk.Complete(ctx, file, mk.Options{Vars: opts.Vars}, completeKinds))
 		return nil
 	}
 
-	// --state only needs the build database
+	// --state only needs the build database. Without configs, every
+	// config's state file is searched.
 	if showState {
-		state := mk.LoadState(configSuffix)
 		if len(buildTargets) == 0 {
 			return fmt.Errorf("--state requires at least one target")
 		}
+		suffixes := []string{configSuffix}
+		if len(opts.Configs) == 0 {
+			suffixes = mk.StateSuffixes()
+		}
+		states := make([]*mk.BuildState, len(suffixes))
+		for i, s := range suffixes {
+			states[i] = mk.LoadState(s)
+		}
 		for _, t := range buildTargets {
-			ts := state.Targets[t]
-			if ts == nil {
+			found := false
+			for i, state := range states {
+				ts := state.Targets[t]
+				if ts == nil {
+					continue
+				}
+				found = true
+				label := "no config"
+				if suffixes[i] != "" {
+					label = "config " + suffixes[i]
+				}
+				data, _ := json.MarshalIndent(ts, "", "  ")
+				fmt.Printf("state for %q (%s, %s):\n%s\n", t, label, mk.StateFile(suffixes[i]), string(data))
+			}
+			if !found {
 				fmt.Printf("no build state recorded for %q\n", t)
-				continue
 			}
-			data, _ := json.MarshalIndent(ts, "", "  ")
-			fmt.Printf("state for %q:\n%s\n", t, string(data))
 		}
 		return nil
 	}
 
-	f, err := os.Open(file)
-	if err != nil {
-		return fmt.Errorf("cannot open %s: %w", file, err)
-	}
-	defer f.Close()
-
-	ast, err := mk.Parse(f)
+	opts.Explain = why && opts.DryRun
+	p, err := mk.Load(ctx, file, opts)
 	if err != nil {
 		return err
 	}
+	defer p.Close()
+	g := p.Graph()
 
-	state := mk.LoadState(configSuffix)
-
-	g, err := mk.BuildGraph(ast, vars, state, activeConfigs)
-	if err != nil {
-		return err
+	// --graph --stats describes the whole graph unless given targets.
+	if graph && opts.Stats && len(buildTargets) == 0 {
+		buildTargets = g.Targets()
 	}
 
-	if len(buildTargets) == 0 {
+	// --why and --graph default to the default target; Build does the same.
+	if (why || graph) && len(buildTargets) == 0 {
 		def := g.DefaultTarget()
 		if def == "" {
 			return fmt.Errorf("no targets specified and no default target")
@@ -162,10 +481,11 @@ func run(file string, verbose, force, dryRun bool, jobs int, why, graph, showSta
 		buildTargets = []string{def}
 	}
 
-	// --why: explain why targets are stale, then exit
-	if why {
+	// --why: explain why targets are stale, then exit. With -n, the dry
+	// run explains itself instead.
+	if why && !opts.DryRun {
 		for _, t := range buildTargets {
-			reasons, err := g.WhyRebuild(t)
+			reasons, err := g.WhyRebuild(ctx, t)
 			if err != nil {
 				return err
 			}
@@ -181,30 +501,482 @@ func run(file string, verbose, force, dryRun bool, jobs int, why, graph, showSta
 		return nil
 	}
 
+	// --check: validate the graph, then exit
+	if check {
+		problems := g.Check(buildTargets)
+		for _, pr := range problems {
+			fmt.Println(pr)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("--check found %d problem(s)", len(problems))
+		}
+		return nil
+	}
+
+	// --list: print the help screen, then exit
+	if list {
+		return g.WriteList(os.Stdout)
+	}
+
 	// --graph: print dependency subgraph as DOT, then exit
 	if graph {
-		return g.PrintGraph(buildTargets)
+		if opts.Stats {
+			s, err := g.Stats(buildTargets)
+			if err != nil {
+				return err
+			}
+			s.Print(os.Stdout)
+			return nil
+		}
+		return g.WriteGraph(ctx, os.Stdout, buildTargets, mk.GraphOptions{Depth: graphDepth, Stale: true})
+	}
+
+	err = p.Build(ctx, buildTargets...)
+	if opts.Stats {
+		s := p.Stats()
+		s.Print(os.Stderr)
+	}
+	return err
+}
+
+// stopServices implements mk stop [task...]: it stops the given
+// [service] tasks, or all running ones.
+func stopServices(tasks []string) error {
+	if len(tasks) == 0 {
+		tasks = mk.Services()
+	}
+	for _, t := range tasks {
+		if err := mk.StopService(t); err != nil {
+			return fmt.Errorf("%s: %w", t, err)
+		}
+		fmt.Fprintf(os.Stderr, "mk: stopped service %q\n", t)
+	}
+	return nil
+}
+
+// diffState implements mk diff-state [config[+config]]: it lists the
+// targets whose outputs the last build changed, compared with the state
+// saved before it.
+func diffState(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: mk diff-state [config[+config]]")
+	}
+	var suffix string
+	if len(args) == 1 {
+		suffix = strings.Join(splitConfigs(args[0]), "-")
+	}
+	if _, err := os.Stat(mk.PrevStateFile(suffix)); err != nil {
+		return fmt.Errorf("no previous state to compare with; run two builds first")
+	}
+	changes := mk.DiffStates(mk.LoadPrevState(suffix), mk.LoadState(suffix))
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(os.Stderr, "mk: no outputs changed\n")
+	}
+	return nil
+}
+
+// configsStatus implements mk configs [status]: a table of each config
+// set's builddir, its size, and its state file.
+func configsStatus(ctx context.Context, file string, opts mk.Options, args []string) error {
+	if len(args) > 1 || len(args) == 1 && args[0] != "status" {
+		return fmt.Errorf("usage: mk configs [status]")
 	}
+	statuses, err := mk.ConfigsStatus(ctx, file, opts)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONFIG\tBUILDDIR\tSIZE\tLAST BUILD\tSTATE")
+	for _, s := range statuses {
+		name := strings.Join(s.Configs, "+")
+		switch {
+		case s.Suffix == "":
+			name = "(base)"
+		case !s.Defined:
+			name = s.Suffix + " (undefined)"
+		}
+		dir, size := s.BuildDir, humanBytes(s.DiskUsage)
+		if dir == "" {
+			dir, size = "-", "-"
+		}
+		last, state := "never", "-"
+		if s.StateFile != "" {
+			last, state = s.LastBuild.Format(time.DateTime), s.StateFile
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, dir, size, last, state)
+	}
+	return w.Flush()
+}
 
-	// Normal build
-	exec := mk.NewExecutor(g, state, vars, verbose, force, dryRun, jobs)
+// stateCommand implements mk state restore [config[+config]], which
+// replaces the state file with its newest valid backup, and mk state
+// invalidate.
+func stateCommand(args []string) error {
+	if len(args) > 0 && args[0] == "invalidate" {
+		return invalidateState(args[1:])
+	}
+	if len(args) == 0 || args[0] != "restore" || len(args) > 2 {
+		return fmt.Errorf("usage: mk state restore [config[+config]] | mk state invalidate [:config[+config]] target|glob...")
+	}
+	var suffix string
+	if len(args) == 2 {
+		suffix = strings.Join(splitConfigs(args[1]), "-")
+	}
+	from, err := mk.RestoreState(suffix)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "mk: restored %s from %s\n", mk.StateFile(suffix), from)
+	return nil
+}
 
-	// Build config requires targets first
-	for _, req := range g.ConfigRequires() {
-		if err := exec.Build(req); err != nil {
+// showStatus implements mk status [json]: it prints the outcome of the
+// last build, or the status file itself, failing if the build did.
+func showStatus(args []string) error {
+	if len(args) > 1 || len(args) == 1 && args[0] != "json" {
+		return fmt.Errorf("usage: mk status [json]")
+	}
+	s, err := mk.ReadStatus("")
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s); err != nil {
 			return err
 		}
+	} else {
+		s.Print(os.Stdout, time.Now())
 	}
+	if s.Result != "ok" {
+		return fmt.Errorf("last build %s", s.Result)
+	}
+	return nil
+}
 
-	// Build main targets
-	for _, t := range buildTargets {
-		if err := exec.Build(t); err != nil {
+// invalidateState implements mk state invalidate [:config[+config]]
+// target|glob...: it removes the records of the matching targets, listing
+// them, so that they rebuild.
+func invalidateState(args []string) error {
+	var suffix string
+	if len(args) > 0 && strings.HasPrefix(args[0], ":") {
+		suffix = strings.Join(splitConfigs(args[0][1:]), "-")
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: mk state invalidate [:config[+config]] target|glob...")
+	}
+	removed, err := mk.InvalidateState(suffix, args)
+	if err != nil {
+		return err
+	}
+	for _, t := range removed {
+		fmt.Println(t)
+	}
+	if len(removed) == 0 {
+		return fmt.Errorf("no recorded targets in %s match", mk.StateFile(suffix))
+	}
+	return nil
+}
+
+// doctor prints the problems mk.Doctor finds, failing if there are any.
+func doctor(ctx context.Context, file string, opts mk.Options, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("usage: mk doctor")
+	}
+	found := mk.Doctor(ctx, file, opts)
+	for _, f := range found {
+		fmt.Println(f)
+	}
+	if len(found) > 0 {
+		return fmt.Errorf("%d problems found", len(found))
+	}
+	fmt.Fprintln(os.Stderr, "mk: doctor: no problems found")
+	return nil
+}
+
+// selftest runs the .mktest files named in args, or else those in the
+// tests directory, with this mk, reporting each and failing if any fail.
+func selftest(ctx context.Context, file string, opts mk.Options, args []string) error {
+	files := args
+	if len(files) == 0 {
+		var err error
+		if files, err = mk.SelftestFiles(opts.Dir, file); err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("no tests: %s/*.mktest matches nothing", mk.SelftestDir)
+		}
+	}
+	bin, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
 			return err
 		}
+		t, err := mk.ParseSelftest(name, data)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		log, err := t.Run(ctx, bin, filepath.Dir(file))
+		elapsed := time.Since(start).Round(10 * time.Millisecond)
+		if err != nil {
+			failed++
+			fmt.Printf("--- FAIL: %s (%s)\n", name, elapsed)
+			for _, line := range strings.SplitAfter(strings.TrimSuffix(log, "\n"), "\n") {
+				fmt.Printf("    %s", line)
+			}
+			fmt.Printf("\n    FAIL: %s\n", err)
+			continue
+		}
+		fmt.Printf("ok   %s (%s)\n", name, elapsed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tests failed", failed, len(files))
+	}
+	return nil
+}
+
+// humanBytes formats n bytes with a binary unit.
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// definesTarget reports whether the mkfile defines name as a target or
+// task, which then takes precedence over mk's subcommand of that name.
+func definesTarget(ctx context.Context, file string, opts mk.Options, name string) bool {
+	opts.Stderr = io.Discard // the build that follows reports any problems
+	p, err := mk.Load(ctx, file, opts)
+	if err != nil {
+		return false
+	}
+	defer p.Close()
+	return slices.Contains(p.Graph().Targets(), name)
+}
+
+// clean implements mk clean for an mkfile without a clean rule: it
+// removes the outputs the build state records, or with -n lists them. It
+// reports whether it ran, which it doesn't if the mkfile has a clean rule
+// or doesn't load.
+func clean(ctx context.Context, file string, opts mk.Options) (bool, error) {
+	p, err := mk.Load(ctx, file, opts)
+	if err != nil {
+		return false, nil
+	}
+	defined := slices.Contains(p.Graph().Targets(), "clean")
+	p.Close()
+	if defined {
+		return false, nil
+	}
+	removed, err := mk.Clean(ctx, file, opts)
+	for _, path := range removed {
+		if opts.DryRun {
+			fmt.Printf("would remove %s\n", path)
+		} else {
+			fmt.Printf("removed %s\n", path)
+		}
+	}
+	if err == nil && len(removed) == 0 {
+		fmt.Fprintf(os.Stderr, "mk: nothing to clean\n")
+	}
+	return true, err
+}
+
+// cleanConfig implements mk clean :config[+config]: it removes the
+// config set's builddir and state, or with -n lists them.
+func cleanConfig(ctx context.Context, file string, opts mk.Options, configs string) error {
+	removed, err := mk.CleanConfig(ctx, file, opts, splitConfigs(configs))
+	for _, path := range removed {
+		if opts.DryRun {
+			fmt.Printf("would remove %s\n", path)
+		} else {
+			fmt.Printf("removed %s\n", path)
+		}
+	}
+	if err == nil && len(removed) == 0 {
+		fmt.Fprintf(os.Stderr, "mk: nothing to clean for :%s\n", configs)
+	}
+	return err
+}
+
+// runProgram implements mk run [var=value...] target[:config] [--] [args...]:
+// it builds target, then runs it in mk's place (see execProgram), passing
+// args and the terminal through.
+func runProgram(ctx context.Context, file string, opts mk.Options, args []string) error {
+	opts.Vars = map[string]string{}
+	for len(args) > 0 && strings.Contains(args[0], "=") {
+		name, value, _ := strings.Cut(args[0], "=")
+		opts.Vars[name] = value
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: mk run [var=value...] target[:config] [--] [args...]")
+	}
+	target, configs, _ := strings.Cut(args[0], ":")
+	opts.Configs = splitConfigs(configs)
+	args = args[1:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
 	}
 
-	if dryRun {
+	p, err := mk.Load(ctx, file, opts)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	if info, err := p.Graph().Lookup(target); err != nil {
+		return err
+	} else if info.IsTask {
+		return fmt.Errorf("%s is a task, not a program; use mk %s", target, target)
+	}
+	if err := p.Build(ctx, target); err != nil {
+		return err
+	}
+	p.Close() // execProgram doesn't return to the deferred call
+
+	argv := append([]string{target}, args...)
+	if opts.DryRun {
+		fmt.Fprintf(os.Stderr, "mk: would run %s\n", strings.Join(argv, " "))
 		return nil
 	}
-	return state.Save(configSuffix)
+	path, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+	return execProgram(path, argv)
+}
+
+// runGraphDiff prints the rules that differ between two graphs: those of
+// two config sets, or the working tree's and those of a git revision.
+func runGraphDiff(ctx context.Context, file string, opts mk.Options, configs []string, against string, args []string) error {
+	opts.Vars = map[string]string{}
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("--graph-diff takes only variable overrides, not %q", arg)
+		}
+		opts.Vars[name] = value
+	}
+	opts.Stderr = io.Discard
+
+	var oldConfigs, newConfigs []string
+	switch {
+	case len(configs) > 2:
+		return fmt.Errorf("--graph-diff compares at most two --config sets")
+	case len(configs) == 2:
+		oldConfigs, newConfigs = splitConfigs(configs[0]), splitConfigs(configs[1])
+	case len(configs) == 1 && against != "":
+		oldConfigs, newConfigs = splitConfigs(configs[0]), splitConfigs(configs[0])
+	case len(configs) == 1:
+		newConfigs = splitConfigs(configs[0])
+	case against == "":
+		return fmt.Errorf("--graph-diff needs two --config sets or --against")
+	}
+
+	snapshot := func(dir string, configs []string) (*mk.GraphSnapshot, error) {
+		o := opts
+		o.Dir, o.Configs = dir, configs
+		p, err := mk.Load(ctx, file, o)
+		if err != nil {
+			return nil, err
+		}
+		defer p.Close()
+		return p.Graph().Snapshot(), nil
+	}
+
+	var old *mk.GraphSnapshot
+	var err error
+	if against != "" {
+		rev, ok := strings.CutPrefix(against, "git:")
+		if !ok {
+			return fmt.Errorf("--against %q: only git:REV is supported", against)
+		}
+		err = atGitRev(ctx, rev, func(dir string) error {
+			old, err = snapshot(dir, oldConfigs)
+			return err
+		})
+	} else {
+		old, err = snapshot("", oldConfigs)
+	}
+	if err != nil {
+		return err
+	}
+	cur, err := snapshot("", newConfigs)
+	if err != nil {
+		return err
+	}
+	for _, c := range mk.DiffGraphs(old, cur) {
+		fmt.Println(c)
+	}
+	return nil
+}
+
+func splitConfigs(s string) []string {
+	var configs []string
+	for _, c := range strings.Split(s, "+") {
+		if c = strings.TrimSpace(c); c != "" {
+			configs = append(configs, c)
+		}
+	}
+	return configs
+}
+
+// atGitRev checks out rev in a temporary worktree and runs fn with the
+// directory there that corresponds to the current one.
+func atGitRev(ctx context.Context, rev string, fn func(dir string) error) error {
+	prefix, err := exec.CommandContext(ctx, "git", "rev-parse", "--show-prefix").Output()
+	if err != nil {
+		return fmt.Errorf("--against: not in a git repository")
+	}
+	tmp, err := os.MkdirTemp("", "mk-graph-diff-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	wt := filepath.Join(tmp, "tree")
+	if out, err := exec.CommandContext(ctx, "git", "worktree", "add", "--detach", "--quiet", wt, rev).CombinedOutput(); err != nil {
+		return fmt.Errorf("--against git:%s: %s", rev, strings.TrimSpace(string(out)))
+	}
+	defer exec.Command("git", "worktree", "remove", "--force", wt).Run()
+
+	return fn(filepath.Join(wt, strings.TrimSpace(string(prefix))))
+}
+
+// serveRPC runs the JSON-RPC build API on addr until ctx is cancelled.
+func serveRPC(ctx context.Context, addr, file string, opts mk.Options) error {
+	srv := mk.NewServer(file, opts, version)
+	if addr == "-" {
+		return srv.ServeConn(ctx, os.Stdin, os.Stdout)
+	}
+	network := "tcp"
+	if strings.Contains(addr, "/") {
+		network = "unix"
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr) // stale socket from a previous run
+		}
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "mk: serving on %s\n", l.Addr())
+	return srv.Serve(ctx, l)
 }
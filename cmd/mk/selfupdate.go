@@ -0,0 +1,281 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// pinFile names the file that pins a repository to an mk release.
+const pinFile = ".mk-version"
+
+// exeSuffix ends the names of executables on this platform.
+var exeSuffix = map[string]string{"windows": ".exe"}[runtime.GOOS]
+
+// noPinEnv, when set, stops mk from switching to a pinned release. mk
+// sets it when it re-executes itself as the pinned release.
+const noPinEnv = "MK_NO_PIN"
+
+// releasesURL returns the base URL of mk's releases, laid out as GitHub
+// lays them out: <base>/latest redirects to <base>/tag/<tag>, and
+// <base>/download/<tag>/<file> serves a release's files. MK_RELEASES_URL
+// overrides it, for mirrors.
+func releasesURL() string {
+	if u := os.Getenv("MK_RELEASES_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return "https://github.com/marcelocantos/mk/releases"
+}
+
+// findPin looks for a .mk-version file in the current directory and its
+// parents, and returns the release tag it pins, or "" if there is none.
+func findPin() (tag, file string, err error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", "", err
+	}
+	for {
+		file = filepath.Join(dir, pinFile)
+		data, err := os.ReadFile(file)
+		if err == nil {
+			v := strings.TrimSpace(string(data))
+			if v == "" {
+				return "", "", fmt.Errorf("%s is empty", file)
+			}
+			return "v" + strings.TrimPrefix(v, "v"), file, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", nil
+		}
+		dir = parent
+	}
+}
+
+// usePinnedVersion re-executes mk as the release that .mk-version pins,
+// downloading it first if it isn't cached, unless this is that release,
+// a development build, or MK_NO_PIN is set. It returns only if mk should
+// carry on as it is.
+func usePinnedVersion(ctx context.Context) error {
+	if version == "dev" || os.Getenv(noPinEnv) != "" {
+		return nil
+	}
+	tag, file, err := findPin()
+	if err != nil || tag == "" || tag == version {
+		return err
+	}
+	dir, err := versionsDir()
+	if err != nil {
+		return err
+	}
+	exe := filepath.Join(dir, tag, "mk"+exeSuffix)
+	if _, err := os.Stat(exe); err != nil {
+		fmt.Fprintf(os.Stderr, "mk: %s pins mk %s; downloading it\n", file, tag)
+		bin, err := fetchRelease(ctx, tag)
+		if err != nil {
+			return fmt.Errorf("mk %s, pinned by %s: %w", tag, file, err)
+		}
+		if err := writeExecutable(exe, bin); err != nil {
+			return err
+		}
+	}
+	os.Setenv(noPinEnv, "1")
+	return execProgram(exe, append([]string{exe}, os.Args[1:]...))
+}
+
+// versionsDir returns where downloaded releases are kept:
+// $XDG_CACHE_HOME/mk/versions, or under the platform's cache directory.
+func versionsDir() (string, error) {
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		var err error
+		if base, err = os.UserCacheDir(); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(base, "mk", "versions"), nil
+}
+
+// selfUpdate replaces the running mk with the given release, or, if
+// tag is empty, the one .mk-version pins, or else the latest release.
+func selfUpdate(ctx context.Context, tag string) error {
+	if tag == "" {
+		var err error
+		if tag, _, err = findPin(); err != nil {
+			return err
+		}
+	}
+	if tag == "" {
+		var err error
+		if tag, err = latestRelease(ctx); err != nil {
+			return err
+		}
+	} else {
+		tag = "v" + strings.TrimPrefix(tag, "v")
+	}
+	if tag == version {
+		fmt.Printf("mk %s is up to date\n", version)
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	bin, err := fetchRelease(ctx, tag)
+	if err != nil {
+		return err
+	}
+	if err := writeExecutable(exe, bin); err != nil {
+		return err
+	}
+	fmt.Printf("mk updated from %s to %s\n", version, tag)
+	return nil
+}
+
+// latestRelease returns the tag of the latest release, from where
+// <base>/latest redirects.
+func latestRelease(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, releasesURL()+"/latest", nil)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	loc := resp.Header.Get("Location")
+	if dir, tag := path.Split(loc); strings.HasSuffix(dir, "/tag/") && tag != "" {
+		return tag, nil
+	}
+	return "", fmt.Errorf("finding the latest release: unexpected response %s", resp.Status)
+}
+
+// fetchRelease downloads release tag's archive for this platform, checks
+// it against the release's SHA256SUMS and returns the mk binary in it.
+func fetchRelease(ctx context.Context, tag string) ([]byte, error) {
+	archive := fmt.Sprintf("mk-%s-%s-%s.tar.gz", strings.TrimPrefix(tag, "v"), runtime.GOOS, runtime.GOARCH)
+	sums, err := download(ctx, tag, "SHA256SUMS")
+	if err != nil {
+		return nil, err
+	}
+	want := ""
+	sc := bufio.NewScanner(strings.NewReader(string(sums)))
+	for sc.Scan() {
+		if f := strings.Fields(sc.Text()); len(f) == 2 && strings.TrimPrefix(f[1], "*") == archive {
+			want = f[0]
+		}
+	}
+	if want == "" {
+		return nil, fmt.Errorf("%s: no checksum for %s", tag, archive)
+	}
+	data, err := download(ctx, tag, archive)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return nil, fmt.Errorf("%s: checksum mismatch (got %s, want %s)", archive, got, want)
+	}
+	return extractMK(data)
+}
+
+func download(ctx context.Context, tag, file string) ([]byte, error) {
+	url := releasesURL() + "/download/" + tag + "/" + file
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// extractMK returns the mk binary in a release archive.
+func extractMK(archive []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(strings.NewReader(string(archive)))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("release archive has no mk binary")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg && path.Base(hdr.Name) == "mk"+exeSuffix {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// writeExecutable replaces path with an executable holding data, in one
+// step, so a running mk is never left half-written.
+func writeExecutable(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".mk-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o755); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// Windows won't replace a running executable, but will rename it.
+		old := path + ".old"
+		os.Remove(old) // from the last update, unless that mk still runs
+		if err := os.Rename(path, old); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			os.Rename(old, path)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(tmp.Name(), path)
+}
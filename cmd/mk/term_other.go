@@ -0,0 +1,12 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+import "os"
+
+// ttyWidth returns 0: terminal widths aren't known on this platform, so
+// messages are written in full.
+func ttyWidth(f *os.File) int { return 0 }
@@ -0,0 +1,145 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// completionCacheFile, in the state directory, holds the last output of
+// Complete, so that completing in a large project doesn't evaluate its
+// mkfiles, once per config, on every keystroke.
+const completionCacheFile = "complete.json"
+
+type completionCache struct {
+	Key    string            `json:"key"`    // mk's version, the format and the variables
+	Inputs map[string]string `json:"inputs"` // mkfile read, or "glob:" and a $[wildcard] pattern -> hash; "" if missing
+	Output string            `json:"output"`
+}
+
+// Complete returns the names the command line accepts for the mkfile at
+// path, one per line: the explicit targets and tasks, the configs, and
+// each target as target:config under each config. With kinds, each line
+// is the kind (target, task, config or variable), a tab and the name,
+// followed by a tab and its description if the definition has a comment
+// above it; the variables the mkfiles assign are listed too. The output
+// is cached in the state directory until a mkfile read or a $[wildcard]'s
+// matches change. It returns "" if the mkfile doesn't load.
+func Complete(ctx context.Context, path string, opts Options, kinds bool) string {
+	w := mkfileWorkspace(opts.Dir, path)
+	vars := make([]string, 0, len(opts.Vars))
+	for k, v := range opts.Vars {
+		vars = append(vars, k+"="+v)
+	}
+	slices.Sort(vars)
+	key := hashString(fmt.Sprintf("%s\x00%s\x00%t\x00%s", Version, filepath.Base(path), kinds, strings.Join(vars, "\x00")))
+	cachePath := w.path(filepath.Join(stateDir, completionCacheFile))
+	var cache completionCache
+	if data, err := os.ReadFile(cachePath); err == nil && json.Unmarshal(data, &cache) == nil && cache.Key == key && w.inputsUnchanged(cache.Inputs) {
+		return cache.Output
+	}
+
+	load := func(configs []string) *Project {
+		p, err := Load(ctx, path, Options{Dir: opts.Dir, Vars: opts.Vars, Configs: configs, Stderr: io.Discard})
+		if err != nil {
+			return nil
+		}
+		return p
+	}
+	p := load(nil)
+	if p == nil {
+		return ""
+	}
+	defer p.Close()
+	inputs := map[string]string{}
+	var out strings.Builder
+	line := func(c Completion) {
+		switch {
+		case !kinds:
+			fmt.Fprintln(&out, c.Name)
+		case c.Doc != "":
+			fmt.Fprintf(&out, "%s\t%s\t%s\n", c.Kind, c.Name, c.Doc)
+		case len(c.Runs) > 0:
+			fmt.Fprintf(&out, "%s\t%s\truns %s\n", c.Kind, c.Name, strings.Join(c.Runs, " "))
+		default:
+			fmt.Fprintf(&out, "%s\t%s\n", c.Kind, c.Name)
+		}
+	}
+	completions := p.graph.Completions()
+	for _, c := range completions {
+		if c.Kind != "variable" || kinds {
+			line(c)
+		}
+	}
+	w.recordInputs(p.graph, inputs)
+	for _, c := range completions {
+		if c.Kind != "config" {
+			continue
+		}
+		// Configs can add rules, so list each one's own targets.
+		cp := load([]string{c.Name})
+		if cp == nil {
+			continue
+		}
+		for _, t := range cp.graph.Completions() {
+			if t.Kind == "target" || t.Kind == "task" {
+				t.Name += ":" + c.Name
+				line(t)
+			}
+		}
+		w.recordInputs(cp.graph, inputs)
+		cp.Close()
+	}
+	inputs[filepath.Base(path)], _ = hashFile(w.path(filepath.Base(path)))
+
+	data, err := json.Marshal(completionCache{Key: key, Inputs: inputs, Output: out.String()})
+	if err == nil {
+		writeFileAtomic(cachePath, data) // best effort
+	}
+	return out.String()
+}
+
+// recordInputs adds the files g read, other than the top-level mkfile and
+// the standard library, and its $[wildcard] patterns to inputs, with
+// their hashes.
+func (w workspace) recordInputs(g *Graph, inputs map[string]string) {
+	for i, f := range g.files {
+		if i > 0 && !strings.HasSuffix(f, " (built in)") {
+			inputs[f], _ = hashFile(w.path(f))
+		}
+	}
+	for _, pattern := range g.globs {
+		inputs["glob:"+pattern] = w.globHash(pattern)
+	}
+}
+
+// inputsUnchanged reports whether every input still has its recorded
+// hash.
+func (w workspace) inputsUnchanged(inputs map[string]string) bool {
+	for name, want := range inputs {
+		var h string
+		if pattern, ok := strings.CutPrefix(name, "glob:"); ok {
+			h = w.globHash(pattern)
+		} else {
+			h, _ = hashFile(w.path(name))
+		}
+		if h != want {
+			return false
+		}
+	}
+	return len(inputs) > 0
+}
+
+// globHash returns the hash of the files pattern matches.
+func (w workspace) globHash(pattern string) string {
+	matches, _ := w.glob(pattern)
+	return hashString(strings.Join(matches, "\x00"))
+}
@@ -0,0 +1,136 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestComplete(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("mkfile", `
+# Compiler flags.
+cflags = -O2
+include extra.mk
+
+# The program.
+app: main.c
+    cc -o $target $input
+
+# Runs the tests
+# under the race detector.
+!test: app
+    ./app
+
+# Builds with debug info.
+config debug:
+    cflags = -g
+
+parts = $[wildcard parts/*.txt]
+`)
+	write("extra.mk", "lib.a:\n    touch $target\n")
+	ctx := context.Background()
+	opts := Options{Dir: dir}
+
+	want := "lib.a\napp\ntest\ndebug\nlib.a:debug\napp:debug\ntest:debug\n"
+	if got := Complete(ctx, "mkfile", opts, false); got != want {
+		t.Errorf("names:\n%s\nwant:\n%s", got, want)
+	}
+	want = "target\tlib.a\n" +
+		"target\tapp\tThe program.\n" +
+		"task\ttest\tRuns the tests under the race detector.\n" +
+		"config\tdebug\tBuilds with debug info.\n" +
+		"variable\tcflags\tCompiler flags.\n" +
+		"variable\tparts\n" +
+		"target\tlib.a:debug\n" +
+		"target\tapp:debug\tThe program.\n" +
+		"task\ttest:debug\tRuns the tests under the race detector.\n"
+	if got := Complete(ctx, "mkfile", opts, true); got != want {
+		t.Errorf("kinds:\n%s\nwant:\n%s", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, stateDir, completionCacheFile)); err != nil {
+		t.Errorf("no completion cache: %v", err)
+	}
+
+	// A cached result is served until an input changes.
+	cachePath := filepath.Join(dir, stateDir, completionCacheFile)
+	data, _ := os.ReadFile(cachePath)
+	os.WriteFile(cachePath, []byte(strings.Replace(string(data), "lib.a", "cached.a", 1)), 0o644)
+	if got := Complete(ctx, "mkfile", opts, true); !strings.Contains(got, "cached.a") {
+		t.Errorf("expected the cached completions, got:\n%s", got)
+	}
+	for _, change := range []func(){
+		func() { write("extra.mk", "lib.so:\n    touch $target\n") },
+		func() { os.MkdirAll(filepath.Join(dir, "parts"), 0o755); write("parts/a.txt", "") },
+	} {
+		data, _ := os.ReadFile(cachePath)
+		os.WriteFile(cachePath, []byte(strings.Replace(string(data), "app", "cached", 1)), 0o644)
+		change()
+		if got := Complete(ctx, "mkfile", opts, true); strings.Contains(got, "cached") {
+			t.Errorf("expected fresh completions after an input changed, got:\n%s", got)
+		}
+	}
+
+	if got := Complete(ctx, "missing", opts, true); got != "" {
+		t.Errorf("completions for a missing mkfile = %q, want none", got)
+	}
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+# Built from main.c; see also lib.mk.
+## The program.
+app: main.c
+    cc -o $target $input
+
+lib.a:
+    touch $target
+
+## Runs the tests.
+!test: app
+    ./app
+
+!ci: test
+!ci: lint
+
+!lint:
+    golint
+
+# Builds with debug info.
+config debug:
+    cflags = -g
+`), 0o644)
+	p, err := Load(context.Background(), "mkfile", Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := p.Graph().WriteList(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `Tasks:
+  test  Runs the tests.
+  ci    runs test lint
+  lint
+Targets:
+  app    The program. (default)
+  lib.a
+Configs:
+  debug  Builds with debug info.
+`
+	if out.String() != want {
+		t.Errorf("list:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
@@ -1,16 +1,25 @@
 _mk() {
-    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local cur
+    # Keep target:config together despite ':' in COMP_WORDBREAKS.
+    if declare -F _get_comp_words_by_ref >/dev/null; then
+        _get_comp_words_by_ref -n : cur
+    else
+        cur="${COMP_WORDS[COMP_CWORD]}"
+    fi
 
     # Complete flags
     if [[ "$cur" == -* ]]; then
-        COMPREPLY=($(compgen -W "-C -f -v -B -n -j --why --graph --state --help-agent --version" -- "$cur"))
+        COMPREPLY=($(compgen -W "-C -f -v -B -n -j --ordered --audit --manifest --containment --strict --coarse-mtime --rehash-below --check-outputs --local-state --provenance --provenance-key --reproducible --timeout --serve --list --why --debug --trace-globs --check --graph --graph-depth --graph-diff --config --against --state --stats --cpuprofile --memprofile --help-agent --version" -- "$cur"))
         return
     fi
 
-    # Complete targets and configs from mkfile
+    # Complete targets, configs and target:config from mkfile
     local targets
     targets=$(mk --complete 2>/dev/null)
     COMPREPLY=($(compgen -W "$targets" -- "$cur"))
+    if declare -F __ltrim_colon_completions >/dev/null; then
+        __ltrim_colon_completions "$cur"
+    fi
 }
 
 complete -F _mk mk
@@ -0,0 +1,207 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ConfigStatus describes the slice of the workspace belonging to a config
+// set: the build directory it derives and the state file recording its
+// builds.
+type ConfigStatus struct {
+	Configs   []string  // the config set; nil for the base config
+	Suffix    string    // the state file's config suffix, the configs joined by "-"
+	Defined   bool      // the mkfile still defines the configs
+	BuildDir  string    // builddir under the configs; "" if unset or unknown
+	DiskUsage int64     // bytes in files under BuildDir
+	StateFile string    // "" if the configs were never built
+	LastBuild time.Time // when StateFile was last written
+}
+
+// ConfigsStatus returns the status of the base config, every config set
+// with a state file, and every config the mkfile at path defines but
+// that was never built on its own, in that order.
+func ConfigsStatus(ctx context.Context, path string, opts Options) ([]ConfigStatus, error) {
+	opts.Configs = nil
+	p, err := Load(ctx, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	names := p.graph.ConfigNames()
+	slices.Sort(names)
+
+	var statuses []ConfigStatus
+	seen := map[string]bool{}
+	add := func(suffix string) error {
+		seen[suffix] = true
+		s := ConfigStatus{Suffix: suffix, Defined: true}
+		if suffix != "" {
+			s.Configs, s.Defined = splitConfigSuffix(suffix, names)
+		}
+		if info, err := os.Stat(p.dir().path(StateFile(suffix))); err == nil {
+			s.StateFile, s.LastBuild = StateFile(suffix), info.ModTime()
+		}
+		if s.Defined {
+			if s.BuildDir, err = configBuildDir(ctx, p, path, opts, s.Configs); err != nil {
+				return err
+			}
+			s.DiskUsage = diskUsage(p.dir(), s.BuildDir)
+		}
+		statuses = append(statuses, s)
+		return nil
+	}
+	if err := add(""); err != nil {
+		return nil, err
+	}
+	for _, suffix := range p.dir().stateSuffixes() {
+		if !seen[suffix] {
+			if err := add(suffix); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, name := range names {
+		if !seen[name] {
+			if err := add(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return statuses, nil
+}
+
+// CleanConfig removes what builds under configs left behind: the
+// outputs their state records, as Clean does, the builddir they derive,
+// and their state file and its backups.
+// It returns the paths removed, or, if opts.DryRun is set, the paths it
+// would remove. A builddir that isn't a subdirectory of the workspace,
+// or that the base config shares, is left alone.
+func CleanConfig(ctx context.Context, path string, opts Options, configs []string) ([]string, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no configs given")
+	}
+	base := opts
+	base.Configs = nil
+	p, err := Load(ctx, path, base)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	for _, name := range configs {
+		if !slices.Contains(p.graph.ConfigNames(), name) {
+			return nil, fmt.Errorf("unknown config %q", name)
+		}
+	}
+	dir, err := configBuildDir(ctx, p, path, opts, configs)
+	if err != nil {
+		return nil, err
+	}
+	suffix := strings.Join(configs, "-")
+	paths := []string{StateFile(suffix)}
+	for n := range stateBackups {
+		paths = append(paths, stateBackup(suffix, n))
+	}
+	if dir != "" {
+		clean := filepath.Clean(dir)
+		switch {
+		case !filepath.IsLocal(clean):
+			return nil, fmt.Errorf("builddir %s isn't inside the workspace", dir)
+		case clean == filepath.Clean(p.vars.Get("builddir")):
+			return nil, fmt.Errorf("builddir %s is also the base config's", dir)
+		}
+		paths = append([]string{clean}, paths...)
+	}
+
+	opts.Configs = configs
+	cp, err := Load(ctx, path, opts)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", strings.Join(configs, "+"), err)
+	}
+	defer cp.Close()
+
+	var removed []string
+	for _, f := range paths {
+		if _, err := os.Lstat(p.dir().path(f)); err != nil {
+			continue
+		}
+		if !opts.DryRun {
+			if err := os.RemoveAll(p.dir().path(f)); err != nil {
+				return removed, err
+			}
+		}
+		removed = append(removed, f)
+	}
+	// The outputs in the builddir went with it, or, in a dry run, would
+	// have.
+	outputs, err := cp.cleanOutputs(opts.DryRun)
+	for _, f := range outputs {
+		if rel, err := filepath.Rel(filepath.Clean(dir), f); dir == "" || err != nil || !filepath.IsLocal(rel) {
+			removed = append(removed, f)
+		}
+	}
+	return removed, err
+}
+
+// configBuildDir returns builddir as the mkfile at path sets it under
+// configs. base is the project loaded without configs.
+func configBuildDir(ctx context.Context, base *Project, path string, opts Options, configs []string) (string, error) {
+	if len(configs) == 0 {
+		return base.vars.Get("builddir"), nil
+	}
+	opts.Configs = configs
+	p, err := Load(ctx, path, opts)
+	if err != nil {
+		return "", fmt.Errorf("config %s: %w", strings.Join(configs, "+"), err)
+	}
+	defer p.Close()
+	return p.vars.Get("builddir"), nil
+}
+
+// splitConfigSuffix splits a state file suffix into the defined config
+// names it joins with "-", which config names may themselves contain.
+func splitConfigSuffix(suffix string, names []string) ([]string, bool) {
+	if suffix == "" {
+		return nil, true
+	}
+	for _, name := range names {
+		rest, ok := strings.CutPrefix(suffix, name)
+		switch {
+		case !ok:
+		case rest == "":
+			return []string{name}, true
+		case rest[0] == '-':
+			if tail, ok := splitConfigSuffix(rest[1:], names); ok {
+				return append([]string{name}, tail...), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// diskUsage returns the total size of the files under dir in the
+// workspace w.
+func diskUsage(w workspace, dir string) int64 {
+	if dir == "" {
+		return 0
+	}
+	var n int64
+	filepath.WalkDir(w.path(dir), func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				n += info.Size()
+			}
+		}
+		return nil
+	})
+	return n
+}
@@ -0,0 +1,100 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"io"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestConfigsStatusAndClean(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+builddir = build
+
+config debug:
+    cflags = -g
+
+config cross-arm64:
+    cflags = -arch
+
+$builddir/app:
+    echo app$cflags > $target
+`), 0o644)
+
+	ctx := context.Background()
+	opts := Options{Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}
+	for _, configs := range [][]string{nil, {"debug"}, {"debug", "cross-arm64"}} {
+		o := opts
+		o.Configs = configs
+		p, err := Load(ctx, "mkfile", o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Build(ctx, p.Vars().Get("builddir")+"/app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(StateFile("gone"), []byte(`{"targets":{}}`), 0o644)
+
+	statuses, err := ConfigsStatus(ctx, "mkfile", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type row struct {
+		suffix, builddir string
+		defined, built   bool
+	}
+	var got []row
+	for _, s := range statuses {
+		got = append(got, row{s.Suffix, s.BuildDir, s.Defined, s.StateFile != ""})
+		if s.BuildDir != "" && s.StateFile != "" && s.DiskUsage == 0 {
+			t.Errorf("%s: no disk usage for %s", s.Suffix, s.BuildDir)
+		}
+	}
+	want := []row{
+		{"", "build", true, true},
+		{"debug-cross-arm64", "build-debug-cross-arm64", true, true},
+		{"debug", "build-debug", true, true},
+		{"gone", "", false, true},
+		{"cross-arm64", "build-cross-arm64", true, false},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("statuses = %+v\nwant %+v", got, want)
+	}
+
+	opts.DryRun = true
+	removed, err := CleanConfig(ctx, "mkfile", opts, []string{"debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("build-debug"); err != nil {
+		t.Errorf("dry run removed build-debug")
+	}
+	opts.DryRun = false
+	again, err := CleanConfig(ctx, "mkfile", opts, []string{"debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRemoved := []string{"build-debug", StateFile("debug")} // built once, so no previous state
+	if !slices.Equal(removed, wantRemoved) || !slices.Equal(again, wantRemoved) {
+		t.Errorf("removed %v (dry run %v), want %v", again, removed, wantRemoved)
+	}
+	for _, f := range []string{"build/app", "build-debug-cross-arm64/app", StateFile(""), StateFile("debug-cross-arm64")} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("cleaning :debug removed %s", f)
+		}
+	}
+
+	if _, err := CleanConfig(ctx, "mkfile", opts, []string{"nope"}); err == nil {
+		t.Error("cleaning an undefined config succeeded")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// console writes mk's own messages, as opposed to recipe output. Given a
+// terminal width, it elides banner lines that don't fit and collapses
+// runs of up-to-date messages into a count; otherwise, for logs and
+// pipes, it writes everything in full. Callers hold Executor.outputMu.
+type console struct {
+	w        io.Writer
+	width    int    // terminal columns; 0 = write full text
+	upToDate int    // up-to-date messages held back
+	last     string // the latest of them
+}
+
+// printf writes a message in full.
+func (c *console) printf(format string, args ...any) {
+	c.flush()
+	fmt.Fprintf(c.w, format, args...)
+}
+
+// banner writes text, eliding each line to the terminal width.
+func (c *console) banner(text string) {
+	c.flush()
+	if c.width <= 0 {
+		io.WriteString(c.w, text)
+		return
+	}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line != "" {
+			io.WriteString(c.w, elide(line, c.width))
+		}
+	}
+}
+
+// reportUpToDate notes that target is up to date. With a width, the
+// message waits to be merged with any that follow it.
+func (c *console) reportUpToDate(target string) {
+	msg := fmt.Sprintf("mk: %q is up to date\n", target)
+	if c.width <= 0 {
+		io.WriteString(c.w, msg)
+		return
+	}
+	c.upToDate++
+	c.last = msg
+}
+
+// flush writes the up-to-date messages held back: the message itself if
+// there was one, else how many.
+func (c *console) flush() {
+	switch {
+	case c.upToDate == 1:
+		io.WriteString(c.w, elide(c.last, c.width))
+	case c.upToDate > 1:
+		fmt.Fprintf(c.w, "mk: %d targets up to date\n", c.upToDate)
+	}
+	c.upToDate = 0
+}
+
+// elide shortens line, which may end in a newline, to width columns,
+// marking the cut with "…".
+func elide(line string, width int) string {
+	body, nl := strings.CutSuffix(line, "\n")
+	if width <= 0 || utf8.RuneCountInString(body) <= width {
+		return line
+	}
+	runes := []rune(body)
+	s := string(runes[:max(width-1, 0)]) + "…"
+	if nl {
+		s += "\n"
+	}
+	return s
+}
+
+// A lockedWriter writes to w holding mu, so that recipe output streamed
+// to a writer that isn't a file interleaves safely with mk's messages.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
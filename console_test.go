@@ -0,0 +1,107 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConsole(t *testing.T) {
+	var buf bytes.Buffer
+	c := &console{w: &buf, width: 20}
+	c.reportUpToDate("a")
+	c.reportUpToDate("b")
+	c.reportUpToDate("c")
+	c.banner("mk: building \"a-very-long-target-name\"\n  short\n")
+	c.reportUpToDate("d")
+	c.printf("mk: warning: this one is long but kept whole\n")
+	c.reportUpToDate("e")
+	c.flush()
+	want := `mk: 3 targets up to date
+mk: building "a-ver…
+  short
+mk: "d" is up to da…
+mk: warning: this one is long but kept whole
+mk: "e" is up to da…
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// Without a width, everything is written in full, as it comes.
+	buf.Reset()
+	c = &console{w: &buf}
+	c.reportUpToDate("a")
+	c.reportUpToDate("b")
+	c.banner("mk: building \"a-very-long-target-name\"\n")
+	if want := "mk: \"a\" is up to date\nmk: \"b\" is up to date\nmk: building \"a-very-long-target-name\"\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestConsoleWidthBuild(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+a.txt:
+    echo a > $target
+b.txt:
+    echo b > $target
+c.txt:
+    echo c > $target
+
+!all: a.txt b.txt c.txt
+    echo done with a deliberately long recipe line that will not fit
+`), 0o644)
+
+	build := func(width int) string {
+		t.Helper()
+		var stderr bytes.Buffer
+		mustBuild(t, Options{Jobs: 1, Verbose: true, Width: width, LocalState: true, Stdout: io.Discard, Stderr: &stderr}, "all")
+		return stderr.String()
+	}
+	build(0)
+
+	if got := build(40); !strings.Contains(got, "mk: 3 targets up to date\n") || !strings.Contains(got, "  echo done with a deliberately long re…\n") {
+		t.Errorf("with a width, stderr = %q, want up-to-date targets counted and the recipe elided", got)
+	}
+	if got := build(0); strings.Count(got, "is up to date") != 3 || !strings.Contains(got, "will not fit") {
+		t.Errorf("without a width, stderr = %q, want every message in full", got)
+	}
+}
+
+func TestRecipeEcho(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+!all:
+    echo shown
+    @echo quiet
+    -false
+`), 0o644)
+	build := func(opts Options) string {
+		t.Helper()
+		var stderr bytes.Buffer
+		opts.Dir, opts.Jobs, opts.LocalState = dir, 1, true
+		opts.Stdout, opts.Stderr = io.Discard, &stderr
+		mustBuild(t, opts, "all")
+		return stderr.String()
+	}
+
+	if got, want := build(Options{}), "mk: building \"all\"\n  echo shown\n  false\nmk: warning: ignored exit status 1 of recipe line 3\n"; got != want {
+		t.Errorf("stderr = %q, want %q (no @ lines)", got, want)
+	}
+	for _, opts := range []Options{{Verbose: true}, {DryRun: true}} {
+		if got := build(opts); !strings.Contains(got, "  echo shown\n  echo quiet\n  false\n") {
+			t.Errorf("with %+v, stderr = %q, want every command without prefixes", opts, got)
+		}
+	}
+}
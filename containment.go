@@ -0,0 +1,87 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// checkContainment returns an error if any of rule's targets lies outside
+// the workspace or, for a rule from a scoped
+// include, outside that include's directory.
+func checkContainment(rule *resolvedRule) error {
+	for _, t := range rule.targets {
+		if !insideDir(t, ".") {
+			return fmt.Errorf("target %q is outside the workspace", t)
+		}
+		if rule.scope != "" && !insideDir(t, rule.scope) {
+			return fmt.Errorf("target %q is outside its include scope %q", t, rule.scope)
+		}
+	}
+	return nil
+}
+
+// insideDir reports whether path lies within dir. Both are interpreted
+// relative to the workspace root.
+func insideDir(path, dir string) bool {
+	if filepath.IsAbs(path) {
+		return false
+	}
+	rel, err := filepath.Rel(dir, filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+type fileStamp struct {
+	mtime time.Time
+	size  int64
+}
+
+// workspaceSnapshot records the files in the workspace outside skip, so
+// that writes a recipe makes outside its scope can be found afterwards.
+type workspaceSnapshot map[string]fileStamp
+
+func (w workspace) snapshot(skip string) workspaceSnapshot {
+	snap := make(workspaceSnapshot)
+	fs.WalkDir(os.DirFS(w.path(".")), ".", func(path string, d fs.DirEntry, err error) error { //nolint:errcheck // unreadable entries are skipped
+		if err != nil {
+			return nil
+		}
+		path = filepath.FromSlash(path)
+		if d.IsDir() {
+			if path == stateDir || path == ".git" || path == skip {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			snap[path] = fileStamp{info.ModTime(), info.Size()}
+		}
+		return nil
+	})
+	return snap
+}
+
+// changed returns the files created, modified or removed between s and
+// after, sorted.
+func (s workspaceSnapshot) changed(after workspaceSnapshot) []string {
+	var paths []string
+	for p, st := range after {
+		if old, ok := s[p]; !ok || !old.mtime.Equal(st.mtime) || old.size != st.size {
+			paths = append(paths, p)
+		}
+	}
+	for p := range s {
+		if _, ok := after[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,59 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestContainment(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.Mkdir("lib", 0o755)
+	os.WriteFile("mkfile", []byte(`
+include lib/mkfile as lib
+
+/tmp/abs.txt:
+    true
+`), 0o644)
+	os.WriteFile("lib/mkfile", []byte(`
+ok.txt:
+    echo ok > $target
+
+../escape.txt:
+    echo no > $target
+
+sneaky.txt:
+    echo leak > leak.txt
+    echo ok > $target
+`), 0o644)
+
+	build := func(target string) error {
+		_, err := loadAndBuild(t, Options{Jobs: 1, Stderr: io.Discard, Containment: true}, target)
+		return err
+	}
+
+	if err := build("lib/ok.txt"); err != nil {
+		t.Errorf("lib/ok.txt: %v", err)
+	}
+	if err := build("escape.txt"); err == nil || !strings.Contains(err.Error(), `outside its include scope "lib"`) {
+		t.Errorf("escape.txt: %v, want scope error", err)
+	}
+	if err := build("/tmp/abs.txt"); err == nil || !strings.Contains(err.Error(), "outside the workspace") {
+		t.Errorf("/tmp/abs.txt: %v, want workspace error", err)
+	}
+	err := build("lib/sneaky.txt")
+	if err == nil || !strings.Contains(err.Error(), "leak.txt") {
+		t.Errorf("lib/sneaky.txt: %v, want write outside scope", err)
+	}
+	if _, err := os.Stat("lib/sneaky.txt"); err == nil {
+		t.Error("lib/sneaky.txt should be removed after containment failure")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import "strings"
+
+// tripleGOOS implements $[goos triple]: the GOOS for a target triple such
+// as aarch64-linux-gnu or x86_64-w64-mingw32, or "" if it names no
+// operating system Go knows.
+func tripleGOOS(triple string) string {
+	parts := strings.Split(triple, "-")
+	if len(parts) < 2 {
+		return ""
+	}
+	parts = parts[1:]
+	// aarch64-linux-android is android, not linux.
+	for _, p := range parts {
+		if strings.HasPrefix(p, "android") {
+			return "android"
+		}
+	}
+	for _, p := range parts {
+		switch {
+		case p == "linux":
+			return "linux"
+		case p == "apple" || strings.HasPrefix(p, "darwin") || strings.HasPrefix(p, "macos"):
+			return "darwin"
+		case p == "w64" || p == "windows" || strings.HasPrefix(p, "mingw"):
+			return "windows"
+		case strings.HasPrefix(p, "wasi"):
+			return "wasip1"
+		}
+		for _, os := range []string{"freebsd", "netbsd", "openbsd", "dragonfly", "solaris", "illumos"} {
+			if strings.HasPrefix(p, os) {
+				return os
+			}
+		}
+	}
+	return ""
+}
+
+// tripleGOARCH implements $[goarch triple]: the GOARCH for a target
+// triple's architecture, or "" if Go has none.
+func tripleGOARCH(triple string) string {
+	arch, _, _ := strings.Cut(triple, "-")
+	switch arch {
+	case "x86_64", "amd64":
+		return "amd64"
+	case "aarch64", "arm64":
+		return "arm64"
+	case "i386", "i486", "i586", "i686", "x86":
+		return "386"
+	case "ppc64le", "powerpc64le":
+		return "ppc64le"
+	case "ppc64", "powerpc64":
+		return "ppc64"
+	case "mipsel":
+		return "mipsle"
+	case "mips64el":
+		return "mips64le"
+	case "mips", "mips64", "s390x", "riscv64":
+		return arch
+	case "loongarch64":
+		return "loong64"
+	case "wasm32":
+		return "wasm"
+	}
+	if strings.HasPrefix(arch, "arm") || strings.HasPrefix(arch, "thumb") {
+		return "arm"
+	}
+	return ""
+}
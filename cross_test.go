@@ -0,0 +1,85 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestTripleGoNames(t *testing.T) {
+	tests := []struct{ triple, goos, goarch string }{
+		{"x86_64-linux-gnu", "linux", "amd64"},
+		{"x86_64-unknown-linux-gnu", "linux", "amd64"},
+		{"aarch64-linux-gnu", "linux", "arm64"},
+		{"aarch64-linux-android", "android", "arm64"},
+		{"arm-linux-gnueabihf", "linux", "arm"},
+		{"armv7-unknown-linux-gnueabihf", "linux", "arm"},
+		{"i686-linux-gnu", "linux", "386"},
+		{"riscv64-linux-gnu", "linux", "riscv64"},
+		{"mips64el-linux-gnuabi64", "linux", "mips64le"},
+		{"x86_64-w64-mingw32", "windows", "amd64"},
+		{"aarch64-apple-darwin", "darwin", "arm64"},
+		{"x86_64-unknown-freebsd14", "freebsd", "amd64"},
+		{"wasm32-wasi", "wasip1", "wasm"},
+		{"sparc-sun-unknown", "", ""},
+	}
+	for _, tt := range tests {
+		if got := tripleGOOS(tt.triple); got != tt.goos {
+			t.Errorf("goos %s = %q, want %q", tt.triple, got, tt.goos)
+		}
+		if got := tripleGOARCH(tt.triple); got != tt.goarch {
+			t.Errorf("goarch %s = %q, want %q", tt.triple, got, tt.goarch)
+		}
+	}
+}
+
+func TestStdlibCrossConfigs(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+include std/go.mk
+include std/c.mk
+
+eval $[cross mips64el-linux-gnuabi64]
+`), 0o644)
+
+	tests := []struct {
+		config                             string
+		triple, cc, goos, goarch, builddir string
+	}{
+		{"cross-arm64", "aarch64-linux-gnu", "aarch64-linux-gnu-gcc", "linux", "arm64", "build-cross-arm64"},
+		{"cross-windows-amd64", "x86_64-w64-mingw32", "x86_64-w64-mingw32-gcc", "windows", "amd64", "build-cross-windows-amd64"},
+		{"cross-mips64le", "mips64el-linux-gnuabi64", "mips64el-linux-gnuabi64-gcc", "linux", "mips64le", "build-cross-mips64le"},
+	}
+	for _, tt := range tests {
+		p, err := Load(context.Background(), "mkfile", Options{Configs: []string{tt.config}, LocalState: true, Stdout: io.Discard, Stderr: io.Discard})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.config, err)
+		}
+		v := p.Vars()
+		got := []string{v.Get("target_triple"), v.Get("cc"), v.Get("goos"), v.Get("goarch"), v.Get("builddir")}
+		want := []string{tt.triple, tt.cc, tt.goos, tt.goarch, tt.builddir}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s: target_triple, cc, goos, goarch, builddir = %q, want %q", tt.config, got, want)
+				break
+			}
+		}
+	}
+
+	// Without a cross config, the native toolchain is used.
+	p, err := Load(context.Background(), "mkfile", Options{LocalState: true, Stdout: io.Discard, Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := p.Vars(); v.Get("target_triple") != "" || v.Get("cc") != "cc" || v.Get("goos") != "" {
+		t.Errorf("native: target_triple %q, cc %q, goos %q; want \"\", cc, \"\"", v.Get("target_triple"), v.Get("cc"), v.Get("goos"))
+	}
+}
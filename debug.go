@@ -0,0 +1,106 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Debug selects which of mk's decisions Options.Debug traces to stderr.
+type Debug uint
+
+const (
+	DebugResolve Debug = 1 << iota // how targets match explicit and pattern rules
+	DebugStale                     // why targets are or aren't rebuilt
+	DebugVars                      // variable assignments and what they expand to
+	DebugInclude                   // which files includes read, and their scopes
+
+	DebugAll = DebugResolve | DebugStale | DebugVars | DebugInclude
+)
+
+var debugNames = []struct {
+	name string
+	cat  Debug
+}{
+	{"resolve", DebugResolve},
+	{"stale", DebugStale},
+	{"vars", DebugVars},
+	{"include", DebugInclude},
+}
+
+// ParseDebug parses a comma-separated list of debug categories, as given
+// to --debug: resolve, stale, vars, include, or all.
+func ParseDebug(s string) (Debug, error) {
+	var d Debug
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			d |= DebugAll
+			continue
+		}
+		found := false
+		for _, n := range debugNames {
+			if n.name == name {
+				d |= n.cat
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown debug category %q (want resolve, stale, vars, include or all)", name)
+		}
+	}
+	return d, nil
+}
+
+// tracer writes debug lines tagged with their category, "mk: [stale] ...",
+// so they can be told apart from warnings and filtered with grep. A nil
+// tracer traces nothing.
+type tracer struct {
+	w    io.Writer
+	cats Debug
+
+	mu   sync.Mutex
+	seen map[string]bool // targets whose resolution has been traced
+}
+
+func newTracer(w io.Writer, cats Debug) *tracer {
+	if cats == 0 {
+		return nil
+	}
+	return &tracer{w: w, cats: cats, seen: make(map[string]bool)}
+}
+
+func (t *tracer) on(cat Debug) bool {
+	return t != nil && t.cats&cat != 0
+}
+
+func (t *tracer) printf(cat Debug, format string, args ...any) {
+	if !t.on(cat) {
+		return
+	}
+	var tag string
+	for _, n := range debugNames {
+		if n.cat == cat {
+			tag = n.name
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, "mk: [%s] %s\n", tag, fmt.Sprintf(format, args...))
+}
+
+// first reports whether this is the first call for key, so that lookups
+// repeated during a build are traced once.
+func (t *tracer) first(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seen[key] {
+		return false
+	}
+	t.seen[key] = true
+	return true
+}
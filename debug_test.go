@@ -0,0 +1,67 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseDebug(t *testing.T) {
+	d, err := ParseDebug("stale, include")
+	if err != nil || d != DebugStale|DebugInclude {
+		t.Errorf("ParseDebug = %v, %v; want stale|include", d, err)
+	}
+	if d, _ := ParseDebug("all"); d != DebugAll {
+		t.Errorf("ParseDebug(all) = %v, want %v", d, DebugAll)
+	}
+	if _, err := ParseDebug("resolve,nope"); err == nil {
+		t.Error("ParseDebug accepted an unknown category")
+	}
+}
+
+func TestDebugTrace(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.MkdirAll("lib", 0o755)
+	os.WriteFile("mkfile", []byte(`
+cc = gcc
+include lib/mkfile as lib
+
+{name}.o: {name}.c
+    cp $input $target
+`), 0o644)
+	os.WriteFile("lib/mkfile", []byte("x = 1\n"), 0o644)
+	os.WriteFile("a.c", []byte("int a;"), 0o644)
+
+	var stderr bytes.Buffer
+	mustBuild(t, Options{Debug: DebugAll, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: &stderr}, "a.o")
+	out := stderr.String()
+	for _, want := range []string{
+		`mk: [vars] mkfile:2: cc = "gcc"`,
+		`mk: [include] mkfile:3: include "lib/mkfile"`,
+		`mk: [include] reading lib/mkfile as scope "lib"`,
+		`mk: [vars] lib/mkfile:1: x = "1"`,
+		`mk: [resolve] a.o: pattern {name}.o at mkfile:5 matches (name=a), supplies the recipe [a.c]`,
+		`mk: [resolve] a.c: no rule; an existing file`,
+		`mk: [stale] a.o: no previous build recorded`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("trace lacks %q:\n%s", want, out)
+		}
+	}
+
+	// Only the requested categories are traced.
+	stderr.Reset()
+	mustBuild(t, Options{Debug: DebugStale, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: &stderr}, "a.o")
+	if out := stderr.String(); out != "mk: [stale] a.o: up to date\n" {
+		t.Errorf("stale trace = %q, want only a.o up to date", out)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// parseDepfile parses a Make-style dependency file, as written by
+// cc -MD, tsc and protoc --dependency_out, and returns the prerequisites
+// of all its rules, without duplicates, in the order they appear. Lines
+// continue with a trailing backslash, a backslash escapes a space or #,
+// $$ is $, and # starts a comment. The rules' targets are ignored: the
+// file describes the targets of the rule whose recipe wrote it.
+func parseDepfile(data string) ([]string, error) {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\\\n", " ")
+	var deps []string
+	seen := map[string]bool{}
+	for n, line := range strings.Split(data, "\n") {
+		words, colon := depfileWords(line)
+		if colon < 0 {
+			if len(words) > 0 {
+				return nil, fmt.Errorf("line %d: no colon after the targets", n+1)
+			}
+			continue
+		}
+		for _, w := range words[colon:] {
+			if !seen[w] {
+				seen[w] = true
+				deps = append(deps, w)
+			}
+		}
+	}
+	return deps, nil
+}
+
+// depfileWords splits a depfile line into words, unescaping them, and
+// returns the index of the first word after the colon that ends the
+// targets, or -1 if there isn't one.
+func depfileWords(line string) (words []string, colon int) {
+	colon = -1
+	var word strings.Builder
+	inWord := false
+	flush := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '#':
+			flush()
+			return words, colon
+		case c == ' ' || c == '\t':
+			flush()
+		case c == '\\' && i+1 < len(line) && (line[i+1] == ' ' || line[i+1] == '#'):
+			i++
+			word.WriteByte(line[i])
+			inWord = true
+		case c == '$' && i+1 < len(line) && line[i+1] == '$':
+			i++
+			word.WriteByte('$')
+			inWord = true
+		case c == ':' && colon < 0 && (i+1 == len(line) || line[i+1] == ' ' || line[i+1] == '\t'):
+			flush()
+			colon = len(words)
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	flush()
+	return words, colon
+}
+
+// readDepfile reads the depfile the recipe for rule wrote, and returns
+// the files it lists that mk doesn't already track: not the rule's
+// targets or prerequisites. Relative paths in it are relative to the
+// directory the recipe ran in.
+func (e *Executor) readDepfile(rule *resolvedRule, path string) ([]string, error) {
+	data, err := os.ReadFile(e.dir.path(path))
+	if err != nil {
+		return nil, err
+	}
+	deps, err := parseDepfile(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cwd := rule.workdir(e.vars)
+	var found []string
+	for _, d := range deps {
+		if cwd != "" && !filepath.IsAbs(d) {
+			d = filepath.Join(cwd, d)
+		}
+		d = filepath.ToSlash(filepath.Clean(d))
+		if !slices.Contains(rule.targets, d) && !slices.Contains(rule.prereqs, d) && !slices.Contains(found, d) {
+			found = append(found, d)
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseDepfile(t *testing.T) {
+	tests := []struct {
+		name, in string
+		want     []string
+	}{
+		{"gcc", "foo.o: foo.c foo.h \\\n  include/bar.h\n", []string{"foo.c", "foo.h", "include/bar.h"}},
+		{"phony targets", "foo.o: foo.c foo.h\nfoo.h:\n", []string{"foo.c", "foo.h"}},
+		{"several rules", "a.js b.js: a.ts\nb.js: b.ts a.ts\n", []string{"a.ts", "b.ts"}},
+		{"escapes", "out: my\\ file.h cost$$.h \\#x.h # comment\n", []string{"my file.h", "cost$.h", "#x.h"}},
+		{"spaced colon", "out : in\r\n", []string{"in"}},
+		{"drive letter", "out: C:\\src\\in.h\n", []string{"C:\\src\\in.h"}},
+		{"empty", "\n# nothing\n", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseDepfile(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: deps = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if _, err := parseDepfile("foo.o foo.c\n"); err == nil {
+		t.Error("expected error for a line without a colon")
+	}
+}
+
+func TestParseDepfileAnnotation(t *testing.T) {
+	f, err := Parse(strings.NewReader("{name}.o [depfile: {name}.d]: {name}.c\n    cc -MD -c $input -o $target\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := f.Stmts[0].(Rule); r.Depfile != "{name}.d" || strings.Join(r.Targets, " ") != "{name}.o" {
+		t.Errorf("rule = %#v, want {name}.o with depfile {name}.d", r)
+	}
+	if _, err := Parse(strings.NewReader("!gen [depfile: gen.d]:\n    gen\n")); err == nil {
+		t.Error("expected error for [depfile] on a task")
+	}
+}
+
+func TestDepfile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The "compiler" concatenates its input with the headers the input
+	// names, and lists them in the depfile.
+	write("mkfile", `
+{name}.o [depfile: {name}.d]: {name}.c
+    cat $input $$(cat $input) > $target
+    printf '%s: %s \\\n  %s\n' $target $input "$$(cat $input)" > {name}.d
+`)
+	write("main.c", "a.h b.h\n")
+	write("a.h", "a\n")
+	write("b.h", "b\n")
+	build := func() (Stats, []string) {
+		t.Helper()
+		var reasons []string
+		progress := func(ev Event) {
+			for _, r := range ev.Reasons {
+				reasons = append(reasons, r.Kind.String())
+			}
+		}
+		p := mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard, Progress: progress}, "main.o")
+		return p.Stats(), reasons
+	}
+
+	if s, _ := build(); s.Built != 1 {
+		t.Fatalf("first build: %+v, want main.o built", s)
+	}
+	if s, _ := build(); s.Built != 0 {
+		t.Errorf("second build: %+v, want up to date", s)
+	}
+
+	// A header the depfile listed makes the target stale.
+	write("b.h", "b2\n")
+	if s, reasons := build(); s.Built != 1 || !slices.Contains(reasons, "discovered") {
+		t.Errorf("after editing b.h: %+v, reasons %v, want main.o rebuilt for a discovered dependency", s, reasons)
+	}
+
+	// A header the input no longer names drops out of the depfile.
+	write("main.c", "a.h\n")
+	build()
+	os.Remove(filepath.Join(dir, "b.h"))
+	if s, _ := build(); s.Built != 0 {
+		t.Errorf("after removing b.h: %+v, want up to date", s)
+	}
+
+	// A missing depfile is a warning, not a failure.
+	write("mkfile", "out [depfile: out.d]: main.c\n    cp $input $target\n")
+	var warned bool
+	progress := func(ev Event) { warned = warned || ev.Kind == TargetWarning }
+	mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard, Progress: progress}, "out")
+	if !warned {
+		t.Error("expected a warning for a missing depfile")
+	}
+}
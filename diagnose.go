@@ -0,0 +1,283 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// maxSuggestions bounds the "did you mean" targets listed for a target
+// with no rule.
+const maxSuggestions = 3
+
+// noRuleError explains why target has no rule: which mkfiles were read,
+// pattern rules that nearly matched, explicit targets with similar names
+// and files whose names differ only in case.
+func (g *Graph) noRuleError(target string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "no rule to build %q", target)
+	if len(g.files) > 0 {
+		fmt.Fprintf(&b, "\n  searched: %s", strings.Join(g.files, ", "))
+	}
+	for _, s := range g.similarTargets(target) {
+		fmt.Fprintf(&b, "\n  did you mean %q?", s)
+	}
+	for _, s := range g.nearPatterns(target) {
+		fmt.Fprintf(&b, "\n  %s", s)
+	}
+	for _, f := range g.dir.caseVariants(target) {
+		fmt.Fprintf(&b, "\n  file %q exists; names are case-sensitive", f)
+	}
+	return errors.New(b.String())
+}
+
+// similarTargets returns explicit targets within a small edit distance of
+// target, closest first.
+func (g *Graph) similarTargets(target string) []string {
+	limit := max(1, min(2, len(target)/3))
+	type candidate struct {
+		name string
+		dist int
+	}
+	var found []candidate
+	for _, r := range g.rules {
+		for _, t := range r.targets {
+			if d := editDistance(target, t); d <= limit && !slices.ContainsFunc(found, func(c candidate) bool { return c.name == t }) {
+				found = append(found, candidate{t, d})
+			}
+		}
+	}
+	slices.SortStableFunc(found, func(a, b candidate) int {
+		if a.dist != b.dist {
+			return a.dist - b.dist
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	var names []string
+	for _, c := range found[:min(len(found), maxSuggestions)] {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// nearPatterns describes pattern rules that match target except for a
+// capture constraint, or that match its file name in another directory.
+func (g *Graph) nearPatterns(target string) []string {
+	var notes []string
+	for _, pr := range g.patterns {
+		for _, tp := range pr.targetPatterns {
+			if note := nearMiss(tp, target); note != "" {
+				notes = append(notes, fmt.Sprintf("pattern %s (%s) %s", tp.Raw, pr.pos, note))
+			}
+		}
+	}
+	return notes
+}
+
+// nearMiss reports how tp nearly matches target, or "" if it doesn't.
+func nearMiss(tp Pattern, target string) string {
+	if _, ok := tp.Match(target); ok {
+		return ""
+	}
+	loose := tp
+	loose.Constraints = nil
+	if captures, ok := loose.Match(target); ok {
+		for i, name := range tp.Captures {
+			if c := tp.Constraints[i]; c != nil && !c.Matches(captures[name]) {
+				return fmt.Sprintf("matches, but %q fails the constraint on {%s}", captures[name], name)
+			}
+		}
+		return ""
+	}
+
+	// Match the file name against the pattern's last path element.
+	seg := lastPatternElem(tp.Raw)
+	if seg == tp.Raw {
+		return ""
+	}
+	segPat, ok, err := ParsePattern(seg)
+	if !ok || err != nil {
+		return ""
+	}
+	segPat.Constraints = nil
+	captures, ok := segPat.Match(filepath.Base(target))
+	if !ok {
+		return ""
+	}
+	for _, name := range tp.Captures {
+		if _, ok := captures[name]; !ok {
+			return fmt.Sprintf("builds files named %q, in other directories", filepath.Base(target))
+		}
+	}
+	return fmt.Sprintf("builds %q", tp.Expand(captures))
+}
+
+// lastPatternElem returns the part of a pattern after its last slash,
+// ignoring slashes inside {captures}, whose regexes may contain them.
+func lastPatternElem(raw string) string {
+	depth, start := 0, 0
+	for i := 0; i < len(raw); i++ {
+		switch raw[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '/':
+			if depth == 0 {
+				start = i + 1
+			}
+		}
+	}
+	return raw[start:]
+}
+
+// caseVariants returns existing files whose paths differ from target only
+// in the case of the file name.
+func (w workspace) caseVariants(target string) []string {
+	dir, base := filepath.Split(target)
+	entries, err := os.ReadDir(w.path(filepath.Clean(dir + ".")))
+	if err != nil {
+		return nil
+	}
+	var found []string
+	for _, e := range entries {
+		if e.Name() != base && strings.EqualFold(e.Name(), base) {
+			found = append(found, dir+e.Name())
+		}
+	}
+	return found
+}
+
+// editDistance returns the optimal string alignment distance between a
+// and b: insertions, deletions, substitutions and transpositions of
+// adjacent bytes each cost 1.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// maxNeeders bounds the rules listed as needing each missing file.
+const maxNeeders = 3
+
+// checkSources resolves the graph under targets, as the build will, with
+// the prerequisites that name no rule statted in parallel, and reports
+// every one that isn't a file, with the rules that need it, in one
+// error. A build would otherwise fail on the first it reached, with
+// other recipes already running. Targets themselves are left to the
+// build, which explains a missing one in more detail, as are
+// prerequisites built under other configs.
+func (g *Graph) checkSources(targets []string) error {
+	var (
+		mu      sync.Mutex
+		needers = map[string][]*resolvedRule{} // target → the rules needing it
+		errs    = map[string]error{}           // prerequisite → why it can't be resolved
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, 8*runtime.NumCPU())
+	)
+	var visit func(target string, parent *resolvedRule, chain *buildChain)
+	visit = func(target string, parent *resolvedRule, chain *buildChain) {
+		mu.Lock()
+		defer mu.Unlock()
+		rules, seen := needers[target]
+		if parent != nil {
+			rules = append(rules, parent)
+		}
+		needers[target] = rules
+		if seen {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			rule, err := g.resolve(target)
+			<-sem
+			if err != nil {
+				if parent != nil {
+					mu.Lock()
+					errs[target] = err
+					mu.Unlock()
+				}
+				return
+			}
+			link := &buildChain{target: target, pattern: rule.pattern, parent: chain}
+			if link.checkImplicit() != nil {
+				return // the build reports it
+			}
+			for _, p := range slices.Concat(rule.prereqs, rule.orderOnlyPrereqs) {
+				if _, ok := rule.configs[p]; !ok {
+					visit(p, rule, link)
+				}
+			}
+		}()
+	}
+	for _, t := range targets {
+		visit(t, nil, nil)
+	}
+	wg.Wait()
+	if len(errs) == 0 {
+		return nil
+	}
+
+	files := slices.Sorted(maps.Keys(errs))
+	var b strings.Builder
+	if len(files) == 1 {
+		fmt.Fprintf(&b, "a prerequisite is missing and no rule builds it:")
+	} else {
+		fmt.Fprintf(&b, "%d prerequisites are missing and no rule builds them:", len(files))
+	}
+	for _, f := range files {
+		var by []string
+		for _, r := range needers[f] {
+			if n := fmt.Sprintf("%q (%s)", r.target, r.pos); !slices.Contains(by, n) {
+				by = append(by, n)
+			}
+		}
+		slices.Sort(by)
+		more := ""
+		if len(by) > maxNeeders {
+			more = fmt.Sprintf(" and %d more", len(by)-maxNeeders)
+			by = by[:maxNeeders]
+		}
+		fmt.Fprintf(&b, "\n  %q, needed by %s%s", f, strings.Join(by, ", "), more)
+		// The hints of noRuleError, but for the mkfiles searched,
+		// which are the same for every file.
+		for _, line := range strings.Split(errs[f].Error(), "\n")[1:] {
+			if !strings.HasPrefix(line, "  searched: ") {
+				fmt.Fprintf(&b, "\n  %s", line)
+			}
+		}
+	}
+	if len(g.files) > 0 {
+		fmt.Fprintf(&b, "\n  searched: %s", strings.Join(g.files, ", "))
+	}
+	return errors.New(b.String())
+}
@@ -0,0 +1,301 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A Finding is a problem mk doctor found, with what to do about it.
+type Finding struct {
+	Check   string // the check that found it: sh, mkfile, tools, state, clock, case, services or nested
+	Problem string
+	Fix     string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s\n  fix: %s", f.Check, f.Problem, f.Fix)
+}
+
+// maxClockSkew is how far a file's modification time may be from the
+// clock before mk doctor reports skew.
+const maxClockSkew = 2 * time.Second
+
+// stdlibTools lists the variables naming the commands each standard
+// library file runs.
+var stdlibTools = map[string][]string{
+	"std/c.mk":       {"cc", "ar"},
+	"std/cxx.mk":     {"cxx"},
+	"std/go.mk":      {"go"},
+	"std/release.mk": {"git", "go"},
+	"std/version.mk": {"git"},
+}
+
+// Doctor checks the environment and the workspace of the mkfile at path
+// for problems that make builds fail or misbehave in ways mk's own
+// errors don't explain: a missing shell or tool, a corrupt state file,
+// clock skew, targets that collide on a case-insensitive file system,
+// leftovers of interrupted builds, and state directories nested in the
+// workspace. It returns what it found, in that order.
+func Doctor(ctx context.Context, path string, opts Options) []Finding {
+	w := mkfileWorkspace(opts.Dir, path)
+	var found []Finding
+	add := func(check, fix, format string, args ...any) {
+		found = append(found, Finding{Check: check, Problem: fmt.Sprintf(format, args...), Fix: fix})
+	}
+
+	if _, err := exec.LookPath("sh"); err != nil && len(defaultInterpreter()) == 0 {
+		add("sh", "install a POSIX shell, or add its directory to PATH", "no sh on PATH; every recipe runs with sh -c")
+	}
+
+	opts.Stderr = io.Discard // the mkfile's warnings aren't findings
+	p, err := Load(ctx, path, opts)
+	if err != nil {
+		add("mkfile", "fix the mkfile; the checks that need it were skipped", "%v", err)
+	} else {
+		defer p.Close()
+		found = append(found, p.doctorTools()...)
+	}
+
+	found = append(found, w.doctorState()...)
+	found = append(found, w.doctorClock(p)...)
+	if p != nil {
+		found = append(found, w.doctorCase(p)...)
+	}
+	found = append(found, w.doctorServices()...)
+	found = append(found, w.doctorNested()...)
+	return found
+}
+
+// doctorTools checks that the commands the included standard library
+// files run, and the declared tools, can be found.
+func (p *Project) doctorTools() []Finding {
+	var found []Finding
+	checked := map[string]bool{}
+	for _, file := range p.graph.files {
+		std, ok := strings.CutSuffix(file, " (built in)")
+		if !ok {
+			continue
+		}
+		for _, name := range stdlibTools[std] {
+			fields := strings.Fields(p.vars.Get(name))
+			if len(fields) == 0 || checked[fields[0]] {
+				continue
+			}
+			checked[fields[0]] = true
+			if !p.commandExists(fields[0]) {
+				found = append(found, Finding{
+					Check:   "tools",
+					Problem: fmt.Sprintf("$%s is %q, which isn't on PATH; %s needs it", name, fields[0], std),
+					Fix:     fmt.Sprintf("install it, or set %s to a command that is", name),
+				})
+			}
+		}
+	}
+	for _, t := range p.graph.toolFiles() {
+		if fileExists(p.dir().path(t.path)) {
+			continue
+		}
+		if _, err := p.graph.resolve(t.path); err != nil {
+			found = append(found, Finding{
+				Check:   "tools",
+				Problem: fmt.Sprintf("tool %s is %s, which doesn't exist and has no rule", t.name, t.path),
+				Fix:     "correct the tool declaration, or add a rule that builds it",
+			})
+		}
+	}
+	return found
+}
+
+// commandExists reports whether cmd is a path to a file in the workspace
+// or a command on PATH.
+func (p *Project) commandExists(cmd string) bool {
+	if strings.ContainsRune(cmd, '/') {
+		return fileExists(p.dir().path(cmd))
+	}
+	_, err := exec.LookPath(cmd)
+	return err == nil
+}
+
+// doctorState checks that the state files parse, and looks for the
+// temporary files of saves that were interrupted.
+func (w workspace) doctorState() []Finding {
+	var found []Finding
+	for _, suffix := range w.stateSuffixes() {
+		files := []string{StateFile(suffix)}
+		for n := range stateBackups {
+			files = append(files, stateBackup(suffix, n))
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(w.path(file))
+			if err != nil {
+				continue
+			}
+			var s BuildState
+			if err := json.Unmarshal(data, &s); err != nil {
+				fix := fmt.Sprintf("remove %s", file)
+				if file == StateFile(suffix) {
+					fix = fmt.Sprintf("run mk state restore to recover the newest valid backup, or remove %s to rebuild everything", file)
+				}
+				found = append(found, Finding{Check: "state", Problem: fmt.Sprintf("%s is corrupt: %v", file, err), Fix: fix})
+			}
+		}
+	}
+	filepath.WalkDir(w.path(stateDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(d.Name(), ".tmp") || strings.HasPrefix(d.Name(), ".mk-tmp-") {
+			rel, _ := filepath.Rel(string(w.path(".")), path)
+			found = append(found, Finding{
+				Check:   "state",
+				Problem: fmt.Sprintf("%s is left from a save that was interrupted", rel),
+				Fix:     fmt.Sprintf("remove %s", rel),
+			})
+		}
+		return nil
+	})
+	return found
+}
+
+// doctorClock compares the file system's clock with this machine's, and
+// looks for targets p's state records that were modified in the future.
+func (w workspace) doctorClock(p *Project) []Finding {
+	var found []Finding
+	dir := w.path(stateDir)
+	if _, err := os.Stat(dir); err != nil {
+		dir = w.path(".")
+	}
+	if f, err := os.CreateTemp(dir, ".mk-doctor-*"); err == nil {
+		now := time.Now()
+		info, err := f.Stat()
+		f.Close()
+		os.Remove(f.Name())
+		if skew := info.ModTime().Sub(now); err == nil && (skew > maxClockSkew || skew < -maxClockSkew) {
+			found = append(found, Finding{
+				Check:   "clock",
+				Problem: fmt.Sprintf("the file system's clock is %s off this machine's", skew.Round(time.Second)),
+				Fix:     "synchronize the clocks (NTP); mk compares content, but the tools recipes run may compare times",
+			})
+		}
+	}
+	if p == nil {
+		return found
+	}
+	var future []string
+	limit := time.Now().Add(maxClockSkew)
+	for _, t := range slices.Sorted(func(yield func(string) bool) {
+		for t := range p.state.Targets {
+			if !yield(t) {
+				return
+			}
+		}
+	}) {
+		if info, err := os.Stat(w.path(t)); err == nil && info.ModTime().After(limit) {
+			future = append(future, t)
+		}
+	}
+	if len(future) > 0 {
+		found = append(found, Finding{
+			Check:   "clock",
+			Problem: fmt.Sprintf("%d targets were modified in the future, such as %s", len(future), future[0]),
+			Fix:     "fix the clock of the machine that wrote them, then touch them",
+		})
+	}
+	return found
+}
+
+// doctorCase looks for explicit targets that name the same file on a
+// case-insensitive file system, if the workspace is on one.
+func (w workspace) doctorCase(p *Project) []Finding {
+	dir := w.path(".")
+	f, err := os.CreateTemp(dir, ".mk-Doctor-*")
+	if err != nil {
+		return nil
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+	a, errA := os.Stat(name)
+	b, errB := os.Stat(filepath.Join(filepath.Dir(name), strings.ToLower(filepath.Base(name))))
+	if errA != nil || errB != nil || !os.SameFile(a, b) {
+		return nil // case-sensitive
+	}
+
+	var found []Finding
+	seen := map[string]string{}
+	for _, t := range p.graph.Targets() {
+		key := strings.ToLower(t)
+		if other, ok := seen[key]; ok && other != t {
+			found = append(found, Finding{
+				Check:   "case",
+				Problem: fmt.Sprintf("targets %s and %s are the same file on this case-insensitive file system", other, t),
+				Fix:     "rename one of them",
+			})
+			continue
+		}
+		seen[key] = t
+	}
+	return found
+}
+
+// doctorServices looks for the pidfiles of services that aren't
+// running.
+func (w workspace) doctorServices() []Finding {
+	var found []Finding
+	matches, _ := filepath.Glob(w.path(filepath.Join(serviceDir, "*.pid")))
+	for _, m := range matches {
+		task, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(m), ".pid"))
+		if err != nil {
+			continue
+		}
+		if _, _, ok := w.readService(task); !ok {
+			found = append(found, Finding{
+				Check:   "services",
+				Problem: fmt.Sprintf("service %s has a pidfile but isn't running", task),
+				Fix:     fmt.Sprintf("run mk stop %s to remove it", task),
+			})
+		}
+	}
+	return found
+}
+
+// doctorNested looks for .mk directories below the workspace's, left by
+// builds run from a subdirectory, such as one with a mkfile that this
+// one includes scoped.
+func (w workspace) doctorNested() []Finding {
+	var found []Finding
+	root := w.path(".")
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == root {
+			return nil
+		}
+		switch d.Name() {
+		case ".git":
+			return filepath.SkipDir
+		case stateDir:
+			if rel, _ := filepath.Rel(root, path); rel != stateDir {
+				found = append(found, Finding{
+					Check:   "nested",
+					Problem: fmt.Sprintf("%s holds the state of builds run from %s, which builds from here don't use", rel, filepath.Dir(rel)),
+					Fix:     fmt.Sprintf("build from one directory consistently; remove %s if %s is only built from here", rel, filepath.Dir(rel)),
+				})
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return found
+}
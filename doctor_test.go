@@ -0,0 +1,53 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDoctor(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte("out.txt:\n    touch $target\n"), 0o644)
+	doctor := func() []string {
+		t.Helper()
+		var problems []string
+		for _, f := range Doctor(context.Background(), "mkfile", Options{Dir: dir, LocalState: true, Stderr: io.Discard}) {
+			if f.Check != "sh" && f.Check != "clock" && f.Check != "case" { // depend on the machine
+				problems = append(problems, f.Check+": "+f.Problem)
+			}
+		}
+		return problems
+	}
+	if got := doctor(); len(got) != 0 {
+		t.Errorf("clean workspace: %q, want no problems", got)
+	}
+
+	os.MkdirAll(filepath.Join(dir, ".mk", "services"), 0o755)
+	os.WriteFile(filepath.Join(dir, ".mk", "state.json"), []byte(`{"targets": {`), 0o644)
+	os.WriteFile(filepath.Join(dir, ".mk", "state.json.tmp"), nil, 0o644)
+	os.WriteFile(filepath.Join(dir, ".mk", "services", "serve.pid"), []byte("999999999\n"), 0o644)
+	os.MkdirAll(filepath.Join(dir, "sub", ".mk"), 0o755)
+	got := doctor()
+	want := []string{
+		"state: .mk/state.json is corrupt: unexpected end of JSON input",
+		"state: .mk/state.json.tmp is left from a save that was interrupted",
+		"services: service serve has a pidfile but isn't running",
+		"nested: sub/.mk holds the state of builds run from sub, which builds from here don't use",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte("include std/go.mk\ngo = no-such-go\n"), 0o644)
+	if got := doctor(); !slices.Contains(got, `tools: $go is "no-such-go", which isn't on PATH; std/go.mk needs it`) {
+		t.Errorf("problems: %q, want the missing go reported", got)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// GraphOptions controls WriteGraph.
+type GraphOptions struct {
+	Depth int  // expand at most this many levels below the targets; 0 means no limit
+	Stale bool // fill the nodes a build would rebuild; consults the build state
+}
+
+// PrintGraph prints the dependency subgraph rooted at the given targets as DOT.
+func (g *Graph) PrintGraph(targets []string) error {
+	return g.WriteGraph(context.Background(), os.Stdout, targets, GraphOptions{})
+}
+
+// dotNode is a target in the graph being written.
+type dotNode struct {
+	name  string
+	rule  *resolvedRule
+	depth int
+	stale int // 0 unknown, 1 up to date, 2 stale
+}
+
+// WriteGraph writes the dependency subgraph rooted at the given targets
+// as DOT. Nodes are clustered by include scope, or else by directory.
+// Tasks are boxes, targets of pattern rules hexagons, files without a
+// recipe notes and other targets ellipses. Order-only edges are dashed.
+func (g *Graph) WriteGraph(ctx context.Context, w io.Writer, targets []string, opts GraphOptions) error {
+	// Breadth first, so each node has its shallowest depth.
+	nodes := map[string]*dotNode{}
+	var order []*dotNode
+	queue := slices.Clone(targets)
+	for _, t := range targets {
+		if nodes[t] == nil {
+			nodes[t] = &dotNode{name: t}
+		}
+	}
+	for len(queue) > 0 {
+		n := nodes[queue[0]]
+		queue = queue[1:]
+		if n.rule != nil {
+			continue
+		}
+		rule, err := g.resolve(n.name)
+		if err != nil {
+			return err
+		}
+		n.rule = rule
+		order = append(order, n)
+		if opts.Depth > 0 && n.depth >= opts.Depth {
+			continue
+		}
+		for _, p := range slices.Concat(rule.prereqs, rule.orderOnlyPrereqs) {
+			if nodes[p] == nil {
+				pn := &dotNode{name: p, depth: n.depth + 1}
+				nodes[p] = pn
+				if _, ok := rule.configs[p]; ok {
+					// Built under another config's graph: shown as a leaf.
+					pn.rule = &resolvedRule{target: p, targets: []string{p}}
+					order = append(order, pn)
+					continue
+				}
+				queue = append(queue, p)
+			}
+		}
+	}
+
+	if opts.Stale {
+		cache := g.hashCache()
+		for _, n := range order {
+			g.dotStale(ctx, n, nodes, cache)
+		}
+	}
+
+	// Group nodes into clusters, keeping first-seen order.
+	var clusters []string
+	members := map[string][]*dotNode{}
+	for _, n := range order {
+		c := dotCluster(n.rule)
+		if _, ok := members[c]; !ok {
+			clusters = append(clusters, c)
+		}
+		members[c] = append(members[c], n)
+	}
+
+	fmt.Fprintln(w, "digraph mk {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	for i, c := range clusters {
+		indent := "  "
+		if c != "" {
+			fmt.Fprintf(w, "  subgraph cluster_%d {\n    label=%q;\n", i, c)
+			indent = "    "
+		}
+		for _, n := range members[c] {
+			fmt.Fprintf(w, "%s%q [%s];\n", indent, n.name, dotAttrs(n, opts.Depth))
+		}
+		if c != "" {
+			fmt.Fprintln(w, "  }")
+		}
+	}
+	for _, n := range order {
+		if opts.Depth > 0 && n.depth >= opts.Depth {
+			continue
+		}
+		for _, p := range n.rule.prereqs {
+			fmt.Fprintf(w, "  %q -> %q;\n", n.name, p)
+		}
+		for _, p := range n.rule.orderOnlyPrereqs {
+			fmt.Fprintf(w, "  %q -> %q [style=dashed, label=\"order-only\"];\n", n.name, p)
+		}
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
+
+// dotStale reports whether a build would rebuild n: its recorded state is
+// stale, or a normal prerequisite would be rebuilt first. Tasks always run
+// but are never stale, since running one changes no recorded hash.
+func (g *Graph) dotStale(ctx context.Context, n *dotNode, nodes map[string]*dotNode, cache *HashCache) bool {
+	if n.stale != 0 {
+		return n.stale == 2
+	}
+	n.stale = 1 // also breaks cycles
+	stale := false
+	for _, p := range n.rule.prereqs {
+		pn := nodes[p]
+		if pn == nil {
+			// Beyond the depth limit: not shown, but still rebuilt.
+			rule, err := g.resolve(p)
+			if err != nil {
+				continue
+			}
+			pn = &dotNode{name: p, rule: rule}
+			nodes[p] = pn
+		}
+		if g.dotStale(ctx, pn, nodes, cache) {
+			stale = true
+		}
+	}
+	if n.rule.isTask || len(n.rule.recipe) == 0 {
+		return false
+	}
+	if !stale {
+		recipeText, fingerprint := g.hashedRecipe(n.rule, cache)
+		stale = g.state.IsStale(ctx, n.rule.targets, n.rule.prereqs, recipeText, fingerprint, cache.forRule(n.rule))
+	}
+	if stale {
+		n.stale = 2
+	}
+	return stale
+}
+
+// dotCluster names the cluster for a node: its include scope, or the
+// directory of a file target. Top-level tasks and files aren't clustered.
+func dotCluster(rule *resolvedRule) string {
+	if rule.scope != "" {
+		return rule.scope
+	}
+	if rule.isTask {
+		return ""
+	}
+	if dir := filepath.Dir(rule.target); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+func dotAttrs(n *dotNode, depth int) string {
+	var attrs string
+	switch {
+	case n.rule.isTask:
+		attrs = "shape=box"
+	case n.rule.pattern != "":
+		attrs = fmt.Sprintf("shape=hexagon, tooltip=%q", n.rule.pattern)
+	case len(n.rule.recipe) == 0 && len(n.rule.prereqs) == 0 && len(n.rule.orderOnlyPrereqs) == 0:
+		attrs = "shape=note"
+	default:
+		attrs = "shape=ellipse"
+	}
+	if n.stale == 2 {
+		attrs += ", style=filled, fillcolor=salmon"
+	}
+	if depth > 0 && n.depth >= depth && len(n.rule.prereqs)+len(n.rule.orderOnlyPrereqs) > 0 {
+		attrs += ", peripheries=2" // prerequisites not shown
+	}
+	return attrs
+}
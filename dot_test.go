@@ -0,0 +1,121 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteGraph(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.Mkdir("src", 0o755)
+	os.WriteFile("src/main.c", []byte("a"), 0o644)
+	os.WriteFile("src/util.c", []byte("a"), 0o644)
+	os.WriteFile("mkfile", []byte(`
+build/app: build/main.o build/util.o | build
+    touch $target
+build/{n}.o: src/{n}.c
+    touch $target
+build:
+    mkdir -p build
+!test: build/app
+    true
+`), 0o644)
+
+	ctx := context.Background()
+	mustBuild(t, Options{Jobs: 1, Stderr: io.Discard}, "build/app")
+	os.WriteFile("src/util.c", []byte("b"), 0o644)
+
+	p, err := Load(ctx, "mkfile", Options{Jobs: 1, Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := p.Graph().WriteGraph(ctx, &b, []string{"test"}, GraphOptions{Stale: true}); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		`"test" [shape=box];`,
+		"subgraph cluster_1 {\n    label=\"build\";",
+		`"build/main.o" [shape=hexagon, tooltip="build/{n}.o"];`,
+		`"build/util.o" [shape=hexagon, tooltip="build/{n}.o", style=filled, fillcolor=salmon];`,
+		`"build/app" [shape=ellipse, style=filled, fillcolor=salmon];`,
+		`"src/main.c" [shape=note];`,
+		`"build/app" -> "build" [style=dashed, label="order-only"];`,
+		`"build/util.o" -> "src/util.c";`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("graph lacks %s:\n%s", want, out)
+		}
+	}
+
+	b.Reset()
+	if err := p.Graph().WriteGraph(ctx, &b, []string{"test"}, GraphOptions{Depth: 1, Stale: true}); err != nil {
+		t.Fatal(err)
+	}
+	out = b.String()
+	if !strings.Contains(out, `"build/app" [shape=ellipse, style=filled, fillcolor=salmon, peripheries=2];`) {
+		t.Errorf("depth-limited graph should show build/app stale and truncated:\n%s", out)
+	}
+	if strings.Contains(out, "main.o") {
+		t.Errorf("depth-limited graph shows prerequisites beyond the limit:\n%s", out)
+	}
+}
+
+func TestGraphStats(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/src", 0o755)
+	for _, f := range []string{"src/a.c", "src/b.c", "src/c.c", "src/common.h"} {
+		os.WriteFile(dir+"/"+f, []byte("x"), 0o644)
+	}
+	os.WriteFile(dir+"/mkfile", []byte(`
+build/app: build/a.o build/b.o build/c.o | build
+    touch $target
+build/{n}.o: src/{n}.c src/common.h
+    touch $target
+build:
+    mkdir -p build
+!test: build/app
+    true
+`), 0o644)
+	p, err := Load(context.Background(), "mkfile", Options{Dir: dir, Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := p.Graph().Stats([]string{"test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	s.Print(&out)
+	want := `nodes: 10 (targets 5, tasks 1, sources 4)
+edges: 11 (order-only 1)
+depth: 3
+widest level: 0, with 5 nodes (level 0 has no prerequisites)
+most depended on (direct dependents):
+  3  src/common.h
+  1  build
+  1  build/a.o
+  1  build/app
+  1  build/b.o
+  1  build/c.o
+  1  src/a.c
+  1  src/b.c
+  1  src/c.c
+pattern rules (targets matched):
+  3  build/{n}.o (mkfile:4)
+`
+	if out.String() != want {
+		t.Errorf("stats:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
@@ -5,14 +5,21 @@ package mk
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Executor runs build recipes.
@@ -25,18 +32,84 @@ type Executor struct {
 	dryRun  bool // -n: print commands without executing
 	jobs    int  // max concurrent recipes (0 = unlimited)
 
-	mu       sync.Mutex
-	building map[string]*buildResult // singleflight dedup
-	sem      chan struct{}           // recipe concurrency limiter; nil = unlimited
-	outputMu sync.Mutex              // serializes buffered output flushes
-	cache    *HashCache              // file content hash cache
+	mu        sync.Mutex
+	building  map[string]*buildResult // singleflight dedup
+	raced     map[[2]string]bool      // pairs of rules, by position, reported as writing the same target
+	sem       chan struct{}           // recipe concurrency limiter; nil = unlimited
+	jobserver *jobserver              // recipe slots shared with GNU make; nil = none
+	outputMu  sync.Mutex              // serializes buffered output flushes
+	cache     *HashCache              // file content hash cache
+	syntax    syntaxCache             // sh -n results by script hash
+	dir       workspace               // the graph's workspace, where recipes run
+
+	// toolsOnce builds the declared tools before anything else; then
+	// toolPath is recipes' PATH and toolHash is appended to hashed
+	// recipes (see prepareTools).
+	toolsOnce          sync.Once
+	toolsErr           error
+	toolPath, toolHash string
+
+	stdout, stderr io.Writer // recipe output and mk's own messages
+	console        *console  // mk's messages, on stderr
+	runner         Runner    // nil = local, or remote if $remote_exec is set
+	provenance     *provenanceWriter
+	audit          *auditLog
+
+	// containment checks that targets, and files written by recipes from
+	// scoped includes, stay inside the workspace and their scope. Scoped
+	// recipes then run exclusively so their writes can be attributed.
+	containment bool
+	containMu   sync.RWMutex
+	sandbox     bool                // run recipes with only their prerequisites (see runSandboxed)
+	strict      bool                // fail on recipes that modify their prerequisites
+	explain     bool                // with dryRun, predict downstream rebuilds and list them
+	dependents  map[string][]string // with explain, the targets reached through each prerequisite
+	wouldBuild  map[string]bool     // with explain, targets the dry run would rebuild
+	actions     *actionCache        // outputs by action digest; nil = no caching
+	progress    ProgressFunc        // optional build event callback
+	progressMu  sync.Mutex          // serializes progress callbacks
+
+	// under returns the executor for prerequisites written
+	// target@config; nil if they can't be built.
+	under func(configs string) (*Executor, error)
+
+	// checkpoint, if set, saves the build state part way through the
+	// build (see checkpointed).
+	checkpoint     func() error
+	checkpointMu   sync.Mutex
+	lastCheckpoint time.Time
+	checkpointErr  error
+
+	// staleTime and execTime total the nanoseconds spent checking
+	// staleness and running recipes, summed across parallel jobs.
+	staleTime, execTime atomic.Int64
+
+	ignored atomic.Int64 // failures of recipe lines marked -
+
+	// keepGoing starts recipes after one has failed, so that everything
+	// not downstream of a failure is built (-k). Otherwise the first
+	// failure stops recipes that haven't started yet.
+	keepGoing bool
+	stopped   atomic.Bool
+	failures  []error // of recipes that failed, in order; guarded by mu
+
+	// rebuild holds the targets --rebuild forces, and with downstream,
+	// those found to depend on them; guarded by mu.
+	rebuild    map[string]bool
+	downstream bool
 }
 
+// errStopped is the error of targets whose recipes weren't started
+// because another recipe failed.
+var errStopped = errors.New("not started: another recipe failed")
+
 // buildResult tracks the in-progress or completed build of a target.
 // Multiple targets from the same multi-output rule share one buildResult.
 type buildResult struct {
-	done chan struct{}
-	err  error
+	target string // the target the rule was resolved for
+	rule   *resolvedRule
+	done   chan struct{}
+	err    error
 }
 
 func NewExecutor(graph *Graph, state *BuildState, vars *Vars, verbose, force, dryRun bool, jobs int) *Executor {
@@ -60,98 +133,639 @@ func NewExecutor(graph *Graph, state *BuildState, vars *Vars, verbose, force, dr
 		jobs:     jobs,
 		building: make(map[string]*buildResult),
 		sem:      sem,
-		cache:    NewHashCache(),
+		cache:    graph.hashCache(),
+		dir:      graph.dir,
+		stdout:   os.Stdout,
+		stderr:   os.Stderr,
+		console:  &console{w: os.Stderr},
 	}
 }
 
-// Build builds the given target and all its dependencies.
+// SetOutput directs recipe output and mk's messages to stdout and stderr
+// instead of the process's standard streams.
+func (e *Executor) SetOutput(stdout, stderr io.Writer) {
+	e.stdout = stdout
+	e.stderr = stderr
+	e.console = &console{w: stderr, width: e.console.width}
+}
+
+// SetProgress registers a callback that receives build events. Calls are
+// serialized, but may come from any goroutine.
+func (e *Executor) SetProgress(fn ProgressFunc) {
+	e.progress = fn
+}
+
+// SetRunner replaces the runner that executes recipes.
+func (e *Executor) SetRunner(r Runner) {
+	e.runner = r
+}
+
+// runnerFor returns the configured runner, falling back to a WrapperRunner
+// when the mkfile or command line sets remote_exec.
+func (e *Executor) runnerFor() Runner {
+	if e.runner != nil {
+		return e.runner
+	}
+	if cmd := e.vars.Get("remote_exec"); cmd != "" {
+		return WrapperRunner{Command: cmd}
+	}
+	return LocalRunner{}
+}
+
+// jobInputs returns the files rule's recipe is known to read: its
+// prerequisites, order-only ones included, and the declared tools, which
+// its PATH leads to.
+func (e *Executor) jobInputs(rule *resolvedRule) []string {
+	inputs := slices.Concat(rule.prereqs, rule.orderOnlyPrereqs)
+	for _, t := range e.graph.toolFiles() {
+		if !slices.Contains(inputs, t.path) {
+			inputs = append(inputs, t.path)
+		}
+	}
+	return inputs
+}
+
+// SetRebuild forces the rules that build targets to rebuild, as -B does
+// for all of them, and if downstream is set, the rules that depend on
+// them, directly or not.
+func (e *Executor) SetRebuild(targets []string, downstream bool) {
+	e.rebuild = nil
+	if len(targets) == 0 {
+		return
+	}
+	e.rebuild = make(map[string]bool, len(targets))
+	for _, t := range targets {
+		e.rebuild[t] = true
+	}
+	e.downstream = downstream
+}
+
+// forces reports whether rule is forced to rebuild by SetRebuild: it
+// builds one of the targets named, or with downstream, one of its
+// prerequisites is forced. With downstream, the targets of a forced rule
+// are then forced too, so that its dependents, built after it, are.
+func (e *Executor) forces(rule *resolvedRule) bool {
+	if e.rebuild == nil {
+		return false // set only by SetRebuild, before the build; the map is guarded by e.mu
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	forced := func(t string) bool { return e.rebuild[t] }
+	if !slices.ContainsFunc(rule.targets, forced) && !(e.downstream && slices.ContainsFunc(rule.prereqs, forced)) {
+		return false
+	}
+	if e.downstream {
+		for _, t := range rule.targets {
+			e.rebuild[t] = true
+		}
+	}
+	return true
+}
+
+// SetKeepGoing makes the executor keep starting recipes after one
+// fails, building every target that doesn't depend on a failed one.
+func (e *Executor) SetKeepGoing(keepGoing bool) {
+	e.keepGoing = keepGoing
+}
+
+// failed records the failure of a recipe and, unless the executor keeps
+// going, stops recipes from starting.
+func (e *Executor) failed(err error) {
+	e.mu.Lock()
+	e.failures = append(e.failures, err)
+	e.mu.Unlock()
+	if !e.keepGoing {
+		e.stopped.Store(true)
+	}
+}
+
+// Failures returns the errors of the recipes that have failed, in the
+// order they failed.
+func (e *Executor) Failures() []error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.failures)
+}
+
+func (e *Executor) emit(ev Event) {
+	if e.progress == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	e.progressMu.Lock()
+	defer e.progressMu.Unlock()
+	e.progress(ev)
+}
+
+// warn prints a warning about rule and reports it as an event. e.outputMu
+// must be held.
+func (e *Executor) warn(rule *resolvedRule, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	e.console.printf("mk: warning: %s\n", msg)
+	e.emit(Event{Kind: TargetWarning, Target: rule.target, Targets: rule.targets, Rule: rule.pos, Message: msg})
+}
+
+// streamTo returns w for recipe output streamed in serial mode. Other
+// targets' goroutines print messages meanwhile, so a writer that isn't a
+// file, which a recipe would otherwise write through a copying goroutine
+// of its own, is written holding e.outputMu.
+func (e *Executor) streamTo(w io.Writer) io.Writer {
+	if _, ok := w.(*os.File); ok {
+		return w
+	}
+	return &lockedWriter{mu: &e.outputMu, w: w}
+}
+
+// maxImplicitChain bounds runs of targets resolved through pattern rules,
+// so a pattern whose prerequisites match itself fails instead of
+// recursing forever.
+const maxImplicitChain = 16
+
+// buildChain is the path from a top-level target to the target being
+// built, innermost first.
+type buildChain struct {
+	target  string
+	pattern string // target pattern it was resolved through; "" if explicit
+	parent  *buildChain
+}
+
+// path returns the targets in the chain, outermost first.
+func (c *buildChain) path() []string {
+	var path []string
+	for ; c != nil; c = c.parent {
+		path = append(path, c.target)
+	}
+	slices.Reverse(path)
+	return path
+}
+
+// chainError reports a dependency cycle or runaway implicit chain. It is
+// returned as is, not wrapped once per level of the chain.
+type chainError struct {
+	msg string
+}
+
+func (e *chainError) Error() string { return e.msg }
+
+// Build builds the given target and all its dependencies. Cancelling ctx
+// stops new recipes from starting and kills those already running.
 // Safe to call concurrently from multiple goroutines.
-func (e *Executor) Build(target string) error {
+func (e *Executor) Build(ctx context.Context, target string) error {
+	err := e.prepareTools(ctx)
+	if err == nil {
+		err = e.build(ctx, target, nil)
+	}
+	if errors.Is(err, errStopped) {
+		// Report the failure that stopped the build instead.
+		if failures := e.Failures(); len(failures) > 0 {
+			err = failures[0]
+		}
+	}
+	e.outputMu.Lock()
+	e.console.flush()
+	e.outputMu.Unlock()
+	return err
+}
+
+// BuildAll builds targets together, in parallel as if they were the
+// prerequisites of one rule, and returns the errors of those that
+// failed, in the order given. Without keep-going, the first recipe to
+// fail stops the rest, and is the error of every target it stopped.
+func (e *Executor) BuildAll(ctx context.Context, targets []string) []error {
+	results := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = e.Build(ctx, t)
+		}()
+	}
+	wg.Wait()
+	var errs []error
+	for _, err := range results {
+		if err != nil && !slices.Contains(errs, err) {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (e *Executor) build(ctx context.Context, target string, chain *buildChain) error {
+	for c := chain; c != nil; c = c.parent {
+		if c.target == target {
+			path := append(chain.path(), target)
+			return &chainError{fmt.Sprintf("dependency cycle: %s", strings.Join(path, " -> "))}
+		}
+	}
+
 	e.mu.Lock()
 	if res, ok := e.building[target]; ok {
+		// A target reached as another's co-target may also have a rule
+		// of its own, which would write it too.
+		var clash *resolvedRule
+		if res.target != target && writes(res.rule) {
+			if rule, err := e.graph.resolve(target); err == nil && e.clashes(rule, res.rule) {
+				clash = rule
+			}
+		}
 		e.mu.Unlock()
+		if clash != nil {
+			if err := e.checkWriters(clash, []*resolvedRule{res.rule}); err != nil {
+				return err
+			}
+		}
 		<-res.done
 		return res.err
 	}
 
 	// Resolve rule under lock to discover co-targets for multi-output dedup.
-	// Graph.Resolve is read-only and safe to call here.
-	rule, err := e.graph.Resolve(target)
+	// Graph.resolve is read-only and safe to call here.
+	rule, err := e.graph.resolve(target)
 	if err != nil {
 		e.mu.Unlock()
 		return err
 	}
+	link := &buildChain{target: target, pattern: rule.pattern, parent: chain}
+	if err := link.checkImplicit(); err != nil {
+		e.mu.Unlock()
+		return err
+	}
 
-	res := &buildResult{done: make(chan struct{})}
+	if e.explain {
+		for _, p := range slices.Concat(rule.prereqs, rule.orderOnlyPrereqs) {
+			if !slices.Contains(e.dependents[p], rule.target) {
+				e.dependents[p] = append(e.dependents[p], rule.target)
+			}
+		}
+	}
+
+	res := &buildResult{target: target, rule: rule, done: make(chan struct{})}
+	var clashes []*resolvedRule
 	for _, t := range rule.targets {
+		if other, ok := e.building[t]; ok {
+			// Another rule writes this target too: it was reached
+			// through a different grouping or pattern.
+			if e.clashes(rule, other.rule) {
+				clashes = append(clashes, other.rule)
+			}
+			continue
+		}
 		e.building[t] = res
 	}
 	e.mu.Unlock()
 
-	err = e.doBuild(target, rule)
+	if err := e.checkWriters(rule, clashes); err != nil {
+		res.err = err
+		close(res.done)
+		return err
+	}
+	err = e.doBuild(ctx, target, rule, link)
 	res.err = err
 	close(res.done)
 	return err
 }
 
-func (e *Executor) doBuild(target string, rule *resolvedRule) error {
-	// Build all prerequisites concurrently
-	allPrereqs := make([]string, 0, len(rule.prereqs)+len(rule.orderOnlyPrereqs))
-	allPrereqs = append(allPrereqs, rule.prereqs...)
-	allPrereqs = append(allPrereqs, rule.orderOnlyPrereqs...)
+// affected returns the targets of this build that depend on rule's
+// targets, directly or not, sorted. e.mu must be held.
+func (e *Executor) affected(rule *resolvedRule) []string {
+	seen := map[string]bool{}
+	queue := slices.Clone(rule.targets)
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		for _, d := range e.dependents[t] {
+			if !seen[d] && !slices.Contains(rule.targets, d) {
+				seen[d] = true
+				queue = append(queue, d)
+			}
+		}
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// writes reports whether rule's recipe writes its targets.
+func writes(rule *resolvedRule) bool {
+	return len(rule.recipe) > 0 && !rule.isTask
+}
+
+// clashes reports whether a and b are different rules that both write
+// files, the first time it is asked about them. e.mu must be held.
+func (e *Executor) clashes(a, b *resolvedRule) bool {
+	if !writes(a) || !writes(b) || a.same(b) {
+		return false
+	}
+	key := [2]string{a.pos, b.pos}
+	if key[0] > key[1] {
+		key[0], key[1] = key[1], key[0]
+	}
+	if e.raced[key] {
+		return false
+	}
+	if e.raced == nil {
+		e.raced = make(map[[2]string]bool)
+	}
+	e.raced[key] = true
+	return true
+}
+
+// same reports whether r and o are the same rule, resolved once each.
+func (r *resolvedRule) same(o *resolvedRule) bool {
+	return r.pos == o.pos && slices.Equal(r.targets, o.targets)
+}
+
+// checkWriters warns, or in strict mode fails, if other rules in this
+// build write some of rule's targets too. Their recipes would race under
+// -j, leaving whichever finished last.
+func (e *Executor) checkWriters(rule *resolvedRule, others []*resolvedRule) error {
+	for _, o := range others {
+		var shared []string
+		for _, t := range rule.targets {
+			if slices.Contains(o.targets, t) {
+				shared = append(shared, fmt.Sprintf("%q", t))
+			}
+		}
+		first, second := o.pos, rule.pos
+		if comparePos(first, second) > 0 {
+			first, second = second, first
+		}
+		msg := fmt.Sprintf("rules at %s and %s both write %s; their recipes race", first, second, strings.Join(shared, ", "))
+		if e.strict {
+			return errors.New(msg)
+		}
+		e.outputMu.Lock()
+		e.warn(rule, "%s", msg)
+		e.outputMu.Unlock()
+	}
+	return nil
+}
 
-	errs := make([]error, len(allPrereqs))
+// comparePos orders "file:line" source locations by file, then line.
+func comparePos(a, b string) int {
+	split := func(pos string) (string, int) {
+		i := strings.LastIndexByte(pos, ':')
+		if i < 0 {
+			return pos, 0
+		}
+		line, _ := strconv.Atoi(pos[i+1:])
+		return pos[:i], line
+	}
+	afile, aline := split(a)
+	bfile, bline := split(b)
+	if c := strings.Compare(afile, bfile); c != 0 {
+		return c
+	}
+	return cmp.Compare(aline, bline)
+}
+
+// checkpointInterval is the least time between checkpoints of the build
+// state during a build.
+const checkpointInterval = 2 * time.Second
+
+// checkpointed is called after a target is recorded in the build state.
+// It saves the state if no checkpoint was made in the last
+// checkpointInterval, so that a build that crashes or is killed doesn't
+// lose the record of what it built. A failure is reported once and
+// stops checkpoints; the save at the end of the build still runs.
+func (e *Executor) checkpointed() {
+	if e.checkpoint == nil || !e.checkpointMu.TryLock() {
+		return // another target is checkpointing
+	}
+	defer e.checkpointMu.Unlock()
+	if e.checkpointErr != nil || time.Since(e.lastCheckpoint) < checkpointInterval {
+		return
+	}
+	e.lastCheckpoint = time.Now()
+	if e.checkpointErr = e.checkpoint(); e.checkpointErr != nil {
+		e.outputMu.Lock()
+		e.console.printf("mk: warning: saving build state: %v\n", e.checkpointErr)
+		e.outputMu.Unlock()
+	}
+}
+
+// buildPrereqs builds the given prerequisites of rule concurrently.
+func (e *Executor) buildPrereqs(ctx context.Context, target string, rule *resolvedRule, prereqs []string, chain *buildChain) error {
+	errs := make([]error, len(prereqs))
 	var wg sync.WaitGroup
-	for i, p := range allPrereqs {
+	for i, p := range prereqs {
 		wg.Add(1)
 		go func(idx int, prereq string) {
 			defer wg.Done()
-			errs[idx] = e.Build(prereq)
+			if configs, ok := rule.configs[prereq]; ok {
+				errs[idx] = e.buildUnder(ctx, prereq, configs)
+			} else {
+				errs[idx] = e.build(ctx, prereq, chain)
+			}
 		}(i, p)
 	}
 	wg.Wait()
 
 	// Check for prereq errors
 	for i, err := range errs {
+		var chainErr *chainError
+		if errors.As(err, &chainErr) {
+			return err
+		}
 		if err != nil {
-			return fmt.Errorf("building %q for %q: %w", allPrereqs[i], target, err)
+			return fmt.Errorf("building %q for %q: %w", prereqs[i], target, err)
+		}
+	}
+	return nil
+}
+
+// checkImplicit fails if the chain ends in more than maxImplicitChain
+// targets in a row resolved through pattern rules.
+func (c *buildChain) checkImplicit() error {
+	n := 0
+	var patterns []string
+	for l := c; l != nil && l.pattern != ""; l = l.parent {
+		n++
+		if !slices.Contains(patterns, l.pattern) {
+			patterns = append(patterns, l.pattern)
+		}
+	}
+	if n <= maxImplicitChain {
+		return nil
+	}
+	var links []string
+	for l := c; l != nil && l.pattern != ""; l = l.parent {
+		links = append(links, fmt.Sprintf("%q", l.target))
+	}
+	slices.Reverse(links)
+	return &chainError{fmt.Sprintf("implicit rule chain more than %d deep, through patterns %s: %s",
+		maxImplicitChain, strings.Join(patterns, ", "), strings.Join(links, " <- "))}
+}
+
+func (e *Executor) doBuild(ctx context.Context, target string, rule *resolvedRule, chain *buildChain) error {
+	// Build all prerequisites concurrently
+	allPrereqs := make([]string, 0, len(rule.prereqs)+len(rule.orderOnlyPrereqs))
+	allPrereqs = append(allPrereqs, rule.prereqs...)
+	allPrereqs = append(allPrereqs, rule.orderOnlyPrereqs...)
+	if err := e.buildPrereqs(ctx, target, rule, allPrereqs, chain); err != nil {
+		return err
+	}
+
+	// Late-bound prerequisites are expanded now that the others, which
+	// may generate the files they name, are built
+	if len(rule.late) > 0 {
+		bound := e.graph.bindLate(rule, e.vars)
+		if err := e.buildPrereqs(ctx, target, bound, bound.prereqs[len(rule.prereqs):], chain); err != nil {
+			return err
 		}
+		rule = bound
 	}
+	forced := e.forces(rule)
 
 	// No recipe = leaf node or prerequisite-only rule
 	if len(rule.recipe) == 0 {
 		return nil
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if e.containment && !rule.isTask {
+		if err := checkContainment(rule); err != nil {
+			return err
+		}
+	}
 
-	// Check staleness (only normal prereqs affect staleness)
-	recipeText := e.expandRecipe(rule)
+	// Check staleness (only normal prereqs affect staleness). The hashed
+	// recipe omits $compiler_launcher so toggling ccache isn't a change.
+	sh := e.shellFor(rule)
+	recipe, err := e.expandRecipe(ctx, rule, chain, false)
+	if err != nil {
+		return err
+	}
+	if !sh.posix() && slices.ContainsFunc(recipe, func(l recipeLine) bool { return l.ignoreErr }) {
+		return fmt.Errorf("%s: recipe for %q: the - prefix needs a POSIX shell, not %s", rule.pos, rule.target, sh[0])
+	}
+	recipeText := recipe.text()
+	hashText := recipeText
+	if rule.varsFor(e.vars).Get(launcherVar) != "" {
+		forHash, _ := e.expandRecipe(ctx, rule, chain, true) // its targets are built
+		hashText = forHash.text()
+	}
+	hashText = hashedRecipeText(hashText, e.toolHash, sh, rule.workdir(e.vars))
 	fingerprint := e.expandFingerprint(rule)
-	if !rule.isTask && !e.force && !e.state.IsStale(rule.targets, rule.prereqs, recipeText, fingerprint, e.cache) {
+	if rule.service {
+		return e.runService(ctx, rule, recipeText, hashText)
+	}
+	var reasons []StaleReason
+	switch {
+	case rule.isTask:
+		// Tasks always run.
+	case e.force || forced:
+		reasons = []StaleReason{{Kind: StaleForced}}
+	default:
+		start := time.Now()
+		reasons = e.state.Evaluate(ctx, rule.targets, rule.prereqs, hashText, fingerprint, e.cache.forRule(rule)).Reasons
+		e.staleTime.Add(int64(time.Since(start)))
+		if len(reasons) == 0 && e.explain {
+			// The prerequisites a dry run skipped rebuilding would
+			// probably change.
+			e.mu.Lock()
+			for _, p := range rule.prereqs {
+				if e.wouldBuild[p] {
+					reasons = append(reasons, StaleReason{Kind: StaleUpstream, Prereq: p})
+				}
+			}
+			e.mu.Unlock()
+		}
+	}
+	if e.graph.trace.on(DebugStale) {
+		switch {
+		case rule.isTask:
+			e.graph.trace.printf(DebugStale, "%s: a task; always runs", rule.target)
+		case len(reasons) == 0:
+			e.graph.trace.printf(DebugStale, "%s: up to date", rule.target)
+		default:
+			for _, r := range reasons {
+				if r.Target != "" {
+					e.graph.trace.printf(DebugStale, "%s", r) // names its target
+				} else {
+					e.graph.trace.printf(DebugStale, "%s: %s", rule.target, r)
+				}
+			}
+		}
+	}
+	if !rule.isTask && len(reasons) == 0 {
+		if e.state.outputCheck == OutputsWarn && fingerprint == "" {
+			for _, t := range e.state.ModifiedOutputs(rule.targets, e.cache) {
+				e.outputMu.Lock()
+				e.warn(rule, "%q was modified since mk built it; not rebuilding", t)
+				e.outputMu.Unlock()
+			}
+		}
+		if e.verbose {
+			e.outputMu.Lock()
+			e.console.reportUpToDate(rule.target)
+			e.outputMu.Unlock()
+		}
+		e.emit(Event{Kind: TargetSkipped, Target: rule.target, Targets: rule.targets, Rule: rule.pos})
+		return nil
+	}
+
+	// Restore the outputs of an identical earlier build, perhaps in
+	// another checkout, rather than running the recipe.
+	var digest string
+	if e.actions != nil && !rule.isTask && fingerprint == "" && !rule.checkMtime && rule.depfile == "" && !rule.tracksOutdir() && !e.dryRun {
+		digest = actionDigest(rule.targets, rule.prereqs, hashText, e.cache)
+	}
+	if digest != "" && !e.force && !forced && e.actions.restore(digest, rule.targets) {
 		if e.verbose {
 			e.outputMu.Lock()
-			fmt.Fprintf(os.Stderr, "mk: %q is up to date\n", rule.target)
+			e.console.printf("mk: restored %q from cache\n", rule.target)
 			e.outputMu.Unlock()
 		}
+		e.state.Record(ctx, rule.targets, rule.prereqs, hashText, fingerprint, e.cache.forRule(rule))
+		e.checkpointed()
+		e.emit(Event{Kind: TargetRestored, Target: rule.target, Targets: rule.targets, Rule: rule.pos, Reasons: reasons, Digest: digest})
 		return nil
 	}
 
+	if err := e.checkSyntax(ctx, rule, sh, sh.script(recipeText)); err != nil {
+		return err
+	}
+
 	// Acquire semaphore slot to limit concurrent recipes
 	if e.sem != nil {
-		e.sem <- struct{}{}
+		select {
+		case e.sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		defer func() { <-e.sem }()
 	}
+	if e.jobserver != nil {
+		release, err := e.jobserver.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	if e.stopped.Load() {
+		return errStopped
+	}
 
-	return e.executeRecipe(rule, recipeText, fingerprint)
+	return e.executeRecipe(ctx, rule, recipe, hashText, fingerprint, digest, reasons)
 }
 
-func (e *Executor) executeRecipe(rule *resolvedRule, recipeText, fingerprint string) error {
+// executeRecipe runs a rule's recipe and records the result. If digest is
+// set, the outputs are also stored in the action cache under it. Reasons
+// say why the rule is being rebuilt, for verbose output and events.
+func (e *Executor) executeRecipe(ctx context.Context, rule *resolvedRule, recipe expandedRecipe, hashText, fingerprint, digest string, reasons []StaleReason) error {
+	recipeText := recipe.text()
+	sh := e.shellFor(rule)
+
 	// Auto-create parent directories for all targets
 	if !rule.isTask {
 		for _, t := range rule.targets {
 			dir := filepath.Dir(t)
 			if dir != "." && dir != "" {
 				if !e.dryRun {
-					if err := os.MkdirAll(dir, 0o755); err != nil {
+					if err := os.MkdirAll(e.dir.path(dir), 0o755); err != nil {
 						return fmt.Errorf("creating directory %q: %w", dir, err)
 					}
 				}
@@ -161,16 +775,29 @@ func (e *Executor) executeRecipe(rule *resolvedRule, recipeText, fingerprint str
 
 	// Build banner
 	var banner strings.Builder
-	fmt.Fprintf(&banner, "mk: building %q\n", rule.target)
-	if e.verbose || e.dryRun {
-		for _, line := range strings.Split(recipeText, "\n") {
-			fmt.Fprintf(&banner, "  %s\n", line)
-		}
+	if (e.verbose || e.dryRun) && len(reasons) > 0 {
+		report := StalenessReport{Reasons: reasons}
+		fmt.Fprintf(&banner, "mk: building %q: %s\n", rule.target, strings.Join(report.Strings(), "; "))
+	} else {
+		fmt.Fprintf(&banner, "mk: building %q\n", rule.target)
+	}
+	for _, line := range recipe.echo(e.verbose || e.dryRun) {
+		fmt.Fprintf(&banner, "  %s\n", line)
 	}
 
 	if e.dryRun {
+		if e.explain {
+			e.mu.Lock()
+			for _, t := range rule.targets {
+				e.wouldBuild[t] = true
+			}
+			if affected := e.affected(rule); len(affected) > 0 {
+				fmt.Fprintf(&banner, "  # affects: %s\n", strings.Join(affected, " "))
+			}
+			e.mu.Unlock()
+		}
 		e.outputMu.Lock()
-		fmt.Fprint(os.Stderr, banner.String())
+		e.console.printf("%s", banner.String()) // the commands are the point
 		e.outputMu.Unlock()
 		return nil
 	}
@@ -183,10 +810,10 @@ func (e *Executor) executeRecipe(rule *resolvedRule, recipeText, fingerprint str
 	if serial {
 		// Serial mode: stream banner and output directly
 		e.outputMu.Lock()
-		fmt.Fprint(os.Stderr, banner.String())
+		e.console.banner(banner.String())
 		e.outputMu.Unlock()
-		stdout = os.Stdout
-		stderr = os.Stderr
+		stdout = e.streamTo(e.stdout)
+		stderr = e.streamTo(e.stderr)
 	} else {
 		// Parallel mode: buffer output, flush atomically on completion
 		stdout = &outBuf
@@ -194,20 +821,73 @@ func (e *Executor) executeRecipe(rule *resolvedRule, recipeText, fingerprint str
 	}
 
 	// Execute recipe
-	fullScript := "set -e\n" + recipeText
-	cmd := exec.Command("sh", "-c", fullScript)
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-	cmd.Env = e.vars.Environ()
-
-	err := cmd.Run()
+	e.emit(Event{Kind: TargetStarted, Target: rule.target, Targets: rule.targets, Rule: rule.pos, Reasons: reasons, Command: recipeText})
+	start := time.Now()
+	job := &Job{
+		Target:  rule.target,
+		Targets: rule.targets,
+		Inputs:  e.jobInputs(rule),
+		IsTask:  rule.isTask,
+		Script:  sh.script(recipeText),
+		Shell:   sh,
+		Env:     e.recipeEnv(rule),
+		Files:   e.jobserver.files(),
+		Dir:     string(e.dir),
+		Cwd:     rule.workdir(e.vars),
+		Stdout:  stdout,
+		Stderr:  stderr,
+	}
+	var ignored *os.File
+	if inheritsFiles && slices.ContainsFunc(recipe, func(l recipeLine) bool { return l.ignoreErr }) {
+		f, err := os.CreateTemp("", "mk-ignored-*")
+		if err != nil {
+			return err
+		}
+		os.Remove(f.Name())
+		defer f.Close()
+		ignored = f
+		job.Files = withIgnoredFile(job.Files, f)
+	}
+	var prereqHashes []string
+	if !rule.isTask {
+		prereqHashes = e.hashPrereqs(rule)
+	}
+	var outdirBefore workspaceSnapshot
+	if rule.tracksOutdir() {
+		outdirBefore = e.dir.snapshotDir(rule.outdir())
+	}
+	err := e.runRecipe(ctx, rule, job)
+	elapsed := time.Since(start)
+	if ignored != nil {
+		for _, msg := range ignoredReports(ignored) {
+			e.ignored.Add(1)
+			e.emit(Event{Kind: TargetWarning, Target: rule.target, Targets: rule.targets, Rule: rule.pos, Message: msg})
+		}
+	}
+	e.execTime.Add(int64(elapsed))
+	if e.audit != nil {
+		e.audit.record(job, start, start.Add(elapsed), err)
+	}
+	if err == nil && !rule.isTask {
+		if modified := e.modifiedPrereqs(rule, prereqHashes); len(modified) > 0 {
+			digest = "" // the outputs came from other inputs
+			msg := fmt.Sprintf("recipe for %q modified its prerequisites %s; it will rebuild every time", rule.target, strings.Join(modified, ", "))
+			if e.strict {
+				err = errors.New(msg)
+			} else {
+				// With the recipe's output, not through e.warn.
+				fmt.Fprintf(stderr, "mk: warning: %s\n", msg)
+				e.emit(Event{Kind: TargetWarning, Target: rule.target, Targets: rule.targets, Rule: rule.pos, Message: msg})
+			}
+		}
+	}
 
 	if !serial {
 		// Flush buffered output atomically
 		e.outputMu.Lock()
-		fmt.Fprint(os.Stderr, banner.String())
-		outBuf.WriteTo(os.Stdout)
-		errBuf.WriteTo(os.Stderr)
+		e.console.banner(banner.String())
+		outBuf.WriteTo(e.stdout)
+		errBuf.WriteTo(e.stderr)
 		e.outputMu.Unlock()
 	}
 
@@ -215,81 +895,177 @@ func (e *Executor) executeRecipe(rule *resolvedRule, recipeText, fingerprint str
 		// Delete partial output on failure (for file targets), unless [keep]
 		if !rule.isTask && !rule.keep {
 			for _, t := range rule.targets {
-				os.Remove(t)
+				os.Remove(e.dir.path(t))
 			}
 		}
-		return fmt.Errorf("recipe for %q failed: %w", rule.target, err)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		err = fmt.Errorf("recipe for %q failed: %w", rule.target, err)
+		e.failed(err)
+		e.emit(Event{Kind: TargetFailed, Target: rule.target, Targets: rule.targets, Rule: rule.pos, Duration: elapsed, Err: err})
+		return err
 	}
 
 	// Record successful build for all outputs
 	if !rule.isTask {
-		e.state.Record(rule.targets, rule.prereqs, recipeText, fingerprint, e.cache)
+		var extra []string
+		if outdirBefore != nil {
+			extra = e.outdirOutputs(rule, outdirBefore)
+		}
+		e.state.Record(ctx, rule.targets, rule.prereqs, hashText, fingerprint, e.cache.forRule(rule))
+		e.state.recordExtra(rule.targets, extra, e.cache.forRule(rule))
+		e.state.setDuration(rule.targets, elapsed)
+		if rule.depfile != "" {
+			path := e.expandDepfile(rule)
+			if deps, err := e.readDepfile(rule, path); err != nil {
+				e.outputMu.Lock()
+				e.warn(rule, "reading depfile of %q: %v; the dependencies it lists aren't tracked", rule.target, err)
+				e.outputMu.Unlock()
+			} else {
+				e.state.recordDiscovered(rule.targets, deps, e.cache.forRule(rule))
+			}
+		}
+		e.checkpointed()
+		if digest != "" {
+			if err := e.actions.store(digest, rule.targets, e.cache); err != nil && e.verbose {
+				fmt.Fprintf(e.stderr, "mk: not caching %q: %s\n", rule.target, err)
+			}
+		}
+		if e.provenance != nil {
+			e.provenance.record(job, recipeText, start, start.Add(elapsed))
+		}
+	}
+	e.emit(Event{Kind: TargetFinished, Target: rule.target, Targets: rule.targets, Rule: rule.pos, Duration: elapsed})
+
+	return nil
+}
+
+// hashPrereqs returns the content hash of each of the rule's prerequisites
+// ("" if it can't be read).
+func (e *Executor) hashPrereqs(rule *resolvedRule) []string {
+	hashes := make([]string, len(rule.prereqs))
+	for i, p := range rule.prereqs {
+		hashes[i], _ = e.cache.Hash(p)
+	}
+	return hashes
+}
+
+// modifiedPrereqs returns the prerequisites whose content differs from
+// before, quoted for messages. A recipe that rewrites its own inputs is
+// always stale afterwards.
+func (e *Executor) modifiedPrereqs(rule *resolvedRule, before []string) []string {
+	var modified []string
+	for i, h := range e.hashPrereqs(rule) {
+		if h != before[i] {
+			modified = append(modified, fmt.Sprintf("%q", rule.prereqs[i]))
+		}
+	}
+	return modified
+}
+
+// runRecipe runs job, in sandbox mode in a sandbox, checking in
+// containment mode that a scoped rule's recipe only touched files inside
+// its scope.
+func (e *Executor) runRecipe(ctx context.Context, rule *resolvedRule, job *Job) error {
+	run := e.runnerFor().Run
+	if e.sandbox && sandboxes(rule) {
+		run = func(ctx context.Context, job *Job) error { return e.runSandboxed(ctx, rule, job) }
+	}
+	if !e.containment {
+		return run(ctx, job)
+	}
+	if rule.scope == "" {
+		e.containMu.RLock()
+		defer e.containMu.RUnlock()
+		return run(ctx, job)
 	}
 
+	e.containMu.Lock()
+	defer e.containMu.Unlock()
+	before := e.dir.snapshot(rule.scope)
+	if err := run(ctx, job); err != nil {
+		return err
+	}
+	if outside := before.changed(e.dir.snapshot(rule.scope)); len(outside) > 0 {
+		return fmt.Errorf("recipe wrote outside its include scope %q: %s", rule.scope, strings.Join(outside, ", "))
+	}
 	return nil
 }
 
+// expandFingerprint expands the rule's [fingerprint: ...] command. It
+// runs in the workspace root, whatever the recipe's [cwd: ...].
 func (e *Executor) expandFingerprint(rule *resolvedRule) string {
 	if rule.fingerprint == "" {
 		return ""
 	}
-	vars := e.vars.Clone()
-	vars.Set("target", rule.target)
-	if len(rule.prereqs) > 0 {
-		vars.Set("input", rule.prereqs[0])
-	}
-	vars.Set("inputs", strings.Join(rule.prereqs, " "))
-	if rule.stem != "" {
-		vars.Set("stem", rule.stem)
-	}
+	vars := rule.varsFor(e.vars).Clone()
+	setAutoVars(vars, rule, e.dir, "")
 	return vars.Expand(rule.fingerprint)
 }
 
-func (e *Executor) expandRecipe(rule *resolvedRule) string {
-	vars := e.vars.Clone()
-	vars.Set("target", rule.target)
-	if len(rule.prereqs) > 0 {
-		vars.Set("input", rule.prereqs[0])
+// expandDepfile expands the rule's [depfile: ...] path like its recipe,
+// and returns it in the workspace.
+func (e *Executor) expandDepfile(rule *resolvedRule) string {
+	cwd := rule.workdir(e.vars)
+	vars := rule.varsFor(e.vars).Clone()
+	setAutoVars(vars, rule, e.dir, cwd)
+	path := strings.TrimSpace(vars.Expand(rule.depfile))
+	if cwd != "" && !filepath.IsAbs(path) {
+		path = joinName(cwd, path)
 	}
-	vars.Set("inputs", strings.Join(rule.prereqs, " "))
+	return path
+}
 
-	// Set stem if available from pattern match
-	if rule.stem != "" {
-		vars.Set("stem", rule.stem)
+// expandRecipe expands the rule's recipe. With forHash, variables that
+// don't affect the output, such as $compiler_launcher, expand to nothing.
+// Targets the recipe names with $[mk ...] are built on the way, after
+// the rule's own in chain; the error is the first of theirs to fail.
+func (e *Executor) expandRecipe(ctx context.Context, rule *resolvedRule, chain *buildChain, forHash bool) (expandedRecipe, error) {
+	vars := rule.varsFor(e.vars).Clone()
+	if forHash {
+		vars.Set(launcherVar, "")
+	}
+	cwd := rule.workdir(e.vars)
+	setAutoVars(vars, rule, e.dir, cwd)
+	var mkErr error
+	vars.mk = func(targets []string) []string {
+		for i, t := range targets {
+			if rule.scope != "" {
+				targets[i] = joinName(rule.scope, t)
+			}
+		}
+		if err := e.buildPrereqs(ctx, rule.target, rule, targets, chain); err != nil && mkErr == nil {
+			mkErr = fmt.Errorf("$[mk]: %w", err)
+		}
+		names := make([]string, len(targets))
+		for i, t := range targets {
+			names[i] = relName(cwd, t)
+		}
+		return names
 	}
 
 	// Find changed prerequisites (only normal prereqs)
 	var changed []string
 	ts := e.state.GetTarget(rule.target)
+	cache := e.cache.forRule(rule)
 	for _, p := range rule.prereqs {
 		if ts == nil {
-			changed = append(changed, p)
+			changed = append(changed, relName(cwd, p))
 			continue
 		}
-		h, err := e.cache.Hash(p)
+		h, err := cache.Hash(p)
 		if err != nil || ts.InputHashes[p] != h {
-			changed = append(changed, p)
+			changed = append(changed, relName(cwd, p))
 		}
 	}
 	vars.Set("changed", strings.Join(changed, " "))
+	vars.Set("inputs.new", vars.Get("changed"))
 
-	var lines []string
-	for _, line := range rule.recipe {
-		ignoreErr := false
-		l := line
-		for len(l) > 0 && (l[0] == '@' || l[0] == '-') {
-			if l[0] == '-' {
-				ignoreErr = true
-			}
-			l = l[1:]
-		}
-
-		expanded := vars.Expand(l)
-		if ignoreErr {
-			expanded += " || true"
-		}
-		lines = append(lines, expanded)
+	prelude := e.graph.prelude
+	if !ruleShell(rule, vars).posix() {
+		prelude = nil // written for sh
 	}
-
-	return strings.Join(lines, "\n")
+	recipe := expandRecipeLines(prelude, rule.recipe, vars)
+	return recipe, mkErr
 }
@@ -0,0 +1,71 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	for _, s := range []string{
+		"x = 1\nall: a b\n    echo $x > $target\n",
+		"!task: | dir\n    @-true\n",
+		"{name}.o: {name}.c\n    cc -c $input -o $target\n",
+		"if $x == 1\ny = 2\nelif $x\nelse\nend\n",
+		"config debug:\n    cflags += -g\n    excludes: release\n",
+		"fn greet(name):\n    echo hi $name\n",
+		"for f in a b c:\n    $f.o: $f.c\nend\n",
+		"eval $[shell echo x]\n",
+		"include lib/mkfile as lib\n",
+		"x = ${unterminated\n",
+		"a b: c\n\tcmd\n  cmd2\n",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		Parse(strings.NewReader(src))
+	})
+}
+
+func FuzzParsePattern(f *testing.F) {
+	for _, s := range []string{
+		"{name}.o", "build/{dir}/{name:[a-z]+}.o", "{a}{b}", "{", "{}", "{x:[}", "{x:(}",
+		"{{name}}", "{name:.*}/{name2:.*}/{name3:.*}", "lib{name}.a", "{a}{b}{c}{d}{e}{f}-{a}{a}y",
+	} {
+		f.Add(s, "build/foo/bar.o")
+	}
+	f.Fuzz(func(t *testing.T, pattern, target string) {
+		p, ok, err := ParsePattern(pattern)
+		if err != nil || !ok {
+			return
+		}
+		if captures, ok := p.Match(target); ok {
+			// What a pattern matched, it must expand back to.
+			if got := p.Expand(captures); got != target {
+				t.Errorf("%q matched %q with %v, but expands to %q", pattern, target, captures, got)
+			}
+		}
+	})
+}
+
+func FuzzExpand(f *testing.F) {
+	for _, s := range []string{
+		"$x ${x} $[words $x] $$", "${", "$[", "$[subst a,b,", "${x:.c=.o}", "$[if $x,$[y],z]",
+		"$[[[[", "${${${x}}}", "$[patsubst %.c,%.o,$[wildcard *.c]]", "$x.$y.${z}",
+		"$[strip ${x", "$[word 99999999999999999999,a b]",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		v := NewVars()
+		v.Set("x", "a.c b.c")
+		v.Set("y", "$x")
+		v.SetLazy("z", "$y")
+		if strings.Contains(s, "shell") {
+			return // don't run the fuzzer's commands
+		}
+		v.Expand(s)
+	})
+}
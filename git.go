@@ -0,0 +1,131 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// gitCache holds the output of each git command the $[git-...]
+// functions have run, so that however many rules ask for the commit or
+// the changed files, git runs once per mk invocation.
+type gitCache struct {
+	mu  sync.Mutex
+	out map[string]gitResult
+}
+
+type gitResult struct {
+	out string
+	err error
+}
+
+// funcGitChanged implements $[git-changed ref]: the files in the
+// workspace that differ from ref, including uncommitted changes and
+// untracked files that aren't ignored, sorted. Deleted files are
+// included, so callers can tell a removal from no change.
+func (v *Vars) funcGitChanged(args string) string {
+	ref := strings.TrimSpace(v.Expand(args))
+	if ref == "" {
+		v.warnf("git-changed: missing ref\n")
+		return ""
+	}
+	changed, err := v.git("diff", "--name-only", "--relative", ref, "--")
+	if err != nil {
+		v.warnf("git-changed: %v\n", err)
+		return ""
+	}
+	untracked, err := v.git("ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		v.warnf("git-changed: %v\n", err)
+		return ""
+	}
+	seen := map[string]bool{}
+	var files []string
+	for _, f := range append(strings.Fields(changed), strings.Fields(untracked)...) {
+		if !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+	return strings.Join(files, " ")
+}
+
+// funcGitSha implements $[git-sha] and $[git-sha ref]: the commit ref,
+// HEAD by default, names.
+func (v *Vars) funcGitSha(args string) string {
+	ref := strings.TrimSpace(v.Expand(args))
+	if ref == "" {
+		ref = "HEAD"
+	}
+	out, err := v.git("rev-parse", "--verify", ref+"^{commit}")
+	if err != nil {
+		v.warnf("git-sha: %s: %v\n", ref, err)
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+// funcGitDirty implements $[git-dirty]: "dirty" if tracked files have
+// uncommitted changes, otherwise nothing, for use with $[if ...].
+// Untracked files don't count, as with git describe --dirty.
+func (v *Vars) funcGitDirty() string {
+	out, err := v.git("status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		v.warnf("git-dirty: %v\n", err)
+		return ""
+	}
+	if strings.TrimSpace(out) != "" {
+		return "dirty"
+	}
+	return ""
+}
+
+// git runs git with args in the workspace, or returns what it printed
+// the first time these args were run. A failure's error includes the
+// first line git wrote to stderr.
+func (v *Vars) git(args ...string) (string, error) {
+	root := v
+	for root.parent != nil {
+		root = root.parent
+	}
+	cache := root.gitOut
+	if cache == nil {
+		return v.runGit(args...)
+	}
+	key := strings.Join(args, "\x00")
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if r, ok := cache.out[key]; ok {
+		return r.out, r.err
+	}
+	out, err := v.runGit(args...)
+	if cache.out == nil {
+		cache.out = make(map[string]gitResult)
+	}
+	cache.out[key] = gitResult{out, err}
+	return out, err
+}
+
+func (v *Vars) runGit(args ...string) (string, error) {
+	c := v.workspace().command(v.context(), "git", args...)
+	killOnCancel(c)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		err = errors.New("git is not installed")
+	case err != nil && stderr.Len() > 0:
+		line, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		err = fmt.Errorf("%w: %s", err, line)
+	}
+	return string(out), err
+}
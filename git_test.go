@@ -0,0 +1,88 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitFuncs(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		c := exec.Command("git", append([]string{"-c", "user.name=mk", "-c", "user.email=mk@example.com"}, args...)...)
+		c.Dir = dir
+		out, err := c.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	write := func(name, content string) {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755)
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	}
+	vars := func() *Vars {
+		v := NewVars()
+		v.dir = workspace(dir)
+		v.stderr = io.Discard
+		return v
+	}
+
+	git("init", "-q")
+	write(".gitignore", "*.o\n")
+	write("a.c", "a")
+	write("src/b.c", "b")
+	write("gone.c", "gone")
+	git("add", ".")
+	git("commit", "-q", "-m", "base")
+	base := git("rev-parse", "HEAD")
+
+	v := vars()
+	if got := v.Expand("$[git-sha]"); got != base {
+		t.Errorf("git-sha = %q, want %q", got, base)
+	}
+	if got := v.Expand("$[git-dirty]"); got != "" {
+		t.Errorf("git-dirty on a clean tree = %q, want empty", got)
+	}
+
+	write("a.c", "a2")
+	os.Remove(filepath.Join(dir, "gone.c"))
+	write("src/new.c", "new")
+	write("a.o", "ignored")
+
+	// Results are cached for the life of the variables.
+	if got := v.Expand("$[git-dirty]"); got != "" {
+		t.Errorf("cached git-dirty = %q, want empty", got)
+	}
+
+	v = vars()
+	if got := v.Expand("$[git-dirty]"); got != "dirty" {
+		t.Errorf("git-dirty on a modified tree = %q, want dirty", got)
+	}
+	if got, want := v.Expand("$[git-changed HEAD]"), "a.c gone.c src/new.c"; got != want {
+		t.Errorf("git-changed HEAD = %q, want %q", got, want)
+	}
+
+	git("add", ".")
+	git("commit", "-q", "-m", "next")
+	v = vars()
+	if got := v.Expand("$[git-sha HEAD~1]"); got != base {
+		t.Errorf("git-sha HEAD~1 = %q, want %q", got, base)
+	}
+	if got, want := v.Expand("$[git-changed "+base+"]"), "a.c gone.c src/new.c"; got != want {
+		t.Errorf("git-changed base = %q, want %q", got, want)
+	}
+	if got := v.Expand("$[git-sha nosuchref]"); got != "" {
+		t.Errorf("git-sha nosuchref = %q, want empty", got)
+	}
+}
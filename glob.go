@@ -0,0 +1,145 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// countGlob is filepath.Glob, also counting the file system calls it
+// makes, an lstat for a name without wildcards and a directory read for
+// each directory searched, in *stats.
+func countGlob(pattern string, stats *int) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if !hasGlobMeta(pattern) {
+		*stats++
+		if _, err := os.Lstat(pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+
+	dir, file := filepath.Split(pattern)
+	if dir == "" {
+		dir = "."
+	} else if len(dir) > len(filepath.VolumeName(dir))+1 {
+		dir = dir[:len(dir)-1] // the separator, but not of the root
+	}
+	dirs := []string{dir}
+	if hasGlobMeta(dir) {
+		var err error
+		if dirs, err = countGlob(dir, stats); err != nil {
+			return nil, err
+		}
+	}
+
+	var matches []string
+	for _, d := range dirs {
+		*stats++
+		f, err := os.Open(d)
+		if err != nil {
+			continue
+		}
+		names, _ := f.Readdirnames(-1)
+		f.Close()
+		slices.Sort(names)
+		for _, name := range names {
+			if ok, _ := filepath.Match(file, name); ok {
+				matches = append(matches, filepath.Join(d, name))
+			}
+		}
+	}
+	return matches, nil
+}
+
+// hasGlobMeta reports whether path contains any of the characters
+// filepath.Match treats specially.
+func hasGlobMeta(path string) bool {
+	magic := `*?[\`
+	if runtime.GOOS == "windows" {
+		magic = `*?[`
+	}
+	return strings.ContainsAny(path, magic)
+}
+
+// A globCache holds the matches of each glob pattern while the graph is
+// built, when a mkfile's loops and functions may expand the same
+// $[wildcard] many times. Recipes, expanded as the build goes, glob
+// afresh to see the files earlier recipes wrote.
+type globCache struct {
+	mu      sync.Mutex
+	matches map[string][]string
+	trace   map[string]*globTrace
+}
+
+// A globTrace is what one pattern cost while the graph was built.
+type globTrace struct {
+	calls, stats, matches int
+}
+
+func newGlobCache() *globCache {
+	return &globCache{matches: map[string][]string{}, trace: map[string]*globTrace{}}
+}
+
+// glob returns w.glob(pattern), from the cache if the pattern has been
+// globbed before.
+func (c *globCache) glob(w workspace, pattern string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.trace[pattern]
+	if t == nil {
+		t = &globTrace{}
+		c.trace[pattern] = t
+	}
+	t.calls++
+	if m, ok := c.matches[pattern]; ok {
+		return slices.Clone(m), nil
+	}
+	m, stats, err := w.countGlob(pattern)
+	t.stats += stats
+	if err != nil {
+		return nil, err
+	}
+	t.matches = len(m)
+	c.matches[pattern] = m
+	return slices.Clone(m), nil
+}
+
+// printTrace writes what each pattern cost to w, costliest first: how
+// often it was globbed, the file system calls the first glob made and
+// the files it matched.
+func (c *globCache) printTrace(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	patterns := make([]string, 0, len(c.trace))
+	calls, stats := 0, 0
+	for p, t := range c.trace {
+		patterns = append(patterns, p)
+		calls += t.calls
+		stats += t.stats
+	}
+	slices.SortFunc(patterns, func(a, b string) int {
+		ta, tb := c.trace[a], c.trace[b]
+		return cmp.Or(cmp.Compare(tb.stats, ta.stats), cmp.Compare(tb.calls, ta.calls), cmp.Compare(a, b))
+	})
+	fmt.Fprintf(w, "mk: globs: %d patterns, %d calls, %d file system calls\n", len(patterns), calls, stats)
+	if len(patterns) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  %6s %6s %7s  %s\n", "calls", "stats", "matches", "pattern")
+	for _, p := range patterns {
+		t := c.trace[p]
+		fmt.Fprintf(w, "  %6d %6d %7d  %s\n", t.calls, t.stats, t.matches, p)
+	}
+}
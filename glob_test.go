@@ -0,0 +1,83 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCountGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"a.c", "b.c", "x/y.c", "z/y.c", "z/w.h"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, f)), 0o755)
+		os.WriteFile(filepath.Join(dir, f), nil, 0o644)
+	}
+	w := workspace(dir)
+	for _, tt := range []struct {
+		pattern string
+		want    []string
+		stats   int
+	}{
+		{"*.c", []string{"a.c", "b.c"}, 1},
+		{"*/y.c", []string{"x/y.c", "z/y.c"}, 5}, // the top, then everything in it
+		{"z/*", []string{"z/w.h", "z/y.c"}, 1},
+		{"a.c", []string{"a.c"}, 1},
+		{"nope/*.c", nil, 1},
+	} {
+		got, stats, err := w.countGlob(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tt.want) || stats != tt.stats {
+			t.Errorf("countGlob(%q) = %q, %d stats, want %q, %d", tt.pattern, got, stats, tt.want, tt.stats)
+		}
+	}
+	if _, _, err := w.countGlob("[a"); err == nil {
+		t.Errorf("countGlob of a bad pattern: no error")
+	}
+}
+
+func TestGlobCache(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "src"), 0o755)
+	for _, f := range []string{"a.c", "b.c"} {
+		os.WriteFile(filepath.Join(dir, "src", f), nil, 0o644)
+	}
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+for i in 1 2 3:
+    n$i = $[words $[wildcard src/*.c]]
+end
+
+!gen:
+    touch src/c.c
+
+list.txt: gen
+    echo $[wildcard src/*.c] > $target
+`), 0o644)
+	var stderr bytes.Buffer
+	p, err := Load(context.Background(), "mkfile", Options{Dir: dir, Jobs: 1, LocalState: true, TraceGlobs: true, Stdout: io.Discard, Stderr: &stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stderr.String(); !strings.Contains(got, "mk: globs: 1 patterns, 3 calls, 1 file system calls\n") ||
+		!strings.Contains(got, "src/*.c") {
+		t.Errorf("trace:\n%s\nwant src/*.c globbed once for three calls", got)
+	}
+
+	// Recipes glob afresh, seeing what earlier recipes wrote.
+	if err := p.Build(context.Background(), "list.txt"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "list.txt"))
+	if got, want := strings.TrimSpace(string(data)), "src/a.c src/b.c src/c.c"; got != want {
+		t.Errorf("list.txt = %q, want %q", got, want)
+	}
+}
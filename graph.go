@@ -4,10 +4,15 @@
 package mk
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 )
 
 // Graph represents the build dependency graph.
@@ -16,17 +21,53 @@ type Graph struct {
 	patterns    []patternRule
 	vars        *Vars
 	state       *BuildState
-	scopePrefix string // current include scope path prefix (e.g., "lib/")
+	scopePrefix string            // current include scope path prefix (e.g., "lib/")
+	file        string            // path of the mkfile being evaluated
+	loopVars    map[string]string // variables bound by enclosing for loops
+	evalDepth   int               // nesting of eval statements
+	files       []string          // mkfiles read, in order, for diagnostics
+	index       *ruleIndex        // for resolve; rebuilt when rules change
+	indexMu     sync.Mutex        // guards index; builds resolve concurrently
 
 	rawRules      []rawRuleEntry        // stored for re-expansion after config application
 	configs       map[string]*ConfigDef // registered config definitions
 	activeConfigs []string              // configs requested via CLI
+	warnings      []Warning             // from the top-level file and includes
+	trace         *tracer               // --debug output; nil if off
+	dir           workspace             // where targets and includes are found
+	tools         []toolDecl            // declared tools, in declaration order
+	plugins       []*Plugin             // declared plugins, closed with the project
+	prelude       []string              // prelude lines, run before every recipe
+	provides      []provision           // [provides: ...] annotations, in declaration order
+	globs         []string              // patterns $[wildcard] matched during evaluation
+	globCache     *globCache            // their matches, reused while evaluating, for --trace-globs
+	canonical     map[string]string     // target -> [canonical: ...] command, expanded
+	remoteCache   string                // URL of the cache declaration, expanded
+	requires      []string              // the active configs' requires targets
+	requiredBy    map[string]bool       // targets needed to build requires, which don't wait for them
+	assigned      map[string]string     // variables the mkfiles assign at top level -> doc comment
+	evaluating    bool                  // rules are being added, so more pattern rules may follow
+	usedAll       bool                  // $[all] was expanded while evaluating
+	pendingAll    []pendingAll          // prerequisites that used $[all], expanded again at the end
+}
+
+// A pendingAll is a prerequisite of an explicit rule that used $[all]
+// while the mkfile was evaluated, when pattern rules defined further on
+// weren't known yet.
+type pendingAll struct {
+	rule      int // index in Graph.rules
+	word      string
+	orderOnly bool
+	scope     string
+	vars      *Vars
 }
 
 // rawRuleEntry stores a Rule AST node with its scope context for re-expansion.
 type rawRuleEntry struct {
 	rule        Rule
 	scopePrefix string
+	file        string
+	vars        *Vars
 }
 
 type resolvedRule struct {
@@ -34,79 +75,193 @@ type resolvedRule struct {
 	targets          []string // all output targets (for multi-output rules)
 	prereqs          []string
 	orderOnlyPrereqs []string
+	late             []string // $$ prerequisites, expanded when the rule is built
 	recipe           []string
 	isTask           bool
 	keep             bool   // [keep] annotation — don't delete on error
+	service          bool   // [service] annotation — run in the background
 	fingerprint      string // [fingerprint: command] for non-file artifacts
+	checkMtime       bool   // [check: mtime]: files compared by mtime and size, not content
+	depfile          string // [depfile: path], unexpanded
+	shell            string // [shell: command], unexpanded; "" for $shell
+	cwd              string // [cwd: path], unexpanded; "" for the workspace root
+	doc              string // the comment above the rule
 	stem             string // first capture value from pattern match
+	scope            string // directory of the scoped include that defined the rule; "" at top level
+	vars             *Vars  // variables of the scoped include that defined the rule; nil at top level
+	pos              string // source location of the rule, "file:line"
+	pattern          string // target pattern the rule was resolved through; "" if explicit
+
+	// configs maps prerequisites written target@config to the configs
+	// (a+b) they're built under.
+	configs map[string]string
 }
 
-// WhyRebuild returns human-readable reasons why the target needs rebuilding,
-// or nil if it is up to date.
-func (g *Graph) WhyRebuild(target string) ([]string, error) {
-	rule, err := g.Resolve(target)
-	if err != nil {
-		return nil, err
+// varsFor returns the variables a rule's recipe is expanded with: those
+// of the scoped include that defined it, or else top.
+func (r *resolvedRule) varsFor(top *Vars) *Vars {
+	if r.vars != nil {
+		return r.vars
 	}
-	if len(rule.recipe) == 0 {
-		return nil, nil
+	return top
+}
+
+// bindLate returns rule with its late-bound ($$) prerequisites expanded,
+// with the files present now, and appended to its prerequisites; or
+// rule itself if it has none. The expansion sees $target and $stem.
+func (g *Graph) bindLate(rule *resolvedRule, top *Vars) *resolvedRule {
+	if len(rule.late) == 0 {
+		return rule
 	}
-	vars := g.vars.Clone()
+	vars := rule.varsFor(top).Clone()
 	vars.Set("target", rule.target)
-	if len(rule.prereqs) > 0 {
-		vars.Set("input", rule.prereqs[0])
+	if rule.stem != "" {
+		vars.Set("stem", rule.stem)
 	}
-	vars.Set("inputs", strings.Join(rule.prereqs, " "))
-	var lines []string
-	for _, line := range rule.recipe {
-		l := line
-		for len(l) > 0 && (l[0] == '@' || l[0] == '-') {
-			l = l[1:]
+	bound := *rule
+	bound.prereqs = slices.Clone(rule.prereqs)
+	bound.late = nil
+	for _, l := range rule.late {
+		for _, p := range strings.Fields(vars.Expand(l)) {
+			if rule.scope != "" {
+				p = joinName(rule.scope, p)
+			}
+			bound.prereqs = append(bound.prereqs, p)
 		}
-		lines = append(lines, vars.Expand(l))
 	}
-	recipeText := strings.Join(lines, "\n")
-	fingerprint := rule.fingerprint
+	return &bound
+}
+
+// hashedRecipe expands a rule's recipe and fingerprint as the executor
+// does for the recorded recipe hash, hashing tools with cache.
+func (g *Graph) hashedRecipe(rule *resolvedRule, cache *HashCache) (recipeText, fingerprint string) {
+	cwd := rule.workdir(g.vars)
+	vars := rule.varsFor(g.vars).Clone()
+	vars.Set(launcherVar, "") // as for the recorded recipe hash
+	setAutoVars(vars, rule, g.dir, cwd)
+	sh := ruleShell(rule, vars)
+	prelude := g.prelude
+	if !sh.posix() {
+		prelude = nil
+	}
+	lines := expandRecipeLines(prelude, rule.recipe, vars)
+	fingerprint = rule.fingerprint
 	if fingerprint != "" {
-		fingerprint = vars.Expand(fingerprint)
+		fpVars := rule.varsFor(g.vars).Clone()
+		setAutoVars(fpVars, rule, g.dir, "") // it runs in the workspace root
+		fingerprint = fpVars.Expand(fingerprint)
 	}
-	return g.state.WhyStale(rule.targets, rule.prereqs, recipeText, fingerprint, NewHashCache()), nil
+	tools, _ := g.toolDigest(cache) // a missing tool leaves rules stale
+	return hashedRecipeText(lines.text(), tools, sh, cwd), fingerprint
+}
+
+// WhyRebuild returns human-readable reasons why the target needs rebuilding,
+// or nil if it is up to date.
+func (g *Graph) WhyRebuild(ctx context.Context, target string) ([]string, error) {
+	rule, err := g.resolve(target)
+	if err != nil {
+		return nil, err
+	}
+	if len(rule.recipe) == 0 {
+		return nil, nil
+	}
+	rule = g.bindLate(rule, g.vars)
+	cache := g.hashCache()
+	recipeText, fingerprint := g.hashedRecipe(rule, cache)
+	return g.state.Evaluate(ctx, rule.targets, rule.prereqs, recipeText, fingerprint, cache.forRule(rule)).Strings(), nil
 }
 
 type patternRule struct {
 	targetPatterns          []Pattern
 	prereqPatterns          []Pattern
 	orderOnlyPrereqPatterns []Pattern
+	late                    []string
 	recipe                  []string
 	keep                    bool
 	fingerprint             string
+	checkMtime              bool
+	depfile                 string
+	shell                   string
+	cwd                     string
+	scope                   string
+	vars                    *Vars
+	pos                     string
 }
 
 // BuildGraph constructs a dependency graph from a parsed file.
 // activeConfigs specifies the configs requested via CLI (e.g., ["debug", "asan"]).
 func BuildGraph(file *File, vars *Vars, state *BuildState, activeConfigs []string) (*Graph, error) {
+	return buildGraph(file, vars, state, activeConfigs, nil)
+}
+
+func buildGraph(file *File, vars *Vars, state *BuildState, activeConfigs []string, trace *tracer) (*Graph, error) {
 	g := &Graph{
 		vars:          vars,
 		state:         state,
 		configs:       make(map[string]*ConfigDef),
 		activeConfigs: activeConfigs,
+		file:          file.Path,
+		trace:         trace,
+		dir:           vars.workspace(),
 	}
 
+	vars.sources = g.sourcePattern
+	vars.derivable = g.derivable
+	vars.globbed = g.recordGlob
+	g.globCache = newGlobCache()
+	vars.globs = g.globCache
+	defer func() { vars.globbed, vars.globs = nil, nil }()
+	if file.Path != "" {
+		g.files = append(g.files, file.Path)
+	}
+	g.addWarnings(file.Path, file.Warnings)
+	g.evaluating = true
 	if err := g.evaluate(file.Stmts); err != nil {
+		g.closePlugins()
 		return nil, err
 	}
+	g.evaluating = false
+	g.expandPendingAll()
 
 	// Apply active configs after all statements are evaluated
 	if len(activeConfigs) > 0 {
 		if err := g.applyConfigs(); err != nil {
+			g.closePlugins()
 			return nil, err
 		}
 		g.reExpandRules()
+		g.expandPendingAll()
+	}
+	for i := range g.rules {
+		g.splitConfigPrereqs(&g.rules[i])
 	}
+	g.addConfigRequires()
 
 	return g, nil
 }
 
+// closePlugins closes the plugins the mkfile declared.
+func (g *Graph) closePlugins() error {
+	var errs []error
+	for _, p := range g.plugins {
+		errs = append(errs, p.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Warnings returns the parse warnings for the mkfile and the files it
+// includes (the standard library is not checked).
+func (g *Graph) Warnings() []Warning {
+	return g.warnings
+}
+
+func (g *Graph) addWarnings(path string, ws []Warning) {
+	for _, w := range ws {
+		w.File = path
+		g.warnings = append(g.warnings, w)
+	}
+}
+
 // ConfigRequires returns the targets that active configs require to be built first.
 func (g *Graph) ConfigRequires() []string {
 	var requires []string
@@ -118,6 +273,47 @@ func (g *Graph) ConfigRequires() []string {
 	return requires
 }
 
+// addConfigRequires makes the targets the active configs require
+// order-only prerequisites of every rule not needed to build them, so
+// that they are built first but in parallel with each other, and show in
+// --graph, --why and dry runs like any other prerequisite.
+func (g *Graph) addConfigRequires() {
+	g.requires = g.ConfigRequires()
+	if len(g.requires) == 0 {
+		return
+	}
+	g.requiredBy = map[string]bool{}
+	var walk func(target string)
+	walk = func(target string) {
+		if g.requiredBy[target] {
+			return
+		}
+		g.requiredBy[target] = true
+		if r, err := g.resolve(target); err == nil {
+			for _, p := range slices.Concat(r.prereqs, r.orderOnlyPrereqs) {
+				walk(p)
+			}
+		}
+	}
+	for _, t := range g.requires {
+		walk(t)
+	}
+	for i := range g.rules {
+		g.waitForRequires(&g.rules[i])
+	}
+}
+
+// waitForRequires adds the active configs' requires targets to r's
+// order-only prerequisites, unless r is needed to build them.
+func (g *Graph) waitForRequires(r *resolvedRule) {
+	for _, t := range r.targets {
+		if g.requiredBy[t] {
+			return
+		}
+	}
+	r.orderOnlyPrereqs = slices.Concat(r.orderOnlyPrereqs, g.requires)
+}
+
 func (g *Graph) applyConfigs() error {
 	// Validate all active configs are defined
 	for _, name := range g.activeConfigs {
@@ -142,6 +338,9 @@ func (g *Graph) applyConfigs() error {
 	for _, name := range g.activeConfigs {
 		cfg := g.configs[name]
 		for _, va := range cfg.Vars {
+			if g.vars.IsOverridden(va.Name) {
+				continue
+			}
 			value := g.vars.Expand(va.Value)
 			switch va.Op {
 			case OpSet:
@@ -153,28 +352,110 @@ func (g *Graph) applyConfigs() error {
 					g.vars.Set(va.Name, value)
 				}
 			}
+			g.trace.printf(DebugVars, "config %s: %s = %q", name, va.Name, g.vars.Get(va.Name))
 		}
 	}
 
 	// Auto-derive builddir
 	if base := g.vars.Get("builddir"); base != "" {
 		g.vars.Set("builddir", base+"-"+strings.Join(g.activeConfigs, "-"))
+		g.trace.printf(DebugVars, "configs %s: builddir = %q", strings.Join(g.activeConfigs, "+"), g.vars.Get("builddir"))
 	}
 
 	return nil
 }
 
+// sourcePattern returns the first prerequisite pattern of the first
+// pattern rule with target as a target pattern.
+func (g *Graph) sourcePattern(target string) (Pattern, bool) {
+	for _, pr := range g.patterns {
+		for _, tp := range pr.targetPatterns {
+			if tp.Raw == target && len(pr.prereqPatterns) > 0 && pr.prereqPatterns[0].IsPattern() {
+				return pr.prereqPatterns[0], true
+			}
+		}
+	}
+	return Pattern{}, false
+}
+
+// derivable returns the names matching target, a target pattern, that
+// the pattern rules with it as a target pattern can build from existing
+// files, for $[all]: for each such rule, the files matching its first
+// prerequisite pattern that binds the target's captures, and the names
+// derivable for that pattern in turn, mapped to the target. ok is false
+// if no pattern rule has the target pattern, though while the mkfile is
+// evaluated, when one may be defined further on, it is always true.
+func (g *Graph) derivable(target string) (names []string, ok bool) {
+	if g.evaluating {
+		g.usedAll = true
+	}
+	tgt, isPattern, err := ParsePattern(target)
+	if err != nil || !isPattern {
+		return nil, g.evaluating
+	}
+	names, ok = g.derive(tgt, 0)
+	slices.Sort(names)
+	return slices.Compact(names), ok || g.evaluating
+}
+
+// derive returns the names derivable for tgt, through chains of up to
+// maxImplicitChain pattern rules, unsorted.
+func (g *Graph) derive(tgt Pattern, depth int) (names []string, ok bool) {
+	if depth >= maxImplicitChain {
+		return nil, false
+	}
+	for _, pr := range g.patterns {
+		for _, tp := range pr.targetPatterns {
+			if !slices.Equal(tp.Parts, tgt.Parts) {
+				continue
+			}
+			ok = true
+			i := slices.IndexFunc(pr.prereqPatterns, func(p Pattern) bool {
+				return p.IsPattern() && checkCapturesBound(p, tp) == nil
+			})
+			if i < 0 {
+				continue
+			}
+			src := pr.prereqPatterns[i]
+			files, _ := g.vars.glob(src.Glob())
+			for i, f := range files {
+				files[i] = filepath.ToSlash(f)
+			}
+			made, _ := g.derive(src, depth+1)
+			for _, f := range slices.Concat(files, made) {
+				captures, ok := src.Match(f)
+				if !ok {
+					continue
+				}
+				name := tp.Expand(captures)
+				if _, ok := tp.Match(name); !ok {
+					continue // excluded by the rule's constraints
+				}
+				if _, ok := tgt.Match(name); ok {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	return names, ok
+}
+
 func (g *Graph) reExpandRules() {
 	saved := g.rawRules
 	g.rules = nil
 	g.patterns = nil
 	g.rawRules = nil
+	g.provides = nil
+	g.canonical = nil
+	g.index = nil
+	g.evaluating = true
 	for _, raw := range saved {
-		savedPrefix := g.scopePrefix
-		g.scopePrefix = raw.scopePrefix
+		savedPrefix, savedFile, savedVars := g.scopePrefix, g.file, g.vars
+		g.scopePrefix, g.file, g.vars = raw.scopePrefix, raw.file, raw.vars
 		g.addRule(raw.rule) //nolint:errcheck // re-expansion of previously valid rules
-		g.scopePrefix = savedPrefix
+		g.scopePrefix, g.file, g.vars = savedPrefix, savedFile, savedVars
 	}
+	g.evaluating = false
 }
 
 func (g *Graph) evaluate(stmts []Node) error {
@@ -189,7 +470,20 @@ func (g *Graph) evaluate(stmts []Node) error {
 func (g *Graph) evalNode(node Node) error {
 	switch n := node.(type) {
 	case VarAssign:
+		n.Name, n.Value = g.bindLoopVars(n.Name), g.bindLoopVars(n.Value)
 		name := g.vars.Expand(n.Name)
+		if g.vars.IsOverridden(name) {
+			g.trace.printf(DebugVars, "%s: %s is overridden; assignment ignored", srcPos(g.file, n.Line), name)
+			return nil
+		}
+		if g.scopePrefix == "" {
+			if g.assigned == nil {
+				g.assigned = make(map[string]string)
+			}
+			if n.Doc != "" || g.assigned[name] == "" {
+				g.assigned[name] = n.Doc
+			}
+		}
 		value := n.Value
 		if !n.Lazy {
 			value = g.vars.Expand(value)
@@ -208,6 +502,13 @@ func (g *Graph) evalNode(node Node) error {
 				g.vars.Set(name, value)
 			}
 		}
+		if g.trace.on(DebugVars) {
+			if n.Lazy && n.Op == OpSet {
+				g.trace.printf(DebugVars, "%s: %s = %s (expanded when used)", srcPos(g.file, n.Line), name, n.Value)
+			} else {
+				g.trace.printf(DebugVars, "%s: %s = %q", srcPos(g.file, n.Line), name, g.vars.Get(name))
+			}
+		}
 
 	case Rule:
 		return g.addRule(n)
@@ -224,28 +525,205 @@ func (g *Graph) evalNode(node Node) error {
 	case ConfigDef:
 		g.configs[n.Name] = &n
 
+	case ToolDef:
+		return g.declareTool(n)
+
+	case CacheDef:
+		if g.remoteCache != "" {
+			return fmt.Errorf("%s: remote cache already declared", srcPos(g.file, n.Line))
+		}
+		g.remoteCache = strings.TrimSpace(g.vars.Expand(n.URL))
+
+	case Prelude:
+		for _, line := range n.Lines {
+			g.prelude = append(g.prelude, g.bindLoopVars(line))
+		}
+
+	case PluginDef:
+		p := newPlugin(g.vars.workspace(), g.vars.stderr, g.vars.Expand(n.Command), n.Funcs)
+		g.plugins = append(g.plugins, p)
+		g.vars.SetPlugin(p)
+
 	case Loop:
 		return g.evalLoop(n)
+
+	case Eval:
+		return g.evalEval(n)
 	}
 
 	return nil
 }
 
+// maxEvalDepth bounds eval statements that generate eval statements.
+const maxEvalDepth = 100
+
+// evalEval expands an eval statement's text and evaluates it as mkfile
+// source in the current scope. Since expansion folds command output onto
+// one line, the two characters \n in the expanded text start a new line.
+// Rules it defines are attributed to "FILE:LINE eval:N".
+func (g *Graph) evalEval(e Eval) error {
+	pos := srcPos(g.file, e.Line)
+	if g.evalDepth >= maxEvalDepth {
+		return fmt.Errorf("%s: eval nested more than %d deep", pos, maxEvalDepth)
+	}
+	text := strings.ReplaceAll(g.vars.Expand(g.bindLoopVars(e.Text)), `\n`, "\n")
+	ast, err := Parse(strings.NewReader(text))
+	if err != nil {
+		return fmt.Errorf("%s: eval: %w", pos, err)
+	}
+
+	savedFile := g.file
+	g.file = pos + " eval"
+	g.evalDepth++
+	defer func() {
+		g.file = savedFile
+		g.evalDepth--
+	}()
+	return g.evaluate(ast.Stmts)
+}
+
+// evalLoop evaluates the loop body once per item. The loop variable is
+// bound only while the body is evaluated, and rules and lazy variables
+// defined in the body capture its current value (see bindLoopVars).
 func (g *Graph) evalLoop(loop Loop) error {
 	listStr := g.vars.Expand(loop.List)
 	items := strings.Fields(listStr)
+
+	outer, hadOuter := g.loopVars[loop.Var]
+	if g.loopVars == nil {
+		g.loopVars = make(map[string]string)
+	}
+	defer func() {
+		if hadOuter {
+			g.loopVars[loop.Var] = outer
+		} else {
+			delete(g.loopVars, loop.Var)
+		}
+	}()
+
 	for _, item := range items {
-		g.vars.Set(loop.Var, item)
-		if err := g.evaluate(loop.Body); err != nil {
+		g.loopVars[loop.Var] = item
+		restore := g.vars.Bind(loop.Var, item)
+		err := g.evaluate(loop.Body)
+		restore()
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// bindRule returns r with loop variables bound in its targets,
+// prerequisites, recipe and fingerprint.
+func (g *Graph) bindRule(r Rule) Rule {
+	bind := func(ss []string) []string {
+		out := make([]string, len(ss))
+		for i, s := range ss {
+			out[i] = g.bindLoopVars(s)
+		}
+		return out
+	}
+	r.Targets = bind(r.Targets)
+	r.Prereqs = bind(r.Prereqs)
+	r.OrderOnlyPrereqs = bind(r.OrderOnlyPrereqs)
+	r.Recipe = bind(r.Recipe)
+	r.Fingerprint = g.bindLoopVars(r.Fingerprint)
+	r.Canonical = g.bindLoopVars(r.Canonical)
+	r.Depfile = g.bindLoopVars(r.Depfile)
+	r.Shell = g.bindLoopVars(r.Shell)
+	return r
+}
+
+// bindLoopVars replaces references to loop variables in s with their
+// current values, so text that is expanded after the loop moves on, such
+// as recipes, sees the value from its own iteration. References nested
+// in ${...} and $[...] are replaced too.
+func (g *Graph) bindLoopVars(s string) string {
+	if len(g.loopVars) == 0 || !strings.Contains(s, "$") {
+		return s
+	}
+	var b strings.Builder
+	i := 0
+	for i < len(s) {
+		if s[i] != '$' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+		next := s[i+1]
+		switch {
+		case next == '$':
+			b.WriteString("$$")
+			i += 2
+		case next == '{':
+			if end := strings.IndexByte(s[i:], '}'); end >= 0 {
+				if val, ok := g.loopVars[s[i+2:i+end]]; ok {
+					b.WriteString(strings.ReplaceAll(val, "$", "$$"))
+					i += end + 1
+					continue
+				}
+			}
+			b.WriteString("${")
+			i += 2
+		case isIdentStart(next):
+			start := i + 1
+			j := start
+			for j < len(s) && isIdentCont(s[j]) {
+				j++
+			}
+			name := s[start:j]
+			val, ok := g.loopVars[name]
+			if !ok {
+				b.WriteString(s[i:j])
+				i = j
+				continue
+			}
+			// Take in the rest of the reference ($name.dir, $name:.c=.o)
+			// and expand it against the binding alone, as Expand would.
+			if j < len(s) && s[j] == '.' {
+				k := j + 1
+				for k < len(s) && isIdentCont(s[k]) {
+					k++
+				}
+				if g.vars.Get(name+"."+s[j+1:k]) != "" {
+					b.WriteString(s[i:j]) // scoped variable, e.g. $lib.src
+					i = j
+					continue
+				}
+				j = k
+			} else if j < len(s) && s[j] == ':' {
+				if eq := strings.IndexByte(s[j+1:], '='); eq >= 0 {
+					rest := j + 1 + eq + 1
+					if sp := strings.IndexByte(s[rest:], ' '); sp >= 0 {
+						j = rest + sp
+					} else {
+						j = len(s)
+					}
+				}
+			}
+			one := &Vars{vals: map[string]string{name: val}}
+			b.WriteString(strings.ReplaceAll(one.Expand(s[i:j]), "$", "$$"))
+			i = j
+		default:
+			b.WriteByte('$')
+			i++
+		}
+	}
+	return b.String()
+}
+
 func (g *Graph) addRule(r Rule) error {
+	if len(g.loopVars) > 0 {
+		r = g.bindRule(r)
+	}
+
 	// Store raw rule for re-expansion after config application
-	g.rawRules = append(g.rawRules, rawRuleEntry{rule: r, scopePrefix: g.scopePrefix})
+	g.rawRules = append(g.rawRules, rawRuleEntry{rule: r, scopePrefix: g.scopePrefix, file: g.file, vars: g.vars})
+	pos := srcPos(g.file, r.Line)
+	var scopeVars *Vars
+	if g.vars.parent != nil {
+		scopeVars = g.vars
+	}
 
 	// Expand variable references in targets and prereqs
 	var expandedTargets []string
@@ -253,28 +731,41 @@ func (g *Graph) addRule(r Rule) error {
 		expandedTargets = append(expandedTargets, g.vars.Expand(t))
 	}
 
-	var expandedPrereqs []string
+	var expandedPrereqs, late []string
+	var usedAll []pendingAll
 	for _, p := range r.Prereqs {
+		if strings.HasPrefix(p, "$$") {
+			late = append(late, p[1:])
+			continue
+		}
+		g.usedAll = false
 		expanded := g.vars.Expand(p)
-		expandedPrereqs = append(expandedPrereqs, strings.Fields(expanded)...)
+		expandedPrereqs = append(expandedPrereqs, patternFields(expanded)...)
+		if g.usedAll {
+			usedAll = append(usedAll, pendingAll{word: p, scope: g.scopePrefix, vars: g.vars})
+		}
 	}
 
 	var expandedOrderOnly []string
 	for _, p := range r.OrderOnlyPrereqs {
+		g.usedAll = false
 		expanded := g.vars.Expand(p)
-		expandedOrderOnly = append(expandedOrderOnly, strings.Fields(expanded)...)
+		expandedOrderOnly = append(expandedOrderOnly, patternFields(expanded)...)
+		if g.usedAll {
+			usedAll = append(usedAll, pendingAll{word: p, orderOnly: true, scope: g.scopePrefix, vars: g.vars})
+		}
 	}
 
 	// Rebase paths under scope prefix
 	if g.scopePrefix != "" {
 		for i, t := range expandedTargets {
-			expandedTargets[i] = filepath.Clean(filepath.Join(g.scopePrefix, t))
+			expandedTargets[i] = joinName(g.scopePrefix, t)
 		}
 		for i, p := range expandedPrereqs {
-			expandedPrereqs[i] = filepath.Clean(filepath.Join(g.scopePrefix, p))
+			expandedPrereqs[i] = joinName(g.scopePrefix, p)
 		}
 		for i, p := range expandedOrderOnly {
-			expandedOrderOnly[i] = filepath.Clean(filepath.Join(g.scopePrefix, p))
+			expandedOrderOnly[i] = joinName(g.scopePrefix, p)
 		}
 	}
 
@@ -288,7 +779,13 @@ func (g *Graph) addRule(r Rule) error {
 	}
 
 	if isPattern {
-		pr := patternRule{recipe: r.Recipe, keep: r.Keep, fingerprint: r.Fingerprint}
+		if len(r.Provides) > 0 {
+			return fmt.Errorf("%s: [provides: ...] applies only to explicit rules", pos)
+		}
+		if r.Canonical != "" {
+			return fmt.Errorf("%s: [canonical: ...] applies only to explicit rules", pos)
+		}
+		pr := patternRule{late: late, recipe: r.Recipe, keep: r.Keep, fingerprint: r.Fingerprint, checkMtime: r.Check == "mtime", depfile: r.Depfile, shell: r.Shell, cwd: r.Cwd, scope: g.scopePrefix, vars: scopeVars, pos: pos}
 		for _, t := range expandedTargets {
 			p, _, err := ParsePattern(t)
 			if err != nil {
@@ -311,23 +808,161 @@ func (g *Graph) addRule(r Rule) error {
 			pr.orderOnlyPrereqPatterns = append(pr.orderOnlyPrereqPatterns, pat)
 		}
 		g.patterns = append(g.patterns, pr)
+		g.checkSelfMatching(pr, r.Line)
 	} else {
+		if r.IsTask && len(r.Recipe) == 0 && len(late) == 0 && len(expandedTargets) == 1 {
+			if i := g.aggregateIndex(expandedTargets[0]); i >= 0 {
+				agg := &g.rules[i]
+				// Another declaration of an aggregate adds to it.
+				for _, p := range expandedPrereqs {
+					if !slices.Contains(agg.prereqs, p) {
+						agg.prereqs = append(agg.prereqs, p)
+					}
+				}
+				for _, p := range expandedOrderOnly {
+					if !slices.Contains(agg.orderOnlyPrereqs, p) {
+						agg.orderOnlyPrereqs = append(agg.orderOnlyPrereqs, p)
+					}
+				}
+				if agg.doc == "" {
+					agg.doc = r.Doc
+				}
+				g.deferAll(i, usedAll)
+				return nil
+			}
+		}
 		// Explicit rule — one resolvedRule with all targets grouped
 		g.rules = append(g.rules, resolvedRule{
 			target:           expandedTargets[0],
 			targets:          expandedTargets,
 			prereqs:          expandedPrereqs,
 			orderOnlyPrereqs: expandedOrderOnly,
+			late:             late,
 			recipe:           r.Recipe,
 			isTask:           r.IsTask,
 			keep:             r.Keep,
+			service:          r.Service,
 			fingerprint:      r.Fingerprint,
+			checkMtime:       r.Check == "mtime",
+			depfile:          r.Depfile,
+			shell:            r.Shell,
+			cwd:              r.Cwd,
+			doc:              r.Doc,
+			scope:            g.scopePrefix,
+			vars:             scopeVars,
+			pos:              pos,
 		})
+		g.deferAll(len(g.rules)-1, usedAll)
+		if len(r.Provides) > 0 {
+			g.addProvision(r, expandedTargets[0], pos)
+		}
+		if r.Canonical != "" {
+			if g.canonical == nil {
+				g.canonical = make(map[string]string)
+			}
+			for _, t := range expandedTargets {
+				vars := g.vars.Clone()
+				vars.Set("target", t)
+				g.canonical[t] = vars.Expand(r.Canonical)
+			}
+		}
 	}
 
 	return nil
 }
 
+// deferAll records the prerequisites of g.rules[rule] that used $[all],
+// to expand again once every pattern rule is known.
+func (g *Graph) deferAll(rule int, pending []pendingAll) {
+	for _, p := range pending {
+		p.rule = rule
+		g.pendingAll = append(g.pendingAll, p)
+	}
+}
+
+// expandPendingAll expands again the prerequisites that used $[all]
+// while the mkfile was evaluated, now that every pattern rule is known,
+// and adds the names that the pattern rules defined after them add.
+func (g *Graph) expandPendingAll() {
+	pending := g.pendingAll
+	g.pendingAll = nil
+	for _, p := range pending {
+		r := &g.rules[p.rule]
+		list := &r.prereqs
+		if p.orderOnly {
+			list = &r.orderOnlyPrereqs
+		}
+		for _, name := range patternFields(p.vars.Expand(p.word)) {
+			if p.scope != "" {
+				name = joinName(p.scope, name)
+			}
+			if !slices.Contains(*list, name) {
+				*list = append(*list, name)
+			}
+		}
+	}
+}
+
+// aggregates reports whether r is an aggregate task: one with no recipe,
+// which runs its prerequisites, in parallel, and nothing else.
+func (r *resolvedRule) aggregates() bool {
+	return r.isTask && len(r.recipe) == 0 && len(r.late) == 0 && len(r.targets) == 1
+}
+
+// aggregateIndex returns the index of the explicit rule for task if it
+// is an aggregate, which further declarations of the task with no recipe
+// add prerequisites to, or else -1.
+func (g *Graph) aggregateIndex(task string) int {
+	for i := range g.rules {
+		if slices.Contains(g.rules[i].targets, task) {
+			if g.rules[i].aggregates() {
+				return i
+			}
+			return -1
+		}
+	}
+	return -1
+}
+
+// checkSelfMatching warns about a pattern rule whose prerequisite matches
+// its own target pattern, such as {name}.in: {name}.in.in. A missing
+// prerequisite then resolves through the same rule again, without end.
+func (g *Graph) checkSelfMatching(pr patternRule, line int) {
+	for _, tp := range pr.targetPatterns {
+		for _, pp := range pr.prereqPatterns {
+			if !selfMatching(tp, pp) {
+				continue
+			}
+			w := Warning{File: g.file, Line: line,
+				Msg: fmt.Sprintf("prerequisite %s matches target pattern %s, so a missing file chains through this rule indefinitely", pp.Raw, tp.Raw)}
+			if !slices.Contains(g.warnings, w) { // rules are re-added when configs apply
+				g.warnings = append(g.warnings, w)
+			}
+			return
+		}
+	}
+}
+
+// selfMatching reports whether expanding prereq pattern pp for a target
+// that matches tp yields another match for tp. It checks one sample
+// target, with every capture set to "x"; patterns whose constraints
+// reject that are not checked.
+func selfMatching(tp, pp Pattern) bool {
+	if !tp.IsPattern() || !pp.IsPattern() {
+		return false
+	}
+	sample := map[string]string{}
+	for _, c := range tp.Captures {
+		sample[c] = "x"
+	}
+	captures, ok := tp.Match(tp.Expand(sample))
+	if !ok {
+		return false
+	}
+	_, ok = tp.Match(pp.Expand(captures))
+	return ok
+}
+
 func (g *Graph) evalConditional(c Conditional) error {
 	for _, branch := range c.Branches {
 		if branch.Op == "else" {
@@ -352,6 +987,7 @@ func (g *Graph) evalConditional(c Conditional) error {
 
 func (g *Graph) evalInclude(inc Include) error {
 	path := g.vars.Expand(inc.Path)
+	g.trace.printf(DebugInclude, "%s: include %q", srcPos(g.file, inc.Line), path)
 
 	// Pattern discovery: include {path}/mkfile as {path}
 	if strings.Contains(path, "{") {
@@ -385,17 +1021,20 @@ func (g *Graph) evalPatternInclude(pattern, _ string) error {
 		globPattern = filepath.Join(g.scopePrefix, globPattern)
 	}
 
-	matches, err := filepath.Glob(globPattern)
+	matches, err := g.dir.glob(globPattern)
 	if err != nil {
 		return fmt.Errorf("include glob %q: %w", globPattern, err)
 	}
+	matches, _ = g.dir.sortPaths(matches, "") // include in a stable order
+	g.trace.printf(DebugInclude, "%s matches %d files", globPattern, len(matches))
 
 	for _, match := range matches {
-		dir := filepath.Dir(match)
+		dir := dirName(match)
 		// Strip scopePrefix to get the alias
 		alias := dir
 		if g.scopePrefix != "" {
 			alias, _ = filepath.Rel(g.scopePrefix, dir)
+			alias = filepath.ToSlash(alias)
 		}
 		if err := g.doInclude(match, alias); err != nil {
 			return err
@@ -405,7 +1044,7 @@ func (g *Graph) evalPatternInclude(pattern, _ string) error {
 }
 
 func (g *Graph) doInclude(path, alias string) error {
-	f, err := os.Open(path)
+	f, err := os.Open(g.dir.path(path))
 	if err != nil {
 		// Try embedded stdlib
 		if ef, embedErr := stdlibFS.Open(path); embedErr == nil {
@@ -414,10 +1053,10 @@ func (g *Graph) doInclude(path, alias string) error {
 			if parseErr != nil {
 				return fmt.Errorf("parsing %s: %w", path, parseErr)
 			}
-			if alias == "" {
-				return g.evaluate(ast.Stmts)
-			}
-			return g.evalScopedInclude(path, alias, ast)
+			ast.Path = path
+			g.traceInclude(path+" (built in)", alias)
+			g.addFile(path + " (built in)")
+			return g.evalIncluded(alias, ast)
 		}
 		return fmt.Errorf("cannot open %s: %w", path, err)
 	}
@@ -427,38 +1066,64 @@ func (g *Graph) doInclude(path, alias string) error {
 	if err != nil {
 		return fmt.Errorf("parsing %s: %w", path, err)
 	}
+	ast.Path = path
+	g.traceInclude(path, alias)
+	g.addFile(path)
+	g.addWarnings(path, ast.Warnings)
+	return g.evalIncluded(alias, ast)
+}
+
+func (g *Graph) traceInclude(path, alias string) {
+	if alias == "" {
+		g.trace.printf(DebugInclude, "reading %s into the current scope", path)
+	} else {
+		g.trace.printf(DebugInclude, "reading %s as scope %q", path, alias)
+	}
+}
+
+// addFile records an included mkfile, once however often it's included.
+func (g *Graph) addFile(path string) {
+	if !slices.Contains(g.files, path) {
+		g.files = append(g.files, path)
+	}
+}
+
+// evalIncluded evaluates an included file, scoped under alias if set.
+func (g *Graph) evalIncluded(alias string, ast *File) error {
+	savedFile := g.file
+	g.file = ast.Path
+	defer func() { g.file = savedFile }()
 
 	if alias == "" {
 		// Unscoped include — paste directly into current scope
 		return g.evaluate(ast.Stmts)
 	}
 
-	return g.evalScopedInclude(path, alias, ast)
+	return g.evalScopedInclude(ast.Path, alias, ast)
+}
+
+// srcPos formats a source location for messages.
+func srcPos(file string, line int) string {
+	if file == "" {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("%s:%d", file, line)
 }
 
 func (g *Graph) evalScopedInclude(path, alias string, ast *File) error {
 	parentVars := g.vars
 	parentPrefix := g.scopePrefix
 
-	childVars := parentVars.Clone()
-	parentSnapshot := parentVars.Snapshot()
-
-	g.vars = childVars
-	g.scopePrefix = filepath.Dir(path)
+	// The child's variables and functions live in a scope of their own,
+	// which the parent reads as alias.name.
+	g.vars = parentVars.Scope(alias)
+	g.scopePrefix = dirName(path)
 	if g.scopePrefix == "." {
 		g.scopePrefix = alias
 	}
 
 	err := g.evaluate(ast.Stmts)
 
-	// Export child-set variables as alias.varname to parent
-	childSnapshot := childVars.Snapshot()
-	for k, v := range childSnapshot {
-		if old, exists := parentSnapshot[k]; !exists || old != v {
-			parentVars.Set(alias+"."+k, v)
-		}
-	}
-
 	// Restore parent scope
 	g.vars = parentVars
 	g.scopePrefix = parentPrefix
@@ -466,142 +1131,206 @@ func (g *Graph) evalScopedInclude(path, alias string, ast *File) error {
 	return err
 }
 
-// Resolve finds the rule for a given target, including pattern matching.
-func (g *Graph) Resolve(target string) (*resolvedRule, error) {
+// RuleInfo describes the rule that builds a target.
+type RuleInfo struct {
+	Targets     []string `json:"targets"` // all outputs of the rule; Targets[0] is $target
+	Prereqs     []string `json:"prereqs"`
+	OrderOnly   []string `json:"order_only,omitempty"` // order-only prerequisites
+	Recipe      []string `json:"recipe,omitempty"`     // recipe lines, before variable expansion
+	IsTask      bool     `json:"is_task,omitempty"`
+	Keep        bool     `json:"keep,omitempty"`
+	Service     bool     `json:"service,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Shell       string   `json:"shell,omitempty"` // [shell: ...] interpreter, before variable expansion
+	Cwd         string   `json:"cwd,omitempty"`   // [cwd: ...] directory, before variable expansion
+	Stem        string   `json:"stem,omitempty"`  // first capture value, for pattern rules
+}
+
+// Lookup returns the rule that builds target, matching explicit rules
+// first and then pattern rules. Existing files with no rule resolve to a
+// recipe-less leaf.
+func (g *Graph) Lookup(target string) (*RuleInfo, error) {
+	r, err := g.resolve(target)
+	if err != nil {
+		return nil, err
+	}
+	return &RuleInfo{
+		Targets:     r.targets,
+		Prereqs:     r.prereqs,
+		OrderOnly:   r.orderOnlyPrereqs,
+		Recipe:      r.recipe,
+		IsTask:      r.isTask,
+		Keep:        r.keep,
+		Service:     r.service,
+		Fingerprint: r.fingerprint,
+		Shell:       r.shell,
+		Cwd:         r.cwd,
+		Stem:        r.stem,
+	}, nil
+}
+
+// resolve finds the rule for a given target, including pattern matching.
+func (g *Graph) resolve(target string) (*resolvedRule, error) {
+	tracing := g.trace.on(DebugResolve) && g.trace.first(target)
+
 	// Check explicit rules first (match against any target in the group)
-	for i := range g.rules {
-		for _, t := range g.rules[i].targets {
-			if t == target {
-				return &g.rules[i], nil
-			}
+	ix := g.ruleIndex()
+	if i, ok := ix.explicit[target]; ok {
+		if tracing {
+			g.trace.printf(DebugResolve, "%s: explicit rule at %s", target, g.rules[i].pos)
 		}
+		return &g.rules[i], nil
 	}
 
 	// Try pattern rules — collect ALL matches and merge
 	var merged *resolvedRule
 	recipeCount := 0
-	for _, pr := range g.patterns {
-		for _, tp := range pr.targetPatterns {
-			captures, ok := tp.Match(target)
-			if !ok {
-				continue
+	matched := -1 // the last pattern rule matched
+	for _, ref := range ix.candidates(target) {
+		if ref.rule == matched {
+			continue // matched by an earlier target pattern of the rule
+		}
+		pr := g.patterns[ref.rule]
+		tp := pr.targetPatterns[ref.target]
+		captures, ok := tp.Match(target)
+		if !ok {
+			if tracing {
+				g.trace.printf(DebugResolve, "%s: pattern %s at %s doesn't match", target, tp.Raw, pr.pos)
 			}
+			continue
+		}
+		matched = ref.rule
 
-			// Expand prerequisite patterns with captures
-			var prereqs []string
-			for _, pp := range pr.prereqPatterns {
-				prereqs = append(prereqs, pp.Expand(captures))
+		// Expand prerequisite patterns with captures
+		var prereqs []string
+		for _, pp := range pr.prereqPatterns {
+			prereqs = append(prereqs, pp.Expand(captures))
+		}
+
+		// Expand order-only prerequisite patterns with captures
+		var orderOnly []string
+		for _, pp := range pr.orderOnlyPrereqPatterns {
+			orderOnly = append(orderOnly, pp.Expand(captures))
+		}
+
+		// Late-bound prerequisites keep their captures
+		var late []string
+		for _, l := range pr.late {
+			for k, v := range captures {
+				l = strings.ReplaceAll(l, "{"+k+"}", v)
 			}
+			late = append(late, l)
+		}
 
-			// Expand order-only prerequisite patterns with captures
-			var orderOnly []string
-			for _, pp := range pr.orderOnlyPrereqPatterns {
-				orderOnly = append(orderOnly, pp.Expand(captures))
+		if merged == nil {
+			// First match — initialise with targets
+			var targets []string
+			for _, tp2 := range pr.targetPatterns {
+				targets = append(targets, tp2.Expand(captures))
 			}
+			merged = &resolvedRule{
+				target:           targets[0],
+				targets:          targets,
+				prereqs:          prereqs,
+				orderOnlyPrereqs: orderOnly,
+				late:             late,
+				pattern:          tp.Raw,
+			}
+		} else {
+			// Subsequent match — merge prerequisites
+			merged.prereqs = append(merged.prereqs, prereqs...)
+			merged.orderOnlyPrereqs = append(merged.orderOnlyPrereqs, orderOnly...)
+			merged.late = append(merged.late, late...)
+		}
 
-			if merged == nil {
-				// First match — initialise with targets
-				var targets []string
-				for _, tp2 := range pr.targetPatterns {
-					targets = append(targets, tp2.Expand(captures))
-				}
-				merged = &resolvedRule{
-					target:           targets[0],
-					targets:          targets,
-					prereqs:          prereqs,
-					orderOnlyPrereqs: orderOnly,
-				}
-			} else {
-				// Subsequent match — merge prerequisites
-				merged.prereqs = append(merged.prereqs, prereqs...)
-				merged.orderOnlyPrereqs = append(merged.orderOnlyPrereqs, orderOnly...)
+		if len(pr.recipe) > 0 {
+			recipeCount++
+			if recipeCount > 1 {
+				return nil, fmt.Errorf("ambiguous pattern rules for %q: multiple rules have recipes", target)
 			}
 
-			if len(pr.recipe) > 0 {
-				recipeCount++
-				if recipeCount > 1 {
-					return nil, fmt.Errorf("ambiguous pattern rules for %q: multiple rules have recipes", target)
+			// Expand captures in recipe
+			var recipe []string
+			for _, line := range pr.recipe {
+				expanded := line
+				for k, v := range captures {
+					expanded = strings.ReplaceAll(expanded, "{"+k+"}", v)
 				}
+				recipe = append(recipe, expanded)
+			}
 
-				// Expand captures in recipe
-				var recipe []string
-				for _, line := range pr.recipe {
-					expanded := line
-					for k, v := range captures {
-						expanded = strings.ReplaceAll(expanded, "{"+k+"}", v)
-					}
-					recipe = append(recipe, expanded)
-				}
+			// Expand captures in fingerprint command
+			fp := pr.fingerprint
+			for k, v := range captures {
+				fp = strings.ReplaceAll(fp, "{"+k+"}", v)
+			}
 
-				// Expand captures in fingerprint command
-				fp := pr.fingerprint
-				for k, v := range captures {
-					fp = strings.ReplaceAll(fp, "{"+k+"}", v)
-				}
+			df := pr.depfile
+			for k, v := range captures {
+				df = strings.ReplaceAll(df, "{"+k+"}", v)
+			}
 
-				// Use the first capture value as stem
-				var stem string
-				if len(tp.Captures) > 0 {
-					stem = captures[tp.Captures[0]]
-				}
+			cwd := pr.cwd
+			for k, v := range captures {
+				cwd = strings.ReplaceAll(cwd, "{"+k+"}", v)
+			}
 
-				merged.recipe = recipe
-				merged.keep = pr.keep
-				merged.fingerprint = fp
-				merged.stem = stem
+			// Use the first capture value as stem
+			var stem string
+			if len(tp.Captures) > 0 {
+				stem = captures[tp.Captures[0]]
 			}
 
-			break // matched this pattern rule, move to next
+			merged.recipe = recipe
+			merged.keep = pr.keep
+			merged.fingerprint = fp
+			merged.checkMtime = pr.checkMtime
+			merged.depfile = df
+			merged.shell = pr.shell
+			merged.cwd = cwd
+			merged.stem = stem
+			merged.scope = pr.scope
+			merged.vars = pr.vars
+			merged.pos = pr.pos
+		}
+		if tracing {
+			role := "adds prerequisites"
+			if len(pr.recipe) > 0 {
+				role = "supplies the recipe"
+			}
+			var caps []string
+			for _, c := range tp.Captures {
+				caps = append(caps, c+"="+captures[c])
+			}
+			g.trace.printf(DebugResolve, "%s: pattern %s at %s matches (%s), %s %v", target, tp.Raw, pr.pos, strings.Join(caps, " "), role, prereqs)
 		}
 	}
 	if merged != nil {
+		g.splitConfigPrereqs(merged)
+		g.waitForRequires(merged)
 		return merged, nil
 	}
 
-	// Check if the target exists as a file (leaf node)
-	if fileExists(target) {
-		return &resolvedRule{target: target, targets: []string{target}}, nil
-	}
-
-	return nil, fmt.Errorf("no rule to build %q", target)
-}
-
-// PrintGraph prints the dependency subgraph rooted at the given targets as DOT.
-func (g *Graph) PrintGraph(targets []string) error {
-	fmt.Println("digraph mk {")
-	fmt.Println("  rankdir=LR;")
-	visited := map[string]bool{}
-	for _, t := range targets {
-		if err := g.printGraph(t, visited); err != nil {
-			return err
+	// A file generated by a rule that provides it depends on that rule
+	if pv, ok := g.provider(target); ok {
+		if tracing {
+			g.trace.printf(DebugResolve, "%s: provided by %s at %s", target, pv.target, pv.pos)
 		}
+		return &resolvedRule{target: target, targets: []string{target}, prereqs: []string{pv.target}, pos: pv.pos}, nil
 	}
-	fmt.Println("}")
-	return nil
-}
 
-func (g *Graph) printGraph(target string, visited map[string]bool) error {
-	if visited[target] {
-		return nil
-	}
-	visited[target] = true
-
-	rule, err := g.Resolve(target)
-	if err != nil {
-		return err
+	// Check if the target exists as a file (leaf node)
+	if fileExists(g.dir.path(target)) {
+		if tracing {
+			g.trace.printf(DebugResolve, "%s: no rule; an existing file", target)
+		}
+		return &resolvedRule{target: target, targets: []string{target}}, nil
 	}
-
-	if rule.isTask {
-		fmt.Printf("  %q [shape=box];\n", target)
+	if tracing {
+		g.trace.printf(DebugResolve, "%s: no rule", target)
 	}
 
-	for _, p := range rule.prereqs {
-		fmt.Printf("  %q -> %q;\n", target, p)
-		if err := g.printGraph(p, visited); err != nil {
-			return err
-		}
-	}
-	return nil
+	return nil, g.noRuleError(target)
 }
 
 // DefaultTarget returns the first explicit non-task target.
@@ -643,6 +1372,50 @@ func (g *Graph) Tasks() []string {
 	return tasks
 }
 
+// A Completion is a name the command line accepts, for shell and editor
+// completion.
+type Completion struct {
+	Kind string // target, task, config or variable
+	Name string
+	Doc  string   // the comment above its definition; "" if none
+	Runs []string // for an aggregate task (one with no recipe), its prerequisites
+}
+
+// Completions returns the explicit targets and tasks in declaration
+// order, then the configs and the variables the mkfiles assign at top
+// level (which name=value overrides), sorted.
+func (g *Graph) Completions() []Completion {
+	var cs []Completion
+	seen := map[string]bool{}
+	for _, r := range g.rules {
+		kind := "target"
+		if r.isTask {
+			kind = "task"
+		}
+		var runs []string
+		if r.aggregates() {
+			for _, p := range slices.Concat(r.prereqs, r.orderOnlyPrereqs) {
+				if !slices.Contains(runs, p) {
+					runs = append(runs, p)
+				}
+			}
+		}
+		for _, t := range r.targets {
+			if !seen[t] {
+				seen[t] = true
+				cs = append(cs, Completion{Kind: kind, Name: t, Doc: r.doc, Runs: runs})
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(g.configs)) {
+		cs = append(cs, Completion{Kind: "config", Name: name, Doc: g.configs[name].Doc})
+	}
+	for _, name := range slices.Sorted(maps.Keys(g.assigned)) {
+		cs = append(cs, Completion{Kind: "variable", Name: name, Doc: g.assigned[name]})
+	}
+	return cs
+}
+
 // ConfigNames returns all defined config names.
 func (g *Graph) ConfigNames() []string {
 	var names []string
@@ -0,0 +1,218 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// RuleSnapshot is a rule as the graph sees it once variables are
+// expanded. For pattern rules, prerequisites and recipe are the patterns
+// and unexpanded recipe lines.
+type RuleSnapshot struct {
+	Targets   []string `json:"targets"`
+	Prereqs   []string `json:"prereqs,omitempty"`
+	OrderOnly []string `json:"order_only,omitempty"`
+	Recipe    []string `json:"recipe,omitempty"`
+	IsTask    bool     `json:"is_task,omitempty"`
+}
+
+// GraphSnapshot captures a graph's rules for comparison with another,
+// perhaps loaded with different configs or from another revision.
+type GraphSnapshot struct {
+	Rules    map[string]*RuleSnapshot // explicit rules, by their space-separated targets
+	Patterns map[string]*RuleSnapshot // pattern rules, by their space-separated target patterns
+}
+
+// Snapshot expands every explicit rule in the graph, and every pattern
+// rule instance their prerequisites resolve to. Recipes are expanded as
+// they would be for a build, except that $changed is empty.
+func (g *Graph) Snapshot() *GraphSnapshot {
+	s := &GraphSnapshot{Rules: map[string]*RuleSnapshot{}, Patterns: map[string]*RuleSnapshot{}}
+	add := func(r *resolvedRule) {
+		key := strings.Join(r.targets, " ")
+		if _, ok := s.Rules[key]; ok {
+			return // only the first rule for a target is used
+		}
+		s.Rules[key] = &RuleSnapshot{
+			Targets:   r.targets,
+			Prereqs:   r.prereqs,
+			OrderOnly: r.orderOnlyPrereqs,
+			Recipe:    g.expandRecipeLines(r),
+			IsTask:    r.isTask,
+		}
+	}
+	seen := map[string]bool{}
+	var derive func(prereqs []string, depth int)
+	derive = func(prereqs []string, depth int) {
+		for _, p := range prereqs {
+			if seen[p] || depth > maxImplicitChain {
+				continue
+			}
+			seen[p] = true
+			if r, err := g.resolve(p); err == nil && r.pattern != "" {
+				add(r)
+				derive(r.prereqs, depth+1)
+				derive(r.orderOnlyPrereqs, depth+1)
+			}
+		}
+	}
+	for i := range g.rules {
+		add(&g.rules[i])
+	}
+	for _, r := range g.rules {
+		derive(r.prereqs, 1)
+		derive(r.orderOnlyPrereqs, 1)
+	}
+	for _, pr := range g.patterns {
+		rs := &RuleSnapshot{Recipe: pr.recipe}
+		for _, p := range pr.targetPatterns {
+			rs.Targets = append(rs.Targets, p.Raw)
+		}
+		for _, p := range pr.prereqPatterns {
+			rs.Prereqs = append(rs.Prereqs, p.Raw)
+		}
+		for _, p := range pr.orderOnlyPrereqPatterns {
+			rs.OrderOnly = append(rs.OrderOnly, p.Raw)
+		}
+		key := strings.Join(rs.Targets, " ")
+		if prev, ok := s.Patterns[key]; ok {
+			// Matching pattern rules merge their prerequisites.
+			prev.Prereqs = append(prev.Prereqs, rs.Prereqs...)
+			prev.OrderOnly = append(prev.OrderOnly, rs.OrderOnly...)
+			if len(rs.Recipe) > 0 {
+				prev.Recipe = rs.Recipe
+			}
+			continue
+		}
+		s.Patterns[key] = rs
+	}
+	return s
+}
+
+// expandRecipeLines expands a rule's recipe as the executor would, but
+// without build state, so $changed is empty.
+func (g *Graph) expandRecipeLines(rule *resolvedRule) []string {
+	vars := rule.varsFor(g.vars).Clone()
+	vars.Set(launcherVar, "") // a launcher doesn't change what a rule does
+	setAutoVars(vars, rule, g.dir, rule.workdir(g.vars))
+	vars.Set("changed", "")
+	vars.Set("inputs.new", "")
+	var lines []string
+	for _, line := range rule.recipe {
+		l := line
+		prefix := ""
+		for len(l) > 0 && (l[0] == '@' || l[0] == '-') {
+			prefix += l[:1]
+			l = l[1:]
+		}
+		lines = append(lines, prefix+vars.Expand(l))
+	}
+	return lines
+}
+
+// ChangeKind classifies a GraphChange.
+type ChangeKind int
+
+const (
+	RuleAdded ChangeKind = iota
+	RuleRemoved
+	RuleChanged
+)
+
+// GraphChange is a difference between two graph snapshots.
+type GraphChange struct {
+	Kind    ChangeKind
+	Pattern bool     // a pattern rule rather than an explicit one
+	Targets string   // space-separated targets or target patterns
+	Details []string // for RuleChanged, what changed, one item per line
+}
+
+func (c GraphChange) String() string {
+	var b strings.Builder
+	b.WriteString([]string{"+", "-", "~"}[c.Kind])
+	if c.Pattern {
+		b.WriteString(" pattern")
+	}
+	b.WriteString(" " + c.Targets)
+	for _, d := range c.Details {
+		b.WriteString("\n    " + d)
+	}
+	return b.String()
+}
+
+// DiffGraphs lists the rules added, removed and changed between old and
+// new, explicit rules first, each group sorted by target.
+func DiffGraphs(old, new *GraphSnapshot) []GraphChange {
+	changes := diffRules(old.Rules, new.Rules, false)
+	return append(changes, diffRules(old.Patterns, new.Patterns, true)...)
+}
+
+func diffRules(old, new map[string]*RuleSnapshot, pattern bool) []GraphChange {
+	keys := slices.Sorted(maps.Keys(old))
+	for k := range new {
+		if _, ok := old[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	var changes []GraphChange
+	for _, k := range keys {
+		o, n := old[k], new[k]
+		switch {
+		case o == nil:
+			changes = append(changes, GraphChange{Kind: RuleAdded, Pattern: pattern, Targets: k})
+		case n == nil:
+			changes = append(changes, GraphChange{Kind: RuleRemoved, Pattern: pattern, Targets: k})
+		default:
+			var details []string
+			if d := diffWords(o.Prereqs, n.Prereqs); d != "" {
+				details = append(details, "prereqs: "+d)
+			}
+			if d := diffWords(o.OrderOnly, n.OrderOnly); d != "" {
+				details = append(details, "order-only: "+d)
+			}
+			if o.IsTask != n.IsTask {
+				details = append(details, fmt.Sprintf("task: %v -> %v", o.IsTask, n.IsTask))
+			}
+			if !slices.Equal(o.Recipe, n.Recipe) {
+				details = append(details, "recipe:")
+				for _, l := range o.Recipe {
+					details = append(details, "  - "+l)
+				}
+				for _, l := range n.Recipe {
+					details = append(details, "  + "+l)
+				}
+			}
+			if len(details) > 0 {
+				changes = append(changes, GraphChange{Kind: RuleChanged, Pattern: pattern, Targets: k, Details: details})
+			}
+		}
+	}
+	return changes
+}
+
+// diffWords describes the words added to and removed from a list, or
+// returns "" if only their order changed.
+func diffWords(old, new []string) string {
+	var parts []string
+	for _, w := range new {
+		if !slices.Contains(old, w) {
+			parts = append(parts, "+"+w)
+		}
+	}
+	for _, w := range old {
+		if !slices.Contains(new, w) {
+			parts = append(parts, "-"+w)
+		}
+	}
+	if len(parts) == 0 && !slices.Equal(old, new) {
+		return "reordered"
+	}
+	return strings.Join(parts, " ")
+}
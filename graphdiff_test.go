@@ -0,0 +1,61 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"io"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestDiffGraphs(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+cflags = -O2
+objs = main.o
+
+config debug:
+    cflags = -g
+    objs = main.o debug.o
+
+app: $objs
+    cc -o $target $inputs
+
+{name}.o: {name}.c
+    cc $cflags -c $input
+
+!test: app
+    ./app
+`), 0o644)
+
+	load := func(configs ...string) *GraphSnapshot {
+		p, err := Load(context.Background(), "mkfile", Options{Configs: configs, Stderr: io.Discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Graph().Snapshot()
+	}
+	var got []string
+	for _, c := range DiffGraphs(load(), load("debug")) {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"~ app\n    prereqs: +debug.o\n    recipe:\n      - cc -o app main.o\n      + cc -o app main.o debug.o",
+		"+ debug.o",
+		"~ main.o\n    recipe:\n      - cc -O2 -c main.c\n      + cc -g -c main.c",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("DiffGraphs:\n%q\nwant:\n%q", got, want)
+	}
+
+	if d := DiffGraphs(load("debug"), load("debug")); len(d) != 0 {
+		t.Errorf("identical graphs differ: %v", d)
+	}
+}
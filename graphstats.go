@@ -0,0 +1,181 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// graphStatsTop is how many entries GraphStats keeps in its ranked
+// lists.
+const graphStatsTop = 10
+
+// GraphStats describes the shape of the graph under some targets, for
+// finding what makes a large build slow to plan or hard to parallelize.
+type GraphStats struct {
+	Targets int // file targets with recipes
+	Tasks   int
+	Sources int // files with no recipe: the leaves
+	Edges   int // prerequisite edges, order-only ones included
+	Orders  int // order-only edges
+
+	// Depth is the longest chain of prerequisites, in edges: the fewest
+	// recipes that must run one after another in a full build.
+	Depth int
+
+	// A node's level is the length of the longest chain of
+	// prerequisites below it, so sources are at level 0 and everything
+	// at one level can be built in parallel once the levels below are.
+	// WidestLevel is the level with the most nodes, Width of them.
+	WidestLevel, Width int
+
+	// MostDependedOn lists the nodes with the most direct dependents,
+	// most first, and Patterns the pattern rules by how many nodes they
+	// build; each is cut to the top ten.
+	MostDependedOn []GraphCount
+	Patterns       []GraphCount
+}
+
+// A GraphCount is a node or pattern rule and how often it occurs.
+type GraphCount struct {
+	Name  string
+	Count int
+}
+
+// Stats returns statistics for the graph under targets.
+func (g *Graph) Stats(targets []string) (*GraphStats, error) {
+	rules := map[string]*resolvedRule{}
+	var order []string
+	queue := slices.Clone(targets)
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		if rules[t] != nil {
+			continue
+		}
+		rule, err := g.resolve(t)
+		if err != nil {
+			return nil, err
+		}
+		rules[t] = rule
+		order = append(order, t)
+		for _, p := range slices.Concat(rule.prereqs, rule.orderOnlyPrereqs) {
+			if _, ok := rule.configs[p]; ok {
+				// Built under another config's graph: counted as a leaf.
+				if rules[p] == nil {
+					rules[p] = &resolvedRule{target: p, targets: []string{p}}
+					order = append(order, p)
+				}
+				continue
+			}
+			queue = append(queue, p)
+		}
+	}
+
+	s := &GraphStats{}
+	dependents := map[string]int{}
+	patterns := map[string]int{}
+	for _, t := range order {
+		rule := rules[t]
+		switch {
+		case rule.isTask:
+			s.Tasks++
+		case len(rule.recipe) > 0:
+			s.Targets++
+		default:
+			s.Sources++
+		}
+		s.Edges += len(rule.prereqs) + len(rule.orderOnlyPrereqs)
+		s.Orders += len(rule.orderOnlyPrereqs)
+		for _, p := range slices.Concat(rule.prereqs, rule.orderOnlyPrereqs) {
+			dependents[p]++
+		}
+		if rule.pattern != "" {
+			patterns[fmt.Sprintf("%s (%s)", rule.pattern, rule.pos)]++
+		}
+	}
+
+	// Levels, by depth-first search; an edge that closes a cycle is
+	// ignored.
+	levels := map[string]int{}
+	visiting := map[string]bool{}
+	var level func(t string) int
+	level = func(t string) int {
+		if l, ok := levels[t]; ok {
+			return l
+		}
+		if visiting[t] {
+			return -1
+		}
+		visiting[t] = true
+		l := 0
+		rule := rules[t]
+		for _, p := range slices.Concat(rule.prereqs, rule.orderOnlyPrereqs) {
+			if rules[p] != nil {
+				l = max(l, level(p)+1)
+			}
+		}
+		visiting[t] = false
+		levels[t] = l
+		return l
+	}
+	width := map[int]int{}
+	for _, t := range order {
+		l := level(t)
+		width[l]++
+		s.Depth = max(s.Depth, l)
+	}
+	for l := 0; l <= s.Depth; l++ {
+		if width[l] > s.Width {
+			s.WidestLevel, s.Width = l, width[l]
+		}
+	}
+
+	s.MostDependedOn = topCounts(dependents)
+	s.Patterns = topCounts(patterns)
+	return s, nil
+}
+
+// topCounts returns the graphStatsTop largest counts, largest first and
+// then by name.
+func topCounts(counts map[string]int) []GraphCount {
+	var top []GraphCount
+	for name, n := range counts {
+		top = append(top, GraphCount{name, n})
+	}
+	slices.SortFunc(top, func(a, b GraphCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Name, b.Name))
+	})
+	if len(top) > graphStatsTop {
+		top = top[:graphStatsTop]
+	}
+	return top
+}
+
+// Print writes the statistics to w as a report.
+func (s *GraphStats) Print(w io.Writer) {
+	fmt.Fprintf(w, "nodes: %d (targets %d, tasks %d, sources %d)\n", s.Targets+s.Tasks+s.Sources, s.Targets, s.Tasks, s.Sources)
+	fmt.Fprintf(w, "edges: %d (order-only %d)\n", s.Edges, s.Orders)
+	fmt.Fprintf(w, "depth: %d\n", s.Depth)
+	fmt.Fprintf(w, "widest level: %d, with %d nodes (level 0 has no prerequisites)\n", s.WidestLevel, s.Width)
+	for _, list := range []struct {
+		title  string
+		counts []GraphCount
+	}{
+		{"most depended on (direct dependents)", s.MostDependedOn},
+		{"pattern rules (targets matched)", s.Patterns},
+	} {
+		if len(list.counts) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s:\n", list.title)
+		width := len(fmt.Sprint(list.counts[0].Count))
+		for _, c := range list.counts {
+			fmt.Fprintf(w, "  %*d  %s\n", width, c.Count, c.Name)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import "strings"
+
+// ruleIndex narrows the rules resolve has to try for a target: explicit
+// rules by target, and target patterns by the extension their last
+// literal part fixes, so a target only meets the patterns that could
+// match it. Patterns that fix no extension, such as {name} or
+// {name}.{ext}, are candidates for every target.
+type ruleIndex struct {
+	rules, patterns int // len(g.rules) and len(g.patterns) when built
+
+	explicit map[string]int          // target → index of its first rule in g.rules
+	byExt    map[string][]patternRef // extension → candidates, in rule order
+	other    []patternRef            // candidates for targets with another extension
+}
+
+// patternRef is a target pattern: g.patterns[rule].targetPatterns[target].
+type patternRef struct {
+	rule, target int
+}
+
+// ruleIndex returns the index of g's rules, building it if rules have
+// been added since it was last built.
+func (g *Graph) ruleIndex() *ruleIndex {
+	g.indexMu.Lock()
+	defer g.indexMu.Unlock()
+	if ix := g.index; ix != nil && ix.rules == len(g.rules) && ix.patterns == len(g.patterns) {
+		return ix
+	}
+	ix := &ruleIndex{
+		rules:    len(g.rules),
+		patterns: len(g.patterns),
+		explicit: make(map[string]int),
+		byExt:    make(map[string][]patternRef),
+	}
+	for i, r := range g.rules {
+		for _, t := range r.targets {
+			if _, ok := ix.explicit[t]; !ok {
+				ix.explicit[t] = i
+			}
+		}
+	}
+	for _, pr := range g.patterns {
+		for _, tp := range pr.targetPatterns {
+			if ext := patternExt(tp); ext != "" {
+				ix.byExt[ext] = nil
+			}
+		}
+	}
+	for i, pr := range g.patterns {
+		for j, tp := range pr.targetPatterns {
+			ref := patternRef{i, j}
+			if ext := patternExt(tp); ext != "" {
+				ix.byExt[ext] = append(ix.byExt[ext], ref)
+				continue
+			}
+			ix.other = append(ix.other, ref)
+			for ext := range ix.byExt {
+				ix.byExt[ext] = append(ix.byExt[ext], ref)
+			}
+		}
+	}
+	g.index = ix
+	return ix
+}
+
+// candidates returns the target patterns that might match target, in
+// the order resolve must try them.
+func (ix *ruleIndex) candidates(target string) []patternRef {
+	if refs, ok := ix.byExt[extKey(target)]; ok {
+		return refs
+	}
+	return ix.other
+}
+
+// patternExt returns the extension every match of p ends with, or "" if
+// its last literal part doesn't fix one. A match ends with that part, so
+// its last dot, if the part has one, is the part's.
+func patternExt(p Pattern) string {
+	if !p.IsPattern() {
+		return extKey(p.Raw) // a plain target in a pattern rule
+	}
+	return extKey(p.Parts[len(p.Parts)-1])
+}
+
+// extKey returns the suffix of s from its last dot, or "" if there is no
+// dot after the last slash.
+func extKey(s string) string {
+	i := strings.LastIndexByte(s, '.')
+	if i < 0 || strings.IndexByte(s[i:], '/') >= 0 {
+		return ""
+	}
+	return s[i:]
+}
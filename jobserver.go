@@ -0,0 +1,197 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A jobserver is a pool of recipe slots shared with GNU make, using its
+// jobserver protocol: a pipe holding one byte per slot beyond the one
+// every process has implicitly. A recipe takes a byte before it runs and
+// writes it back when it finishes, so that mk, and makes run by its
+// recipes or running it, never run more recipes between them than the
+// top-level -j.
+//
+// mk joins the jobserver of a make that runs it (see inheritedJobserver),
+// or else, with -j greater than 1, starts its own (see newJobserver), and
+// passes it to recipes as make does to recursive ones: the pipe's ends as
+// file descriptors 3 and 4, named by --jobserver-auth in MAKEFLAGS.
+type jobserver struct {
+	r, w *os.File
+	jobs int // the -j passed on in MAKEFLAGS; 0 if unknown
+
+	free chan struct{} // the implicit slot, taken when full
+
+	mu      sync.Mutex
+	waiting int  // acquire calls waiting for a token
+	reading bool // whether read is running
+	tokens  chan jobToken
+}
+
+// A jobToken is a byte read from the jobserver, or the error reading
+// one.
+type jobToken struct {
+	b   byte
+	err error
+}
+
+func newJobserverFiles(r, w *os.File, jobs int) *jobserver {
+	return &jobserver{r: r, w: w, jobs: jobs, free: make(chan struct{}, 1), tokens: make(chan jobToken)}
+}
+
+// acquire waits for a slot: the implicit one if it is free, else a
+// token from the pipe. The returned function gives the slot back.
+func (js *jobserver) acquire(ctx context.Context) (func(), error) {
+	select {
+	case js.free <- struct{}{}:
+		return js.releaseFree, nil
+	default:
+	}
+
+	// One goroutine reads tokens for all waiters, so that waiting
+	// recipes don't each block a thread in read.
+	js.mu.Lock()
+	js.waiting++
+	if !js.reading {
+		js.reading = true
+		go js.read()
+	}
+	js.mu.Unlock()
+	defer func() {
+		js.mu.Lock()
+		js.waiting--
+		js.mu.Unlock()
+	}()
+
+	select {
+	case js.free <- struct{}{}:
+		return js.releaseFree, nil
+	case t := <-js.tokens:
+		if t.err != nil {
+			return nil, fmt.Errorf("jobserver: %w", t.err)
+		}
+		return func() { js.w.Write([]byte{t.b}) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (js *jobserver) releaseFree() { <-js.free }
+
+// read reads tokens while acquire calls are waiting and hands them over.
+// A token no one takes, because its waiter got the implicit slot or gave
+// up, goes straight back.
+func (js *jobserver) read() {
+	var buf [1]byte
+	for {
+		js.mu.Lock()
+		if js.waiting == 0 {
+			js.reading = false
+			js.mu.Unlock()
+			return
+		}
+		js.mu.Unlock()
+
+		_, err := js.r.Read(buf[:])
+		select {
+		case js.tokens <- jobToken{buf[0], err}:
+		default:
+			if err == nil {
+				js.w.Write(buf[:])
+			}
+		}
+		if err != nil {
+			js.mu.Lock()
+			js.reading = false
+			js.mu.Unlock()
+			return
+		}
+	}
+}
+
+// files returns the files recipes inherit as descriptors 3 and 4.
+func (js *jobserver) files() []*os.File {
+	if js == nil {
+		return nil
+	}
+	return []*os.File{js.r, js.w}
+}
+
+// close closes a jobserver mk started.
+func (js *jobserver) close() {
+	js.r.Close()
+	js.w.Close()
+}
+
+// makeflags returns MAKEFLAGS for recipes: flags with any -j and
+// jobserver options replaced by the jobserver's, which name descriptors
+// 3 and 4. Variable definitions after -- are kept as they are.
+func (js *jobserver) makeflags(flags string) string {
+	opts, vars, hasVars := strings.Cut(flags, " -- ")
+	var words []string
+	for i, w := range strings.Fields(opts) {
+		if i == 0 && !strings.HasPrefix(w, "-") {
+			// Single-letter flags, such as s for make -s.
+			words = append(words, w)
+			continue
+		}
+		if strings.HasPrefix(w, "-j") || strings.HasPrefix(w, "--jobserver-") {
+			continue
+		}
+		words = append(words, w)
+	}
+	j := "-j"
+	if js.jobs > 0 {
+		j += strconv.Itoa(js.jobs)
+	}
+	s := strings.Join(words, " ") + " " + j + " --jobserver-auth=3,4"
+	if len(words) > 0 && strings.HasPrefix(words[0], "-") {
+		// A leading space says there are no single-letter flags.
+		s = " " + s
+	}
+	if hasVars {
+		s += " -- " + vars
+	}
+	return s
+}
+
+// parseMakeflags returns the jobserver a MAKEFLAGS value names, as
+// fifo:PATH or R,W descriptors, and its -j, or "" if there is none.
+// The last option wins, as for make.
+func parseMakeflags(flags string) (auth string, jobs int) {
+	opts, _, _ := strings.Cut(flags, " -- ")
+	for _, w := range strings.Fields(opts) {
+		if v, ok := strings.CutPrefix(w, "--jobserver-auth="); ok {
+			auth = v
+		} else if v, ok := strings.CutPrefix(w, "--jobserver-fds="); ok {
+			auth = v
+		} else if v, ok := strings.CutPrefix(w, "-j"); ok && !strings.HasPrefix(w, "--") {
+			jobs, _ = strconv.Atoi(v)
+		}
+	}
+	return auth, jobs
+}
+
+// inheritedJobserver returns the jobserver of the make running mk, from
+// MAKEFLAGS, or nil if there is none or mk can't use it: make passes the
+// pipe only to recipes it knows run make, those using $(MAKE) or marked
+// with +. mk joins it once per process, holding the one implicit slot
+// make gave it for every build.
+var inheritedJobserver = sync.OnceValue(func() *jobserver {
+	auth, jobs := parseMakeflags(os.Getenv("MAKEFLAGS"))
+	if auth == "" {
+		return nil
+	}
+	js, err := openJobserver(auth, jobs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mk: warning: ignoring make's jobserver: %v\n", err)
+	}
+	return js
+})
@@ -0,0 +1,20 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !unix
+
+package mk
+
+import "errors"
+
+// errNoJobserver is returned where GNU make shares its jobserver through
+// a semaphore, which mk doesn't support, rather than a pipe.
+var errNoJobserver = errors.New("not supported on this platform")
+
+// newJobserver returns nil: recipes can't inherit the pipe's
+// descriptors.
+func newJobserver(jobs int) (*jobserver, error) { return nil, nil }
+
+func openJobserver(auth string, jobs int) (*jobserver, error) {
+	return nil, errNoJobserver
+}
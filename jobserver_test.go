@@ -0,0 +1,135 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobserverMakeflags(t *testing.T) {
+	js := &jobserver{jobs: 4}
+	for _, tt := range []struct{ in, want string }{
+		{"", " -j4 --jobserver-auth=3,4"},
+		{"s -j8 --jobserver-auth=fifo:/tmp/GMfifo1", "s -j4 --jobserver-auth=3,4"},
+		{" -k --jobserver-fds=5,6 -- CC=gcc -j", " -k -j4 --jobserver-auth=3,4 -- CC=gcc -j"},
+	} {
+		if got := js.makeflags(tt.in); got != tt.want {
+			t.Errorf("makeflags(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		in   string
+		auth string
+		jobs int
+	}{
+		{"", "", 0},
+		{"s -j4 --jobserver-auth=3,4 -- X=--jobserver-auth=9,9", "3,4", 4},
+		{" -j --jobserver-auth=fifo:/tmp/GMfifo1", "fifo:/tmp/GMfifo1", 0},
+		{" -j2 --jobserver-fds=3,4", "3,4", 2},
+	} {
+		if auth, jobs := parseMakeflags(tt.in); auth != tt.auth || jobs != tt.jobs {
+			t.Errorf("parseMakeflags(%q) = %q, %d, want %q, %d", tt.in, auth, jobs, tt.auth, tt.jobs)
+		}
+	}
+}
+
+func TestJobserverSlots(t *testing.T) {
+	js, err := newJobserver(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if js == nil {
+		t.Skip("no jobserver on this platform")
+	}
+	defer js.close()
+	acquire := func(timeout time.Duration) (func(), error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return js.acquire(ctx)
+	}
+
+	var releases []func()
+	for i := range 3 {
+		release, err := acquire(time.Second)
+		if err != nil {
+			t.Fatalf("slot %d: %v", i+1, err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := acquire(50 * time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("fourth slot of three: err = %v, want a timeout", err)
+	}
+	releases[1]()
+	if _, err := acquire(time.Second); err != nil {
+		t.Errorf("slot after a release: %v", err)
+	}
+}
+
+func TestJobserverMake(t *testing.T) {
+	out, err := exec.Command("make", "--version").Output()
+	if err != nil {
+		t.Skip("make not installed")
+	}
+	m := regexp.MustCompile(`GNU Make (\d+)\.(\d+)`).FindSubmatch(out)
+	if m == nil {
+		t.Skip("make isn't GNU make")
+	}
+	major, _ := strconv.Atoi(string(m[1]))
+	minor, _ := strconv.Atoi(string(m[2]))
+	if major < 4 || major == 4 && minor < 2 {
+		t.Skipf("GNU make %s.%s predates --jobserver-auth", m[1], m[2])
+	}
+
+	// Each job logs + when it starts and - when it ends. With two slots
+	// between them, mk's recipe and the four jobs of the make it runs
+	// never overlap more than two at a time.
+	dir := t.TempDir()
+	job := "echo + >> log; sleep 0.3; echo - >> log"
+	os.WriteFile(filepath.Join(dir, "Makefile"), []byte("all: a b c d\na b c d:\n\t@"+job+"\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+!all: make sleep
+
+!make:
+    make -s
+
+!sleep:
+    `+strings.ReplaceAll(job, "0.3", "0.6")+`
+`), 0o644)
+	var stderr bytes.Buffer
+	p, err := Load(context.Background(), "mkfile", Options{Dir: dir, Jobs: 2, LocalState: true, Stdout: io.Discard, Stderr: &stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Build(context.Background(), "all"); err != nil {
+		t.Fatalf("%v\n%s", err, stderr.String())
+	}
+	if strings.Contains(stderr.String(), "jobserver") {
+		t.Errorf("make complained about the jobserver:\n%s", stderr.String())
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "log"))
+	running, most := 0, 0
+	for _, line := range strings.Fields(string(data)) {
+		if line == "+" {
+			running++
+		} else {
+			running--
+		}
+		most = max(most, running)
+	}
+	if most != 2 {
+		t.Errorf("at most %d jobs ran at once, want 2:\n%s", most, data)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build unix
+
+package mk
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// newJobserver starts a jobserver with jobs slots: a pipe holding a
+// token for each beyond mk's own.
+func newJobserver(jobs int) (*jobserver, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write([]byte(strings.Repeat("+", jobs-1))); err != nil {
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+	return newJobserverFiles(r, w, jobs), nil
+}
+
+// openJobserver joins the jobserver auth names: a named pipe, as
+// fifo:PATH from GNU make 4.4, or a pipe's descriptors, R,W, which mk
+// must have inherited.
+func openJobserver(auth string, jobs int) (*jobserver, error) {
+	if path, ok := strings.CutPrefix(auth, "fifo:"); ok {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		return newJobserverFiles(f, f, jobs), nil
+	}
+	rs, ws, _ := strings.Cut(auth, ",")
+	rfd, rerr := strconv.Atoi(rs)
+	wfd, werr := strconv.Atoi(ws)
+	if rerr != nil || werr != nil {
+		return nil, fmt.Errorf("unrecognized --jobserver-auth=%s", auth)
+	}
+	if rfd < 0 || wfd < 0 {
+		return nil, nil // make's way of saying there is none
+	}
+	for _, fd := range []int{rfd, wfd} {
+		var st syscall.Stat_t
+		if syscall.Fstat(fd, &st) != nil || st.Mode&syscall.S_IFMT != syscall.S_IFIFO {
+			return nil, fmt.Errorf("descriptors %s weren't passed on; mark the make rule running mk with + or use $(MAKE)", auth)
+		}
+	}
+	return newJobserverFiles(os.NewFile(uintptr(rfd), "jobserver-r"), os.NewFile(uintptr(wfd), "jobserver-w"), jobs), nil
+}
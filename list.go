@@ -0,0 +1,59 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteList writes a help screen for the mkfile to w: its tasks, then
+// its explicit file targets, then its configs, each with the
+// description from the comment above its definition. An aggregate task
+// without one is described by what it runs, and the default target is
+// marked. Empty sections are left out.
+func (g *Graph) WriteList(w io.Writer) error {
+	sections := []struct {
+		kind, title string
+	}{
+		{"task", "Tasks"},
+		{"target", "Targets"},
+		{"config", "Configs"},
+	}
+	completions := g.Completions()
+	def := g.DefaultTarget()
+	for _, s := range sections {
+		var names, docs []string
+		width := 0
+		for _, c := range completions {
+			if c.Kind != s.kind {
+				continue
+			}
+			doc := c.Doc
+			if doc == "" && len(c.Runs) > 0 {
+				doc = "runs " + strings.Join(c.Runs, " ")
+			}
+			if c.Kind != "config" && c.Name == def {
+				doc = strings.TrimSpace(doc + " (default)")
+			}
+			names = append(names, c.Name)
+			docs = append(docs, doc)
+			width = max(width, len(c.Name))
+		}
+		if len(names) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s:\n", s.title); err != nil {
+			return err
+		}
+		for i, name := range names {
+			line := fmt.Sprintf("  %-*s  %s", width, name, docs[i])
+			if _, err := fmt.Fprintln(w, strings.TrimRight(line, " ")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ManifestFile is where a build with Options.Manifest writes its
+// manifest.
+var ManifestFile = filepath.Join(stateDir, "manifest.json")
+
+// Manifest lists the file targets a build produced, for packaging and
+// deployment steps to consume.
+type Manifest struct {
+	Artifacts []Artifact `json:"artifacts"` // sorted by path
+}
+
+// Artifact is one file target in a Manifest.
+type Artifact struct {
+	Path       string `json:"path"`
+	Hash       string `json:"sha256"`
+	Size       int64  `json:"size"`
+	Rule       string `json:"rule"`                  // source location of the rule that builds it, "file:line"
+	Status     string `json:"status"`                // "built", "restored" or "up-to-date"
+	DurationMS int64  `json:"duration_ms,omitempty"` // recipe run time, if built
+}
+
+// manifestCollector builds a Manifest from build events.
+type manifestCollector struct {
+	graph     *Graph
+	artifacts map[string]*Artifact
+}
+
+func (c *manifestCollector) observe(ev Event) {
+	var status string
+	switch ev.Kind {
+	case TargetFinished:
+		status = "built"
+	case TargetRestored:
+		status = "restored"
+	case TargetSkipped:
+		status = "up-to-date"
+	default:
+		return
+	}
+	rule, err := c.graph.resolve(ev.Target)
+	if err != nil || rule.isTask {
+		return
+	}
+	if c.artifacts == nil {
+		c.artifacts = make(map[string]*Artifact)
+	}
+	for _, t := range ev.Targets {
+		c.artifacts[t] = &Artifact{Path: t, Rule: rule.pos, Status: status, DurationMS: ev.Duration.Milliseconds()}
+	}
+}
+
+// write hashes the collected artifacts and writes the manifest to path.
+// Targets that no longer exist, such as those a later recipe removed,
+// are left out.
+func (c *manifestCollector) write(path string, cache *HashCache) error {
+	m := Manifest{Artifacts: []Artifact{}}
+	for _, a := range c.artifacts {
+		info, err := os.Stat(cache.dir.path(a.Path))
+		if err != nil {
+			continue
+		}
+		if a.Hash, err = cache.Hash(a.Path); err != nil {
+			return err
+		}
+		a.Size = info.Size()
+		m.Artifacts = append(m.Artifacts, *a)
+	}
+	slices.SortFunc(m.Artifacts, func(a, b Artifact) int { return strings.Compare(a.Path, b.Path) })
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileDurable(path, append(data, '\n'))
+}
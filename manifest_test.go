@@ -0,0 +1,61 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+app.tar: app.bin
+    echo $[artifact app.bin] > $target
+
+app.bin: src.txt
+    cp $input $target
+
+!deploy: app.tar
+    true
+`), 0o644)
+	os.WriteFile("src.txt", []byte("binary"), 0o644)
+
+	build := func() Manifest {
+		t.Helper()
+		mustBuild(t, Options{Manifest: true, LocalState: true, Jobs: 1, Stdout: io.Discard, Stderr: io.Discard}, "deploy")
+		data, err := os.ReadFile(ManifestFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	m := build()
+	if len(m.Artifacts) != 2 || m.Artifacts[0].Path != "app.bin" || m.Artifacts[1].Path != "app.tar" {
+		t.Fatalf("artifacts = %+v, want app.bin and app.tar", m.Artifacts)
+	}
+	bin := m.Artifacts[0]
+	if h, _ := hashFile("app.bin"); bin.Hash != h || bin.Size != 6 || bin.Status != "built" || bin.Rule != "mkfile:5" {
+		t.Errorf("app.bin = %+v, want hash %s, size 6, built by mkfile:5", bin, h)
+	}
+	if data, _ := os.ReadFile("app.tar"); strings.TrimSpace(string(data)) != bin.Hash {
+		t.Errorf("app.tar = %q, want $[artifact app.bin] = %s", data, bin.Hash)
+	}
+
+	if m := build(); len(m.Artifacts) != 2 || m.Artifacts[0].Status != "up-to-date" || m.Artifacts[0].Hash != bin.Hash {
+		t.Errorf("rebuild artifacts = %+v, want both up to date", m.Artifacts)
+	}
+}
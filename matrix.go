@@ -0,0 +1,99 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// splitConfigPrereqs rewrites r's prerequisites written target@config, or
+// target@a+b, as target, noting the configs to build it under. Only
+// defined configs count, so img@2x.png is still a file.
+func (g *Graph) splitConfigPrereqs(r *resolvedRule) {
+	split := func(prereqs []string) []string {
+		cloned := false
+		for i, p := range prereqs {
+			at := strings.LastIndexByte(p, '@')
+			if at <= 0 {
+				continue
+			}
+			configs := p[at+1:]
+			if !g.definesConfigs(configs) {
+				continue
+			}
+			if !cloned {
+				prereqs, cloned = slices.Clone(prereqs), true
+			}
+			if r.configs == nil {
+				r.configs = make(map[string]string)
+			}
+			prereqs[i] = p[:at]
+			r.configs[p[:at]] = configs
+		}
+		return prereqs
+	}
+	r.prereqs = split(r.prereqs)
+	r.orderOnlyPrereqs = split(r.orderOnlyPrereqs)
+}
+
+// definesConfigs reports whether every config in configs (a+b) is
+// defined.
+func (g *Graph) definesConfigs(configs string) bool {
+	for _, name := range strings.Split(configs, "+") {
+		if _, ok := g.configs[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// buildUnder builds target as the graph under configs has it, for a
+// prerequisite written target@configs.
+func (e *Executor) buildUnder(ctx context.Context, target, configs string) error {
+	if e.under == nil {
+		return fmt.Errorf("%s@%s: can't build under another config here", target, configs)
+	}
+	sub, err := e.under(configs)
+	if err != nil {
+		return err
+	}
+	return sub.Build(ctx, target)
+}
+
+// underConfigs returns a function giving exec's counterpart for each
+// config set that prerequisites written target@config name: an executor
+// for the project loaded under those configs, sharing exec's output, job
+// slots, hash cache and action cache. The projects are appended to
+// p.under, for Build to save their state.
+func (p *Project) underConfigs(ctx context.Context, exec *Executor) func(string) (*Executor, error) {
+	var mu sync.Mutex
+	execs := map[string]*Executor{strings.Join(p.opts.Configs, "+"): exec}
+	var under func(configs string) (*Executor, error)
+	under = func(configs string) (*Executor, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if sub, ok := execs[configs]; ok {
+			return sub, nil
+		}
+		opts := p.opts
+		opts.Configs = strings.Split(configs, "+")
+		sp, err := load(ctx, p.ast, opts)
+		if err != nil {
+			return nil, fmt.Errorf("config %s: %w", configs, err)
+		}
+		sp.vars.SetContext(ctx)
+		sub := sp.newExecutor()
+		sub.sem, sub.jobserver, sub.cache, sub.actions = exec.sem, exec.jobserver, exec.cache, exec.actions
+		sub.progress, sub.provenance, sub.audit = exec.progress, exec.provenance, exec.audit
+		sub.under = under
+		execs[configs] = sub
+		p.under = append(p.under, sp)
+		return sub, nil
+	}
+	return under
+}
@@ -0,0 +1,67 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfigPrereqs(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+mode = base
+
+config debug:
+    mode = debug
+
+config release:
+    mode = release
+
+bin-$mode/app: src.txt
+    echo $mode >> log.txt
+    cat $input > $target && echo $mode >> $target
+
+dist/{name}.tar: bin-release/{name}@release
+    cat $input > $target
+
+!dist: bin-debug/app@debug dist/app.tar img@2x.png
+    cat $inputs > dist.txt
+`), 0o644)
+	os.WriteFile("src.txt", []byte("src\n"), 0o644)
+	os.WriteFile("img@2x.png", []byte("png\n"), 0o644)
+
+	build := func() {
+		t.Helper()
+		mustBuild(t, Options{Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "dist")
+	}
+
+	build()
+	if got, _ := os.ReadFile("dist.txt"); string(got) != "src\ndebug\nsrc\nrelease\npng\n" {
+		t.Errorf("dist.txt = %q, want the debug and release builds and the png", got)
+	}
+	for _, f := range []string{StateFile("debug"), StateFile("release")} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("state for a config built as a prerequisite wasn't saved: %v", err)
+		}
+	}
+
+	// Each config's state is kept, so nothing rebuilds.
+	build()
+	if got, _ := os.ReadFile("log.txt"); strings.Count(string(got), "\n") != 2 {
+		t.Errorf("app built %q, want once per config", got)
+	}
+
+	os.WriteFile("src.txt", []byte("src2\n"), 0o644)
+	build()
+	if got, _ := os.ReadFile("dist.txt"); string(got) != "src2\ndebug\nsrc2\nrelease\npng\n" {
+		t.Errorf("after a change, dist.txt = %q", got)
+	}
+}
@@ -4,14 +4,62 @@
 package mk
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// TestMain keeps the shared action cache out of the user's cache directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "mk-test-cache-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if os.Getenv("GOCACHE") == "" {
+		// Go's build cache also defaults to under XDG_CACHE_HOME.
+		if d, err := os.UserCacheDir(); err == nil {
+			os.Setenv("GOCACHE", filepath.Join(d, "go-build"))
+		}
+	}
+	os.Setenv("XDG_CACHE_HOME", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// loadAndBuild loads the mkfile with opts, failing the test if it
+// doesn't load, and builds targets.
+func loadAndBuild(t testing.TB, opts Options, targets ...string) (*Project, error) {
+	t.Helper()
+	p, err := Load(context.Background(), "mkfile", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, p.Build(context.Background(), targets...)
+}
+
+// mustBuild is loadAndBuild, failing the test if the build fails too.
+func mustBuild(t testing.TB, opts Options, targets ...string) *Project {
+	t.Helper()
+	p, err := loadAndBuild(t, opts, targets...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
 func TestParseVariables(t *testing.T) {
 	input := `
 cc = gcc
@@ -387,7 +435,7 @@ build/app: $obj
 	}
 
 	// Verify pattern resolution
-	rule, err := graph.Resolve("build/main.o")
+	rule, err := graph.resolve("build/main.o")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -451,7 +499,7 @@ build/data.db [keep]: schema.sql
 		t.Fatal(err)
 	}
 
-	rule, err := graph.Resolve("build/data.db")
+	rule, err := graph.resolve("build/data.db")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -485,7 +533,7 @@ build/{name}.db [keep]: src/{name}.sql
 		t.Fatal(err)
 	}
 
-	rule, err := graph.Resolve("build/foo.db")
+	rule, err := graph.resolve("build/foo.db")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -522,7 +570,7 @@ out.txt: a.txt b.txt
 
 	// First build: all prereqs are changed (no previous state)
 	exec := NewExecutor(graph, state, vars, false, false, false, 1)
-	if err := exec.Build("out.txt"); err != nil {
+	if err := exec.Build(context.Background(), "out.txt"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -544,7 +592,7 @@ out.txt: a.txt b.txt
 	}
 
 	exec = NewExecutor(graph, state, vars, false, false, false, 1)
-	if err := exec.Build("out.txt"); err != nil {
+	if err := exec.Build(context.Background(), "out.txt"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -599,7 +647,7 @@ gen/{name}.pb.h gen/{name}.pb.cc: proto/{name}.proto
 	}
 
 	// Resolving either target should return the same multi-output rule
-	rule1, err := graph.Resolve("gen/foo.pb.h")
+	rule1, err := graph.resolve("gen/foo.pb.h")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -613,7 +661,7 @@ gen/{name}.pb.h gen/{name}.pb.cc: proto/{name}.proto
 		t.Errorf("second target = %q, want %q", rule1.targets[1], "gen/foo.pb.cc")
 	}
 
-	rule2, err := graph.Resolve("gen/foo.pb.cc")
+	rule2, err := graph.resolve("gen/foo.pb.cc")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -644,7 +692,7 @@ gen/foo.h gen/foo.cc: proto/foo.proto
 	}
 
 	// Both targets should resolve to the same rule
-	rule1, err := graph.Resolve("gen/foo.h")
+	rule1, err := graph.resolve("gen/foo.h")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -652,7 +700,7 @@ gen/foo.h gen/foo.cc: proto/foo.proto
 		t.Fatalf("expected 2 targets, got %d", len(rule1.targets))
 	}
 
-	rule2, err := graph.Resolve("gen/foo.cc")
+	rule2, err := graph.resolve("gen/foo.cc")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -690,7 +738,7 @@ out1.txt out2.txt: input.txt
 	exec := NewExecutor(graph, state, vars, false, false, false, 1)
 
 	// Build first output
-	if err := exec.Build("out1.txt"); err != nil {
+	if err := exec.Build(context.Background(), "out1.txt"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -703,7 +751,7 @@ out1.txt out2.txt: input.txt
 	}
 
 	// Building second output should be a no-op (already built)
-	if err := exec.Build("out2.txt"); err != nil {
+	if err := exec.Build(context.Background(), "out2.txt"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -735,6 +783,17 @@ build/foo.o: src/foo.c | build/
 	}
 }
 
+func TestParseCallPrereqs(t *testing.T) {
+	f, err := Parse(strings.NewReader("!test: lint $[all build/{name}_test] $[wildcard t/[ab].c t/*.h]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"lint", "$[all build/{name}_test]", "$[wildcard t/[ab].c t/*.h]"}
+	if r := f.Stmts[0].(Rule); !slices.Equal(r.Prereqs, want) {
+		t.Errorf("prereqs = %q, want %q", r.Prereqs, want)
+	}
+}
+
 func TestOrderOnlyNoRebuild(t *testing.T) {
 	dir := t.TempDir()
 	oldDir, _ := os.Getwd()
@@ -747,6 +806,7 @@ func TestOrderOnlyNoRebuild(t *testing.T) {
 	mkfile := `
 out.txt: src.txt | order.txt
     cat $input > $target
+    echo ran >> runs.log
 `
 	f, err := Parse(strings.NewReader(mkfile))
 	if err != nil {
@@ -762,14 +822,11 @@ out.txt: src.txt | order.txt
 
 	// First build
 	exec := NewExecutor(graph, state, vars, false, false, false, 1)
-	if err := exec.Build("out.txt"); err != nil {
+	if err := exec.Build(context.Background(), "out.txt"); err != nil {
 		t.Fatal(err)
 	}
 	state.Save("")
 
-	// Overwrite out.txt with a sentinel so we can detect if recipe re-runs
-	os.WriteFile(filepath.Join(dir, "out.txt"), []byte("sentinel"), 0o644)
-
 	// Modify the order-only prereq
 	os.WriteFile(filepath.Join(dir, "order.txt"), []byte("order2-changed"), 0o644)
 
@@ -781,14 +838,14 @@ out.txt: src.txt | order.txt
 	}
 
 	exec = NewExecutor(graph, state, vars, false, false, false, 1)
-	if err := exec.Build("out.txt"); err != nil {
+	if err := exec.Build(context.Background(), "out.txt"); err != nil {
 		t.Fatal(err)
 	}
 
-	// Sentinel should still be there — recipe didn't re-run
-	got, _ := os.ReadFile(filepath.Join(dir, "out.txt"))
-	if string(got) != "sentinel" {
-		t.Errorf("recipe should NOT have re-run, but out.txt = %q", string(got))
+	// The recipe logs each run; it should have run only once.
+	got, _ := os.ReadFile(filepath.Join(dir, "runs.log"))
+	if string(got) != "ran\n" {
+		t.Errorf("recipe should NOT have re-run, but runs.log = %q", string(got))
 	}
 }
 
@@ -819,7 +876,7 @@ out.txt: a.txt | b.txt
 	}
 
 	exec := NewExecutor(graph, state, vars, false, false, false, 1)
-	if err := exec.Build("out.txt"); err != nil {
+	if err := exec.Build(context.Background(), "out.txt"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -862,7 +919,7 @@ build/app: src.c
 	}
 
 	// Rule from root mkfile should work
-	rule, err := graph.Resolve("build/app")
+	rule, err := graph.resolve("build/app")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -909,7 +966,7 @@ include lib/mkfile as lib
 	}
 
 	// Targets should be rebased under lib/
-	rule, err := graph.Resolve("lib/build/libfoo.a")
+	rule, err := graph.resolve("lib/build/libfoo.a")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1029,7 +1086,7 @@ include lib/mkfile as lib
 	}
 
 	// Pattern rule targets should be rebased: lib/build/{name}.o
-	rule, err := graph.Resolve("lib/build/foo.o")
+	rule, err := graph.resolve("lib/build/foo.o")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1106,7 +1163,7 @@ include app/mkfile as app
 	}
 
 	// app/build/app should depend on lib/build/libfoo.a via ../lib/ resolution
-	rule, err := graph.Resolve("app/build/app")
+	rule, err := graph.resolve("app/build/app")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1116,7 +1173,7 @@ include app/mkfile as app
 	}
 
 	// lib/build/libfoo.a should also be resolvable in the same graph
-	libRule, err := graph.Resolve("lib/build/libfoo.a")
+	libRule, err := graph.resolve("lib/build/libfoo.a")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1169,7 +1226,7 @@ include lib/mkfile as lib
 	}
 
 	// Grandchild target should be double-rebased: lib/core/build/core.a
-	rule, err := graph.Resolve("lib/core/build/core.a")
+	rule, err := graph.resolve("lib/core/build/core.a")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1178,7 +1235,7 @@ include lib/mkfile as lib
 	}
 
 	// lib/build/libfoo.a should depend on lib/core/build/core.a
-	libRule, err := graph.Resolve("lib/build/libfoo.a")
+	libRule, err := graph.resolve("lib/build/libfoo.a")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1187,6 +1244,129 @@ include lib/mkfile as lib
 	}
 }
 
+func TestScopedIncludeFuncsAndLazy(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.MkdirAll("lib", 0o755)
+	os.WriteFile("lib/mkfile", []byte(`
+name = lib
+seen = $desc
+fn greet(who):
+    return hello $who from $name
+lazy version = $[shell cat version.txt]
+
+out.txt:
+    echo $[greet world] > $target
+`), 0o644)
+	os.WriteFile("mkfile", []byte(`
+name = top
+lazy desc = $name thing
+include lib/mkfile as lib
+
+!show:
+    echo $[lib.greet you] $lib.version > show.txt
+`), 0o644)
+
+	ctx := context.Background()
+	p, err := Load(ctx, "mkfile", Options{Jobs: 1, Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := p.Vars()
+
+	// Lazy variables are evaluated where they were defined, and a
+	// child's stay lazy until the parent reads them.
+	if got := vars.Get("lib.seen"); got != "top thing" {
+		t.Errorf("lib.seen = %q, want the parent's lazy desc evaluated in its own scope", got)
+	}
+	os.WriteFile("version.txt", []byte("1.2"), 0o644)
+	if got := vars.Get("lib.version"); got != "1.2" {
+		t.Errorf("lib.version = %q, want it evaluated on first use", got)
+	}
+	if got := vars.Get("name"); got != "top" {
+		t.Errorf("name = %q; the child's assignment leaked", got)
+	}
+
+	// The child's functions are exported as lib.fn and see the child's
+	// variables, both from the parent and in the child's own recipes.
+	if got := vars.Expand("$[lib.greet you]"); got != "hello you from lib" {
+		t.Errorf("$[lib.greet you] = %q", got)
+	}
+	if got := vars.Expand("$[greet you]"); got != "" {
+		t.Errorf("$[greet you] = %q; the child's function leaked", got)
+	}
+	if err := p.Build(ctx, "lib/out.txt", "show"); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{
+		"lib/out.txt": "hello world from lib\n",
+		"show.txt":    "hello you from lib 1.2\n",
+	} {
+		if got, _ := os.ReadFile(file); string(got) != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+}
+
+func TestScopeParentAndRootAccess(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.MkdirAll("a/b", 0o755)
+	os.WriteFile("a/b/mkfile", []byte(`
+name = b
+here = $name
+up = $^name
+twoup = $^^name
+root = $::name
+braced = ${^name}
+lazy compiler = $::cc
+`), 0o644)
+	os.WriteFile("a/mkfile", []byte(`
+name = a
+include b/mkfile as b
+`), 0o644)
+	os.WriteFile("mkfile", []byte(`
+name = top
+cc = gcc
+include a/mkfile as a
+cc = clang
+
+fn f(name):
+    return $name/$^name
+`), 0o644)
+
+	p, err := Load(context.Background(), "mkfile", Options{Jobs: 1, Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := p.Vars()
+	for name, want := range map[string]string{
+		"a.b.here":     "b",
+		"a.b.up":       "a",
+		"a.b.twoup":    "top",
+		"a.b.root":     "top",
+		"a.b.braced":   "a",
+		"a.b.compiler": "clang", // read when used, not when included
+	} {
+		if got := vars.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if got := vars.Expand("[$^name]"); got != "[]" {
+		t.Errorf("$^name at top level = %q, want empty", got)
+	}
+	// A function's parameters are a scope of their own.
+	if got := vars.Expand("$[f x]"); got != "x/top" {
+		t.Errorf("$[f x] = %q, want x/top", got)
+	}
+}
+
 func TestNestedPatternDiscovery(t *testing.T) {
 	dir := t.TempDir()
 	oldDir, _ := os.Getwd()
@@ -1245,7 +1425,7 @@ func TestWhyStale(t *testing.T) {
 	state := &BuildState{Targets: make(map[string]*TargetState)}
 
 	// No previous build
-	reasons := state.WhyStale([]string{"foo"}, []string{"bar"}, "recipe", "", NewHashCache())
+	reasons := state.WhyStale(context.Background(), []string{"foo"}, []string{"bar"}, "recipe", "", NewHashCache())
 	if len(reasons) != 1 || reasons[0] != "foo: no previous build recorded" {
 		t.Errorf("WhyStale = %v, want [foo: no previous build recorded]", reasons)
 	}
@@ -1270,6 +1450,28 @@ extracted/config.json [fingerprint: tar xf archive.tar.gz -O config.json]: archi
 	}
 }
 
+func TestParseAnnotationBrackets(t *testing.T) {
+	input := `
+gen.h [fingerprint: cat $[wildcard proto/*.proto]] [cwd: $[dir $outdir]/gen]: gen.py
+    python3 gen.py > $target
+`
+	f, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := f.Stmts[0].(Rule)
+	if r.Fingerprint != "cat $[wildcard proto/*.proto]" {
+		t.Errorf("fingerprint = %q, want %q", r.Fingerprint, "cat $[wildcard proto/*.proto]")
+	}
+	if r.Cwd != "$[dir $outdir]/gen" {
+		t.Errorf("cwd = %q, want %q", r.Cwd, "$[dir $outdir]/gen")
+	}
+	if !slices.Equal(r.Targets, []string{"gen.h"}) {
+		t.Errorf("targets = %q, want [gen.h]", r.Targets)
+	}
+}
+
 func TestParseFingerprintAndKeep(t *testing.T) {
 	input := `
 app.img [keep] [fingerprint: docker inspect myapp]: Dockerfile
@@ -1326,7 +1528,7 @@ extracted/config.json [fingerprint: tar xf archive.tar.gz -O config.json]: archi
 
 	// First build
 	exec := NewExecutor(graph, state, vars, false, false, false, 1)
-	if err := exec.Build("extracted/config.json"); err != nil {
+	if err := exec.Build(context.Background(), "extracted/config.json"); err != nil {
 		t.Fatal(err)
 	}
 	state.Save("")
@@ -1352,7 +1554,7 @@ extracted/config.json [fingerprint: tar xf archive.tar.gz -O config.json]: archi
 	}
 
 	exec = NewExecutor(graph, state, vars, false, false, false, 1)
-	if err := exec.Build("extracted/config.json"); err != nil {
+	if err := exec.Build(context.Background(), "extracted/config.json"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -1373,7 +1575,7 @@ extracted/config.json [fingerprint: tar xf archive.tar.gz -O config.json]: archi
 	}
 
 	exec = NewExecutor(graph, state, vars, false, false, false, 1)
-	if err := exec.Build("extracted/config.json"); err != nil {
+	if err := exec.Build(context.Background(), "extracted/config.json"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -1400,7 +1602,7 @@ extracted/config.json [fingerprint: tar xf archive.tar.gz -O config.json]: archi
 		t.Fatal(err)
 	}
 
-	rule, err := graph.Resolve("extracted/config.json")
+	rule, err := graph.resolve("extracted/config.json")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1439,10 +1641,10 @@ out2.txt: b.txt
 	}
 
 	exec := NewExecutor(graph, state, vars, false, false, false, 2)
-	if err := exec.Build("out1.txt"); err != nil {
+	if err := exec.Build(context.Background(), "out1.txt"); err != nil {
 		t.Fatal(err)
 	}
-	if err := exec.Build("out2.txt"); err != nil {
+	if err := exec.Build(context.Background(), "out2.txt"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -1489,7 +1691,7 @@ right.txt: root.txt
 	}
 
 	exec := NewExecutor(graph, state, vars, false, false, false, 4)
-	if err := exec.Build("top.txt"); err != nil {
+	if err := exec.Build(context.Background(), "top.txt"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -1531,10 +1733,10 @@ out1.txt out2.txt: input.txt
 	exec := NewExecutor(graph, state, vars, false, false, false, 4)
 
 	// Build both outputs — recipe should only run once
-	if err := exec.Build("out1.txt"); err != nil {
+	if err := exec.Build(context.Background(), "out1.txt"); err != nil {
 		t.Fatal(err)
 	}
-	if err := exec.Build("out2.txt"); err != nil {
+	if err := exec.Build(context.Background(), "out2.txt"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -1579,12 +1781,12 @@ top.txt: bad.txt
 	exec := NewExecutor(graph, state, vars, false, false, false, 4)
 
 	// good_out should succeed despite bad existing
-	if err := exec.Build("good_out.txt"); err != nil {
+	if err := exec.Build(context.Background(), "good_out.txt"); err != nil {
 		t.Fatalf("good_out.txt should succeed: %v", err)
 	}
 
 	// top depends on bad, should fail
-	if err := exec.Build("top.txt"); err == nil {
+	if err := exec.Build(context.Background(), "top.txt"); err == nil {
 		t.Fatal("top.txt should fail (depends on bad.txt)")
 	}
 
@@ -1699,7 +1901,7 @@ out.txt: input.txt
 	}
 
 	ex := NewExecutor(graph, state, vars, false, false, false, 1)
-	if err := ex.Build("out.txt"); err != nil {
+	if err := ex.Build(context.Background(), "out.txt"); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -1757,6 +1959,57 @@ func TestHashCacheInvalidation(t *testing.T) {
 	}
 }
 
+func TestHashCacheCoarseMtime(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.txt")
+	mtime := time.Now().Truncate(time.Second)
+
+	// rewrite changes the file without changing its size or mtime and,
+	// as a file system with coarse timestamps might, makes the cached
+	// ctime match too.
+	rewrite := func(cache *HashCache, content string) {
+		os.WriteFile(path, []byte(content), 0o644)
+		os.Chtimes(path, mtime, mtime)
+		info, _ := os.Stat(path)
+		cache.mu.Lock()
+		e := cache.entries[path]
+		e.ino, e.ctime = fileID(info)
+		cache.entries[path] = e
+		cache.mu.Unlock()
+	}
+
+	for _, coarse := range []bool{false, true} {
+		os.WriteFile(path, []byte("content1"), 0o644)
+		os.Chtimes(path, mtime, mtime)
+		cache := NewHashCache()
+		if coarse {
+			cache.SetCoarseMtime(0)
+		}
+		h1, _ := cache.Hash(path)
+		rewrite(cache, "content2")
+		h2, _ := cache.Hash(path)
+		if changed := h1 != h2; changed != coarse {
+			t.Errorf("coarse=%v: change detected = %v, want %v", coarse, changed, coarse)
+		}
+	}
+
+	// Files that were already old when hashed are trusted, unless small.
+	old := mtime.Add(-time.Hour)
+	for _, rehashBelow := range []int64{0, 100} {
+		os.WriteFile(path, []byte("content1"), 0o644)
+		os.Chtimes(path, old, old)
+		cache := NewHashCache()
+		cache.SetCoarseMtime(rehashBelow)
+		h1, _ := cache.Hash(path)
+		mtime = old
+		rewrite(cache, "content2")
+		h2, _ := cache.Hash(path)
+		if changed, want := h1 != h2, rehashBelow > 0; changed != want {
+			t.Errorf("rehashBelow=%d: change detected = %v, want %v", rehashBelow, changed, want)
+		}
+	}
+}
+
 func TestParseConfigDef(t *testing.T) {
 	input := `
 config debug:
@@ -1991,7 +2244,7 @@ $builddir/{name}.o: src/{name}.c
 	if err != nil {
 		t.Fatal(err)
 	}
-	rule, err := graph.Resolve("build/foo.o")
+	rule, err := graph.resolve("build/foo.o")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2005,7 +2258,7 @@ $builddir/{name}.o: src/{name}.c
 	if err != nil {
 		t.Fatal(err)
 	}
-	rule2, err := graph2.Resolve("build-debug/foo.o")
+	rule2, err := graph2.resolve("build-debug/foo.o")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2014,7 +2267,7 @@ $builddir/{name}.o: src/{name}.c
 	}
 
 	// The base path should NOT resolve with debug config
-	_, err = graph2.Resolve("build/foo.o")
+	_, err = graph2.resolve("build/foo.o")
 	if err == nil {
 		t.Error("build/foo.o should NOT resolve with debug config")
 	}
@@ -2044,6 +2297,50 @@ config dist:
 	}
 }
 
+func TestConfigRequiresEdges(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+config dist:
+    requires gen.txt
+
+out.txt: src.txt
+    cp $input $target
+
+gen.txt: tool.txt
+    cp $input $target
+
+tool.txt:
+    echo tool > $target
+
+{name}.o: {name}.c
+    cp $input $target
+`), 0o644)
+	os.WriteFile(filepath.Join(dir, "src.txt"), []byte("src"), 0o644)
+	opts := Options{Dir: dir, Jobs: 4, LocalState: true, Configs: []string{"dist"}, Stdout: io.Discard, Stderr: io.Discard}
+	p, err := Load(context.Background(), "mkfile", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every rule waits for the requirement, except those it needs.
+	for target, want := range map[string]bool{"out.txt": true, "x.o": true, "gen.txt": false, "tool.txt": false} {
+		r, err := p.graph.resolve(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := slices.Contains(r.orderOnlyPrereqs, "gen.txt"); got != want {
+			t.Errorf("%s waits for gen.txt: %v, want %v", target, got, want)
+		}
+	}
+
+	if err := p.Build(context.Background(), "out.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.Stats(); s.Built != 3 {
+		t.Errorf("stats = %+v, want gen.txt, tool.txt and out.txt built", s)
+	}
+}
+
 func TestParseLoop(t *testing.T) {
 	input := `
 configs = debug release
@@ -2134,7 +2431,7 @@ end
 	}
 
 	// Both rules should be resolvable
-	rule1, err := graph.Resolve("build_x86")
+	rule1, err := graph.resolve("build_x86")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2142,7 +2439,7 @@ end
 		t.Errorf("target = %q, want %q", rule1.target, "build_x86")
 	}
 
-	rule2, err := graph.Resolve("build_arm")
+	rule2, err := graph.resolve("build_arm")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2271,7 +2568,7 @@ func TestPatternPrereqMerge(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	rule, err := graph.Resolve("foo.o")
+	rule, err := graph.resolve("foo.o")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2318,7 +2615,7 @@ func TestPatternAmbiguousRecipeError(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = graph.Resolve("foo.o")
+	_, err = graph.resolve("foo.o")
 	if err == nil {
 		t.Fatal("expected error for ambiguous pattern rules")
 	}
@@ -2327,6 +2624,119 @@ func TestPatternAmbiguousRecipeError(t *testing.T) {
 	}
 }
 
+func TestPatternConstraintRouting(t *testing.T) {
+	mkfile := `
+known_configs = debug release
+
+build/{config:$known_configs}/{name!test_*}.o: {name}.c
+    cc -c $input -o $target
+
+build/{config:$known_configs}/{name:test_*}.o: {name}.c
+    cc -DTEST -c $input -o $target
+`
+	f, err := Parse(strings.NewReader(mkfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("foo.c", nil, 0o644)
+	os.WriteFile("test_foo.c", nil, 0o644)
+
+	vars := NewVars()
+	state := &BuildState{Targets: make(map[string]*TargetState)}
+	graph, err := BuildGraph(f, vars, state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for target, want := range map[string]string{
+		"build/debug/foo.o":        "cc -c $input -o $target",
+		"build/release/test_foo.o": "cc -DTEST -c $input -o $target",
+	} {
+		rule, err := graph.resolve(target)
+		if err != nil {
+			t.Errorf("resolve(%s): %v", target, err)
+			continue
+		}
+		if len(rule.recipe) != 1 || rule.recipe[0] != want {
+			t.Errorf("%s recipe = %q, want %q", target, rule.recipe, want)
+		}
+	}
+	if _, err := graph.resolve("build/asan/foo.o"); err == nil {
+		t.Error("build/asan/foo.o resolved; asan isn't a known config")
+	}
+}
+
+func TestResolveIndexKeepsRuleOrder(t *testing.T) {
+	mkfile := `
+out: a
+out: b
+
+lib{name}.a: {name}.list
+    ar rcs $target $input
+
+{any}.{ext}: common.h
+
+{name}.a: {name}.extra
+`
+	f, err := Parse(strings.NewReader(mkfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	state := &BuildState{Targets: make(map[string]*TargetState)}
+	graph, err := BuildGraph(f, NewVars(), state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, want := range map[string][]string{
+		"out":      {"a"},
+		"libfoo.a": {"foo.list", "common.h", "libfoo.extra"},
+		"x.txt":    {"common.h"},
+	} {
+		rule, err := graph.resolve(target)
+		if err != nil {
+			t.Errorf("resolve(%s): %v", target, err)
+			continue
+		}
+		if !slices.Equal(rule.prereqs, want) {
+			t.Errorf("%s prereqs = %q, want %q", target, rule.prereqs, want)
+		}
+	}
+}
+
+func BenchmarkResolve(b *testing.B) {
+	var mkfile strings.Builder
+	for i := range 50 {
+		fmt.Fprintf(&mkfile, "build/{name}.%d.o: src/{name}.%d.c\n    cc -c $input -o $target\n\n", i, i)
+	}
+	f, err := Parse(strings.NewReader(mkfile.String()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	state := &BuildState{Targets: make(map[string]*TargetState)}
+	graph, err := BuildGraph(f, NewVars(), state, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := range b.N {
+		target := fmt.Sprintf("build/module_%d.%d.o", i%2000, i%50)
+		if _, err := graph.resolve(target); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestPatternMergeOrderOnly(t *testing.T) {
 	dir := t.TempDir()
 	oldDir, _ := os.Getwd()
@@ -2353,7 +2763,7 @@ func TestPatternMergeOrderOnly(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	rule, err := graph.Resolve("foo.o")
+	rule, err := graph.resolve("foo.o")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2423,7 +2833,7 @@ app: hello.o
 	}
 
 	// Pattern rule from std/c.mk should resolve hello.o
-	rule, err := graph.Resolve("hello.o")
+	rule, err := graph.resolve("hello.o")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2476,7 +2886,7 @@ func TestStdlibGoInclude(t *testing.T) {
 	}
 
 	// !build task should exist
-	rule, err := graph.Resolve("build")
+	rule, err := graph.resolve("build")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2485,7 +2895,7 @@ func TestStdlibGoInclude(t *testing.T) {
 	}
 
 	// !test task should exist
-	rule, err = graph.Resolve("test")
+	rule, err = graph.resolve("test")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2494,6 +2904,126 @@ func TestStdlibGoInclude(t *testing.T) {
 	}
 }
 
+func TestStdlibReleaseNextVersion(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	git := func(args ...string) {
+		t.Helper()
+		c := exec.Command("git", args...)
+		c.Env = append(os.Environ(), "GIT_AUTHOR_NAME=mk", "GIT_AUTHOR_EMAIL=mk@example.com",
+			"GIT_COMMITTER_NAME=mk", "GIT_COMMITTER_EMAIL=mk@example.com")
+		if out, err := c.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s: %v", args, out, err)
+		}
+	}
+	git("init", "-q")
+	git("commit", "-q", "--allow-empty", "-m", "initial")
+	git("tag", "v1.2.3")
+
+	mkfile := `
+include std/release.mk
+
+!probe:
+    $release_next_sh
+    echo $$next > next.txt
+`
+	f, err := Parse(strings.NewReader(mkfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		commit string
+		want   string
+	}{
+		{"fix: a bug", "1.2.4"},
+		{"feat(cli): a feature", "1.3.0"},
+		{"refactor!: breaking", "2.0.0"},
+	} {
+		git("commit", "-q", "--allow-empty", "-m", tt.commit)
+
+		vars := NewVars()
+		state := &BuildState{Targets: make(map[string]*TargetState)}
+		graph, err := BuildGraph(f, vars, state, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := NewExecutor(graph, state, vars, false, false, false, 1).Build(context.Background(), "probe"); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile("next.txt")
+		if got := strings.TrimSpace(string(data)); got != tt.want {
+			t.Errorf("after %q: next version = %q, want %q", tt.commit, got, tt.want)
+		}
+	}
+}
+
+func TestStdlibVersion(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	build := func(version string) {
+		t.Helper()
+		f, err := Parse(strings.NewReader(`
+version = ` + version + `
+include std/version.mk
+eval $[version-h include/version.h]
+eval $[version-go internal/buildinfo/version.go]
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vars := NewVars()
+		state := LoadState("")
+		graph, err := BuildGraph(f, vars, state, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := NewExecutor(graph, state, vars, false, false, false, 1)
+		for _, target := range []string{"include/version.h", "internal/buildinfo/version.go"} {
+			if err := e.Build(context.Background(), target); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := state.Save(""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build("1.2.3")
+	if data, _ := os.ReadFile("include/version.h"); string(data) != "#define VERSION \"1.2.3\"\n" {
+		t.Errorf("version.h = %q", data)
+	}
+	data, _ := os.ReadFile("internal/buildinfo/version.go")
+	if !strings.Contains(string(data), "package buildinfo\n") || !strings.Contains(string(data), "const Version = \"1.2.3\"\n") {
+		t.Errorf("version.go = %q", data)
+	}
+
+	// A recipe that writes the same content leaves the file alone.
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes("include/version.h", old, old)
+	state := LoadState("")
+	state.Targets["include/version.h"].RecipeHash = ""
+	state.Save("")
+	build("1.2.3")
+	if info, _ := os.Stat("include/version.h"); !info.ModTime().Equal(old) {
+		t.Errorf("unchanged version.h was rewritten: mtime %v, want %v", info.ModTime(), old)
+	}
+
+	build("1.3.0")
+	if data, _ := os.ReadFile("include/version.h"); string(data) != "#define VERSION \"1.3.0\"\n" {
+		t.Errorf("after a new version, version.h = %q", data)
+	}
+}
+
 func TestStdlibOverride(t *testing.T) {
 	dir := t.TempDir()
 	oldDir, _ := os.Getwd()
@@ -2562,3 +3092,737 @@ func createTarball(t *testing.T, dir, name string, files []string) {
 		t.Fatalf("creating tarball: %s: %v", string(out), err)
 	}
 }
+
+func TestWildcardSortedAndDeduplicated(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("b.c", []byte("bb"), 0o644)
+	os.WriteFile("a.c", []byte("aaa"), 0o644)
+	os.WriteFile("c.c", []byte("c"), 0o644)
+
+	vars := NewVars()
+	if got := vars.Expand("$[wildcard c.c *.c a.c]"); got != "a.c b.c c.c" {
+		t.Errorf("wildcard = %q, want %q", got, "a.c b.c c.c")
+	}
+	if got := vars.Expand("$[wildcard *.c,size]"); got != "c.c b.c a.c" {
+		t.Errorf("wildcard by size = %q, want %q", got, "c.c b.c a.c")
+	}
+}
+
+func TestMatchAndCaptures(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.MkdirAll("src", 0o755)
+	for _, f := range []string{"src/b.c", "src/a.cc", "src/test_x.c", "src/notes.txt"} {
+		os.WriteFile(f, nil, 0o644)
+	}
+	os.WriteFile("mkfile", []byte(`
+files = build/foo.o build/arm/bar.o lib/baz.o build/qux.o
+names = $[match build/{name}.o, $files]
+pairs = $[match build/{arch}/{name}.o, $files]
+stems = $[captures src/{name}.{ext:c,cc}]
+tests = $[captures src/{name:test_*}.c]
+
+for name in $[captures src/{name}.c]:
+    build/${name}.o: src/${name}.c
+        cc -c $input -o $target
+end
+`), 0o644)
+	p, err := Load(context.Background(), "mkfile", Options{Jobs: 1, Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := p.Vars()
+	for name, want := range map[string]string{
+		"names": "foo qux",
+		"pairs": "arm/bar",
+		"stems": "a/cc b/c test_x/c",
+		"tests": "test_x",
+	} {
+		if got := vars.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	for _, target := range []string{"build/b.o", "build/test_x.o"} {
+		if _, err := p.graph.resolve(target); err != nil {
+			t.Errorf("no rule for %s: %v", target, err)
+		}
+	}
+}
+
+func TestTargetsOfAndOutputs(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.MkdirAll("src/net", 0o755)
+	for _, f := range []string{"src/main.c", "src/util.c", "src/net/http.c", "src/notes.txt"} {
+		os.WriteFile(f, []byte("x"), 0o644)
+	}
+	os.WriteFile("mkfile", []byte(`
+objs = $[targets-of src/{name}.c -> build/{name}.o]
+arrow = $[targets-of src/{dir}/{name}.c → out/{name}-{dir}.o]
+unbound = $[targets-of src/{name}.c -> build/{arch}/{name}.o]
+
+build/obj/{name}.o: src/{name}.c
+    cp $input $target
+
+objs2 = $[outputs build/obj/{name}.o]
+app: $objs2
+    cat $inputs > $target
+`), 0o644)
+	p, err := Load(context.Background(), "mkfile", Options{Jobs: 1, Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := p.Vars()
+	for name, want := range map[string]string{
+		"objs":    "build/main.o build/util.o",
+		"arrow":   "out/http-net.o",
+		"unbound": "",
+	} {
+		if got := vars.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if err := p.Build(context.Background(), "app"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile("app"); string(got) != "xx" {
+		t.Errorf("app = %q, want both objects", got)
+	}
+}
+
+func TestParseWarnsOnShellFuncs(t *testing.T) {
+	f, err := Parse(strings.NewReader(`src = $(wildcard *.c)
+# $(shell ignored in comments)
+out: $src
+    cc -o $target $(shell pkg-config --libs foo)
+    echo $(date) $(sort list)
+    filter=$(filter x) # mk:shell
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Warnings) != 2 {
+		t.Fatalf("warnings = %v, want 2", f.Warnings)
+	}
+	if w := f.Warnings[0]; w.Line != 1 || !strings.Contains(w.Msg, "$[wildcard ...]") {
+		t.Errorf("warning 0 = %v", w)
+	}
+	if w := f.Warnings[1]; w.Line != 4 || !strings.Contains(w.Msg, "$[shell ...]") {
+		t.Errorf("warning 1 = %v", w)
+	}
+}
+
+func TestLoopVarScoped(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+arch = host
+archs = x86 arm
+extra_x86 = -m64
+lazy base = $arch
+
+for arch in $archs:
+    lazy flags_$arch = -march=$arch ${extra_$arch}
+    seen_$arch = $base
+
+    out-${arch}.txt:
+        echo $arch ${flags_$arch} $$0 > $target
+end
+
+!all: out-x86.txt out-arm.txt
+`), 0o644)
+
+	p, err := Load(context.Background(), "mkfile", Options{Jobs: 1, Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := p.Vars()
+	if got := vars.Get("arch"); got != "host" {
+		t.Errorf("arch after loop = %q, want %q", got, "host")
+	}
+	if got := vars.Get("flags_x86"); got != "-march=x86 -m64" {
+		t.Errorf("flags_x86 = %q, want %q", got, "-march=x86 -m64")
+	}
+	if got := vars.Get("seen_arm"); got != "arm" {
+		t.Errorf("seen_arm = %q, want %q", got, "arm")
+	}
+	if got := vars.Get("base"); got != "host" {
+		t.Errorf("base = %q, want %q (memoized inside the loop?)", got, "host")
+	}
+
+	if err := p.Build(context.Background(), "all"); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{
+		"out-x86.txt": "x86 -march=x86 -m64 sh\n",
+		"out-arm.txt": "arm -march=arm sh\n",
+	} {
+		if data, _ := os.ReadFile(file); string(data) != want {
+			t.Errorf("%s = %q, want %q", file, data, want)
+		}
+	}
+}
+
+func TestEvalGeneratesRules(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("targets.txt", []byte("alpha\nbeta\n"), 0o644)
+	os.WriteFile("mkfile", []byte(`
+names = $[shell cat targets.txt]
+
+for name in $names:
+    eval ${name}.out:\n    echo $name > $$target
+end
+
+eval $[shell sed 's/.*/&.len: &.out\\n    wc -c < $$input > $$target\\n/' targets.txt | tr -d '\n']
+
+eval bad:\n    if true
+`), 0o644)
+
+	p := mustBuild(t, Options{Jobs: 1, Stderr: io.Discard}, "alpha.len", "beta.out")
+	for file, want := range map[string]string{"alpha.out": "alpha\n", "alpha.len": "6\n", "beta.out": "beta\n"} {
+		if data, _ := os.ReadFile(file); strings.TrimSpace(string(data)) != strings.TrimSpace(want) {
+			t.Errorf("%s = %q, want %q", file, data, want)
+		}
+	}
+	if err := p.Build(context.Background(), "bad"); err == nil || !strings.Contains(err.Error(), "mkfile:10 eval:1: syntax error") {
+		t.Errorf("Build(bad) = %v, want syntax error located at the eval", err)
+	}
+
+	os.WriteFile("mkfile", []byte("gen = eval $$gen\neval $gen\n"), 0o644)
+	if _, err := Load(context.Background(), "mkfile", Options{Stderr: io.Discard}); err == nil || !strings.Contains(err.Error(), "eval nested more than") {
+		t.Errorf("Load(recursive eval) = %v, want nesting error", err)
+	}
+}
+
+func TestStateSuffixes(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	if got := StateSuffixes(); len(got) != 0 {
+		t.Errorf("StateSuffixes() with no state = %q", got)
+	}
+	for _, s := range []string{"release", "", "debug-asan"} {
+		if err := (&BuildState{Targets: map[string]*TargetState{}}).Save(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(stateDir, "audit.jsonl"), nil, 0o644)
+	got := StateSuffixes()
+	want := []string{"", "debug-asan", "release"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("StateSuffixes() = %q, want %q", got, want)
+	}
+}
+
+func TestCachedShell(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	mkfile := `
+version = $[shell? echo >> runs.txt; cat version.txt]
+lazy rev = $[shell? echo >> revs.txt; cat head ;; head]
+
+!show:
+    echo $version $rev > out.txt
+`
+	os.WriteFile("mkfile", []byte(mkfile), 0o644)
+	os.WriteFile("version.txt", []byte("1.0"), 0o644)
+	os.WriteFile("head", []byte("abc"), 0o644)
+
+	build := func() {
+		t.Helper()
+		mustBuild(t, Options{Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "show")
+	}
+	check := func(wantOut string, wantRuns, wantRevs int) {
+		t.Helper()
+		if out, _ := os.ReadFile("out.txt"); strings.TrimSpace(string(out)) != wantOut {
+			t.Errorf("out.txt = %q, want %q", out, wantOut)
+		}
+		runs, _ := os.ReadFile("runs.txt")
+		revs, _ := os.ReadFile("revs.txt")
+		if len(runs) != wantRuns || len(revs) != wantRevs {
+			t.Errorf("commands ran %d and %d times, want %d and %d", len(runs), len(revs), wantRuns, wantRevs)
+		}
+	}
+
+	build()
+	check("1.0 abc", 1, 1)
+
+	// Unchanged commands and inputs reuse the recorded output, even if
+	// undeclared files they read changed.
+	os.WriteFile("version.txt", []byte("2.0"), 0o644)
+	build()
+	check("1.0 abc", 1, 1)
+
+	// A declared input changing reruns the command.
+	os.WriteFile("head", []byte("def"), 0o644)
+	build()
+	check("1.0 def", 1, 2)
+
+	// Results no longer used are dropped from the state.
+	os.WriteFile("mkfile", []byte(strings.Replace(mkfile, "version = $[shell? echo >> runs.txt; cat version.txt]", "version = 3.0", 1)), 0o644)
+	build()
+	check("3.0 def", 1, 2)
+	if s := LoadState(""); len(s.Shell) != 1 {
+		t.Errorf("state keeps %d shell results, want 1: %v", len(s.Shell), s.Shell)
+	}
+}
+
+func TestLateBoundPrereqs(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+lazy parts = $[wildcard parts/*.txt]
+
+all.txt: split $$parts
+    cat $inputs > $target
+
+split: list
+    mkdir -p parts
+    for n in $$(cat list); do echo $$n > parts/$$n.txt; done
+    touch $target
+`), 0o644)
+	build := func(list, want string) {
+		t.Helper()
+		os.WriteFile(filepath.Join(dir, "list"), []byte(list), 0o644)
+		mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "all.txt")
+		data, _ := os.ReadFile(filepath.Join(dir, "all.txt"))
+		if got := string(data); got != want {
+			t.Errorf("all.txt = %q, want %q", got, want)
+		}
+	}
+	// The parts don't exist when the mkfile is evaluated; $$parts is
+	// expanded after split has made them.
+	build("x y\n", "x\ny\n")
+	build("x y z\n", "x\ny\nz\n")
+}
+
+func TestStateCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+b.txt:
+    echo b > $target
+
+c.txt: b.txt
+    cp $input $target
+
+d.txt: c.txt
+    grep -q '"c.txt"' .mk/state.json
+    cp $input $target
+`), 0o644)
+	build := func(target string) {
+		t.Helper()
+		mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, target)
+	}
+	build("b.txt")
+
+	// d.txt's recipe sees c.txt in the state file before the build ends.
+	build("d.txt")
+
+	// The checkpoint didn't replace the state kept from before the build.
+	prev := loadStateFile(workspace(dir), PrevStateFile(""))
+	if prev.Targets["b.txt"] == nil || prev.Targets["c.txt"] != nil {
+		t.Errorf("previous state has %v, want only b.txt", slices.Sorted(maps.Keys(prev.Targets)))
+	}
+}
+
+func TestParseLineEndings(t *testing.T) {
+	const src = "cc = gcc\nsrcs = a.c \\\n    b.c\n\nout: $srcs\n    $cc -o $target \\\n        $inputs\n    echo done\n"
+	want, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlf := strings.ReplaceAll(src, "\n", "\r\n")
+	for name, in := range map[string]string{
+		"crlf":                   crlf,
+		"bom":                    "\ufeff" + src,
+		"bom crlf":               "\ufeff" + crlf,
+		"no final newline":       strings.TrimSuffix(src, "\n"),
+		"crlf, no final newline": strings.TrimSuffix(crlf, "\r\n"),
+		"lone cr at end":         strings.TrimSuffix(crlf, "\n"),
+	} {
+		got, err := Parse(strings.NewReader(in))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got.Stmts, want.Stmts) {
+			t.Errorf("%s: parsed %#v, want %#v", name, got.Stmts, want.Stmts)
+		}
+	}
+
+	// A continuation on the last line continues nothing.
+	f, err := Parse(strings.NewReader("x = a \\"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if va := f.Stmts[0].(VarAssign); va.Value != "a" {
+		t.Errorf("x = %q, want %q", va.Value, "a")
+	}
+}
+
+func TestIgnoreErrorLines(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+out.txt:
+    -false; echo after > after.txt
+    -sh -c 'exit 3'
+    -true
+    echo "mk: warning: ignored exit status 7 of recipe line 9" >&2
+    echo ok > $target
+`), 0o644)
+	var events []Event
+	p := mustBuild(t, Options{
+		Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard,
+		Progress: func(ev Event) { events = append(events, ev) },
+	}, "out.txt")
+	// The whole line runs with errors ignored, not just its last command.
+	if _, err := os.Stat(filepath.Join(dir, "after.txt")); err != nil {
+		t.Error("the rest of an ignored line didn't run")
+	}
+	// What the recipe prints isn't taken for a report.
+	if s := p.Stats(); s.Ignored != 1 || s.Built != 1 {
+		t.Errorf("stats = %+v, want one ignored failure", s)
+	}
+	var warnings []string
+	for _, ev := range events {
+		if ev.Kind == TargetWarning {
+			warnings = append(warnings, ev.Message)
+		}
+	}
+	if want := []string{"ignored exit status 3 of recipe line 2"}; !slices.Equal(warnings, want) {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+}
+
+func TestPrelude(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+prelude:
+    say() { echo "$target: $$1"; }
+
+a.txt:
+    say hello > $target
+
+b.txt:
+    say bye > $target
+`), 0o644)
+	build := func() (string, Stats) {
+		t.Helper()
+		var stderr bytes.Buffer
+		p := mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: &stderr}, "a.txt", "b.txt")
+		return stderr.String(), p.Stats()
+	}
+	stderr, _ := build()
+	for name, want := range map[string]string{"a.txt": "a.txt: hello\n", "b.txt": "b.txt: bye\n"} {
+		if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+	if strings.Contains(stderr, "say()") {
+		t.Errorf("stderr = %q, want the prelude not echoed", stderr)
+	}
+
+	// The prelude is part of every recipe's hash.
+	mkfile, _ := os.ReadFile(filepath.Join(dir, "mkfile"))
+	os.WriteFile(filepath.Join(dir, "mkfile"), bytes.Replace(mkfile, []byte(": $$1"), []byte(" - $$1"), 1), 0o644)
+	if _, s := build(); s.Built != 2 {
+		t.Errorf("build after changing the prelude: %+v, want both rebuilt", s)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "a.txt - hello\n" {
+		t.Errorf("a.txt = %q after changing the prelude", data)
+	}
+
+	if _, err := Parse(strings.NewReader("prelude:\nx = 1\n")); err == nil {
+		t.Error("expected error for an empty prelude")
+	}
+}
+
+func TestWriteFileDurable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	for _, data := range []string{"old", "new"} {
+		if err := writeFileDurable(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := os.ReadFile(path); string(got) != "new" {
+		t.Errorf("file = %q, want %q", got, "new")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o644 {
+		t.Errorf("mode = %v, want 0644", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("%d files in the directory, want no temporary files left", len(entries))
+	}
+}
+
+func TestInputGroups(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+out.txt: a.c b.h c.c | order.txt
+    echo "c=$inputs.c h=$inputs.h o=$inputs.order new=$inputs.new" > $target
+    echo "$inputs.lines" >> $target
+    echo "$target.abs $inputs.abs" >> $target
+
+order.txt:
+    touch $target
+`), 0o644)
+	for _, f := range []string{"a.c", "b.h", "c.c"} {
+		os.WriteFile(filepath.Join(dir, f), nil, 0o644)
+	}
+	build := func() string {
+		t.Helper()
+		mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "out.txt")
+		data, _ := os.ReadFile(filepath.Join(dir, "out.txt"))
+		return string(data)
+	}
+
+	abs, _ := filepath.Abs(dir)
+	want := "c=a.c c.c h=b.h o=order.txt new=a.c b.h c.c\na.c\nb.h\nc.c\n" +
+		filepath.Join(abs, "out.txt") + " " + filepath.Join(abs, "a.c") + " " + filepath.Join(abs, "b.h") + " " + filepath.Join(abs, "c.c") + "\n"
+	if got := build(); got != want {
+		t.Errorf("out.txt = %q, want %q", got, want)
+	}
+
+	os.WriteFile(filepath.Join(dir, "b.h"), []byte("changed"), 0o644)
+	if got, _, _ := strings.Cut(build(), "\n"); got != "c=a.c c.c h=b.h o=order.txt new=b.h" {
+		t.Errorf("first line = %q, want only b.h new", got)
+	}
+}
+
+func TestRecipeFunctionsPerTarget(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+kind = $[if $[filter %.o,$target],object,other]
+
+all: a.o b.txt
+
+{name}.o: {name}.c
+    echo "$[if $[filter %.o,$target],object,other] {name} $kind" > $target
+    echo "$[foreach f,$inputs $stem,<$f>]" >> $target
+    echo '$$[literal]' >> $target
+
+{name}.txt:
+    echo "$[if $[filter %.o,$target],object,other] {name}" > $target
+`), 0o644)
+	os.WriteFile(filepath.Join(dir, "a.c"), nil, 0o644)
+	mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "all")
+	read := func(name string) string {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		return string(data)
+	}
+	// $kind was expanded when the mkfile was, with no $target.
+	if got, want := read("a.o"), "object a other\n<a.c> <a>\n$[literal]\n"; got != want {
+		t.Errorf("a.o = %q, want %q", got, want)
+	}
+	if got, want := read("b.txt"), "other b\n"; got != want {
+		t.Errorf("b.txt = %q, want %q", got, want)
+	}
+}
+
+// TestParallelLazyVars reads lazy variables, in the top-level scope and a
+// scoped include's, from many goroutines at once, as recipes building in
+// parallel do. Run with -race.
+func TestParallelLazyVars(t *testing.T) {
+	top := NewVars()
+	top.SetLazy("a", "$[subst x,y,xx]")
+	lib := top.Scope("lib")
+	lib.Set("name", "lib")
+	lib.SetLazy("b", "$name-$a")
+	top.SetLazy("c", "$lib.b+$a")
+
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := top.Clone()
+			c.Set("target", "t")
+			if got := c.Expand("$c $target"); got != "lib-yy+yy t" {
+				t.Errorf("$c $target = %q", got)
+			}
+			if got := lib.Clone().Get("b"); got != "lib-yy" {
+				t.Errorf("b = %q", got)
+			}
+			if got := top.Snapshot()["c"]; got != "lib-yy+yy" {
+				t.Errorf("snapshot c = %q", got)
+			}
+			lib.Environ()
+		}()
+	}
+	wg.Wait()
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "lib"), 0o755)
+	os.WriteFile(filepath.Join(dir, "lib", "mkfile"), []byte("lazy flags = -O$level\n"), 0o644)
+	var mkfile strings.Builder
+	mkfile.WriteString("level = 2\nlazy stamp = $[shell echo stamped]\ninclude lib/mkfile as lib\n\n")
+	var targets []string
+	for i := range 32 {
+		target := fmt.Sprintf("out%d.txt", i)
+		targets = append(targets, target)
+		fmt.Fprintf(&mkfile, "%s:\n    echo $lib.flags $stamp > $target\n\n", target)
+	}
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile.String()), 0o644)
+	mustBuild(t, Options{Dir: dir, Jobs: 8, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, targets...)
+	for _, target := range targets {
+		if got, _ := os.ReadFile(filepath.Join(dir, target)); string(got) != "-O2 stamped\n" {
+			t.Errorf("%s = %q, want %q", target, got, "-O2 stamped\n")
+		}
+	}
+}
+
+func TestMkFunction(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+early = $[mk gen.txt]
+
+gen.txt:
+    echo gen > $target
+    echo ran >> runs.log
+
+out.txt:
+    cat $[mk gen.txt] > $target
+
+!both: out.txt
+    cat $[mk gen.txt] > /dev/null
+
+bad.txt:
+    false
+
+uses-bad.txt:
+    cat $[mk bad.txt] > $target
+
+!loop:
+    echo $[mk loop]
+`), 0o644)
+	var stderr bytes.Buffer
+	p, err := Load(context.Background(), "mkfile", Options{Dir: dir, Jobs: 2, LocalState: true, Stdout: io.Discard, Stderr: &stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr.String(), "can't build gen.txt while the mkfile is evaluated") {
+		t.Errorf("$[mk] while loading: stderr = %q, want a warning", stderr.String())
+	}
+
+	if err := p.Build(context.Background(), "both"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "out.txt")); string(got) != "gen\n" {
+		t.Errorf("out.txt = %q, want %q", got, "gen\n")
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "runs.log")); string(got) != "ran\n" {
+		t.Errorf("gen.txt built %d times, want once", strings.Count(string(got), "ran"))
+	}
+
+	if err := p.Build(context.Background(), "uses-bad.txt"); err == nil || !strings.Contains(err.Error(), `$[mk]: building "bad.txt" for "uses-bad.txt"`) {
+		t.Errorf("failing $[mk] target: err = %v", err)
+	}
+	if err := p.Build(context.Background(), "loop"); err == nil || !strings.Contains(err.Error(), "dependency cycle: loop -> loop") {
+		t.Errorf("$[mk] of the rule's own target: err = %v, want a cycle", err)
+	}
+}
+
+func TestRecipeCwd(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "web", "src"), 0o755)
+	os.MkdirAll(filepath.Join(dir, "lib"), 0o755)
+	os.WriteFile(filepath.Join(dir, "web", "src", "app.ts"), []byte("app"), 0o644)
+	os.WriteFile(filepath.Join(dir, "lib", "a.c"), []byte("a"), 0o644)
+	os.WriteFile(filepath.Join(dir, "lib", "mkfile"), []byte(`
+out/{name}.o [cwd: .]: {name}.c
+    mkdir -p out
+    cat $input > $target
+    pwd > out/{name}.cwd
+`), 0o644)
+	write := func(cwd string) {
+		os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+include lib/mkfile as lib
+
+web/dist/app.js [cwd: `+cwd+`]: web/src/app.ts
+    mkdir -p dist
+    echo "$target $inputs" > ${target}.args
+    cat $input > $target
+`), 0o644)
+	}
+	build := func(targets ...string) {
+		t.Helper()
+		mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, targets...)
+	}
+
+	write("web")
+	build("web/dist/app.js", "lib/out/a.o")
+	if got, _ := os.ReadFile(filepath.Join(dir, "web", "dist", "app.js.args")); string(got) != "dist/app.js src/app.ts\n" {
+		t.Errorf("names in web/ = %q, want them relative to it", got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "lib", "out", "a.o")); string(got) != "a" {
+		t.Errorf("lib/out/a.o = %q, want the scoped pattern's recipe run in lib/", got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "lib", "out", "a.cwd")); filepath.Base(strings.TrimSpace(string(got))) != "lib" {
+		t.Errorf("scoped recipe ran in %q, want lib", got)
+	}
+
+	// Moving the recipe reruns it.
+	write("web/src")
+	build("web/dist/app.js")
+	if got, _ := os.ReadFile(filepath.Join(dir, "web", "dist", "app.js.args")); string(got) != "../dist/app.js app.ts\n" {
+		t.Errorf("names in web/src = %q, want them relative to it", got)
+	}
+}
+
+func TestAllFunction(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "tests"), 0o755)
+	for _, f := range []string{"tests/a_test.c", "tests/b_test.c", "tests/c_test.h", "tests/skip_test.c"} {
+		os.WriteFile(filepath.Join(dir, f), []byte("x"), 0o644)
+	}
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+# Before the rules, which it sees once the mkfile is read.
+!test: $[all build/{name}_test]
+    echo $inputs > ${target}.log
+
+build/{name!skip}_test: build/{name}_test.o
+    cp $input $target
+
+build/{name}_test.o: tests/{name}_test.c
+    cp $input $target
+
+!nothing: $[all nope/{name}]
+`), 0o644)
+	var stderr bytes.Buffer
+	p, err := Load(context.Background(), "mkfile", Options{Dir: dir, Jobs: 2, LocalState: true, Stdout: io.Discard, Stderr: &stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr.String(), "all: no pattern rule builds nope/{name}") {
+		t.Errorf("stderr = %q, want a warning about nope/{name}", stderr.String())
+	}
+	if err := p.Build(context.Background(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "test.log")); string(got) != "build/a_test build/b_test\n" {
+		t.Errorf("test's inputs = %q, want each test with a source, through build/{name}_test.o, but skip", got)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+// outdirRef matches a use of $outdir in a recipe line.
+var outdirRef = regexp.MustCompile(`\$(outdir\b|\{outdir\})`)
+
+// outdir returns the directory $outdir names for rule: its target's.
+func (r *resolvedRule) outdir() string {
+	return dirName(r.target)
+}
+
+// tracksOutdir reports whether the files rule's recipe writes under
+// $outdir are recorded as further outputs of its targets: it is a file
+// rule whose recipe uses $outdir, and $outdir isn't the workspace root,
+// which holds everything else too.
+func (r *resolvedRule) tracksOutdir() bool {
+	return !r.isTask && r.outdir() != "." && slices.ContainsFunc(r.recipe, outdirRef.MatchString)
+}
+
+// snapshotDir records the files under dir, by their paths in the
+// workspace.
+func (w workspace) snapshotDir(dir string) workspaceSnapshot {
+	snap := make(workspaceSnapshot)
+	root := w.path(dir)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error { //nolint:errcheck // unreadable entries are skipped
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			snap[joinName(dir, rel)] = fileStamp{info.ModTime(), info.Size()}
+		}
+		return nil
+	})
+	return snap
+}
+
+// outdirOutputs returns the files under rule's $outdir that its recipe
+// wrote, given a snapshot taken before it ran, and those recorded from
+// its last build that are still there, sorted. The rule's own targets,
+// and files that are other rules' targets in this build or in the
+// state, aren't included.
+func (e *Executor) outdirOutputs(rule *resolvedRule, before workspaceSnapshot) []string {
+	after := e.dir.snapshotDir(rule.outdir())
+	written := map[string]bool{}
+	for _, p := range before.changed(after) {
+		if _, ok := after[p]; ok {
+			written[p] = true
+		}
+	}
+	if ts := e.state.GetTarget(rule.target); ts != nil {
+		for p := range ts.Extra {
+			if _, ok := after[p]; ok {
+				written[p] = true
+			}
+		}
+	}
+	var outputs []string
+	for p := range written {
+		e.mu.Lock()
+		_, building := e.building[p]
+		e.mu.Unlock()
+		if !building && e.state.GetTarget(p) == nil {
+			outputs = append(outputs, p)
+		}
+	}
+	sort.Strings(outputs)
+	return outputs
+}
@@ -0,0 +1,72 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestOutdirOutputs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755)
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	}
+	write("pages", "a b\n")
+	write("mkfile", `
+docs/index.html: pages
+    for p in $(cat $input); do echo $$p > $outdir/$$p.html; done
+    echo index > $target
+    echo run >> runs.log
+
+docs/style.css:
+    echo css > $target
+`)
+	ctx := context.Background()
+	opts := Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}
+	build := func() {
+		t.Helper()
+		mustBuild(t, opts, "docs/style.css", "docs/index.html")
+	}
+	runs := func() int {
+		data, _ := os.ReadFile(filepath.Join(dir, "runs.log"))
+		return len(data) / len("run\n")
+	}
+
+	build()
+	ts := loadState(workspace(dir), "").GetTarget("docs/index.html")
+	if got, want := slices.Sorted(maps.Keys(ts.Extra)), []string{"docs/a.html", "docs/b.html"}; !slices.Equal(got, want) {
+		t.Fatalf("extra outputs = %v, want %v (not style.css, another rule's target)", got, want)
+	}
+	build()
+	if n := runs(); n != 1 {
+		t.Fatalf("recipe ran %d times, want once", n)
+	}
+
+	// Removing or editing a file the recipe wrote makes it stale.
+	os.Remove(filepath.Join(dir, "docs/a.html"))
+	build()
+	write("docs/b.html", "edited\n")
+	build()
+	if n := runs(); n != 3 {
+		t.Errorf("recipe ran %d times, want 3", n)
+	}
+
+	removed, err := Clean(ctx, "mkfile", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"docs/a.html", "docs/b.html"} {
+		if !slices.Contains(removed, f) {
+			t.Errorf("clean removed %v, want %s among them", removed, f)
+		}
+	}
+}
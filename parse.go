@@ -7,22 +7,31 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"regexp"
 	"strings"
 )
 
 // Parse parses an mkfile from a reader.
 func Parse(r io.Reader) (*File, error) {
-	// Read all lines upfront so we can peek/backtrack.
+	// Read all lines upfront so we can peek/backtrack. The scanner drops
+	// the \r of CRLF line endings and reads a last line without a
+	// newline; a UTF-8 byte order mark is dropped too, so files saved on
+	// Windows parse as they would anywhere else.
 	var rawLines []string
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		rawLines = append(rawLines, scanner.Text())
+		line := scanner.Text()
+		if len(rawLines) == 0 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		rawLines = append(rawLines, line)
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
 
-	// Join line continuations: lines ending with \ are merged with the next.
+	// Join line continuations: lines ending with \ are merged with the
+	// next. A continuation on the last line continues nothing.
 	var lines []string
 	for i := 0; i < len(rawLines); i++ {
 		line := rawLines[i]
@@ -30,15 +39,49 @@ func Parse(r io.Reader) (*File, error) {
 			line = line[:len(line)-1] + rawLines[i+1]
 			i++
 		}
+		if i == len(rawLines)-1 {
+			line = strings.TrimSuffix(line, "\\")
+		}
 		lines = append(lines, line)
 	}
 
+	// Check mk-version before parsing anything else, so an mkfile that
+	// needs a newer mk says so rather than failing on syntax this one
+	// doesn't know.
+	constraint, err := versionDirective(lines)
+	if err != nil {
+		return nil, err
+	}
+
 	p := &parser{lines: lines}
 	stmts, err := p.parseBlock(false)
 	if err != nil {
 		return nil, err
 	}
-	return &File{Stmts: stmts}, nil
+	return &File{Stmts: stmts, Warnings: lintShellFuncs(rawLines), MKVersion: constraint}, nil
+}
+
+// versionDirective finds the mk-version directive among the unindented
+// lines and checks the running mk against it.
+func versionDirective(lines []string) (string, error) {
+	constraint, line := "", 0
+	for i, l := range lines {
+		rest, ok := strings.CutPrefix(l, "mk-version ")
+		if !ok {
+			continue
+		}
+		if line > 0 {
+			return "", fmt.Errorf("line %d: mk-version already given on line %d", i+1, line)
+		}
+		if idx := strings.Index(rest, " #"); idx >= 0 {
+			rest = rest[:idx]
+		}
+		constraint, line = strings.TrimSpace(rest), i+1
+		if err := CheckVersion(constraint); err != nil {
+			return "", fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return constraint, nil
 }
 
 type parser struct {
@@ -98,10 +141,22 @@ func (p *parser) parseBlock(inConditional bool) ([]Node, error) {
 			}
 		}
 
+		start := p.pos
 		node, err := p.parseStatement(trimmed)
 		if err != nil {
 			return nil, err
 		}
+		switch n := node.(type) {
+		case Rule:
+			n.Doc = p.docComment(start)
+			node = n
+		case VarAssign:
+			n.Doc = p.docComment(start)
+			node = n
+		case ConfigDef:
+			n.Doc = p.docComment(start)
+			node = n
+		}
 		if node != nil {
 			stmts = append(stmts, node)
 		}
@@ -109,6 +164,26 @@ func (p *parser) parseBlock(inConditional bool) ([]Node, error) {
 	return stmts, nil
 }
 
+// docComment returns the unindented comment lines directly above line i
+// (counting from 0), without their # and joined with spaces: the
+// documentation of what line i defines. If any of them start with ##,
+// only those do; the others are notes for readers of the mkfile.
+func (p *parser) docComment(i int) string {
+	start := i
+	marked := false
+	for start > 0 && strings.HasPrefix(p.lines[start-1], "#") {
+		start--
+		marked = marked || strings.HasPrefix(p.lines[start], "##")
+	}
+	var words []string
+	for _, line := range p.lines[start:i] {
+		if !marked || strings.HasPrefix(line, "##") {
+			words = append(words, strings.Fields(strings.TrimLeft(line, "#"))...)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
 func (p *parser) parseStatement(trimmed string) (Node, error) {
 	_, lineNum, _ := p.next() // consume the line
 
@@ -118,6 +193,48 @@ func (p *parser) parseStatement(trimmed string) (Node, error) {
 		return n, err
 	}
 
+	// mk-version, checked by Parse before anything else
+	if strings.HasPrefix(trimmed, "mk-version ") {
+		return nil, nil
+	}
+
+	// Eval
+	if rest, ok := strings.CutPrefix(trimmed, "eval "); ok {
+		return Eval{Text: strings.TrimSpace(rest), Line: lineNum}, nil
+	}
+
+	// Plugin
+	if strings.HasPrefix(trimmed, "plugin ") {
+		return parsePlugin(trimmed, lineNum)
+	}
+
+	// Tool; tool = x is an ordinary assignment
+	if rest, ok := strings.CutPrefix(trimmed, "tool "); ok {
+		if name, path, ok := strings.Cut(rest, "="); ok && isToolName(strings.TrimSpace(name)) {
+			path = strings.TrimSpace(path)
+			if path == "" {
+				return nil, fmt.Errorf("line %d: tool requires a path: %s", lineNum, trimmed)
+			}
+			return ToolDef{Name: strings.TrimSpace(name), Path: path, Line: lineNum}, nil
+		}
+	}
+
+	// Remote cache; cache = x and rules with a cache target are not
+	if rest, ok := strings.CutPrefix(trimmed, "cache "); ok {
+		if f := strings.Fields(rest); len(f) == 1 && isCacheURL(f[0]) {
+			return CacheDef{URL: f[0], Line: lineNum}, nil
+		}
+	}
+
+	// Prelude
+	if trimmed == "prelude:" {
+		lines := p.parseRecipe()
+		if len(lines) == 0 {
+			return nil, fmt.Errorf("line %d: prelude has no lines", lineNum)
+		}
+		return Prelude{Lines: lines, Line: lineNum}, nil
+	}
+
 	// Conditional
 	if strings.HasPrefix(trimmed, "if ") {
 		return p.parseConditional(trimmed, lineNum)
@@ -163,18 +280,26 @@ func (p *parser) parseStatement(trimmed string) (Node, error) {
 	}
 
 	// Rule or task
-	if isTask, keep, fingerprint, targets, prereqs, orderOnly, ok := parseRuleHeader(trimmed); ok {
-		recipe := p.parseRecipe()
-		return Rule{
-			Targets:          targets,
-			Prereqs:          prereqs,
-			OrderOnlyPrereqs: orderOnly,
-			Recipe:           recipe,
-			IsTask:           isTask,
-			Keep:             keep,
-			Fingerprint:      fingerprint,
-			Line:             lineNum,
-		}, nil
+	if rule, ok := parseRuleHeader(trimmed); ok {
+		if rule.Service && !rule.IsTask {
+			return nil, fmt.Errorf("line %d: [service] applies only to tasks", lineNum)
+		}
+		if len(rule.Provides) > 0 && rule.IsTask {
+			return nil, fmt.Errorf("line %d: [provides: ...] applies only to file targets", lineNum)
+		}
+		switch {
+		case rule.Check != "" && rule.Check != "mtime" && rule.Check != "hash":
+			return nil, fmt.Errorf("line %d: [check: %s]: want mtime or hash", lineNum, rule.Check)
+		case rule.Check != "" && rule.Fingerprint != "":
+			return nil, fmt.Errorf("line %d: [check: ...] and [fingerprint: ...] are exclusive", lineNum)
+		case rule.Canonical != "" && (rule.IsTask || rule.Fingerprint != ""):
+			return nil, fmt.Errorf("line %d: [canonical: ...] applies only to file targets without [fingerprint: ...]", lineNum)
+		case rule.Depfile != "" && (rule.IsTask || rule.Fingerprint != ""):
+			return nil, fmt.Errorf("line %d: [depfile: ...] applies only to file targets without [fingerprint: ...]", lineNum)
+		}
+		rule.Recipe = p.parseRecipe()
+		rule.Line = lineNum
+		return rule, nil
 	}
 
 	return nil, fmt.Errorf("line %d: unrecognized syntax: %s", lineNum, trimmed)
@@ -419,20 +544,23 @@ func parseAppend(line string) (string, string, bool) {
 	return "", "", false
 }
 
-func parseRuleHeader(line string) (isTask, keep bool, fingerprint string, targets, prereqs, orderOnlyPrereqs []string, ok bool) {
+// parseRuleHeader parses a rule's "targets: prerequisites" line, with its
+// annotations, into a Rule without a recipe.
+func parseRuleHeader(line string) (r Rule, ok bool) {
 	if strings.HasPrefix(line, "!") {
-		isTask = true
+		r.IsTask = true
 		line = line[1:]
 	}
 
 	// Find the rule-separating colon, skipping colons inside [...] brackets
+	// and {...} captures such as {name:test_*}
 	colonIdx := -1
 	depth := 0
 	for i := 0; i < len(line); i++ {
 		switch line[i] {
-		case '[':
+		case '[', '{':
 			depth++
-		case ']':
+		case ']', '}':
 			depth--
 		case ':':
 			if depth == 0 {
@@ -443,43 +571,133 @@ func parseRuleHeader(line string) (isTask, keep bool, fingerprint string, target
 	}
 found:
 	if colonIdx < 0 {
-		return false, false, "", nil, nil, nil, false
+		return Rule{}, false
 	}
 
 	targetStr := strings.TrimSpace(line[:colonIdx])
 	prereqStr := strings.TrimSpace(line[colonIdx+1:])
 
 	if targetStr == "" {
-		return false, false, "", nil, nil, nil, false
+		return Rule{}, false
 	}
 
-	// Extract [fingerprint: ...] annotation
-	if idx := strings.Index(targetStr, "[fingerprint:"); idx >= 0 {
-		end := strings.Index(targetStr[idx:], "]")
-		if end >= 0 {
-			fingerprint = strings.TrimSpace(targetStr[idx+len("[fingerprint:") : idx+end])
-			targetStr = strings.TrimSpace(targetStr[:idx] + targetStr[idx+end+1:])
+	// Extract [name: value] annotations
+	var provides string
+	for _, a := range []struct {
+		name  string
+		value *string
+	}{
+		{"fingerprint", &r.Fingerprint},
+		{"provides", &provides},
+		{"canonical", &r.Canonical},
+		{"depfile", &r.Depfile},
+		{"check", &r.Check},
+		{"shell", &r.Shell},
+		{"cwd", &r.Cwd},
+	} {
+		if rest, value, ok := cutAnnotation(targetStr, a.name); ok {
+			targetStr, *a.value = rest, value
 		}
 	}
+	if provides != "" {
+		r.Provides = strings.Fields(provides)
+	}
 
 	// Check for [keep] annotation
 	if idx := strings.Index(targetStr, "[keep]"); idx >= 0 {
-		keep = true
+		r.Keep = true
 		targetStr = strings.TrimSpace(targetStr[:idx] + targetStr[idx+len("[keep]"):])
 	}
 
-	targets = strings.Fields(targetStr)
+	// Check for [service] annotation
+	if idx := strings.Index(targetStr, "[service]"); idx >= 0 {
+		r.Service = true
+		targetStr = strings.TrimSpace(targetStr[:idx] + targetStr[idx+len("[service]"):])
+	}
+
+	r.Targets = strings.Fields(targetStr)
 
 	// Split prereqs on | for order-only prerequisites
 	normalStr, orderOnlyStr, _ := strings.Cut(prereqStr, "|")
 	if s := strings.TrimSpace(normalStr); s != "" {
-		prereqs = strings.Fields(s)
+		r.Prereqs = callFields(s)
 	}
 	if s := strings.TrimSpace(orderOnlyStr); s != "" {
-		orderOnlyPrereqs = strings.Fields(s)
+		r.OrderOnlyPrereqs = callFields(s)
+	}
+
+	return r, true
+}
+
+// cutAnnotation removes the annotation [name: value] from a rule's
+// targets, s, and returns the rest of s and the trimmed value. Brackets
+// in the value, such as those of a $[...] call, must be balanced; the
+// annotation ends at the one that closes it. ok is false if s has no
+// such annotation or it isn't closed.
+func cutAnnotation(s, name string) (rest, value string, ok bool) {
+	prefix := "[" + name + ":"
+	idx := strings.Index(s, prefix)
+	if idx < 0 {
+		return s, "", false
+	}
+	depth := 0
+	for i := idx; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				return strings.TrimSpace(s[:idx] + s[i+1:]), strings.TrimSpace(s[idx+len(prefix) : i]), true
+			}
+		}
+	}
+	return s, "", false
+}
+
+// callFields splits s into words like strings.Fields, except that a
+// function call, $[name args], is kept whole, so that a prerequisite
+// list can call one directly.
+func callFields(s string) []string {
+	var words []string
+	depth, start := 0, -1
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if depth == 0 && (c == ' ' || c == '\t') {
+			if start >= 0 {
+				words = append(words, s[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		switch {
+		case c == '$' && i+1 < len(s) && s[i+1] == '[':
+			depth++
+			i++
+		case c == '[' && depth > 0:
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		}
+	}
+	if depth > 0 {
+		return strings.Fields(s) // unbalanced: not a call
+	}
+	if start >= 0 {
+		words = append(words, s[start:])
 	}
+	return words
+}
 
-	return isTask, keep, fingerprint, targets, prereqs, orderOnlyPrereqs, true
+// isCacheURL reports whether s, the one word after cache, is a cache
+// declaration's URL rather than part of an assignment or rule header.
+func isCacheURL(s string) bool {
+	if strings.HasSuffix(s, ":") || strings.ContainsAny(s[:1], "=+?:!") {
+		return false
+	}
+	return strings.Contains(s, "://") || strings.HasPrefix(s, "$")
 }
 
 func parseInclude(line string, lineNum int) (Node, error) {
@@ -496,6 +714,17 @@ func parseInclude(line string, lineNum int) (Node, error) {
 	return inc, nil
 }
 
+func parsePlugin(line string, lineNum int) (Node, error) {
+	// plugin fn1 fn2: command
+	names, command, ok := strings.Cut(strings.TrimPrefix(line, "plugin "), ":")
+	funcs := strings.Fields(names)
+	command = strings.TrimSpace(command)
+	if !ok || len(funcs) == 0 || command == "" {
+		return nil, fmt.Errorf("line %d: plugin requires function names and a command: %s", lineNum, line)
+	}
+	return PluginDef{Funcs: funcs, Command: command, Line: lineNum}, nil
+}
+
 func parseCondExpr(line string) (CondBranch, error) {
 	if line == "else" {
 		return CondBranch{Op: "else"}, nil
@@ -520,6 +749,16 @@ func parseCondExpr(line string) (CondBranch, error) {
 	return CondBranch{}, fmt.Errorf("expected comparison (== or !=), got: %s", rest)
 }
 
+// isToolName reports whether name can be a command on PATH: a file name
+// without expansions, and not the operator of tool += x and the like.
+func isToolName(name string) bool {
+	switch name {
+	case "", "+", "?", "!":
+		return false
+	}
+	return !strings.ContainsAny(name, "/$: \t")
+}
+
 func isValidVarName(name string) bool {
 	if name == "" {
 		return false
@@ -568,3 +807,27 @@ func containsVarRef(value, name string) bool {
 	}
 	return false
 }
+
+// makeFuncRe matches $(name ...) where name is a Make function that mk
+// spells $[name ...]. Names that are also common commands (sort, dir,
+// basename, ...) are left out to avoid flagging real command substitution.
+var makeFuncRe = regexp.MustCompile(`\$\((wildcard|shell|patsubst|subst|filter|filter-out|notdir|addprefix|addsuffix|foreach|call|firstword|lastword|words|word|abspath|findstring|eval|origin|info|warning|error)[\s)]`)
+
+// lintShellFuncs warns about $(func ...) uses, which mk passes to the
+// shell verbatim but which were probably meant as $[func ...]. A line
+// containing "# mk:shell" is exempt.
+func lintShellFuncs(lines []string) []Warning {
+	var warnings []Warning
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") || strings.Contains(line, "# mk:shell") {
+			continue
+		}
+		for _, m := range makeFuncRe.FindAllStringSubmatch(line, -1) {
+			warnings = append(warnings, Warning{
+				Line: i + 1,
+				Msg:  fmt.Sprintf("$(%s ...) is shell command substitution; did you mean $[%s ...]? (add \"# mk:shell\" to silence)", m[1], m[1]),
+			})
+		}
+	}
+	return warnings
+}
@@ -5,8 +5,9 @@ package mk
 
 import (
 	"fmt"
-	"path/filepath"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -18,21 +19,33 @@ type Pattern struct {
 	Captures    []string             // capture names
 	Constraints []*CaptureConstraint // parallel to Captures; nil entry = unconstrained
 	Raw         string               // original pattern string
+
+	re    *regexp.Regexp // anchored; captures become groups if exact
+	exact bool           // re alone decides a match: no constraints or repeated captures
 }
 
-// CaptureConstraint restricts what a named capture can match.
+// CaptureConstraint restricts what a named capture can match: any of
+// its glob and regex alternatives, or, if Negate is set, none of them.
 type CaptureConstraint struct {
-	Glob  string         // comma-separated alternatives, matched with filepath.Match
-	Regex *regexp.Regexp // compiled regex, anchored with ^...$
+	Glob   string         // comma-separated alternatives, matched with path.Match
+	Regex  *regexp.Regexp // compiled regex, anchored with ^...$
+	Negate bool           // {name!...}: match what the alternatives don't
 }
 
 // Matches returns true if the candidate string satisfies the constraint.
 func (c *CaptureConstraint) Matches(s string) bool {
-	if c.Regex != nil {
-		return c.Regex.MatchString(s)
+	return c.matchesAny(s) != c.Negate
+}
+
+func (c *CaptureConstraint) matchesAny(s string) bool {
+	if c.Regex != nil && c.Regex.MatchString(s) {
+		return true
+	}
+	if c.Glob == "" {
+		return false
 	}
 	for _, alt := range strings.Split(c.Glob, ",") {
-		if matched, _ := filepath.Match(alt, s); matched {
+		if matched, _ := path.Match(alt, s); matched {
 			return true
 		}
 	}
@@ -41,7 +54,9 @@ func (c *CaptureConstraint) Matches(s string) bool {
 
 // ParsePattern parses a pattern string into a Pattern.
 // Patterns use {name} for named captures, {name:glob} for glob-constrained
-// captures, and {name/regex} for regex-constrained captures.
+// captures, and {name/regex} for regex-constrained captures. After : the
+// constraint is a list of alternatives separated by commas or spaces,
+// each a glob or a /regex/; {name!list} matches what the list doesn't.
 func ParsePattern(s string) (Pattern, bool, error) {
 	var parts []string
 	var captures []string
@@ -84,34 +99,71 @@ func ParsePattern(s string) (Pattern, bool, error) {
 		return Pattern{Raw: s}, false, nil
 	}
 
-	return Pattern{
+	p := Pattern{
 		Parts:       parts,
 		Captures:    captures,
 		Constraints: constraints,
 		Raw:         s,
-	}, true, nil
+	}
+	p.compile()
+	return p, true, nil
+}
+
+// compile builds p's regexp. Captures match lazily, as Pattern.match
+// tries the shortest candidate first, so both find the same captures.
+// With constraints or a repeated capture, which regexps can't express,
+// the regexp only rules candidates out before Pattern.match runs.
+// Literal parts that aren't valid UTF-8, which regexps can't match
+// byte for byte, leave p.re nil.
+func (p *Pattern) compile() {
+	p.exact = true
+	seen := map[string]bool{}
+	for i, c := range p.Captures {
+		if seen[c] || p.Constraints[i] != nil {
+			p.exact = false
+		}
+		seen[c] = true
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for i, part := range p.Parts {
+		b.WriteString(regexp.QuoteMeta(part))
+		if i < len(p.Captures) {
+			if p.exact {
+				b.WriteString("([^/]*?)")
+			} else {
+				b.WriteString("[^/]*?")
+			}
+		}
+	}
+	b.WriteString("$")
+	if re, err := regexp.Compile(b.String()); err == nil {
+		p.re = re
+	}
 }
 
 // parseCapture parses the content after '{' and returns the capture name,
 // an optional constraint, and the index of the closing '}' within inner.
 // Returns end=-1 if no closing } is found.
 func parseCapture(inner string) (name string, constraint *CaptureConstraint, end int, err error) {
-	// Scan for the first ':', '/', or '}' to classify
+	// Scan for the first ':', '!', '/', or '}' to classify
 	for i := 0; i < len(inner); i++ {
 		switch inner[i] {
 		case '}':
 			// Simple unconstrained capture: {name}
 			return inner[:i], nil, i, nil
 
-		case ':':
-			// Glob capture: {name:glob}
-			closeBrace := strings.IndexByte(inner[i+1:], '}')
-			if closeBrace < 0 {
+		case ':', '!':
+			// Alternatives: {name:glob,/regex/} or negated {name!glob}
+			c, end, err := parseAlternatives(inner, i+1)
+			if err != nil {
+				return "", nil, -1, fmt.Errorf("capture %q: %w", inner[:i], err)
+			}
+			if end < 0 {
 				return "", nil, -1, nil
 			}
-			closeBrace += i + 1
-			glob := inner[i+1 : closeBrace]
-			return inner[:i], &CaptureConstraint{Glob: glob}, closeBrace, nil
+			c.Negate = inner[i] == '!'
+			return inner[:i], c, end, nil
 
 		case '/':
 			// Regex capture: {name/regex}
@@ -132,6 +184,70 @@ func parseCapture(inner string) (name string, constraint *CaptureConstraint, end
 	return "", nil, -1, nil
 }
 
+// parseAlternatives parses a list of constraint alternatives starting at
+// pos within s, up to the closing }. Alternatives are separated by commas
+// or spaces; one delimited by slashes is a regex, any other a glob.
+// Returns end=-1 if no closing } is found.
+func parseAlternatives(s string, pos int) (c *CaptureConstraint, end int, err error) {
+	var globs, regexes []string
+	i := pos
+	for i < len(s) {
+		switch s[i] {
+		case '}':
+			c = &CaptureConstraint{Glob: strings.Join(globs, ",")}
+			if len(regexes) > 0 {
+				c.Regex, err = regexp.Compile("^(?:" + strings.Join(regexes, "|") + ")$")
+				if err != nil {
+					return nil, -1, fmt.Errorf("invalid regex: %w", err)
+				}
+			}
+			return c, i, nil
+		case ',', ' ', '\t':
+			i++
+		case '/':
+			j := findRegexDelim(s, i+1)
+			if j < 0 {
+				return nil, -1, nil
+			}
+			regexes = append(regexes, s[i+1:j])
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(", \t}", rune(s[j])) {
+				if s[j] == '[' { // a glob class may hold any of those
+					if k := strings.IndexByte(s[j+1:], ']'); k >= 0 {
+						j += k + 1
+					}
+				}
+				j++
+			}
+			globs = append(globs, s[i:j])
+			i = j
+		}
+	}
+	return nil, -1, nil
+}
+
+// findRegexDelim returns the index of the / that ends a /regex/
+// alternative starting at pos within s, skipping escaped characters and
+// character classes, or -1 if there isn't one.
+func findRegexDelim(s string, pos int) int {
+	inCharClass := false
+	for i := pos; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case inCharClass:
+			inCharClass = c != ']'
+		case c == '[':
+			inCharClass = true
+		case c == '/':
+			return i
+		}
+	}
+	return -1
+}
+
 // findRegexEnd walks regex syntax starting at pos within s, tracking
 // escapes (\x), character classes ([...]), and quantifiers ({n,m}) to
 // find the } that closes the capture (not one that's part of the regex).
@@ -173,12 +289,54 @@ func (p Pattern) Match(s string) (map[string]string, bool) {
 	if len(p.Captures) == 0 {
 		return nil, s == p.Raw
 	}
+	switch {
+	case p.re == nil:
+		// Not from ParsePattern; match the slow way.
+	case p.exact:
+		m := p.re.FindStringSubmatch(s)
+		if m == nil {
+			return nil, false
+		}
+		captures := make(map[string]string, len(p.Captures))
+		for i, name := range p.Captures {
+			captures[name] = m[i+1]
+		}
+		return captures, true
+	case !p.re.MatchString(s):
+		return nil, false
+	}
 
 	captures := make(map[string]string)
 	return p.match(s, 0, captures)
 }
 
 func (p Pattern) match(s string, idx int, captures map[string]string) (map[string]string, bool) {
+	return p.matchFrom(s, idx, captures, map[string]bool{})
+}
+
+// matchFrom backtracks over where each capture ends. failed remembers
+// states already found not to match — the capture, how much of the
+// string is left, and the values bound so far of the captures still to
+// come — so that patterns with many constrained or repeated captures
+// don't take exponential time.
+func (p Pattern) matchFrom(s string, idx int, captures map[string]string, failed map[string]bool) (map[string]string, bool) {
+	key := strconv.Itoa(idx) + "/" + strconv.Itoa(len(s))
+	for _, name := range p.Captures[min(idx, len(p.Captures)):] {
+		if v, ok := captures[name]; ok {
+			key += "\x00" + name + "=" + v
+		}
+	}
+	if failed[key] {
+		return nil, false
+	}
+	if result, ok := p.matchHere(s, idx, captures, failed); ok {
+		return result, true
+	}
+	failed[key] = true
+	return nil, false
+}
+
+func (p Pattern) matchHere(s string, idx int, captures map[string]string, failed map[string]bool) (map[string]string, bool) {
 	// Must start with Parts[idx]
 	prefix := p.Parts[idx]
 	if !strings.HasPrefix(s, prefix) {
@@ -241,7 +399,7 @@ func (p Pattern) match(s string, idx int, captures map[string]string) (map[strin
 		}
 		capturesCopy[captureName] = candidate
 
-		if result, ok := p.match(s[i:], idx+1, capturesCopy); ok {
+		if result, ok := p.matchFrom(s[i:], idx+1, capturesCopy, failed); ok {
 			return result, true
 		}
 	}
@@ -274,6 +432,66 @@ func (p Pattern) Expand(captures map[string]string) string {
 	return b.String()
 }
 
+// patternFields splits s into words like strings.Fields, except that
+// space inside a capture's braces, as from {config:$configs}, doesn't
+// split it.
+func patternFields(s string) []string {
+	var words []string
+	depth, start := 0, -1
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '{':
+			depth++
+		case c == '}' && depth > 0:
+			depth--
+		case depth == 0 && (c == ' ' || c == '\t' || c == '\n'):
+			if start >= 0 {
+				words = append(words, s[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if depth > 0 {
+		return strings.Fields(s) // unbalanced: not a pattern
+	}
+	if start >= 0 {
+		words = append(words, s[start:])
+	}
+	return words
+}
+
+// Glob returns a filepath.Glob pattern matching a superset of the paths
+// the pattern matches: each capture becomes *.
+func (p Pattern) Glob() string {
+	var b strings.Builder
+	for i, part := range p.Parts {
+		b.WriteString(globEscape(part))
+		if i < len(p.Captures) {
+			b.WriteString("*")
+		}
+	}
+	return b.String()
+}
+
+// Stem returns the captured values of a match joined by /, in the order
+// the captures first appear, so a one-capture pattern gives the capture
+// itself. Captures never contain /, so the result is unambiguous.
+func (p Pattern) Stem(captures map[string]string) string {
+	var vals []string
+	seen := map[string]bool{}
+	for _, c := range p.Captures {
+		if !seen[c] {
+			seen[c] = true
+			vals = append(vals, captures[c])
+		}
+	}
+	return strings.Join(vals, "/")
+}
+
 // IsPattern returns true if this has any captures.
 func (p Pattern) IsPattern() bool {
 	return len(p.Captures) > 0
@@ -4,6 +4,9 @@
 package mk
 
 import (
+	"maps"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -251,3 +254,92 @@ func TestParsePatternRegexError(t *testing.T) {
 		t.Error("expected error for invalid regex")
 	}
 }
+
+func TestNegatedConstraint(t *testing.T) {
+	p, _, err := ParsePattern("build/{name!test_*,/bench\\d+/}.o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for input, want := range map[string]bool{
+		"build/foo.o":      true,
+		"build/test_foo.o": false,
+		"build/bench12.o":  false,
+		"build/benchx.o":   true,
+	} {
+		if _, ok := p.Match(input); ok != want {
+			t.Errorf("Match(%q) = %v, want %v", input, ok, want)
+		}
+	}
+}
+
+func TestMixedAlternatives(t *testing.T) {
+	// Globs and /regex/ alternatives combine; a regex may hold , and }.
+	p, _, err := ParsePattern("v{ver:latest,/\\d{1,3}/ rc*}.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for input, want := range map[string]bool{
+		"vlatest.txt": true,
+		"v42.txt":     true,
+		"v1234.txt":   false,
+		"vrc1.txt":    true,
+		"vbeta.txt":   false,
+	} {
+		if _, ok := p.Match(input); ok != want {
+			t.Errorf("Match(%q) = %v, want %v", input, ok, want)
+		}
+	}
+	if _, _, err := ParsePattern("v{ver:/*+/}.txt"); err == nil {
+		t.Error("expected error for invalid regex alternative")
+	}
+}
+
+func TestPatternFields(t *testing.T) {
+	for in, want := range map[string][]string{
+		"a.o  build/{config:debug release}/{name}.o ": {"a.o", "build/{config:debug release}/{name}.o"},
+		"a{ b": {"a{", "b"},
+		"":     nil,
+	} {
+		if got := patternFields(in); !slices.Equal(got, want) {
+			t.Errorf("patternFields(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCompiledPatternAgrees(t *testing.T) {
+	// The regexp finds the same captures as the backtracking matcher.
+	patterns := []string{"build/{config}/{name}.o", "{a}{b}.x", "lib{name}", "{a}-{b}-{c}", "{name}.{ext}"}
+	inputs := []string{"build/debug/foo.o", "build/foo.o", "ab.x", ".x", "libfoo", "lib", "x-y-z-w", "a--", "foo.tar.gz", "dir/f.c"}
+	for _, ps := range patterns {
+		p, _, _ := ParsePattern(ps)
+		if !p.exact {
+			t.Fatalf("%s: not exact", ps)
+		}
+		for _, in := range inputs {
+			got, gotOK := p.Match(in)
+			want, wantOK := p.match(in, 0, map[string]string{})
+			if gotOK != wantOK || !maps.Equal(got, want) {
+				t.Errorf("%s.Match(%q) = %v, %v; backtracking gives %v, %v", ps, in, got, gotOK, want, wantOK)
+			}
+		}
+	}
+}
+
+func TestPatternBacktrackingBounded(t *testing.T) {
+	// Without memoizing failed states, these take exponential time: the
+	// repeated capture only fails once every split of the x's is tried.
+	target := strings.Repeat("x", 40) + "-zy"
+	for _, ps := range []string{"{a}{b}{c}{d}{e}{f}-{a}{a}y", "{a:x*}{b:x*}{c:x*}{d:x*}{e:x*}-{a}y"} {
+		p, _, err := ParsePattern(ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := p.Match(target); ok {
+			t.Errorf("%s matched %q", ps, target)
+		}
+	}
+	p, _, _ := ParsePattern("{a}{b}{c}-{a}{c}")
+	if got, ok := p.Match("xyz-xz"); !ok || got["a"] != "x" || got["b"] != "y" || got["c"] != "z" {
+		t.Errorf("Match(xyz-xz) = %v, %v; want a=x b=y c=z", got, ok)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// funcPkgConfig implements $[pkg-config args]: pkg-config's output for
+// args, such as --cflags gtk4, cached in the build state like
+// $[shell? ...] with the packages' .pc files as its inputs. A package
+// pkg-config can't find is reported on stderr and expands to nothing.
+func (v *Vars) funcPkgConfig(args string) string {
+	args = strings.TrimSpace(v.Expand(args))
+	cmd := "pkg-config " + args
+	if path := os.Getenv("PKG_CONFIG_PATH"); path != "" {
+		cmd = "PKG_CONFIG_PATH=" + path + " " + cmd
+	}
+	root := v
+	for root.parent != nil {
+		root = root.parent
+	}
+	cache := root.shellCache
+	if cache != nil {
+		if files := cache.shellInputs(cmd); files != nil {
+			if out, ok := cache.cachedShell(cmd, v.workspace().hashInputs(files)); ok {
+				return out
+			}
+		}
+	}
+
+	words := strings.Fields(args)
+	pkgs := pkgConfigPackages(words)
+	out, err := v.pkgConfig(words...)
+	if err != nil {
+		v.warnf("pkg-config: %v\n", v.pkgConfigError(pkgs, err))
+		return ""
+	}
+	out = strings.ReplaceAll(strings.TrimSpace(out), "\n", " ")
+	if cache == nil {
+		return out
+	}
+	var files []string
+	for _, pkg := range pkgs {
+		dir, err := v.pkgConfig("--variable=pcfiledir", pkg)
+		if err != nil {
+			return out // uncacheable, but the flags are good
+		}
+		files = append(files, filepath.Join(strings.TrimSpace(dir), pkg+".pc"))
+	}
+	cache.recordShell(cmd, v.workspace().hashInputs(files), out)
+	return out
+}
+
+// pkgConfig runs pkg-config with args. A failure's error includes what
+// pkg-config wrote to stderr.
+func (v *Vars) pkgConfig(args ...string) (string, error) {
+	c := v.workspace().command(v.context(), "pkg-config", args...)
+	killOnCancel(c)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil && stderr.Len() > 0 {
+		line, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		err = fmt.Errorf("%w: %s", err, line)
+	}
+	return string(out), err
+}
+
+// pkgConfigError explains why pkg-config failed for pkgs.
+func (v *Vars) pkgConfigError(pkgs []string, err error) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return errors.New("pkg-config is not installed")
+	}
+	for _, pkg := range pkgs {
+		if _, perr := v.pkgConfig("--exists", pkg); perr != nil {
+			return fmt.Errorf("package %s not found; install its development files or add the directory containing %s.pc to PKG_CONFIG_PATH", pkg, pkg)
+		}
+	}
+	return err
+}
+
+// pkgConfigPackages returns the package names among pkg-config
+// arguments, skipping options and version constraints (glib-2.0 >= 2.72).
+func pkgConfigPackages(words []string) []string {
+	var pkgs []string
+	for i := 0; i < len(words); i++ {
+		switch w := words[i]; {
+		case strings.HasPrefix(w, "-"):
+		case w == "=" || w == "!=" || w == "<" || w == "<=" || w == ">" || w == ">=":
+			i++ // the version
+		default:
+			pkgs = append(pkgs, w)
+		}
+	}
+	return pkgs
+}
+
+// hashInputs hashes files for a $[shell? ...] result; a missing file
+// hashes as "".
+func (w workspace) hashInputs(files []string) map[string]string {
+	inputs := make(map[string]string, len(files))
+	for _, f := range files {
+		inputs[f], _ = hashFile(w.path(f))
+	}
+	return inputs
+}
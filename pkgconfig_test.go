@@ -0,0 +1,92 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPkgConfig(t *testing.T) {
+	if _, err := exec.LookPath("pkg-config"); err != nil {
+		t.Skip("pkg-config not installed")
+	}
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	pcdir := filepath.Join(dir, "pc")
+	os.Mkdir(pcdir, 0o755)
+	t.Setenv("PKG_CONFIG_PATH", pcdir)
+	writePC := func(cflags string) {
+		os.WriteFile(filepath.Join(pcdir, "foo.pc"), []byte("Name: foo\nDescription: foo\nVersion: 1.2\nCflags: "+cflags+"\nLibs: -lfoo\n"), 0o644)
+	}
+	writePC("-DFOO=1")
+
+	os.WriteFile("mkfile", []byte(`
+include std/c.mk
+pkgs = foo >= 1.0
+
+!show:
+    echo $pkg_cflags $pkg_libs > out.txt
+`), 0o644)
+
+	build := func() string {
+		t.Helper()
+		mustBuild(t, Options{Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "show")
+		out, _ := os.ReadFile("out.txt")
+		return strings.TrimSpace(string(out))
+	}
+
+	if got := build(); got != "-DFOO=1 -lfoo" {
+		t.Errorf("first build: got %q, want %q", got, "-DFOO=1 -lfoo")
+	}
+	s := LoadState("")
+	if len(s.Shell) != 2 {
+		t.Fatalf("state has %d cached results, want 2 (--cflags, --libs): %v", len(s.Shell), s.Shell)
+	}
+	for cmd, r := range s.Shell {
+		if _, ok := r.Inputs[filepath.Join(pcdir, "foo.pc")]; !ok || !strings.HasPrefix(cmd, "PKG_CONFIG_PATH=") {
+			t.Errorf("%s: inputs %v, want keyed by PKG_CONFIG_PATH and foo.pc", cmd, r.Inputs)
+		}
+	}
+
+	// Editing the .pc file invalidates the cached flags.
+	writePC("-DFOO=2")
+	if got := build(); got != "-DFOO=2 -lfoo" {
+		t.Errorf("after editing foo.pc: got %q, want %q", got, "-DFOO=2 -lfoo")
+	}
+}
+
+func TestPkgConfigMissingPackage(t *testing.T) {
+	if _, err := exec.LookPath("pkg-config"); err != nil {
+		t.Skip("pkg-config not installed")
+	}
+	t.Setenv("PKG_CONFIG_PATH", t.TempDir())
+	v := NewVars()
+	words := []string{"--cflags", "nosuchpkg"}
+	_, err := v.pkgConfig(words...)
+	if err == nil {
+		t.Fatal("pkg-config succeeded for a missing package")
+	}
+	msg := v.pkgConfigError(pkgConfigPackages(words), err).Error()
+	if !strings.Contains(msg, "package nosuchpkg not found") || !strings.Contains(msg, "PKG_CONFIG_PATH") {
+		t.Errorf("error = %q, want it to name the package and PKG_CONFIG_PATH", msg)
+	}
+	if got := v.Expand("$[pkg-config --cflags nosuchpkg]"); got != "" {
+		t.Errorf("expansion = %q, want empty", got)
+	}
+}
+
+func TestPkgConfigPackages(t *testing.T) {
+	got := pkgConfigPackages(strings.Fields("--cflags --static gtk4 glib-2.0 >= 2.72 zlib"))
+	if strings.Join(got, " ") != "gtk4 glib-2.0 zlib" {
+		t.Errorf("packages = %v, want [gtk4 glib-2.0 zlib]", got)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// pluginProtocolVersion is sent with every plugin request so plugins can
+// reject requests they don't understand.
+const pluginProtocolVersion = 1
+
+// Plugin is an external executable that provides $[...] functions.
+//
+// Each uncached call runs the command via sh -c, writes one JSON
+// PluginRequest to its stdin and reads one JSON PluginResponse from its
+// stdout. If the command names a .wasm file, the module is instead run
+// in-process as a sandboxed WASI program (see wasmModule).
+//
+// Results are memoized per invocation by function name and arguments;
+// responses marked cacheable are also persisted under .mk/plugin-cache,
+// keyed by the plugin command, the plugin executable's content hash, the
+// function name and the arguments.
+type Plugin struct {
+	Command string   // shell command that runs the plugin
+	Funcs   []string // function names the plugin provides
+
+	mu    sync.Mutex
+	memo  map[string]string
+	exeID string      // content hash of the plugin executable, if it is a file
+	wasm  *wasmModule // non-nil for WebAssembly plugins
+
+	dir    workspace // where the plugin runs and its cache lives
+	stderr io.Writer // receives the plugin's stderr
+}
+
+// PluginRequest is the JSON object written to a plugin's stdin.
+type PluginRequest struct {
+	Version  int    `json:"version"`
+	Function string `json:"function"`
+	Args     string `json:"args"` // expanded argument text
+}
+
+// PluginResponse is the JSON object a plugin writes to stdout.
+type PluginResponse struct {
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+	Cacheable bool   `json:"cacheable,omitempty"` // persist across invocations
+}
+
+// NewPlugin returns a plugin that runs command to evaluate funcs in the
+// current directory, with its stderr going to os.Stderr.
+func NewPlugin(command string, funcs []string) *Plugin {
+	return newPlugin("", os.Stderr, command, funcs)
+}
+
+// newPlugin returns a plugin that runs command in dir.
+func newPlugin(dir workspace, stderr io.Writer, command string, funcs []string) *Plugin {
+	p := &Plugin{Command: command, Funcs: funcs, memo: make(map[string]string), dir: dir, stderr: stderr}
+	if fields := strings.Fields(command); len(fields) > 0 {
+		if h, err := hashFile(dir.path(fields[0])); err == nil {
+			p.exeID = h
+		}
+		if strings.HasSuffix(fields[0], ".wasm") {
+			p.wasm = newWasmModule(dir, stderr, fields[0], fields[1:])
+		}
+	}
+	return p
+}
+
+// Call evaluates function fn with the given (already expanded) arguments.
+// Cancelling ctx kills a running plugin.
+func (p *Plugin) Call(ctx context.Context, fn, args string) (string, error) {
+	key := hashString(p.Command + "\x00" + p.exeID + "\x00" + fn + "\x00" + args)
+
+	p.mu.Lock()
+	if result, ok := p.memo[key]; ok {
+		p.mu.Unlock()
+		return result, nil
+	}
+	p.mu.Unlock()
+
+	cachePath := p.dir.path(filepath.Join(stateDir, "plugin-cache", key))
+	if data, err := os.ReadFile(cachePath); err == nil {
+		result := string(data)
+		p.remember(key, result)
+		return result, nil
+	}
+
+	req, err := json.Marshal(PluginRequest{Version: pluginProtocolVersion, Function: fn, Args: args})
+	if err != nil {
+		return "", err
+	}
+	out, err := p.run(ctx, append(req, '\n'))
+	if err != nil {
+		return "", fmt.Errorf("plugin %q: %w", p.Command, err)
+	}
+
+	var resp PluginResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", fmt.Errorf("plugin %q: invalid response for %s: %w", p.Command, fn, err)
+	}
+	if resp.Error != "" {
+		return "", fmt.Errorf("plugin %q: %s: %s", p.Command, fn, resp.Error)
+	}
+
+	p.remember(key, resp.Result)
+	if resp.Cacheable {
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0o755); err == nil {
+			_ = os.WriteFile(cachePath, []byte(resp.Result), 0o644)
+		}
+	}
+	return resp.Result, nil
+}
+
+// Close releases the resources the plugin holds: the runtime of a
+// WebAssembly plugin, which can't be called after Close.
+func (p *Plugin) Close() error {
+	if p.wasm == nil {
+		return nil
+	}
+	return p.wasm.close()
+}
+
+func (p *Plugin) run(ctx context.Context, req []byte) ([]byte, error) {
+	if p.wasm != nil {
+		return p.wasm.run(ctx, req)
+	}
+	cmd := p.dir.shellCommand(ctx, p.Command)
+	killOnCancel(cmd)
+	cmd.Stdin = bytes.NewReader(req)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = p.stderr
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (p *Plugin) remember(key, result string) {
+	p.mu.Lock()
+	p.memo[key] = result
+	p.mu.Unlock()
+}
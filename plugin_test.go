@@ -0,0 +1,196 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// upperPlugin is a shell plugin that upper-cases its arguments and logs
+// each invocation to calls.log.
+const upperPlugin = `#!/bin/sh
+read req
+echo call >> calls.log
+args=$(printf '%s' "$req" | sed 's/.*"args":"\([^"]*\)".*/\1/')
+case "$req" in
+*'"function":"upper"'*) printf '{"result":"%s","cacheable":%s}\n' "$(printf '%s' "$args" | tr a-z A-Z)" "$CACHEABLE" ;;
+*) printf '{"error":"unknown function"}\n' ;;
+esac
+`
+
+func TestParsePlugin(t *testing.T) {
+	f, err := Parse(strings.NewReader(`plugin owner team-of: ./tools/registry --url=$url`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := f.Stmts[0].(PluginDef)
+	if len(p.Funcs) != 2 || p.Funcs[0] != "owner" || p.Funcs[1] != "team-of" {
+		t.Errorf("funcs = %v", p.Funcs)
+	}
+	if p.Command != "./tools/registry --url=$url" {
+		t.Errorf("command = %q", p.Command)
+	}
+
+	if _, err := Parse(strings.NewReader(`plugin owner`)); err == nil {
+		t.Error("expected error for plugin without command")
+	}
+}
+
+func TestPluginFunction(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile(filepath.Join(dir, "upper.sh"), []byte(upperPlugin), 0o755)
+
+	mkfile := `
+name = world
+plugin upper: ./upper.sh
+a = $[upper hello $name]
+b = $[upper hello $name]
+`
+	f, err := Parse(strings.NewReader(mkfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CACHEABLE", "false")
+	vars := NewVars()
+	state := &BuildState{Targets: make(map[string]*TargetState)}
+	if _, err := BuildGraph(f, vars, state, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := vars.Get("a"); got != "HELLO WORLD" {
+		t.Errorf("a = %q, want %q", got, "HELLO WORLD")
+	}
+	if got := vars.Get("b"); got != "HELLO WORLD" {
+		t.Errorf("b = %q, want %q", got, "HELLO WORLD")
+	}
+	calls, _ := os.ReadFile("calls.log")
+	if n := strings.Count(string(calls), "call"); n != 1 {
+		t.Errorf("plugin ran %d times, want 1 (memoized)", n)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "plugin-cache")); err == nil {
+		t.Error("non-cacheable result should not be persisted")
+	}
+}
+
+func TestPluginPersistentCache(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile(filepath.Join(dir, "upper.sh"), []byte(upperPlugin), 0o755)
+	t.Setenv("CACHEABLE", "true")
+
+	for range 2 {
+		p := NewPlugin("./upper.sh", []string{"upper"})
+		got, err := p.Call(context.Background(), "upper", "abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "ABC" {
+			t.Errorf("result = %q, want %q", got, "ABC")
+		}
+	}
+	calls, _ := os.ReadFile("calls.log")
+	if n := strings.Count(string(calls), "call"); n != 1 {
+		t.Errorf("plugin ran %d times, want 1 (persisted)", n)
+	}
+
+	// Changing the plugin executable invalidates the cache.
+	os.WriteFile(filepath.Join(dir, "upper.sh"), []byte(upperPlugin+"\n# v2\n"), 0o755)
+	if _, err := NewPlugin("./upper.sh", []string{"upper"}).Call(context.Background(), "upper", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	calls, _ = os.ReadFile("calls.log")
+	if n := strings.Count(string(calls), "call"); n != 2 {
+		t.Errorf("plugin ran %d times, want 2 after executable change", n)
+	}
+
+	if _, err := NewPlugin("./upper.sh", []string{"lower"}).Call(context.Background(), "lower", "abc"); err == nil {
+		t.Error("expected error from plugin")
+	}
+}
+
+func TestWasmPlugin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a wasm module")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not available")
+	}
+	src, _ := filepath.Abs("testdata/wasmplugin")
+	dir := t.TempDir()
+	wasm := filepath.Join(dir, "tools", "plugin.wasm")
+	build := exec.Command(goBin, "build", "-o", wasm, ".")
+	build.Dir = src
+	build.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building wasm plugin: %s: %v", out, err)
+	}
+
+	ws := filepath.Join(dir, "ws")
+	os.MkdirAll(ws, 0o755)
+	os.Rename(filepath.Join(dir, "tools"), filepath.Join(ws, "tools"))
+	os.WriteFile(filepath.Join(ws, "inside.txt"), []byte("inside\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "outside.txt"), []byte("outside\n"), 0o644)
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(ws)
+	defer os.Chdir(oldDir)
+
+	p := NewPlugin("tools/plugin.wasm", []string{"upper", "cat", "touch"})
+	if got, err := p.Call(context.Background(), "upper", "hello"); err != nil || got != "HELLO" {
+		t.Errorf("upper = %q, %v; want %q", got, err, "HELLO")
+	}
+	if got, err := p.Call(context.Background(), "cat", "inside.txt"); err != nil || got != "inside" {
+		t.Errorf("cat inside.txt = %q, %v; want %q", got, err, "inside")
+	}
+
+	// The sandbox confines the module to the workspace, read-only.
+	if got, err := p.Call(context.Background(), "cat", "../outside.txt"); err == nil {
+		t.Errorf("reading outside the workspace succeeded: %q", got)
+	}
+	if _, err := p.Call(context.Background(), "touch", "new.txt"); err == nil {
+		t.Error("writing to the workspace succeeded")
+	}
+	if _, err := os.Stat("new.txt"); err == nil {
+		t.Error("new.txt was created")
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+	if got, err := p.Call(context.Background(), "upper", "closed"); err == nil {
+		t.Errorf("upper after Close = %q, want error", got)
+	}
+
+	// A module can provide rules, through eval.
+	os.WriteFile("mkfile", []byte(`
+plugin rules: tools/plugin.wasm
+
+eval $[rules a.txt b.txt]
+`), 0o644)
+	proj := mustBuild(t, Options{Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "a.txt", "b.txt")
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if data, _ := os.ReadFile(name); string(data) != "generated\n" {
+			t.Errorf("%s = %q, want %q", name, data, "generated\n")
+		}
+	}
+	if err := proj.Close(); err != nil {
+		t.Errorf("Project.Close = %v", err)
+	}
+	if _, err := proj.graph.plugins[0].Call(context.Background(), "rules", "c.txt"); err == nil {
+		t.Error("plugin callable after Project.Close")
+	}
+}
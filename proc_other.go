@@ -0,0 +1,41 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !unix
+
+package mk
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+// killOnCancel bounds how long cmd's Wait blocks after its context is
+// cancelled. Without process groups, grandchildren may outlive it.
+func killOnCancel(cmd *exec.Cmd) {
+	cmd.WaitDelay = waitDelay
+}
+
+// detach is a no-op: processes already outlive mk.
+func detach(cmd *exec.Cmd) {}
+
+// processAlive reports whether pid is running.
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
+
+// stopProcess kills pid. Without process groups, its children may
+// outlive it.
+func stopProcess(pid int, timeout time.Duration) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+// inheritsFiles reports whether commands can inherit descriptors beyond
+// stderr.
+const inheritsFiles = false
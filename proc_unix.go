@@ -0,0 +1,57 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build unix
+
+package mk
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// killOnCancel runs cmd in its own process group and, when its context is
+// cancelled, kills the whole group so that commands started by the shell
+// die with it.
+func killOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = waitDelay
+}
+
+// detach runs cmd in its own process group, so it outlives mk and
+// doesn't get the terminal's signals.
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// processAlive reports whether pid is running. It reaps pid if it is an
+// exited child of mk's, as a service started by this process may be.
+func processAlive(pid int) bool {
+	var status syscall.WaitStatus
+	if p, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); p == pid && err == nil {
+		return false
+	}
+	return syscall.Kill(pid, 0) == nil
+}
+
+// stopProcess sends SIGTERM to pid's process group and, if pid hasn't
+// exited after timeout, SIGKILL.
+func stopProcess(pid int, timeout time.Duration) error {
+	if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if !processAlive(pid) {
+			return nil
+		}
+	}
+	return syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+// inheritsFiles reports whether commands can inherit descriptors beyond
+// stderr.
+const inheritsFiles = true
@@ -0,0 +1,108 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// EventKind identifies the kind of a build Event.
+type EventKind int
+
+const (
+	TargetStarted  EventKind = iota // recipe is about to run
+	TargetFinished                  // recipe succeeded
+	TargetFailed                    // recipe failed; Event.Err is set
+	TargetSkipped                   // target is up to date
+	TargetRestored                  // outputs were restored from the action cache
+	TargetWarning                   // mk warned about the rule; Event.Message is set
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case TargetStarted:
+		return "started"
+	case TargetFinished:
+		return "finished"
+	case TargetFailed:
+		return "failed"
+	case TargetSkipped:
+		return "skipped"
+	case TargetRestored:
+		return "restored"
+	case TargetWarning:
+		return "warning"
+	default:
+		return "unknown"
+	}
+}
+
+// Event reports progress on a single rule during a build.
+type Event struct {
+	Kind     EventKind
+	Time     time.Time     // when it happened
+	Target   string        // $target of the rule
+	Targets  []string      // all outputs of the rule
+	Rule     string        // where the rule is defined, "file:line"; "" for a file with no rule
+	Reasons  []StaleReason // why the rule is rebuilt, for started and restored events
+	Command  string        // the expanded recipe, for started events
+	Duration time.Duration // recipe run time, for finished and failed events
+	Digest   string        // the action cache key the outputs came from, for restored events
+	Message  string        // the warning, without "mk: warning: ", for warning events
+	Err      error         // failure, for failed events
+}
+
+// ProgressFunc receives build events. Calls are serialized, so it may
+// update state without locking or send on a channel; it should return
+// quickly, as the build waits for it.
+type ProgressFunc func(Event)
+
+// jsonEvent is the wire form of an Event, in --events streams and --serve
+// notifications.
+type jsonEvent struct {
+	Kind       string       `json:"kind"`
+	Time       time.Time    `json:"time"`
+	Target     string       `json:"target"`
+	Targets    []string     `json:"targets,omitempty"`
+	Rule       string       `json:"rule,omitempty"`
+	Reasons    []jsonReason `json:"reasons,omitempty"`
+	Command    string       `json:"command,omitempty"`
+	DurationMS int64        `json:"duration_ms,omitempty"`
+	Digest     string       `json:"digest,omitempty"`
+	Message    string       `json:"message,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// jsonReason is a StaleReason in an event.
+type jsonReason struct {
+	Kind    string `json:"kind"`
+	Target  string `json:"target,omitempty"`
+	Prereq  string `json:"prereq,omitempty"`
+	Message string `json:"message"`
+}
+
+func newJSONEvent(ev Event) jsonEvent {
+	je := jsonEvent{Kind: ev.Kind.String(), Time: ev.Time, Target: ev.Target, Targets: ev.Targets, Rule: ev.Rule, Command: ev.Command, DurationMS: ev.Duration.Milliseconds(), Digest: ev.Digest, Message: ev.Message}
+	for _, r := range ev.Reasons {
+		je.Reasons = append(je.Reasons, jsonReason{Kind: r.Kind.String(), Target: r.Target, Prereq: r.Prereq, Message: r.String()})
+	}
+	if ev.Err != nil {
+		je.Error = ev.Err.Error()
+	}
+	return je
+}
+
+// JSONEvents returns a ProgressFunc that writes each event to w as a line
+// of JSON, in the form --serve sends event notifications, with the
+// event's time. Errors writing to w are ignored, so that a consumer that
+// goes away doesn't fail the build.
+func JSONEvents(w io.Writer) ProgressFunc {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false) // recipes are full of > and &
+	return func(ev Event) {
+		enc.Encode(newJSONEvent(ev)) //nolint:errcheck // best effort
+	}
+}
@@ -0,0 +1,524 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Options configures how a Project is loaded and built.
+type Options struct {
+	Configs []string          // active configs, applied in order (target:a+b)
+	Vars    map[string]string // variable overrides (name=value on the CLI)
+	Verbose bool              // print recipes and up-to-date targets
+	Force   bool              // rebuild regardless of state (-B)
+	DryRun  bool              // print what would run without running it (-n)
+	Explain bool              // with DryRun, also predict downstream rebuilds and list what each affects (-n --why)
+	Jobs    int               // max concurrent recipes; <0 = one per CPU, or make's jobserver's; 0 = unlimited
+	Stats   bool              // also collect compiler launcher cache stats (--stats)
+
+	// KeepGoing builds everything that doesn't depend on a failed
+	// recipe, and every target given, rather than starting no more
+	// recipes after the first failure (-k). Build's error is then
+	// Failures.
+	KeepGoing bool
+
+	// Ordered builds the targets given to Build one after another, each
+	// finished before the next starts, as for mk clean build test.
+	// Otherwise they are built together, like the prerequisites of one
+	// rule, in parallel up to Jobs.
+	Ordered bool
+
+	// Rebuild forces the rules that build these targets to rebuild, as
+	// Force does for every rule, leaving the rest of the build
+	// incremental (--rebuild). With Downstream, the rules that depend on
+	// them, directly or not, rebuild too.
+	Rebuild    []string
+	Downstream bool
+
+	// Reproducible pins SOURCE_DATE_EPOCH, TZ and LC_ALL, strips
+	// nondeterministic environment variables, and verifies the build by
+	// rebuilding a sample of targets.
+	Reproducible bool
+
+	// Provenance, if set, is a directory that receives a SLSA provenance
+	// document (an in-toto statement in a DSSE envelope) for each
+	// artifact built. ProvenanceKey optionally names a PEM PKCS #8
+	// private key to sign them with.
+	Provenance    string
+	ProvenanceKey string
+
+	// Containment makes it an error for a target, or a file written by a
+	// recipe from a scoped include, to fall outside the workspace or the
+	// include's directory.
+	Containment bool
+
+	// Sandbox runs each file rule's recipe in a directory under .mk that
+	// holds links to its prerequisites and nothing else of the workspace,
+	// then moves its targets into place, so that a recipe reading a file
+	// it doesn't declare fails as it would on a clean machine. Tasks and
+	// rules with a depfile run in the workspace.
+	Sandbox bool
+
+	// Strict turns warnings about suspect recipes into errors: that a
+	// recipe modified one of its own prerequisites, or that two rules
+	// write the same target.
+	Strict bool
+
+	// CoarseMtime stops trusting file modification times within a build,
+	// for NFS and bind mounts with coarse timestamps: files modified just
+	// before they were hashed, and files smaller than RehashBelow bytes,
+	// are re-hashed whenever they're looked at.
+	CoarseMtime bool
+	RehashBelow int64
+
+	// LocalState keeps the action cache, which restores the outputs of
+	// recipes already run with the same inputs, in .mk/cache rather than
+	// sharing it with other checkouts of the repository under
+	// $XDG_CACHE_HOME/mk.
+	LocalState bool
+
+	// CheckOutputs says what to do about a target whose content differs
+	// from what mk last built: rebuild it (the default), warn, or ignore
+	// it.
+	CheckOutputs OutputCheck
+
+	// Audit, if set, is a file that every executed recipe is appended to
+	// as a JSON line (see AuditEntry).
+	Audit string
+
+	// Manifest writes ManifestFile after a successful build, listing
+	// every file target the build produced or found up to date with its
+	// hash, size, rule and recipe run time.
+	Manifest bool
+
+	// Debug traces the decisions mk makes in the given categories —
+	// pattern matching, staleness, variable assignments, includes — to
+	// Stderr, one tagged line each.
+	Debug Debug
+
+	// TraceGlobs reports, once the graph is built, each pattern that
+	// $[wildcard] and the other file-matching functions globbed while
+	// building it, to Stderr: how often, the file system calls it took
+	// and the files it matched.
+	TraceGlobs bool
+
+	// Width, if positive, is the width of the terminal mk's messages go
+	// to: banner lines longer than that are elided, and runs of
+	// up-to-date messages are collapsed into a count. Zero writes every
+	// message in full, as for logs; progress events always carry full
+	// detail.
+	Width int
+
+	// Dir is the directory the mkfile path given to Load is relative
+	// to; empty means the current directory. The directory containing
+	// the mkfile is the workspace: the mkfile's paths, the .mk state
+	// directory and the other paths in these options are relative to
+	// it, and recipes and shell commands run in it. Projects in
+	// different workspaces can be loaded and built concurrently in one
+	// process.
+	Dir string
+
+	Stdout   io.Writer    // recipe output; nil means os.Stdout
+	Stderr   io.Writer    // mk messages and recipe errors; nil means os.Stderr
+	Progress ProgressFunc // optional build event callback
+	Runner   Runner       // executes recipes; nil means local (or $remote_exec)
+}
+
+// Project is a loaded mkfile together with its build state, ready to
+// build. It is the entry point for embedding mk in other Go programs.
+type Project struct {
+	opts  Options
+	ast   *File
+	vars  *Vars
+	state *BuildState
+	graph *Graph
+	stats Stats // of the last Build
+
+	parseTime, graphTime time.Duration // spent in Load
+
+	under []*Project // loaded by Build for prerequisites written target@config
+}
+
+// Load parses the mkfile at path and builds its dependency graph with the
+// given options. path is relative to opts.Dir; the directory the mkfile
+// is in becomes the project's workspace, which paths in the mkfile and
+// in opts are relative to. ctx bounds commands run while evaluating the mkfile, such as
+// $[shell ...].
+func Load(ctx context.Context, path string, opts Options) (*Project, error) {
+	root := mkfileWorkspace(opts.Dir, path)
+	opts.Dir = string(root)
+	f, err := os.Open(root.path(filepath.Base(path)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	start := time.Now()
+	ast, err := Parse(f)
+	if err != nil {
+		return nil, err
+	}
+	ast.Path = path
+	parseTime := time.Since(start)
+
+	p, err := load(ctx, ast, opts)
+	if err != nil {
+		return nil, err
+	}
+	p.parseTime = parseTime
+	return p, nil
+}
+
+// load builds a Project from a parsed mkfile.
+func load(ctx context.Context, ast *File, opts Options) (*Project, error) {
+	dir := workspace(opts.Dir)
+	vars := NewVars()
+	vars.dir = dir
+	vars.SetContext(ctx)
+	defer vars.SetContext(nil)
+	if opts.Reproducible {
+		setReproducible(ctx, vars)
+	}
+	for name, value := range opts.Vars {
+		vars.Override(name, value)
+	}
+	state := loadState(dir, strings.Join(opts.Configs, "-"))
+	state.SetOutputCheck(opts.CheckOutputs)
+	vars.shellCache = state
+
+	stderr := opts.Stderr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	vars.stderr = stderr
+	if state.corrupt != nil {
+		fmt.Fprintf(stderr, "mk: warning: %v; starting from empty state (mk state restore recovers the newest valid backup)\n", state.corrupt)
+	}
+	start := time.Now()
+	g, err := buildGraph(ast, vars, state, opts.Configs, newTracer(stderr, opts.Debug))
+	if err != nil {
+		return nil, err
+	}
+	graphTime := time.Since(start)
+	if opts.TraceGlobs {
+		g.globCache.printTrace(stderr)
+	}
+	for _, w := range g.Warnings() {
+		fmt.Fprintf(stderr, "mk: %s\n", w)
+	}
+	return &Project{opts: opts, ast: ast, vars: vars, state: state, graph: g, graphTime: graphTime}, nil
+}
+
+// Close releases the resources the project holds, such as the runtimes
+// of its WebAssembly plugins, and those of the projects Build loaded for
+// other configs. The project can't be built after Close.
+func (p *Project) Close() error {
+	var errs []error
+	for _, sp := range p.under {
+		errs = append(errs, sp.Close())
+	}
+	errs = append(errs, p.graph.closePlugins())
+	return errors.Join(errs...)
+}
+
+// Graph returns the project's dependency graph.
+func (p *Project) Graph() *Graph { return p.graph }
+
+// State returns the project's build database.
+func (p *Project) State() *BuildState { return p.state }
+
+// Vars returns the project's variables.
+func (p *Project) Vars() *Vars { return p.vars }
+
+// Stats returns statistics for the most recent Build.
+func (p *Project) Stats() Stats { return p.stats }
+
+// dir returns the project's workspace.
+func (p *Project) dir() workspace { return workspace(p.opts.Dir) }
+
+// Build builds the given targets (the default target if none are given)
+// after any targets required by the active configs, then saves the build
+// state unless this is a dry run. The state is saved however the build
+// ends, so targets built before a failure aren't built again, and also
+// every few seconds as targets finish, so a build that is killed keeps
+// most of its record. Cancelling ctx kills running recipes; targets that
+// completed are still recorded. The outcome is written to StatusFile.
+func (p *Project) Build(ctx context.Context, targets ...string) (err error) {
+	targets = slices.Clone(targets)
+	for i, t := range targets {
+		targets[i] = filepath.ToSlash(t) // build\app.exe, as typed on Windows
+	}
+	if len(targets) == 0 {
+		def := p.graph.DefaultTarget()
+		if def == "" {
+			return fmt.Errorf("no targets specified and no default target")
+		}
+		targets = []string{def}
+	}
+	for _, t := range p.opts.Rebuild {
+		if _, err := p.graph.Lookup(t); err != nil {
+			return fmt.Errorf("--rebuild: %w", err)
+		}
+	}
+	p.stats = Stats{}
+	var failed []string // targets whose recipes failed
+	if !p.opts.DryRun {
+		defer func() {
+			if saveErr := p.saveState(); err == nil {
+				err = saveErr
+			}
+		}()
+		// Deferred before the statistics are, so that it runs after.
+		defer func() {
+			if serr := p.writeStatus(ctx, targets, failed, err); serr != nil && err == nil {
+				err = fmt.Errorf("status: %w", serr)
+			}
+		}()
+	}
+
+	var collect statsCollector
+	var manifest manifestCollector
+	var built []string // file targets whose recipes ran
+	progress := func(ev Event) {
+		collect.observe(ev)
+		if p.opts.Manifest {
+			manifest.observe(ev)
+		}
+		if ev.Kind == TargetFinished {
+			if info, err := p.graph.Lookup(ev.Target); err == nil && !info.IsTask {
+				built = append(built, ev.Target)
+			}
+		}
+		if ev.Kind == TargetFailed {
+			failed = append(failed, ev.Target)
+		}
+		if p.opts.Progress != nil {
+			p.opts.Progress(ev)
+		}
+	}
+	if err := p.generate(ctx, progress); err != nil {
+		return err
+	}
+	// With -k, what doesn't need the missing files is still built. With
+	// --ordered, an earlier target may write the files a later one needs,
+	// so each is checked as its turn comes.
+	checkSources := !p.opts.KeepGoing
+	if checkSources && !p.opts.Ordered {
+		if err := p.graph.checkSources(targets); err != nil {
+			return err
+		}
+	}
+	manifest.graph = p.graph
+	exec := p.newExecutor()
+	exec.SetProgress(progress)
+	if exec.jobserver == nil && exec.jobs > 1 && !p.opts.DryRun {
+		js, err := newJobserver(exec.jobs)
+		if err != nil {
+			return fmt.Errorf("jobserver: %w", err)
+		}
+		if js != nil {
+			defer js.close()
+			exec.jobserver = js
+		}
+	}
+	if !p.opts.DryRun {
+		suffix := strings.Join(p.opts.Configs, "-")
+		exec.checkpoint = func() error { return p.state.checkpoint(suffix) }
+	}
+	exec.under = p.underConfigs(ctx, exec)
+	p.under = nil
+	if p.opts.Explain && p.opts.DryRun {
+		exec.explain = true
+		exec.dependents = make(map[string][]string)
+		exec.wouldBuild = make(map[string]bool)
+	}
+	if !p.opts.DryRun {
+		dir := p.dir().path(filepath.Join(stateDir, "cache"))
+		if !p.opts.LocalState {
+			if shared, err := sharedCacheDir(ctx, p.dir()); err == nil {
+				dir = shared
+			}
+		}
+		exec.actions = &actionCache{dir: dir, root: p.dir()}
+		if url := remoteCacheURL(p.graph); url != "" {
+			exec.actions.remote = newRemoteCache(url)
+		}
+	}
+	if p.opts.Provenance != "" && !p.opts.DryRun {
+		key := p.opts.ProvenanceKey
+		if key != "" {
+			key = p.dir().path(key)
+		}
+		w, err := newProvenanceWriter(p.dir().path(p.opts.Provenance), key, "https://github.com/marcelocantos/mk")
+		if err != nil {
+			return err
+		}
+		exec.provenance = w
+	}
+	if p.opts.Audit != "" && !p.opts.DryRun {
+		a, err := openAuditLog(p.dir().path(p.opts.Audit))
+		if err != nil {
+			return fmt.Errorf("audit log: %w", err)
+		}
+		exec.audit = a
+	}
+
+	p.vars.SetContext(ctx)
+	defer p.vars.SetContext(nil)
+
+	start := time.Now()
+	var name, launcher string
+	var hits0, misses0 int
+	var haveCacheStats bool
+	if p.opts.Stats {
+		launcher = p.vars.Get(launcherVar)
+		name, hits0, misses0, haveCacheStats = launcherStats(ctx, launcher)
+	}
+	defer func() {
+		p.stats = collect.stats
+		p.stats.Elapsed = time.Since(start)
+		p.stats.ParseTime, p.stats.GraphTime = p.parseTime, p.graphTime
+		p.stats.StaleTime = time.Duration(exec.staleTime.Load())
+		p.stats.ExecTime = time.Duration(exec.execTime.Load())
+		p.stats.Ignored = int(exec.ignored.Load())
+		if haveCacheStats {
+			if _, hits, misses, ok := launcherStats(context.Background(), launcher); ok {
+				p.stats.Launcher = name
+				p.stats.CacheHits = hits - hits0
+				p.stats.CacheMisses = misses - misses0
+			}
+		}
+	}()
+
+	var errs []error // with KeepGoing, of the targets that failed
+	if p.opts.Ordered || len(targets) == 1 {
+		for _, t := range targets {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			if checkSources && p.opts.Ordered {
+				if err = p.graph.checkSources([]string{t}); err != nil {
+					break
+				}
+			}
+			if err = exec.Build(ctx, t); err != nil {
+				if !p.opts.KeepGoing {
+					break
+				}
+				errs = append(errs, err)
+				err = nil
+			}
+		}
+	} else {
+		errs = exec.BuildAll(ctx, targets)
+		if !p.opts.KeepGoing && len(errs) > 0 {
+			err, errs = errs[0], nil
+		}
+	}
+	if err == nil && len(errs) > 0 {
+		err = failures(exec.Failures(), errs)
+	}
+	if err == nil && p.opts.Reproducible && !p.opts.DryRun {
+		err = p.verifyReproducible(ctx, exec, built)
+	}
+	if err == nil && exec.provenance != nil {
+		err = exec.provenance.Err()
+	}
+	if err == nil && p.opts.Manifest && !p.opts.DryRun {
+		if merr := manifest.write(p.dir().path(ManifestFile), exec.cache); merr != nil {
+			err = fmt.Errorf("manifest: %w", merr)
+		}
+	}
+	if exec.audit != nil {
+		if cerr := exec.audit.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("audit log: %w", cerr)
+		}
+	}
+
+	return err
+}
+
+// Failures is the error of a build with Options.KeepGoing: the errors of
+// the recipes that failed, in the order they failed, then those of
+// targets that failed for other reasons, such as a missing prerequisite.
+type Failures []error
+
+func (f Failures) Error() string {
+	if len(f) == 1 {
+		return f[0].Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d failures:", len(f))
+	for _, err := range f {
+		fmt.Fprintf(&b, "\n  %v", err)
+	}
+	return b.String()
+}
+
+func (f Failures) Unwrap() []error { return f }
+
+// failures returns the Failures of a build in which recipes failed and
+// targets' builds returned errs: the recipes' errors, and the errors in
+// errs that don't come from one of them.
+func failures(recipes, errs []error) Failures {
+	f := Failures(recipes)
+	for _, err := range errs {
+		if !slices.ContainsFunc(recipes, func(r error) bool { return errors.Is(err, r) }) {
+			f = append(f, err)
+		}
+	}
+	return f
+}
+
+// saveState saves the project's build state and that of the projects
+// loaded for prerequisites under other configs, returning the first
+// error.
+func (p *Project) saveState() error {
+	err := p.state.Save(strings.Join(p.opts.Configs, "-"))
+	for _, sp := range p.under {
+		if saveErr := sp.state.Save(strings.Join(sp.opts.Configs, "-")); err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// newExecutor returns an executor for the project's graph and options.
+func (p *Project) newExecutor() *Executor {
+	exec := NewExecutor(p.graph, p.state, p.vars, p.opts.Verbose, p.opts.Force, p.opts.DryRun, p.opts.Jobs)
+	stdout, stderr := p.opts.Stdout, p.opts.Stderr
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	exec.SetOutput(stdout, stderr)
+	exec.console.width = p.opts.Width
+	exec.SetRunner(p.opts.Runner)
+	if p.opts.Jobs < 0 {
+		// Under make -j, share its slots instead of taking one per CPU.
+		if js := inheritedJobserver(); js != nil {
+			exec.sem, exec.jobserver = nil, js
+		}
+	}
+	exec.containment = p.opts.Containment
+	exec.sandbox = p.opts.Sandbox
+	exec.strict = p.opts.Strict
+	exec.SetKeepGoing(p.opts.KeepGoing)
+	exec.SetRebuild(p.opts.Rebuild, p.opts.Downstream)
+	if p.opts.CoarseMtime {
+		exec.cache.SetCoarseMtime(p.opts.RehashBelow)
+	}
+	return exec
+}
@@ -0,0 +1,979 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProjectBuild(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+greeting = hello
+
+out.txt: in.txt
+    cat $input > $target
+    echo $greeting
+
+!fail:
+    exit 1
+`), 0o644)
+	os.WriteFile("in.txt", []byte("data"), 0o644)
+
+	var stdout, stderr bytes.Buffer
+	var events []Event
+	p, err := Load(context.Background(), "mkfile", Options{
+		Vars:     map[string]string{"greeting": "hi"},
+		Jobs:     1,
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Progress: func(ev Event) { events = append(events, ev) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Build(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(stdout.String()); got != "hi" {
+		t.Errorf("stdout = %q, want %q", got, "hi")
+	}
+	if !strings.Contains(stderr.String(), `mk: building "out.txt"`) {
+		t.Errorf("stderr = %q, want build banner", stderr.String())
+	}
+	if len(events) != 2 || events[0].Kind != TargetStarted || events[1].Kind != TargetFinished || events[1].Target != "out.txt" {
+		t.Errorf("events = %+v, want started and finished for out.txt", events)
+	}
+	if _, err := os.Stat(StateFile("")); err != nil {
+		t.Errorf("state not saved: %v", err)
+	}
+
+	// Second build: up to date.
+	events = nil
+	if err := p.Build(context.Background(), "out.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Kind != TargetSkipped {
+		t.Errorf("events = %+v, want one skipped", events)
+	}
+
+	events = nil
+	if err := p.Build(context.Background(), "fail"); err == nil {
+		t.Error("expected failure")
+	}
+	if len(events) != 2 || events[1].Kind != TargetFailed || events[1].Err == nil {
+		t.Errorf("events = %+v, want started and failed", events)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Build(ctx, "out.txt"); err != context.Canceled {
+		t.Errorf("Build with cancelled context = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestProgressEventDetail(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+sum = $[artifact missing.txt]
+
+out.txt: in.txt
+    cat $input > $target
+
+touchy.txt: in2.txt
+    echo x >> $input; cp $input $target
+`), 0o644)
+	os.WriteFile("in.txt", []byte("data"), 0o644)
+	os.WriteFile("in2.txt", []byte("data"), 0o644)
+
+	var stderr bytes.Buffer
+	var events []Event
+	build := func(targets ...string) {
+		t.Helper()
+		events = nil
+		mustBuild(t, Options{
+			Jobs:       1,
+			LocalState: true,
+			Stdout:     io.Discard,
+			Stderr:     &stderr,
+			Progress:   func(ev Event) { events = append(events, ev) },
+		}, targets...)
+	}
+
+	build("out.txt")
+	if !strings.Contains(stderr.String(), "mk: artifact: ") {
+		t.Errorf("stderr = %q, want the $[artifact] failure on Options.Stderr", stderr.String())
+	}
+	if len(events) != 2 || events[0].Rule != "mkfile:4" || events[0].Time.IsZero() {
+		t.Errorf("events = %+v, want them to name the rule at mkfile:4 and when", events)
+	}
+
+	os.Remove("out.txt")
+	build("out.txt")
+	if len(events) != 1 || events[0].Kind != TargetRestored || events[0].Digest == "" {
+		t.Errorf("events = %+v, want restored from the action cache, with its key", events)
+	}
+
+	build("touchy.txt")
+	i := slices.IndexFunc(events, func(ev Event) bool { return ev.Kind == TargetWarning })
+	if i < 0 || !strings.Contains(events[i].Message, "modified its prerequisites") || events[i].Target != "touchy.txt" {
+		t.Errorf("events = %+v, want a warning that touchy.txt's recipe modified its prerequisite", events)
+	}
+}
+
+func TestJSONEvents(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+out.txt: in.txt
+    cat $input > $target
+
+bad.txt:
+    exit 3
+`), 0o644)
+	os.WriteFile(filepath.Join(dir, "in.txt"), []byte("data"), 0o644)
+
+	var stream bytes.Buffer
+	build := func(target string) error {
+		_, err := loadAndBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard, Progress: JSONEvents(&stream)}, target)
+		return err
+	}
+	build("out.txt")
+	build("out.txt")
+	build("bad.txt")
+
+	var got []map[string]any
+	for line := range strings.Lines(stream.String()) {
+		var ev map[string]any
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		got = append(got, ev)
+	}
+	var kinds []string
+	for _, ev := range got {
+		kinds = append(kinds, ev["kind"].(string)+" "+ev["target"].(string))
+	}
+	want := []string{"started out.txt", "finished out.txt", "skipped out.txt", "started bad.txt", "failed bad.txt"}
+	if !slices.Equal(kinds, want) {
+		t.Fatalf("events = %q, want %q", kinds, want)
+	}
+	if got[0]["command"] != "cat in.txt > out.txt" || got[0]["reasons"] == nil || got[0]["time"] == "" {
+		t.Errorf("started event = %v, want the command, reasons and time", got[0])
+	}
+	if !strings.Contains(got[4]["error"].(string), "exit status 3") {
+		t.Errorf("failed event = %v, want the error", got[4])
+	}
+}
+
+func TestRebuildReasons(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+out.txt: in.txt
+    cat $input > $target
+`), 0o644)
+	os.WriteFile("in.txt", []byte("data"), 0o644)
+
+	var stderr bytes.Buffer
+	var events []Event
+	mustBuild(t, Options{
+		Verbose:  true,
+		Jobs:     1,
+		Stderr:   &stderr,
+		Progress: func(ev Event) { events = append(events, ev) },
+	})
+	if len(events) == 0 || !slices.Contains(events[0].Reasons, StaleReason{Kind: StaleUnbuilt, Target: "out.txt"}) {
+		t.Errorf("events = %+v, want first build reason", events)
+	}
+
+	os.WriteFile("in.txt", []byte("changed"), 0o644)
+	events = nil
+	stderr.Reset()
+	p := mustBuild(t, Options{
+		Verbose:  true,
+		Jobs:     1,
+		Stderr:   &stderr,
+		Progress: func(ev Event) { events = append(events, ev) },
+	})
+	want := StaleReason{Kind: StalePrereq, Prereq: "in.txt"}
+	if len(events) == 0 || events[0].Kind != TargetStarted || !slices.Equal(events[0].Reasons, []StaleReason{want}) {
+		t.Errorf("events = %+v, want started with reason %v", events, want)
+	}
+	if banner := `mk: building "out.txt": prerequisite "in.txt" has changed`; !strings.Contains(stderr.String(), banner) {
+		t.Errorf("stderr = %q, want %q", stderr.String(), banner)
+	}
+	if s := p.Stats(); s.Stale[StalePrereq] != 1 || len(s.Stale) != 1 {
+		t.Errorf("stats stale = %v, want 1 prereq", s.Stale)
+	}
+	if s := p.Stats(); s.ParseTime <= 0 || s.GraphTime <= 0 || s.StaleTime <= 0 || s.ExecTime <= 0 {
+		t.Errorf("stats phases = parse %s, graph %s, stale %s, exec %s; want all timed", s.ParseTime, s.GraphTime, s.StaleTime, s.ExecTime)
+	}
+}
+
+func TestGraphLookup(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+build/{name}.o [keep]: src/{name}.c | build/
+    cc -c $input -o $target
+`), 0o644)
+
+	p, err := Load(context.Background(), filepath.Join(dir, "mkfile"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := p.Graph().Lookup("build/foo.o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Targets[0] != "build/foo.o" || info.Prereqs[0] != "src/foo.c" || info.OrderOnly[0] != "build/" {
+		t.Errorf("unexpected rule: %+v", info)
+	}
+	if !info.Keep || info.Stem != "foo" || len(info.Recipe) != 1 {
+		t.Errorf("unexpected rule: %+v", info)
+	}
+	if _, err := p.Graph().Lookup("nope"); err == nil {
+		t.Error("expected error for unknown target")
+	}
+}
+
+func TestProjectBuildTimeout(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+!slow: done.txt
+    sleep 10
+
+done.txt:
+    echo done > $target
+`), 0o644)
+
+	p, err := Load(context.Background(), "mkfile", Options{Jobs: 1, Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = p.Build(ctx, "slow")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Build = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Build took %v; recipe was not killed", elapsed)
+	}
+
+	// The prerequisite that finished before the deadline is recorded.
+	if LoadState("").GetTarget("done.txt") == nil {
+		t.Error("done.txt not recorded after cancelled build")
+	}
+}
+
+func TestRecipeModifiesPrereq(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+out.txt: in.txt
+    cp $input $target
+    echo more >> $input
+`), 0o644)
+	os.WriteFile("in.txt", []byte("data"), 0o644)
+
+	var stderr bytes.Buffer
+	mustBuild(t, Options{Jobs: 1, Stderr: &stderr}, "out.txt")
+	if !strings.Contains(stderr.String(), `mk: warning: recipe for "out.txt" modified its prerequisites "in.txt"`) {
+		t.Errorf("stderr = %q, want modified-prerequisite warning", stderr.String())
+	}
+
+	if _, err := loadAndBuild(t, Options{Jobs: 1, Stderr: io.Discard, Strict: true, Force: true}, "out.txt"); err == nil || !strings.Contains(err.Error(), "modified its prerequisites") {
+		t.Errorf("strict Build = %v, want modified-prerequisite error", err)
+	}
+	if fileExists("out.txt") {
+		t.Error("out.txt kept after strict failure")
+	}
+}
+
+func TestModifiedOutputs(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+out.txt: in.txt
+    cp $input $target
+`), 0o644)
+	os.WriteFile("in.txt", []byte("data"), 0o644)
+
+	build := func(check OutputCheck) string {
+		t.Helper()
+		var stderr bytes.Buffer
+		mustBuild(t, Options{Jobs: 1, Stderr: &stderr, CheckOutputs: check}, "out.txt")
+		return stderr.String()
+	}
+	edit := func() {
+		os.WriteFile("out.txt", []byte("edited by hand"), 0o644)
+	}
+	contents := func() string {
+		data, _ := os.ReadFile("out.txt")
+		return string(data)
+	}
+
+	build(OutputsRebuild)
+	edit()
+	build(OutputsRebuild)
+	if got := contents(); got != "data" {
+		t.Errorf("after rebuild, out.txt = %q, want it rebuilt", got)
+	}
+
+	edit()
+	if stderr := build(OutputsWarn); !strings.Contains(stderr, `mk: warning: "out.txt" was modified since mk built it; not rebuilding`) {
+		t.Errorf("stderr = %q, want modified-output warning", stderr)
+	}
+	if got := contents(); got != "edited by hand" {
+		t.Errorf("with OutputsWarn, out.txt = %q, want the edit kept", got)
+	}
+
+	if stderr := build(OutputsIgnore); strings.Contains(stderr, "modified") {
+		t.Errorf("with OutputsIgnore, stderr = %q", stderr)
+	}
+	if got := contents(); got != "edited by hand" {
+		t.Errorf("with OutputsIgnore, out.txt = %q, want the edit kept", got)
+	}
+}
+
+func TestImplicitChainLimit(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+{name}.in: {name}.in.in
+    cp $input $target
+
+a: b
+b: a
+`), 0o644)
+
+	var stderr bytes.Buffer
+	p, err := Load(context.Background(), "mkfile", Options{Jobs: 1, Stderr: &stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr.String(), "mkfile:2: warning: prerequisite {name}.in.in matches target pattern {name}.in") {
+		t.Errorf("stderr = %q, want self-matching pattern warning", stderr.String())
+	}
+
+	err = p.Build(context.Background(), "x.in")
+	if err == nil || !strings.HasPrefix(err.Error(), `implicit rule chain more than 16 deep, through patterns {name}.in: "x.in" <- "x.in.in" <- `) {
+		t.Errorf("Build(x.in) = %v, want implicit chain error", err)
+	}
+	if err := p.Build(context.Background(), "a"); err == nil || err.Error() != "dependency cycle: a -> b -> a" {
+		t.Errorf("Build(a) = %v, want dependency cycle", err)
+	}
+}
+
+func TestNoRuleDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.Mkdir("lib", 0o755)
+	os.WriteFile("mkfile", []byte(`
+include lib/mkfile as lib
+
+build/{name}.o: {name}.c
+    cc -c $input -o $target
+
+gen/{name:[a-z]*}.h: {name}.def
+    gen $input > $target
+
+!test:
+    true
+`), 0o644)
+	os.WriteFile("lib/mkfile", []byte("!check:\n    true\n"), 0o644)
+	os.WriteFile("README.md", nil, 0o644)
+
+	p, err := Load(context.Background(), "mkfile", Options{Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, want := range map[string]string{
+		"tset":      `did you mean "test"?`,
+		"foo.o":     `pattern build/{name}.o (mkfile:4) builds "build/foo.o"`,
+		"gen/Foo.h": `pattern gen/{name:[a-z]*}.h (mkfile:7) matches, but "Foo" fails the constraint on {name}`,
+		"readme.md": `file "README.md" exists; names are case-sensitive`,
+	} {
+		_, err := p.Graph().Lookup(target)
+		if err == nil {
+			t.Errorf("Lookup(%q) succeeded", target)
+			continue
+		}
+		msg := err.Error()
+		if !strings.HasPrefix(msg, fmt.Sprintf("no rule to build %q\n  searched: mkfile, lib/mkfile\n", target)) || !strings.Contains(msg, want) {
+			t.Errorf("Lookup(%q) error:\n%s\nwant it to contain %q", target, msg, want)
+		}
+	}
+}
+
+func TestMissingSources(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+app: setup build/a.o build/b.o
+    cat $inputs > $target
+
+!setup:
+    touch ran
+
+build/a.o: a.c config.h
+    cat $inputs > $target
+
+build/b.o: b.c config.h
+    cat $inputs > $target
+`), 0o644)
+	os.WriteFile(filepath.Join(dir, "a.c"), nil, 0o644)
+	os.WriteFile(filepath.Join(dir, "B.c"), nil, 0o644)
+
+	_, err := loadAndBuild(t, Options{Dir: dir, Jobs: 4, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "app")
+	want := `2 prerequisites are missing and no rule builds them:
+  "b.c", needed by "build/b.o" (mkfile:11)
+    file "B.c" exists; names are case-sensitive
+  "config.h", needed by "build/a.o" (mkfile:8), "build/b.o" (mkfile:11)
+  searched: mkfile`
+	if err == nil || err.Error() != want {
+		t.Errorf("err = %v, want %s", err, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ran")); err == nil {
+		t.Errorf("a recipe ran before the missing files were reported")
+	}
+}
+
+func TestActionCacheSharedAcrossCheckouts(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	repo := t.TempDir()
+	oldDir, _ := os.Getwd()
+	defer os.Chdir(oldDir)
+	os.Chdir(repo)
+
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	os.WriteFile("mkfile", []byte(`
+out.txt: in.txt
+    cp $input $target
+    chmod +x $target
+    echo ran >> runs.log
+`), 0o644)
+	os.WriteFile("in.txt", []byte("data"), 0o644)
+	git("init", "-q")
+	git("add", "mkfile", "in.txt")
+	git("commit", "-q", "-m", "init")
+	worktree := filepath.Join(t.TempDir(), "wt")
+	git("worktree", "add", "-q", worktree)
+
+	build := func(opts Options) Stats {
+		t.Helper()
+		opts.Jobs, opts.Stderr = 1, io.Discard
+		return mustBuild(t, opts, "out.txt").Stats()
+	}
+
+	build(Options{})
+	os.Chdir(worktree)
+	if s := build(Options{}); s.Restored != 1 || s.Built != 0 {
+		t.Errorf("worktree build: %+v, want out.txt restored", s)
+	}
+	if data, _ := os.ReadFile("out.txt"); string(data) != "data" {
+		t.Errorf("restored out.txt = %q", data)
+	}
+	if info, err := os.Stat("out.txt"); err != nil || info.Mode()&0o100 == 0 {
+		t.Errorf("restored out.txt lost its mode: %v", info.Mode())
+	}
+	if fileExists("runs.log") {
+		t.Error("recipe ran in the worktree")
+	}
+
+	os.Remove("out.txt")
+	if s := build(Options{LocalState: true}); s.Built != 1 {
+		t.Errorf("worktree build with LocalState: %+v, want out.txt built", s)
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	// parser.tab.h comes from the pattern rule, which also writes
+	// parser.tab.c, but parser.tab.c has an explicit rule of its own.
+	os.WriteFile("mkfile", []byte(`
+parser.tab.c: parser.y
+    cp $input $target
+
+{name}.tab.c {name}.tab.h: {name}.y
+    cp $input {name}.tab.c
+    cp $input {name}.tab.h
+`), 0o644)
+	os.WriteFile("parser.y", []byte("grammar"), 0o644)
+
+	// Either rule may be reached first.
+	want := `mk: warning: rules at mkfile:2 and mkfile:5 both write "parser.tab.c"; their recipes race`
+	for _, targets := range [][]string{{"parser.tab.c", "parser.tab.h"}, {"parser.tab.h", "parser.tab.c"}} {
+		var stderr bytes.Buffer
+		mustBuild(t, Options{Jobs: 1, Stderr: &stderr, Force: true}, targets...)
+		if strings.Count(stderr.String(), want) != 1 {
+			t.Errorf("building %q: stderr = %q, want %q once", targets, stderr.String(), want)
+		}
+	}
+
+	if _, err := loadAndBuild(t, Options{Jobs: 1, Stderr: io.Discard, Strict: true, Force: true}, "parser.tab.c", "parser.tab.h"); err == nil || !strings.Contains(err.Error(), "their recipes race") {
+		t.Errorf("strict Build = %v, want concurrent writers error", err)
+	}
+}
+
+func TestDryRunExplain(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+app: lib.o main.o
+    cat $inputs > $target
+
+lib.o: lib.c
+    cp $input $target
+
+main.o: main.c
+    cp $input $target
+
+!ship: app
+    true
+`), 0o644)
+	os.WriteFile("lib.c", []byte("a"), 0o644)
+	os.WriteFile("main.c", []byte("b"), 0o644)
+	mustBuild(t, Options{Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "app")
+
+	os.WriteFile("lib.c", []byte("changed"), 0o644)
+	var stderr bytes.Buffer
+	mustBuild(t, Options{DryRun: true, Explain: true, Jobs: 1, Stdout: io.Discard, Stderr: &stderr}, "ship")
+	want := `mk: building "lib.o": prerequisite "lib.c" has changed
+  cp lib.c lib.o
+  # affects: app ship
+mk: building "app": prerequisite "lib.o" would be rebuilt
+  cat lib.o main.o > app
+  # affects: ship
+mk: building "ship"
+  true
+`
+	if got := stderr.String(); got != want {
+		t.Errorf("dry run =\n%s\nwant\n%s", got, want)
+	}
+	if data, _ := os.ReadFile("app"); string(data) != "ab" {
+		t.Errorf("app = %q; the dry run rebuilt it", data)
+	}
+}
+
+func TestWorkspaceDir(t *testing.T) {
+	oldDir, _ := os.Getwd()
+	build := func(dir string) (Stats, error) {
+		p, err := Load(context.Background(), "mkfile", Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard})
+		if err != nil {
+			return Stats{}, err
+		}
+		err = p.Build(context.Background())
+		return p.Stats(), err
+	}
+
+	dirs := []string{t.TempDir(), t.TempDir()}
+	for i, dir := range dirs {
+		os.MkdirAll(filepath.Join(dir, "src"), 0o755)
+		os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+include parts.mk
+srcs = $[wildcard src/*.txt]
+out.txt: $srcs
+    cat $inputs > $target
+    echo $name $where >> $target
+`), 0o644)
+		os.WriteFile(filepath.Join(dir, "parts.mk"), []byte("name = "+fmt.Sprint("part", i)+"\nwhere = $[shell basename $(pwd)]\n"), 0o644)
+		os.WriteFile(filepath.Join(dir, "src", "a.txt"), []byte(fmt.Sprintln("a", i)), 0o644)
+	}
+
+	errs := make(chan error, len(dirs))
+	for _, dir := range dirs {
+		go func() {
+			_, err := build(dir)
+			errs <- err
+		}()
+	}
+	for range dirs {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, dir := range dirs {
+		want := fmt.Sprintf("a %d\npart%d %s\n", i, i, filepath.Base(dir))
+		if data, _ := os.ReadFile(filepath.Join(dir, "out.txt")); string(data) != want {
+			t.Errorf("%s/out.txt = %q, want %q", dir, data, want)
+		}
+		if _, err := os.Stat(filepath.Join(dir, StateFile(""))); err != nil {
+			t.Errorf("state not saved in %s: %v", dir, err)
+		}
+		if s, err := build(dir); err != nil || s.Built != 0 {
+			t.Errorf("rebuild in %s: %+v, %v; want up to date", dir, s, err)
+		}
+	}
+	if cwd, _ := os.Getwd(); cwd != oldDir {
+		t.Errorf("working directory changed to %s", cwd)
+	}
+	if fileExists("out.txt") {
+		t.Error("out.txt written to the current directory")
+	}
+}
+
+func TestMkfileDirIsWorkspace(t *testing.T) {
+	top := t.TempDir()
+	sub := filepath.Join(top, "sub")
+	os.MkdirAll(sub, 0o755)
+	os.WriteFile(filepath.Join(sub, "mkfile"), []byte(`
+out.txt: in.txt
+    cp $input $target
+`), 0o644)
+	os.WriteFile(filepath.Join(sub, "in.txt"), []byte("data"), 0o644)
+
+	build := func(dir, path string) Stats {
+		t.Helper()
+		p, err := Load(context.Background(), path, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Build(context.Background(), "out.txt"); err != nil {
+			t.Fatal(err)
+		}
+		return p.Stats()
+	}
+
+	if s := build(top, "sub/mkfile"); s.Built != 1 {
+		t.Fatalf("first build: %+v, want out.txt built", s)
+	}
+	if !fileExists(filepath.Join(sub, "out.txt")) || !fileExists(filepath.Join(sub, StateFile(""))) {
+		t.Error("out.txt and the state file should be in the mkfile's directory")
+	}
+	if fileExists(filepath.Join(top, stateDir)) {
+		t.Error("state written outside the mkfile's directory")
+	}
+	if s := build(sub, "mkfile"); s.Built != 0 {
+		t.Errorf("build from the mkfile's directory: %+v, want up to date", s)
+	}
+}
+
+func TestStateSavedOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+!all: ok.txt bad.txt
+
+ok.txt:
+    echo run >> ok.log
+    echo ok > $target
+
+bad.txt:
+    while [ ! -f ok.txt ]; do sleep 0.01; done
+    test ! -f broken
+    echo bad > $target
+`), 0o644)
+	os.WriteFile(filepath.Join(dir, "broken"), nil, 0o644)
+	build := func(targets ...string) error {
+		t.Helper()
+		_, err := loadAndBuild(t, Options{Dir: dir, Jobs: 2, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, targets...)
+		return err
+	}
+	runs := func() int {
+		data, _ := os.ReadFile(filepath.Join(dir, "ok.log"))
+		return strings.Count(string(data), "run")
+	}
+
+	// Parallel prerequisites: ok.txt is recorded though bad.txt fails
+	// (after it, so that the failure doesn't stop it starting).
+	if err := build("all"); err == nil {
+		t.Fatal("expected bad.txt to fail")
+	}
+	if loadState(workspace(dir), "").GetTarget("ok.txt") == nil {
+		t.Fatal("ok.txt built before the failure wasn't saved")
+	}
+
+	os.Remove(filepath.Join(dir, "broken"))
+	if err := build("all"); err != nil {
+		t.Fatal(err)
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("ok.txt built %d times, want once (it was up to date)", n)
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+!all: bad.txt slow.txt after.txt
+
+bad.txt:
+    while [ ! -f gate.started ]; do sleep 0.01; done
+    exit 1
+
+gate.txt:
+    touch gate.started
+    sleep 0.2
+    echo gate > $target
+
+slow.txt: gate.txt
+    echo slow > $target
+
+after.txt: bad.txt
+    echo after > $target
+
+other.txt:
+    echo other > $target
+
+worse.txt:
+    exit 2
+`), 0o644)
+	build := func(keepGoing bool, targets ...string) error {
+		t.Helper()
+		// Nothing is up to date or cached: gate.txt's recipe must run.
+		for _, f := range []string{".mk", "gate.started", "gate.txt", "slow.txt", "after.txt", "other.txt"} {
+			os.RemoveAll(filepath.Join(dir, f))
+		}
+		// Ordered, so that other.txt starts only after all is done.
+		_, err := loadAndBuild(t, Options{Dir: dir, Jobs: 2, KeepGoing: keepGoing, Ordered: true, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, targets...)
+		return err
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	// Without -k, no recipe starts after bad.txt fails: gate.txt's
+	// finishes, but slow.txt's doesn't start.
+	err := build(false, "all", "other.txt")
+	if err == nil || !strings.Contains(err.Error(), `recipe for "bad.txt" failed`) {
+		t.Fatalf("err = %v, want bad.txt's failure", err)
+	}
+	if !exists("gate.txt") || exists("slow.txt") || exists("other.txt") {
+		t.Error("recipes started after a failure without -k")
+	}
+
+	err = build(true, "all", "other.txt", "worse.txt", "missing.txt")
+	var f Failures
+	if !errors.As(err, &f) || len(f) != 3 {
+		t.Fatalf("err = %v, want Failures of bad.txt, worse.txt and missing.txt", err)
+	}
+	for i, want := range []string{`recipe for "bad.txt"`, `recipe for "worse.txt"`, `"missing.txt"`} {
+		if !strings.Contains(f[i].Error(), want) {
+			t.Errorf("failure %d = %v, want %s", i, f[i], want)
+		}
+	}
+	if !exists("slow.txt") || !exists("other.txt") {
+		t.Error("-k didn't build targets independent of the failure")
+	}
+	if exists("after.txt") {
+		t.Error("-k built after.txt, whose prerequisite failed")
+	}
+}
+
+func TestTargetOrder(t *testing.T) {
+	dir := t.TempDir()
+	// Each of a and b waits for the other to start, which only a
+	// build running them together lets happen.
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+wait = for i in $$(seq 200); do [ -f $1 ] && exit 0; sleep 0.01; done; exit 1
+
+!a:
+    touch a.started
+    $[subst $$1,b.started,$wait]
+
+!b:
+    touch b.started
+    $[subst $$1,a.started,$wait]
+
+!clean:
+    rm -f out.txt
+
+out.txt:
+    echo out > $target
+
+!fetch:
+    echo hello > src.txt
+
+copy.txt: src.txt
+    cp $input $target
+`), 0o644)
+	build := func(ordered bool, targets ...string) error {
+		t.Helper()
+		_, err := loadAndBuild(t, Options{Dir: dir, Jobs: 2, Ordered: ordered, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, targets...)
+		return err
+	}
+
+	if err := build(false, "a", "b"); err != nil {
+		t.Errorf("a and b together: %v", err)
+	}
+	// out.txt is up to date, and removed by clean before it is checked.
+	if err := build(false, "out.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if err := build(true, "clean", "out.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "out.txt")); err != nil {
+			t.Fatalf("out.txt missing after mk --ordered clean out.txt")
+		}
+	}
+
+	// A target's sources are checked when its turn comes, after the
+	// targets before it wrote them.
+	if err := build(true, "copy.txt", "fetch"); err == nil || !strings.Contains(err.Error(), `"src.txt"`) {
+		t.Errorf("copy.txt before fetch: err = %v, want src.txt missing", err)
+	}
+	if err := build(true, "fetch", "copy.txt"); err != nil {
+		t.Errorf("mk --ordered fetch copy.txt: %v", err)
+	}
+}
+
+func TestRebuildTargets(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "src"), []byte("x\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+!all: c z
+
+c: b
+    cp $input $target
+b: a
+    cp $input $target
+a: src
+    cp $input $target
+z: src
+    cp $input $target
+`), 0o644)
+	build := func(opts Options) []string {
+		t.Helper()
+		var built []string
+		opts.Dir, opts.Jobs, opts.LocalState, opts.Stdout, opts.Stderr = dir, 1, true, io.Discard, io.Discard
+		opts.Progress = func(ev Event) {
+			if ev.Kind == TargetStarted && ev.Target != "all" {
+				built = append(built, ev.Target)
+			}
+		}
+		mustBuild(t, opts, "all")
+		slices.Sort(built)
+		return built
+	}
+	build(Options{})
+
+	for _, tc := range []struct {
+		rebuild    []string
+		downstream bool
+		want       []string
+	}{
+		{[]string{"b"}, false, []string{"b"}},
+		{[]string{"b"}, true, []string{"b", "c"}},
+		{[]string{"a", "z"}, false, []string{"a", "z"}},
+		{[]string{"src"}, true, []string{"a", "b", "c", "z"}},
+	} {
+		if got := build(Options{Rebuild: tc.rebuild, Downstream: tc.downstream}); !slices.Equal(got, tc.want) {
+			t.Errorf("--rebuild %v (downstream %v) built %v, want %v", tc.rebuild, tc.downstream, got, tc.want)
+		}
+	}
+
+	if _, err := loadAndBuild(t, Options{Dir: dir, Rebuild: []string{"nope"}}, "all"); err == nil {
+		t.Error("--rebuild of a target with no rule: want error")
+	}
+}
+
+func TestAggregateTasks(t *testing.T) {
+	dir := t.TempDir()
+	// left and right each wait for the other to start: they finish only
+	// if all's prerequisites run in parallel.
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+# Everything.
+!all: left
+
+left:
+    touch left.started
+    while [ ! -f right.started ]; do sleep 0.01; done
+    touch $target
+
+right:
+    touch right.started
+    while [ ! -f left.started ]; do sleep 0.01; done
+    touch $target
+
+!all: right | left
+
+!noop:
+`), 0o644)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p, err := Load(ctx, "mkfile", Options{Dir: dir, Jobs: 2, LocalState: true, Stdout: io.Discard, Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Build(ctx, "all"); err != nil {
+		t.Fatal(err)
+	}
+
+	var runs []string
+	for _, c := range p.Graph().Completions() {
+		if c.Name == "all" {
+			runs = c.Runs
+		}
+	}
+	if want := []string{"left", "right"}; !slices.Equal(runs, want) {
+		t.Errorf("all runs %v, want %v", runs, want)
+	}
+	var problems []string
+	for _, pr := range p.Graph().Check([]string{"all", "noop"}) {
+		problems = append(problems, pr.String())
+	}
+	if want := []string{`mkfile:17: task "noop" has no recipe and no prerequisites; it does nothing`}; !slices.Equal(problems, want) {
+		t.Errorf("Check = %q, want %q", problems, want)
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-toto and SLSA identifiers used in provenance documents.
+const (
+	intotoStatementType = "https://in-toto.io/Statement/v1"
+	intotoPayloadType   = "application/vnd.in-toto+json"
+	slsaPredicateType   = "https://slsa.dev/provenance/v1"
+	mkBuildType         = "https://github.com/marcelocantos/mk/provenance/v1"
+)
+
+// provenanceWriter writes a SLSA provenance statement, wrapped in a DSSE
+// envelope, for each artifact a build produces. The envelope for target t
+// is written to <dir>/<t>.intoto.jsonl.
+type provenanceWriter struct {
+	dir     string
+	builder string        // builder ID
+	signer  crypto.Signer // nil = unsigned envelopes
+	keyID   string
+
+	mu  sync.Mutex
+	err error // first write error
+}
+
+// newProvenanceWriter returns a writer for dir. If keyPath is non-empty it
+// names a PEM-encoded PKCS #8 private key (Ed25519, ECDSA or RSA) used to
+// sign every envelope.
+func newProvenanceWriter(dir, keyPath, builder string) (*provenanceWriter, error) {
+	w := &provenanceWriter{dir: dir, builder: builder}
+	if keyPath == "" {
+		return w, nil
+	}
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("provenance key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("provenance key %s: no PEM block", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("provenance key %s: %w", keyPath, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("provenance key %s: unsupported key type %T", keyPath, key)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("provenance key %s: %w", keyPath, err)
+	}
+	sum := sha256.Sum256(pub)
+	w.signer = signer
+	w.keyID = hex.EncodeToString(sum[:])
+	return w, nil
+}
+
+type intotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []intotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+type intotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition struct {
+		BuildType          string            `json:"buildType"`
+		ExternalParameters map[string]any    `json:"externalParameters"`
+		InternalParameters map[string]any    `json:"internalParameters"`
+		Dependencies       []slsaResourceRef `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn  string `json:"startedOn"`
+			FinishedOn string `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+type slsaResourceRef struct {
+	Name   string            `json:"name"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// record writes provenance for a successfully executed job. Errors are
+// kept and reported by Err, so one unwritable document doesn't stop the
+// build.
+func (w *provenanceWriter) record(job *Job, recipeText string, start, end time.Time) {
+	var st intotoStatement
+	st.Type = intotoStatementType
+	st.PredicateType = slsaPredicateType
+	dir := workspace(job.Dir)
+	for _, t := range job.Targets {
+		h, err := hashFile(dir.path(t))
+		if err != nil {
+			w.fail(fmt.Errorf("provenance for %q: %w", t, err))
+			return
+		}
+		st.Subject = append(st.Subject, intotoSubject{Name: t, Digest: map[string]string{"sha256": h}})
+	}
+
+	p := &st.Predicate
+	p.BuildDefinition.BuildType = mkBuildType
+	p.BuildDefinition.ExternalParameters = map[string]any{
+		"target": job.Target,
+		"recipe": recipeText,
+	}
+	p.BuildDefinition.InternalParameters = map[string]any{
+		"env": redactEnv(job.Env),
+	}
+	for _, in := range job.Inputs {
+		if h, err := hashFile(dir.path(in)); err == nil {
+			p.BuildDefinition.Dependencies = append(p.BuildDefinition.Dependencies,
+				slsaResourceRef{Name: in, Digest: map[string]string{"sha256": h}})
+		}
+	}
+	p.BuildDefinition.Dependencies = append(p.BuildDefinition.Dependencies, toolRefs(recipeText, job.Env)...)
+	p.RunDetails.Builder.ID = w.builder
+	p.RunDetails.Metadata.StartedOn = start.UTC().Format(time.RFC3339)
+	p.RunDetails.Metadata.FinishedOn = end.UTC().Format(time.RFC3339)
+
+	payload, err := json.Marshal(st)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	env := dsseEnvelope{
+		PayloadType: intotoPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []dsseSignature{},
+	}
+	if w.signer != nil {
+		sig, err := w.sign(dssePAE(intotoPayloadType, payload))
+		if err != nil {
+			w.fail(fmt.Errorf("signing provenance for %q: %w", job.Target, err))
+			return
+		}
+		env.Signatures = append(env.Signatures, dsseSignature{KeyID: w.keyID, Sig: base64.StdEncoding.EncodeToString(sig)})
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+
+	path := filepath.Join(w.dir, job.Target+".intoto.jsonl")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		w.fail(err)
+		return
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		w.fail(err)
+	}
+}
+
+func (w *provenanceWriter) sign(msg []byte) ([]byte, error) {
+	if _, ok := w.signer.(ed25519.PrivateKey); ok {
+		return w.signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(msg)
+	return w.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func (w *provenanceWriter) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Err returns the first error encountered while writing provenance.
+func (w *provenanceWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// dssePAE is the DSSE pre-authentication encoding that signatures cover.
+func dssePAE(payloadType string, payload []byte) []byte {
+	return fmt.Appendf(nil, "DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+}
+
+// toolRefs fingerprints the executables that recipe lines invoke: the
+// first word of each line, looked up on the recipe's PATH.
+func toolRefs(recipeText string, env []string) []slsaResourceRef {
+	path := os.Getenv("PATH")
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "PATH="); ok {
+			path = v
+		}
+	}
+	seen := map[string]bool{}
+	var refs []slsaResourceRef
+	for _, line := range strings.Split(recipeText, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || seen[fields[0]] {
+			continue
+		}
+		seen[fields[0]] = true
+		exe, err := lookPathIn(fields[0], path)
+		if err != nil {
+			continue // shell builtin, function or missing tool
+		}
+		if h, err := hashFile(exe); err == nil {
+			refs = append(refs, slsaResourceRef{Name: "tool:" + fields[0], URI: "file://" + exe, Digest: map[string]string{"sha256": h}})
+		}
+	}
+	return refs
+}
+
+func lookPathIn(name, path string) (string, error) {
+	if strings.Contains(name, "/") {
+		return filepath.Abs(name)
+	}
+	for _, dir := range filepath.SplitList(path) {
+		p := filepath.Join(dir, name)
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() && fi.Mode()&0o111 != 0 {
+			return p, nil
+		}
+	}
+	return "", exec.ErrNotFound
+}
+
+// redactEnv returns env as a map, hiding values of variables whose names
+// suggest credentials.
+func redactEnv(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = redactValue(k, v)
+	}
+	return m
+}
+
+// redactValue returns "<redacted>" in place of v if name looks like it
+// holds a credential.
+func redactValue(name, v string) string {
+	upper := strings.ToUpper(name)
+	for _, s := range []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "CREDENTIAL", "KEY"} {
+		if strings.Contains(upper, s) {
+			return "<redacted>"
+		}
+	}
+	return v
+}
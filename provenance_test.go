@@ -0,0 +1,80 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	os.WriteFile("key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+
+	t.Setenv("API_TOKEN", "hunter2")
+	os.WriteFile("mkfile", []byte(`
+build/out.txt: in.txt
+    cat $input > $target
+`), 0o644)
+	os.WriteFile("in.txt", []byte("data"), 0o644)
+
+	mustBuild(t, Options{
+		Jobs:          1,
+		Stderr:        io.Discard,
+		Provenance:    "prov",
+		ProvenanceKey: "key.pem",
+	}, "build/out.txt")
+
+	data, err := os.ReadFile("prov/build/out.txt.intoto.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env dsseEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := base64.StdEncoding.DecodeString(env.Payload)
+	if len(env.Signatures) != 1 {
+		t.Fatalf("signatures = %d, want 1", len(env.Signatures))
+	}
+	sig, _ := base64.StdEncoding.DecodeString(env.Signatures[0].Sig)
+	if !ed25519.Verify(pub, dssePAE(env.PayloadType, payload), sig) {
+		t.Error("signature does not verify")
+	}
+
+	var st intotoStatement
+	if err := json.Unmarshal(payload, &st); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Subject) != 1 || st.Subject[0].Name != "build/out.txt" || st.Subject[0].Digest["sha256"] != hashString("data") {
+		t.Errorf("subject = %+v", st.Subject)
+	}
+	deps := st.Predicate.BuildDefinition.Dependencies
+	if len(deps) < 2 || deps[0].Name != "in.txt" || deps[1].Name != "tool:cat" {
+		t.Errorf("dependencies = %+v, want in.txt and tool:cat", deps)
+	}
+	if got := st.Predicate.BuildDefinition.ExternalParameters["recipe"]; got != "cat in.txt > build/out.txt" {
+		t.Errorf("recipe = %q", got)
+	}
+	envVars := st.Predicate.BuildDefinition.InternalParameters["env"].(map[string]any)
+	if envVars["API_TOKEN"] != "<redacted>" {
+		t.Errorf("API_TOKEN = %v, want redacted", envVars["API_TOKEN"])
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// provision is a rule's [provides: ...] annotation: globs matching the
+// files its recipe generates besides its targets.
+type provision struct {
+	globs  []string
+	target string // the rule's first target
+	pos    string
+}
+
+// addProvision records the globs that the explicit rule for target
+// provides, expanded and rebased like its targets.
+func (g *Graph) addProvision(r Rule, target, pos string) {
+	var globs []string
+	for _, p := range r.Provides {
+		for _, glob := range strings.Fields(g.vars.Expand(p)) {
+			if g.scopePrefix != "" {
+				glob = joinName(g.scopePrefix, glob)
+			}
+			globs = append(globs, glob)
+		}
+	}
+	g.provides = append(g.provides, provision{globs: globs, target: target, pos: pos})
+}
+
+// recordGlob notes a pattern that $[wildcard] matched while the mkfile
+// was being evaluated.
+func (g *Graph) recordGlob(pattern string) {
+	g.globs = append(g.globs, strings.Fields(pattern)...)
+}
+
+// provider returns the provision of the rule that provides file, if any.
+func (g *Graph) provider(file string) (provision, bool) {
+	for _, pv := range g.provides {
+		for _, glob := range pv.globs {
+			if ok, _ := path.Match(glob, file); ok {
+				return pv, true
+			}
+		}
+	}
+	return provision{}, false
+}
+
+// globProviders returns the targets of the rules that provide files a
+// $[wildcard] evaluated with the mkfile may have looked for, in
+// declaration order.
+func (g *Graph) globProviders() []string {
+	var targets []string
+	for _, pv := range g.provides {
+	search:
+		for _, glob := range pv.globs {
+			for _, pattern := range g.globs {
+				if globsOverlap(glob, pattern) {
+					targets = append(targets, pv.target)
+					break search
+				}
+			}
+		}
+	}
+	return targets
+}
+
+// globsOverlap reports whether globs a and b may match the same file: if
+// they are the same, or either, read as a path, matches the other.
+func globsOverlap(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if ok, _ := path.Match(a, b); ok {
+		return true
+	}
+	ok, _ := path.Match(b, a)
+	return ok
+}
+
+// generate runs the rules that provide files a $[wildcard] looked for
+// while the mkfile was evaluated, before anything else is built. If any
+// of them ran, it checkpoints the build state and evaluates the mkfile
+// again, so that the wildcards see the files they generated.
+func (p *Project) generate(ctx context.Context, progress ProgressFunc) error {
+	providers := p.graph.globProviders()
+	if len(providers) == 0 || p.opts.DryRun {
+		return nil
+	}
+	p.vars.SetContext(ctx)
+	defer p.vars.SetContext(nil)
+
+	suffix := strings.Join(p.opts.Configs, "-")
+	exec := p.newExecutor()
+	exec.checkpoint = func() error { return p.state.checkpoint(suffix) }
+	ran := false
+	exec.SetProgress(func(ev Event) {
+		if ev.Kind == TargetFinished {
+			ran = true
+		}
+		progress(ev)
+	})
+	var err error
+	for _, t := range providers {
+		if err = exec.Build(ctx, t); err != nil {
+			break
+		}
+	}
+	if !ran {
+		return err
+	}
+	if saveErr := p.state.checkpoint(suffix); err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		return err
+	}
+	np, err := load(ctx, p.ast, p.opts)
+	if err != nil {
+		return fmt.Errorf("after generating %s: %w", strings.Join(providers, " "), err)
+	}
+	np.state.keptPrev = true // by the checkpoint
+	p.graph.closePlugins()
+	p.vars, p.state, p.graph = np.vars, np.state, np.graph
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseProvides(t *testing.T) {
+	f, err := Parse(strings.NewReader("gen/stamp [provides: gen/*.go gen/*.h] [keep]: schema\n    gen\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := f.Stmts[0].(Rule)
+	if strings.Join(r.Targets, " ") != "gen/stamp" || strings.Join(r.Provides, " ") != "gen/*.go gen/*.h" || !r.Keep {
+		t.Errorf("rule = %#v, want gen/stamp providing gen/*.go gen/*.h", r)
+	}
+
+	if _, err := Parse(strings.NewReader("!gen [provides: gen/*.go]:\n    gen\n")); err == nil {
+		t.Error("expected error for [provides] on a task")
+	}
+}
+
+func TestProvides(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+srcs = $[wildcard gen/*.txt]
+
+all.txt: $srcs
+    cat $inputs > $target
+
+gen/stamp [provides: gen/*.txt]: names
+    mkdir -p gen
+    rm -f gen/*.txt
+    for n in $$(cat names); do echo $$n > gen/$$n.txt; done
+    touch $target
+`), 0o644)
+	build := func() Stats {
+		t.Helper()
+		return mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "all.txt").Stats()
+	}
+	out := func() string {
+		data, _ := os.ReadFile(filepath.Join(dir, "all.txt"))
+		return string(data)
+	}
+
+	// The wildcard sees the files the generator makes in the same build.
+	os.WriteFile(filepath.Join(dir, "names"), []byte("a b\n"), 0o644)
+	if s := build(); s.Built != 2 {
+		t.Errorf("first build: %+v, want the generator and all.txt built", s)
+	}
+	if got := out(); got != "a\nb\n" {
+		t.Errorf("all.txt = %q, want %q", got, "a\nb\n")
+	}
+	if s := build(); s.Built != 0 {
+		t.Errorf("second build: %+v, want up to date", s)
+	}
+
+	os.WriteFile(filepath.Join(dir, "names"), []byte("a b c\n"), 0o644)
+	build()
+	if got := out(); got != "a\nb\nc\n" {
+		t.Errorf("all.txt = %q, want %q", got, "a\nb\nc\n")
+	}
+}
+
+func TestProvidedFileResolvesToProvider(t *testing.T) {
+	f, err := Parse(strings.NewReader("gen/stamp [provides: gen/*.go]:\n    gen\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := BuildGraph(f, NewVars(), &BuildState{Targets: make(map[string]*TargetState)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := g.resolve("gen/x.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(r.prereqs, " ") != "gen/stamp" || len(r.recipe) != 0 {
+		t.Errorf("gen/x.go resolved to %#v, want a dependency on gen/stamp", r)
+	}
+	if _, err := g.resolve("gen/x.c"); err == nil {
+		t.Error("expected no rule for gen/x.c")
+	}
+}
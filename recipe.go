@@ -0,0 +1,208 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// An expandedRecipe is a recipe's lines, expanded, with their prefixes.
+type expandedRecipe []recipeLine
+
+type recipeLine struct {
+	cmd       string // without prefixes
+	silent    bool   // @: not echoed
+	ignoreErr bool   // -: failure ignored
+	prelude   bool   // from a prelude block: never echoed or numbered
+}
+
+// expandRecipeLines expands the prelude's lines and then a recipe's with
+// vars.
+func expandRecipeLines(prelude, recipe []string, vars *Vars) expandedRecipe {
+	lines := make(expandedRecipe, 0, len(prelude)+len(recipe))
+	for _, line := range prelude {
+		lines = append(lines, recipeLine{cmd: vars.Expand(line), prelude: true})
+	}
+	for _, line := range recipe {
+		rl := parseRecipeLine(line)
+		rl.cmd = vars.Expand(rl.cmd)
+		lines = append(lines, rl)
+	}
+	return lines
+}
+
+// setAutoVars sets the automatic variables for building rule in vars:
+// $target, $input, $inputs, $stem and $outdir, and the $inputs groups: .order
+// (order-only prerequisites), .abs (absolute paths, also $target.abs and
+// $input.abs), .lines (newline-separated, for response files) and, for
+// each extension among the prerequisites, the prerequisites with it
+// ($inputs.c). $changed and $inputs.new, which need the build state, are
+// the caller's. Paths other than the .abs ones are relative to cwd, the
+// directory in the workspace the recipe runs in.
+func setAutoVars(vars *Vars, rule *resolvedRule, dir workspace, cwd string) {
+	abs := func(p string) string {
+		if a, err := filepath.Abs(dir.path(p)); err == nil {
+			return a
+		}
+		return p
+	}
+	rel := func(p string) string { return relName(cwd, p) }
+	prereqs := make([]string, len(rule.prereqs))
+	for i, p := range rule.prereqs {
+		prereqs[i] = rel(p)
+	}
+	vars.Set("target", rel(rule.target))
+	vars.Set("target.abs", abs(rule.target))
+	vars.Set("outdir", rel(rule.outdir()))
+	if len(rule.prereqs) > 0 {
+		vars.Set("input", prereqs[0])
+		vars.Set("input.abs", abs(rule.prereqs[0]))
+	}
+	vars.Set("inputs", strings.Join(prereqs, " "))
+	if rule.stem != "" {
+		vars.Set("stem", rule.stem)
+	}
+
+	byExt := map[string][]string{}
+	var absInputs []string
+	for i, p := range rule.prereqs {
+		if ext := strings.TrimPrefix(filepath.Ext(p), "."); isIdent(ext) {
+			byExt[ext] = append(byExt[ext], prereqs[i])
+		}
+		absInputs = append(absInputs, abs(p))
+	}
+	for ext, ps := range byExt {
+		vars.Set("inputs."+ext, strings.Join(ps, " "))
+	}
+	var orderOnly []string
+	for _, p := range rule.orderOnlyPrereqs {
+		orderOnly = append(orderOnly, rel(p))
+	}
+	vars.Set("inputs.order", strings.Join(orderOnly, " "))
+	vars.Set("inputs.abs", strings.Join(absInputs, " "))
+	vars.Set("inputs.lines", strings.Join(prereqs, "\n"))
+}
+
+// workdir returns the directory in the workspace rule's recipe runs in,
+// from its [cwd: ...] annotation, which is relative to the rule's scope
+// and expanded with its variables; or "" for the workspace root.
+func (r *resolvedRule) workdir(top *Vars) string {
+	cwd := strings.TrimSpace(r.varsFor(top).Expand(r.cwd))
+	if cwd == "" {
+		return ""
+	}
+	if r.scope != "" && !filepath.IsAbs(cwd) {
+		cwd = joinName(r.scope, cwd)
+	}
+	if cwd = filepath.ToSlash(filepath.Clean(cwd)); cwd == "." {
+		return ""
+	}
+	return cwd
+}
+
+// hashedRecipeText returns the text recorded as a rule's recipe hash: the
+// recipe expanded without $compiler_launcher, then the tool digest, the
+// interpreter and the working directory, so that changing any of them
+// reruns it.
+func hashedRecipeText(text, tools string, sh interpreter, cwd string) string {
+	text += tools + sh.hash()
+	if cwd != "" {
+		text += "\x00cwd " + cwd
+	}
+	return text
+}
+
+// isIdent reports whether s is a name, as after $ or a dot.
+func isIdent(s string) bool {
+	if s == "" || !isIdentStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isIdentCont(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRecipeLine splits the @ and - prefixes off a recipe line.
+func parseRecipeLine(line string) recipeLine {
+	var rl recipeLine
+	for len(line) > 0 && (line[0] == '@' || line[0] == '-') {
+		if line[0] == '-' {
+			rl.ignoreErr = true
+		} else {
+			rl.silent = true
+		}
+		line = line[1:]
+	}
+	rl.cmd = line
+	return rl
+}
+
+// ignoredFD is the descriptor a recipe reports the failures of its -
+// lines on, after the jobserver's 3 and 4, so that nothing it prints can
+// pass for a report.
+const ignoredFD = 5
+
+// text returns the script the recipe runs. A line whose failure is
+// ignored runs as written, with errexit off, and a failure is reported
+// with its exit status on stderr and, as "STATUS LINE", on ignoredFD,
+// rather than stopping the recipe.
+func (r expandedRecipe) text() string {
+	lines := make([]string, len(r))
+	n := 0 // recipe line number
+	for i, l := range r {
+		if !l.prelude {
+			n++
+		}
+		if !l.ignoreErr {
+			lines[i] = l.cmd
+			continue
+		}
+		lines[i] = fmt.Sprintf("set +e\n%s\nmk_status=$?; set -e; [ $mk_status -eq 0 ] || { echo \"mk: warning: ignored exit status $mk_status of recipe line %d\" >&2; echo \"$mk_status %d\" 2>/dev/null >&%d || :; }",
+			l.cmd, n, n, ignoredFD)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// echo returns the commands shown as the recipe runs: those without an
+// @ prefix, or all of them if all is set (for -v and -n), as written,
+// without prefixes. The prelude isn't shown.
+func (r expandedRecipe) echo(all bool) []string {
+	var lines []string
+	for _, l := range r {
+		if !l.prelude && (all || !l.silent) {
+			lines = append(lines, l.cmd)
+		}
+	}
+	return lines
+}
+
+// withIgnoredFile returns files, the descriptors a job inherits from
+// 3, with f as ignoredFD.
+func withIgnoredFile(files []*os.File, f *os.File) []*os.File {
+	fds := make([]*os.File, ignoredFD-3, ignoredFD-2)
+	copy(fds, files)
+	return append(fds, f)
+}
+
+// ignoredReports returns the failures a recipe reported to f.
+func ignoredReports(f *os.File) []string {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+	data, _ := io.ReadAll(f)
+	var reports []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if status, n, ok := strings.Cut(line, " "); ok {
+			reports = append(reports, fmt.Sprintf("ignored exit status %s of recipe line %s", status, n))
+		}
+	}
+	return reports
+}
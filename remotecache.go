@@ -0,0 +1,148 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// remoteCacheTimeout bounds each request to a remote cache, so an
+// unreachable cache slows a build rather than hanging it.
+const remoteCacheTimeout = 2 * time.Minute
+
+// remoteCache is an action cache shared over HTTP, laid out like the
+// local one: GET and PUT of <url>/ac/<digest> and <url>/cas/<hash>. Any
+// server that stores what is PUT and serves it back works, including
+// S3-compatible object stores through presigned or gateway URLs. Userinfo
+// in the URL is sent as basic auth, and $MK_CACHE_TOKEN, if set, as a
+// bearer token.
+type remoteCache struct {
+	url    string // without a trailing slash
+	token  string
+	client *http.Client
+}
+
+// remoteCacheURL returns the URL of the remote cache to use: $MK_CACHE_URL
+// if set, otherwise the mkfile's cache declaration, if any.
+func remoteCacheURL(g *Graph) string {
+	if u := os.Getenv("MK_CACHE_URL"); u != "" {
+		return u
+	}
+	return g.remoteCache
+}
+
+func newRemoteCache(url string) *remoteCache {
+	return &remoteCache{
+		url:    strings.TrimSuffix(url, "/"),
+		token:  os.Getenv("MK_CACHE_TOKEN"),
+		client: &http.Client{Timeout: remoteCacheTimeout},
+	}
+}
+
+// get returns the object at path, or ok false if the cache has none.
+func (r *remoteCache) get(path string) (data []byte, ok bool, err error) {
+	resp, err := r.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	data, err = io.ReadAll(resp.Body)
+	return data, err == nil, err
+}
+
+// has reports whether the cache has an object at path.
+func (r *remoteCache) has(path string) bool {
+	resp, err := r.do(http.MethodHead, path, nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// put stores data at path.
+func (r *remoteCache) put(path string, data []byte) error {
+	resp, err := r.do(http.MethodPut, path, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %s: %s", path, resp.Status)
+	}
+	return nil
+}
+
+func (r *remoteCache) do(method, path string, body []byte) (*http.Response, error) {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, r.url+"/"+path, rd)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	return r.client.Do(req)
+}
+
+// fetch copies the entry for digest, and the outputs it lists, from the
+// remote cache into the local one. It reports whether it did.
+func (c *actionCache) fetch(digest string) bool {
+	data, ok, err := c.remote.get("ac/" + digest)
+	if err != nil || !ok {
+		return false
+	}
+	entry, ok := parseActionEntry(data)
+	if !ok {
+		return false
+	}
+	for _, out := range entry.Outputs {
+		if _, err := os.Stat(c.blobPath(out.Hash)); err == nil {
+			continue
+		}
+		blob, ok, err := c.remote.get("cas/" + out.Hash)
+		if err != nil || !ok || hashString(string(blob)) != out.Hash {
+			return false
+		}
+		if err := writeFileAtomic(c.blobPath(out.Hash), blob); err != nil {
+			return false
+		}
+	}
+	return writeFileAtomic(c.entryPath(digest), data) == nil
+}
+
+// push copies the entry for digest, with data its content, and the
+// outputs it lists, from the local cache to the remote one. Outputs go
+// first, so that the remote cache never has an entry without them.
+func (c *actionCache) push(digest string, data []byte, entry actionEntry) error {
+	for _, out := range entry.Outputs {
+		path := "cas/" + out.Hash
+		if c.remote.has(path) {
+			continue
+		}
+		blob, err := os.ReadFile(c.blobPath(out.Hash))
+		if err != nil {
+			return err
+		}
+		if err := c.remote.put(path, blob); err != nil {
+			return err
+		}
+	}
+	return c.remote.put("ac/"+digest, data)
+}
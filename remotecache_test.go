@@ -0,0 +1,96 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseCache(t *testing.T) {
+	f, err := Parse(strings.NewReader("cache https://cache.example.com/mk\ncache = x\ncache $url\ncache dir: src\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := f.Stmts[0].(CacheDef); !ok || c.URL != "https://cache.example.com/mk" {
+		t.Errorf("stmt 0 = %#v, want a cache declaration", f.Stmts[0])
+	}
+	if _, ok := f.Stmts[1].(VarAssign); !ok {
+		t.Errorf("stmt 1 = %#v, want an assignment to cache", f.Stmts[1])
+	}
+	if c, ok := f.Stmts[2].(CacheDef); !ok || c.URL != "$url" {
+		t.Errorf("stmt 2 = %#v, want a cache declaration", f.Stmts[2])
+	}
+	if _, ok := f.Stmts[3].(Rule); !ok {
+		t.Errorf("stmt 3 = %#v, want a rule", f.Stmts[3])
+	}
+}
+
+func TestRemoteCache(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		case http.MethodGet, http.MethodHead:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("MK_CACHE_TOKEN", "secret")
+
+	checkout := func() string {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "mkfile"), []byte("cache "+srv.URL+"/mk\n\nout.txt: src.txt\n    cp $input $target\n    echo ran >> ran.log\n"), 0o644)
+		os.WriteFile(filepath.Join(dir, "src.txt"), []byte("content"), 0o644)
+		return dir
+	}
+	build := func(dir string) Stats {
+		t.Helper()
+		return mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "out.txt").Stats()
+	}
+
+	if s := build(checkout()); s.Built != 1 {
+		t.Fatalf("first checkout: %+v, want out.txt built", s)
+	}
+	if len(objects) != 2 {
+		t.Errorf("remote has %d objects, want an entry and a blob", len(objects))
+	}
+
+	// Another checkout, with its own local cache, fetches the outputs.
+	dir := checkout()
+	if s := build(dir); s.Built != 0 || s.Restored != 1 {
+		t.Errorf("second checkout: %+v, want out.txt restored", s)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "out.txt")); string(got) != "content" {
+		t.Errorf("out.txt = %q, want %q", got, "content")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ran.log")); err == nil {
+		t.Error("recipe ran in the second checkout")
+	}
+
+	// MK_CACHE_URL overrides the declaration.
+	t.Setenv("MK_CACHE_URL", srv.URL+"/elsewhere")
+	if s := build(checkout()); s.Built != 1 {
+		t.Errorf("checkout with another cache: %+v, want out.txt built", s)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// nondeterministicEnv lists environment variables that describe the
+// machine or session rather than the build. Reproducible mode keeps them
+// out of recipes.
+var nondeterministicEnv = map[string]bool{
+	"COLUMNS":         true,
+	"DISPLAY":         true,
+	"HOSTNAME":        true,
+	"LINES":           true,
+	"LOGNAME":         true,
+	"OLDPWD":          true,
+	"SHLVL":           true,
+	"SSH_AUTH_SOCK":   true,
+	"SSH_CLIENT":      true,
+	"SSH_CONNECTION":  true,
+	"SSH_TTY":         true,
+	"TERM_SESSION_ID": true,
+	"TMUX":            true,
+	"TMUX_PANE":       true,
+	"USER":            true,
+	"WINDOWID":        true,
+	"XDG_RUNTIME_DIR": true,
+	"XDG_SESSION_ID":  true,
+}
+
+// setReproducible puts vars into reproducible-build mode and pins the
+// variables that commonly leak time and locale into outputs.
+// SOURCE_DATE_EPOCH defaults to the time of the last git commit, or 0.
+func setReproducible(ctx context.Context, vars *Vars) {
+	vars.SetReproducible(true)
+	if vars.Get("SOURCE_DATE_EPOCH") == "" {
+		epoch := "0"
+		if out, err := runShellCapture(ctx, vars.dir, "git log -1 --format=%ct 2>/dev/null"); err == nil && strings.TrimSpace(out) != "" {
+			epoch = strings.TrimSpace(out)
+		}
+		vars.Set("SOURCE_DATE_EPOCH", epoch)
+	}
+	vars.Set("TZ", "UTC")
+	vars.Set("LC_ALL", "C")
+}
+
+// verifyReproducible rebuilds a random sample of the targets built in
+// this run and fails if any output differs from the first build. The
+// sample size is $reproducible_sample, default 1.
+func (p *Project) verifyReproducible(ctx context.Context, exec *Executor, built []string) error {
+	n := 1
+	if s := p.vars.Get("reproducible_sample"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("reproducible_sample: %w", err)
+		}
+		n = v
+	}
+	rand.Shuffle(len(built), func(i, j int) { built[i], built[j] = built[j], built[i] })
+	if n < len(built) {
+		built = built[:n]
+	}
+
+	var bad []string
+	for _, target := range built {
+		same, err := exec.rebuildSame(ctx, target)
+		if err != nil {
+			return err
+		}
+		if !same {
+			bad = append(bad, fmt.Sprintf("%q", target))
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("not reproducible: rebuilding %s produced different output", strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// rebuildSame re-runs the recipe for target and reports whether every
+// output hashes the same as before.
+func (e *Executor) rebuildSame(ctx context.Context, target string) (bool, error) {
+	rule, err := e.graph.resolve(target)
+	if err != nil {
+		return false, err
+	}
+	// The late-bound prerequisites were built with the rest.
+	rule = e.graph.bindLate(rule, e.vars)
+	before := make([]string, len(rule.targets))
+	for i, t := range rule.targets {
+		before[i], _ = hashFile(e.dir.path(t))
+	}
+
+	fmt.Fprintf(e.stderr, "mk: verifying %q is reproducible\n", rule.target)
+	recipe, err := e.expandRecipe(ctx, rule, nil, false)
+	if err != nil {
+		return false, err
+	}
+	forHash, _ := e.expandRecipe(ctx, rule, nil, true)
+	hashText := hashedRecipeText(forHash.text(), e.toolHash, e.shellFor(rule), rule.workdir(e.vars))
+	progress := e.progress
+	e.progress = nil // the rebuild is not part of the build proper
+	err = e.executeRecipe(ctx, rule, recipe, hashText, e.expandFingerprint(rule), "", nil)
+	e.progress = progress
+	if err != nil {
+		return false, err
+	}
+
+	for i, t := range rule.targets {
+		if h, _ := hashFile(e.dir.path(t)); h != before[i] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
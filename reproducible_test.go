@@ -0,0 +1,72 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReproducibleBuild(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	t.Setenv("USER", "alice")
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	os.WriteFile("mkfile", []byte(`
+files = $[wildcard b.in a.in]
+
+env.txt: $files
+    echo "$files" > $target
+    printenv SOURCE_DATE_EPOCH TZ >> $target
+    printenv USER >> $target || true
+
+stamp.txt:
+    date +%s%N > $target
+
+late = a.in
+
+late.txt: b.in $$late
+    echo $inputs > $target
+`), 0o644)
+	os.WriteFile("a.in", nil, 0o644)
+	os.WriteFile("b.in", nil, 0o644)
+
+	load := func() *Project {
+		t.Helper()
+		p, err := Load(context.Background(), "mkfile", Options{
+			Jobs:         1,
+			Reproducible: true,
+			Stderr:       io.Discard,
+			Vars:         map[string]string{"reproducible_sample": "5"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	if err := load().Build(context.Background(), "env.txt"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile("env.txt")
+	if got, want := string(data), "a.in b.in\n0\nUTC\n"; got != want {
+		t.Errorf("env.txt = %q, want %q", got, want)
+	}
+
+	// The rebuild sees the late-bound prerequisites too.
+	if err := load().Build(context.Background(), "late.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := load().Build(context.Background(), "stamp.txt")
+	if err == nil || !strings.Contains(err.Error(), `not reproducible: rebuilding "stamp.txt"`) {
+		t.Errorf("Build(stamp.txt) = %v, want not reproducible", err)
+	}
+}
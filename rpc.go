@@ -0,0 +1,344 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// RPCProtocolVersion is the version of the JSON-RPC build API. It changes
+// only when existing methods change incompatibly; new methods and fields
+// may be added within a version.
+const RPCProtocolVersion = 1
+
+// JSON-RPC 2.0 error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcBuildFailed    = 1 // application error: the build or query failed
+)
+
+// Server exposes a project over JSON-RPC 2.0 so that editors and CI
+// orchestrators can drive builds. Messages are newline-delimited JSON
+// objects. Methods:
+//
+//	version                                  → {protocol, version}
+//	build      {targets, configs, vars, force} → {} (after events)
+//	targets    {configs, vars}               → {targets, tasks, configs}
+//	lookup     {target, configs, vars}       → RuleInfo
+//	why        {target, configs, vars}       → {reasons}
+//	invalidate {paths, configs}              → {forgotten}
+//	cancel     {id}                          → {}
+//
+// While a build runs, the server sends "event" notifications for each
+// target and "output" notifications carrying recipe output. The mkfile is
+// reloaded for every request, so edits take effect without a restart.
+// Builds are serialized; other requests run concurrently with them.
+type Server struct {
+	path    string
+	opts    Options
+	version string
+
+	buildMu sync.Mutex // one build (and state write) at a time
+}
+
+// NewServer returns a server for the mkfile at path. opts supplies
+// defaults for every request; Stdout, Stderr and Progress are ignored.
+func NewServer(path string, opts Options, version string) *Server {
+	return &Server{path: path, opts: opts, version: version}
+}
+
+// Serve accepts connections on l and serves each until ctx is cancelled.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			s.ServeConn(ctx, conn, conn) //nolint:errcheck // per-connection errors end that connection only
+		}()
+	}
+}
+
+// ServeConn serves requests read from r, writing responses and
+// notifications to w, until r is exhausted or ctx is cancelled.
+func (s *Server) ServeConn(ctx context.Context, r io.Reader, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := &rpcConn{srv: s, w: w, inflight: make(map[string]context.CancelFunc)}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var req rpcRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			c.reply(nil, nil, &rpcError{Code: rpcParseError, Message: err.Error()})
+			continue
+		}
+		if req.JSONRPC != "2.0" || req.Method == "" {
+			c.reply(req.ID, nil, &rpcError{Code: rpcInvalidRequest, Message: "not a JSON-RPC 2.0 request"})
+			continue
+		}
+		reqCtx, reqCancel := context.WithCancel(ctx)
+		key := string(req.ID)
+		if key != "" {
+			c.mu.Lock()
+			c.inflight[key] = reqCancel
+			c.mu.Unlock()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer reqCancel()
+			result, rerr := c.handle(reqCtx, req)
+			if key != "" {
+				c.mu.Lock()
+				delete(c.inflight, key)
+				c.mu.Unlock()
+				c.reply(req.ID, result, rerr)
+			}
+		}()
+	}
+	return sc.Err()
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// rpcParams is the union of all method parameters.
+type rpcParams struct {
+	Targets []string          `json:"targets"`
+	Target  string            `json:"target"`
+	Configs []string          `json:"configs"`
+	Vars    map[string]string `json:"vars"`
+	Force   bool              `json:"force"`
+	Paths   []string          `json:"paths"`
+	ID      json.RawMessage   `json:"id"`
+}
+
+type rpcConn struct {
+	srv *Server
+
+	wmu sync.Mutex // serializes writes to w
+	w   io.Writer
+
+	mu       sync.Mutex
+	inflight map[string]context.CancelFunc // request ID → cancel
+}
+
+func (c *rpcConn) write(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.w.Write(append(data, '\n')) //nolint:errcheck // a dead client just stops receiving
+}
+
+func (c *rpcConn) reply(id json.RawMessage, result any, rerr *rpcError) {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	if rerr == nil && result == nil {
+		result = struct{}{}
+	}
+	c.write(rpcResponse{JSONRPC: "2.0", ID: id, Result: result, Error: rerr})
+}
+
+func (c *rpcConn) notify(method string, params any) {
+	c.write(rpcNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (c *rpcConn) handle(ctx context.Context, req rpcRequest) (any, *rpcError) {
+	var p rpcParams
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+	}
+
+	var result any
+	var err error
+	switch req.Method {
+	case "version":
+		result = map[string]any{"protocol": RPCProtocolVersion, "version": c.srv.version}
+	case "build":
+		err = c.build(ctx, p)
+	case "targets":
+		result, err = c.targets(ctx, p)
+	case "lookup":
+		result, err = c.lookup(ctx, p)
+	case "why":
+		result, err = c.why(ctx, p)
+	case "invalidate":
+		result, err = c.invalidate(p)
+	case "cancel":
+		c.mu.Lock()
+		if cancel, ok := c.inflight[string(p.ID)]; ok {
+			cancel()
+		}
+		c.mu.Unlock()
+	default:
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("unknown method %q", req.Method)}
+	}
+	if err != nil {
+		return nil, &rpcError{Code: rpcBuildFailed, Message: err.Error()}
+	}
+	return result, nil
+}
+
+// load reloads the project with the request's configs and variables
+// layered over the server's defaults.
+func (c *rpcConn) load(ctx context.Context, p rpcParams) (*Project, error) {
+	opts := c.srv.opts
+	if p.Configs != nil {
+		opts.Configs = p.Configs
+	}
+	if len(p.Vars) > 0 {
+		vars := make(map[string]string, len(opts.Vars)+len(p.Vars))
+		for k, v := range opts.Vars {
+			vars[k] = v
+		}
+		for k, v := range p.Vars {
+			vars[k] = v
+		}
+		opts.Vars = vars
+	}
+	opts.Force = opts.Force || p.Force
+	opts.Stdout = rpcOutput{c, "stdout"}
+	opts.Stderr = rpcOutput{c, "stderr"}
+	opts.Progress = func(ev Event) { c.notify("event", newJSONEvent(ev)) }
+	return Load(ctx, c.srv.path, opts)
+}
+
+func (c *rpcConn) build(ctx context.Context, p rpcParams) error {
+	c.srv.buildMu.Lock()
+	defer c.srv.buildMu.Unlock()
+	proj, err := c.load(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer proj.Close()
+	return proj.Build(ctx, p.Targets...)
+}
+
+func (c *rpcConn) targets(ctx context.Context, p rpcParams) (any, error) {
+	proj, err := c.load(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	defer proj.Close()
+	g := proj.Graph()
+	return map[string][]string{
+		"targets": g.Targets(),
+		"tasks":   g.Tasks(),
+		"configs": g.ConfigNames(),
+	}, nil
+}
+
+func (c *rpcConn) lookup(ctx context.Context, p rpcParams) (any, error) {
+	if p.Target == "" {
+		return nil, errors.New("lookup requires a target")
+	}
+	proj, err := c.load(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	defer proj.Close()
+	return proj.Graph().Lookup(p.Target)
+}
+
+func (c *rpcConn) why(ctx context.Context, p rpcParams) (any, error) {
+	if p.Target == "" {
+		return nil, errors.New("why requires a target")
+	}
+	proj, err := c.load(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	defer proj.Close()
+	reasons, err := proj.Graph().WhyRebuild(ctx, p.Target)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]string{"reasons": reasons}, nil
+}
+
+func (c *rpcConn) invalidate(p rpcParams) (any, error) {
+	c.srv.buildMu.Lock()
+	defer c.srv.buildMu.Unlock()
+	configs := c.srv.opts.Configs
+	if p.Configs != nil {
+		configs = p.Configs
+	}
+	suffix := strings.Join(configs, "-")
+	forgotten, err := mkfileWorkspace(c.srv.opts.Dir, c.srv.path).invalidateState(suffix, p.Paths)
+	if err != nil {
+		return nil, err
+	}
+	if forgotten == nil {
+		forgotten = []string{}
+	}
+	return map[string][]string{"forgotten": forgotten}, nil
+}
+
+// rpcOutput forwards recipe output to the client as notifications.
+type rpcOutput struct {
+	c      *rpcConn
+	stream string
+}
+
+func (o rpcOutput) Write(b []byte) (int, error) {
+	o.c.notify("output", map[string]string{"stream": o.stream, "text": string(b)})
+	return len(b), nil
+}
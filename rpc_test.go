@@ -0,0 +1,123 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRPCServer(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+out.txt: in.txt
+    cat $input > $target
+    echo built
+
+!fail:
+    exit 1
+`), 0o644)
+	os.WriteFile("in.txt", []byte("data"), 0o644)
+
+	cr, cw := io.Pipe() // client → server
+	sr, sw := io.Pipe() // server → client
+	srv := NewServer("mkfile", Options{Jobs: 1}, "test")
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.ServeConn(context.Background(), cr, sw)
+		sw.Close()
+	}()
+
+	in := bufio.NewScanner(sr)
+	var notes []map[string]any
+	call := func(id int, method string, params any) map[string]any {
+		t.Helper()
+		req, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+		if _, err := cw.Write(append(req, '\n')); err != nil {
+			t.Fatal(err)
+		}
+		for in.Scan() {
+			var msg map[string]any
+			if err := json.Unmarshal(in.Bytes(), &msg); err != nil {
+				t.Fatalf("bad message %q: %v", in.Text(), err)
+			}
+			if _, ok := msg["id"]; !ok {
+				notes = append(notes, msg)
+				continue
+			}
+			return msg
+		}
+		t.Fatal("server closed connection")
+		return nil
+	}
+
+	resp := call(1, "version", nil)
+	if v := resp["result"].(map[string]any)["protocol"]; v != float64(RPCProtocolVersion) {
+		t.Errorf("protocol = %v", v)
+	}
+
+	resp = call(2, "build", map[string]any{"targets": []string{"out.txt"}})
+	if resp["error"] != nil {
+		t.Fatalf("build failed: %v", resp["error"])
+	}
+	var kinds []string
+	var output strings.Builder
+	for _, n := range notes {
+		params := n["params"].(map[string]any)
+		switch n["method"] {
+		case "event":
+			kinds = append(kinds, params["kind"].(string)+" "+params["target"].(string))
+		case "output":
+			output.WriteString(params["text"].(string))
+		}
+	}
+	if strings.Join(kinds, ",") != "started out.txt,finished out.txt" {
+		t.Errorf("events = %v", kinds)
+	}
+	if !strings.Contains(output.String(), "built") {
+		t.Errorf("output = %q, want recipe output", output.String())
+	}
+
+	resp = call(3, "lookup", map[string]any{"target": "out.txt"})
+	if prereqs := resp["result"].(map[string]any)["prereqs"].([]any); len(prereqs) != 1 || prereqs[0] != "in.txt" {
+		t.Errorf("lookup prereqs = %v", prereqs)
+	}
+
+	resp = call(4, "targets", nil)
+	if tasks := resp["result"].(map[string]any)["tasks"].([]any); len(tasks) != 1 || tasks[0] != "fail" {
+		t.Errorf("tasks = %v", tasks)
+	}
+
+	resp = call(5, "invalidate", map[string]any{"paths": []string{"in.txt"}})
+	if f := resp["result"].(map[string]any)["forgotten"].([]any); len(f) != 1 || f[0] != "out.txt" {
+		t.Errorf("forgotten = %v", f)
+	}
+	resp = call(6, "why", map[string]any{"target": "out.txt"})
+	if r := resp["result"].(map[string]any)["reasons"].([]any); len(r) == 0 {
+		t.Error("out.txt should be stale after invalidate")
+	}
+
+	resp = call(7, "build", map[string]any{"targets": []string{"fail"}})
+	if resp["error"] == nil {
+		t.Error("expected build error")
+	}
+	resp = call(8, "nope", nil)
+	if code := resp["error"].(map[string]any)["code"]; code != float64(rpcMethodNotFound) {
+		t.Errorf("code = %v", code)
+	}
+
+	cw.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ServeConn: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Job is one expanded recipe, ready to run.
+type Job struct {
+	Target  string   // $target
+	Targets []string // all outputs of the rule
+	Inputs  []string // every file the recipe is known to read: prerequisites, order-only ones and tools
+	IsTask  bool
+	Script  string     // script, including the leading "set -e" for a POSIX shell
+	Shell   []string   // interpreter that runs Script with -c; nil means sh
+	Env     []string   // environment in os.Environ form
+	Files   []*os.File // inherited as descriptors 3 and up: the jobserver's pipe, then 5 for - lines' failures; nil entries are closed
+	Dir     string     // workspace to run in; "" means the current directory
+	Cwd     string     // directory Script runs in, relative to Dir, from [cwd: ...]; "" for Dir itself
+	Stdout  io.Writer
+	Stderr  io.Writer
+}
+
+// workdir returns the directory the job's script runs in.
+func (job *Job) workdir() string {
+	if job.Cwd == "" || filepath.IsAbs(job.Cwd) {
+		return cmp.Or(job.Cwd, job.Dir)
+	}
+	return filepath.Join(job.Dir, job.Cwd)
+}
+
+// Runner executes recipes. The default runs them locally with sh -c, or
+// the job's Shell; embedders can supply their own, e.g. to send jobs to
+// a worker farm.
+type Runner interface {
+	Run(ctx context.Context, job *Job) error
+}
+
+// LocalRunner runs recipes in a local shell.
+type LocalRunner struct{}
+
+func (LocalRunner) Run(ctx context.Context, job *Job) error {
+	args := interpreter(job.Shell).command(job.Script)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = job.workdir()
+	cmd.Stdout = job.Stdout
+	cmd.Stderr = job.Stderr
+	cmd.Env = job.Env
+	cmd.ExtraFiles = job.Files
+	killOnCancel(cmd)
+	return cmd.Run()
+}
+
+// WrapperRunner runs recipes through a wrapper command, typically a
+// remote execution client such as reclient's rewrapper. mk doesn't speak the Remote Execution API
+// itself; it wraps each recipe in a call to the client, which uploads the
+// inputs to the CAS, executes the action on a worker and downloads the
+// outputs. The client is invoked as
+//
+//	Command --input_list_paths=FILE --output_list_paths=FILE -- sh -c SCRIPT
+//
+// with the job's Shell in place of sh if it has one, in the directory the
+// script would run in. Each FILE lists one path per line, relative to
+// that directory, so names holding commas or spaces reach the client
+// intact. The client inherits Job.Files, as the script does. Tasks
+// always run locally since they have no declared outputs.
+type WrapperRunner struct {
+	Command string // client command line, e.g. "rewrapper --cfg=re.cfg"
+}
+
+func (r WrapperRunner) Run(ctx context.Context, job *Job) error {
+	if job.IsTask {
+		return LocalRunner{}.Run(ctx, job)
+	}
+	inputs, err := writeList("mk-inputs-*", clientPaths(job, job.Inputs))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(inputs)
+	outputs, err := writeList("mk-outputs-*", clientPaths(job, job.Targets))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outputs)
+	// Pass the list files and command as positional parameters so the
+	// client command can use shell syntax without mk having to quote
+	// anything.
+	wrapper := `inputs=$1 outputs=$2; shift 2; ` + r.Command + ` --input_list_paths="$inputs" --output_list_paths="$outputs" -- "$@"`
+	args := append([]string{"-c", wrapper, "mk", inputs, outputs},
+		interpreter(job.Shell).command(job.Script)...)
+	cmd := exec.CommandContext(ctx, "sh", args...)
+	cmd.Dir = job.workdir()
+	cmd.Stdout = job.Stdout
+	cmd.Stderr = job.Stderr
+	cmd.Env = job.Env
+	cmd.ExtraFiles = job.Files
+	killOnCancel(cmd)
+	return cmd.Run()
+}
+
+// clientPaths returns names, which are relative to the workspace, as
+// the client sees them from the job's working directory.
+func clientPaths(job *Job, names []string) []string {
+	wd, err := filepath.Abs(job.workdir())
+	if err != nil {
+		return names
+	}
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = name
+		if filepath.IsAbs(name) {
+			continue
+		}
+		if abs, err := filepath.Abs(filepath.Join(job.Dir, name)); err == nil {
+			if rel, err := filepath.Rel(wd, abs); err == nil {
+				paths[i] = rel
+			}
+		}
+	}
+	return paths
+}
+
+// writeList writes names, one per line, to a new temporary file and
+// returns its path.
+func writeList(pattern string, names []string) (string, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		fmt.Fprintln(f, name)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
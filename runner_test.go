@@ -0,0 +1,83 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestWrapperRunner(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	// A stand-in for a remote execution client: log the flags and the
+	// lists they name, then run the command.
+	os.WriteFile("fake-rewrapper", []byte(`#!/bin/sh
+log=`+dir+`/remote.log
+while [ $# -gt 0 ]; do
+    case $1 in
+    --) shift; break ;;
+    --*_list_paths=*) echo "${1%%=*}:" $(cat "${1#*=}") >> $log ;;
+    *) echo "$1" >> $log ;;
+    esac
+    shift
+done
+exec "$@"
+`), 0o755)
+	os.WriteFile("mkfile", []byte(`
+remote_exec = `+dir+`/fake-rewrapper --cfg=re.cfg
+tool cat = $[shell command -v cat]
+tool mkdir = $[shell command -v mkdir]
+tool sh = $[shell command -v sh]
+
+out.txt: a.txt b,c.txt | dir
+    cat a.txt b,c.txt > $target
+
+dir:
+    mkdir -p $target
+
+sub/out.txt [cwd: sub]: out.txt
+    -false
+    cat ../out.txt > out.txt
+
+!task: sub/out.txt
+    echo local > task.txt
+`), 0o644)
+	os.WriteFile("a.txt", []byte("a"), 0o644)
+	os.WriteFile("b,c.txt", []byte("b"), 0o644)
+	os.Mkdir("sub", 0o755)
+
+	p := mustBuild(t, Options{Jobs: 1, Stderr: io.Discard}, "task")
+
+	if data, _ := os.ReadFile("out.txt"); string(data) != "ab" {
+		t.Errorf("out.txt = %q, want %q", data, "ab")
+	}
+	log, _ := os.ReadFile("remote.log")
+	var tools []string
+	for _, name := range []string{"cat", "mkdir", "sh"} {
+		path, _ := exec.LookPath(name)
+		tools = append(tools, path)
+	}
+	want := "--cfg=re.cfg\n--input_list_paths: " + strings.Join(tools, " ") + "\n--output_list_paths: dir\n" +
+		"--cfg=re.cfg\n--input_list_paths: a.txt b,c.txt dir " + strings.Join(tools, " ") + "\n--output_list_paths: out.txt\n" +
+		// The lists are relative to the directory the client runs in.
+		"--cfg=re.cfg\n--input_list_paths: ../out.txt " + strings.Join(tools, " ") + "\n--output_list_paths: out.txt\n"
+	if string(log) != want {
+		t.Errorf("remote.log = %q, want %q", log, want)
+	}
+	// The client passes on the descriptors the script reports ignored
+	// failures on.
+	if s := p.Stats(); s.Ignored != 1 {
+		t.Errorf("%d ignored failures, want 1", s.Ignored)
+	}
+	if data, _ := os.ReadFile("task.txt"); strings.TrimSpace(string(data)) != "local" {
+		t.Errorf("task did not run locally")
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// sandboxes reports whether rule's recipe runs in a sandbox in sandbox
+// mode. Tasks have no outputs to move back, a rule with a depfile
+// reads files that it only lists once it has run, and one that writes
+// files under $outdir writes files it doesn't name.
+func sandboxes(rule *resolvedRule) bool {
+	return !rule.isTask && rule.depfile == "" && !rule.tracksOutdir()
+}
+
+// runSandboxed runs job in a new directory under the state directory
+// that holds only links to the rule's prerequisites, as a clean checkout
+// that had just the declared inputs would, then moves the targets it
+// wrote into the workspace. Other files the recipe writes there are
+// discarded. A recipe that fails there likely reads a file it doesn't
+// declare; the error names any workspace file the recipe mentions that
+// isn't a prerequisite.
+func (e *Executor) runSandboxed(ctx context.Context, rule *resolvedRule, job *Job) error {
+	if err := os.MkdirAll(e.dir.path(stateDir), 0o755); err != nil {
+		return err
+	}
+	// In the state directory, so that targets can be renamed into place.
+	box, err := os.MkdirTemp(e.dir.path(stateDir), "sandbox-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(box)
+	if err := e.populateSandbox(box, rule); err != nil {
+		return fmt.Errorf("preparing sandbox: %w", err)
+	}
+
+	sandboxed := *job
+	sandboxed.Dir = box
+	if filepath.IsLocal(job.Cwd) {
+		// The recipe's [cwd: ...], which may hold none of its files.
+		if err := os.MkdirAll(sandboxed.workdir(), 0o755); err != nil {
+			return fmt.Errorf("preparing sandbox: %w", err)
+		}
+	}
+	if err := e.runnerFor().Run(ctx, &sandboxed); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		msg := "in a sandbox holding only its prerequisites"
+		if mentioned := e.undeclaredMentions(rule, job.Script); len(mentioned) > 0 {
+			msg += "; it mentions " + strings.Join(mentioned, ", ") + ", not declared as prerequisites"
+		}
+		return fmt.Errorf("%w (%s)", err, msg)
+	}
+
+	for _, t := range rule.targets {
+		if !filepath.IsLocal(t) {
+			continue
+		}
+		src := filepath.Join(box, t)
+		info, err := os.Lstat(src)
+		if err != nil {
+			continue // not written, or written through $target.abs
+		}
+		if info.Mode()&fs.ModeSymlink != 0 && slices.Contains(rule.prereqs, t) {
+			continue // the link to a prerequisite that's also a target
+		}
+		if info.IsDir() {
+			if err := os.RemoveAll(e.dir.path(t)); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(src, e.dir.path(t)); err != nil {
+			return fmt.Errorf("moving %q out of the sandbox: %w", t, err)
+		}
+	}
+	return nil
+}
+
+// populateSandbox links each of rule's prerequisites in the workspace
+// from the same path under box, and creates the directories of its
+// targets there.
+func (e *Executor) populateSandbox(box string, rule *resolvedRule) error {
+	for _, p := range slices.Concat(rule.prereqs, rule.orderOnlyPrereqs) {
+		if !filepath.IsLocal(p) {
+			continue // outside the workspace, where the recipe sees it anyway
+		}
+		abs, err := filepath.Abs(e.dir.path(p))
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(abs); err != nil {
+			continue // a task, or a file the recipe can't read anyway
+		}
+		link := filepath.Join(box, p)
+		if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+			return err
+		}
+		// A prerequisite inside a directory that's already linked is
+		// there already.
+		if err := os.Symlink(abs, link); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	for _, t := range rule.targets {
+		if filepath.IsLocal(t) {
+			if err := os.MkdirAll(filepath.Join(box, filepath.Dir(t)), 0o755); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// undeclaredMentions returns the words of script that name files in the
+// workspace other than rule's prerequisites and targets, quoted.
+func (e *Executor) undeclaredMentions(rule *resolvedRule, script string) []string {
+	var mentioned []string
+	for _, word := range strings.Fields(script) {
+		word = strings.Trim(word, `'";()<>|&`)
+		word = filepath.Clean(word)
+		if !filepath.IsLocal(word) || slices.Contains(rule.prereqs, word) || slices.Contains(rule.orderOnlyPrereqs, word) || slices.Contains(rule.targets, word) {
+			continue
+		}
+		if info, err := os.Stat(e.dir.path(word)); err != nil || info.IsDir() {
+			continue
+		}
+		if q := fmt.Sprintf("%q", word); !slices.Contains(mentioned, q) {
+			mentioned = append(mentioned, q)
+		}
+	}
+	return mentioned
+}
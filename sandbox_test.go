@@ -0,0 +1,62 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSandbox(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "src"), 0o755)
+	os.WriteFile(filepath.Join(dir, "src", "in.txt"), []byte("in\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "header.h"), []byte("header\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+out/ok.txt: src/in.txt
+    cat $input > $target
+    echo stray > stray.txt
+
+bad.txt: src/in.txt
+    cat $input header.h > $target
+
+!show:
+    cat header.h
+`), 0o644)
+
+	build := func(sandbox bool, target string) error {
+		_, err := loadAndBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Sandbox: sandbox, Stdout: io.Discard, Stderr: io.Discard}, target)
+		return err
+	}
+
+	if err := build(true, "out/ok.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "out", "ok.txt")); string(got) != "in\n" {
+		t.Errorf("out/ok.txt = %q, want %q", got, "in\n")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stray.txt")); err == nil {
+		t.Error("a file the recipe wrote other than its target reached the workspace")
+	}
+	if boxes, _ := filepath.Glob(filepath.Join(dir, stateDir, "sandbox-*")); len(boxes) > 0 {
+		t.Errorf("sandboxes left behind: %v", boxes)
+	}
+
+	err := build(true, "bad.txt")
+	if err == nil || !strings.Contains(err.Error(), `it mentions "header.h"`) {
+		t.Errorf("bad.txt: %v, want a failure naming header.h", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.txt")); err == nil {
+		t.Error("bad.txt was written despite the failure")
+	}
+	if err := build(true, "show"); err != nil {
+		t.Errorf("tasks run in the workspace, but show failed: %v", err)
+	}
+	if err := build(false, "bad.txt"); err != nil {
+		t.Errorf("bad.txt without the sandbox: %v", err)
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SelftestDir is the directory, next to the mkfile, that mk selftest
+// looks for .mktest files in.
+const SelftestDir = "tests"
+
+// A Selftest is a test of an mkfile's rules, read from a .mktest file: a
+// script, then the files of the workspace it runs in, each introduced by
+// a line "-- path --". Each line of the script is a step:
+//
+//	mk args...         run mk; it must succeed
+//	! mk args...       run mk; it must fail
+//	status n           the last mk exited with status n
+//	stdout regexp      the last mk's stdout matches regexp
+//	stderr regexp      the same for its stderr
+//	exists path...     the files exist
+//	cmp path1 path2    the files have the same content
+//	sh command         run command with sh -c; it must succeed
+//
+// A ! before stdout, stderr or exists negates it. Arguments are split at
+// spaces, except in single or double quotes; sh takes the rest of the
+// line as written. Blank lines and lines starting with # are ignored.
+type Selftest struct {
+	Name  string // the file it was read from
+	steps []selftestStep
+	files []selftestFile
+}
+
+type selftestStep struct {
+	line int
+	neg  bool
+	cmd  string
+	args []string
+}
+
+type selftestFile struct {
+	path string
+	data []byte
+}
+
+// ParseSelftest parses the .mktest file name, with content data.
+func ParseSelftest(name string, data []byte) (*Selftest, error) {
+	t := &Selftest{Name: name}
+	var file *selftestFile
+	for n, line := range strings.SplitAfter(string(data), "\n") {
+		if path, ok := selftestFileHeader(line); ok {
+			if path == "" || filepath.IsAbs(path) || strings.HasPrefix(filepath.Clean(path), "..") {
+				return nil, fmt.Errorf("%s:%d: file %q isn't in the workspace", name, n+1, path)
+			}
+			t.files = append(t.files, selftestFile{path: path})
+			file = &t.files[len(t.files)-1]
+			continue
+		}
+		if file != nil {
+			file.data = append(file.data, line...)
+			continue
+		}
+		step, err := parseSelftestStep(strings.TrimSpace(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, n+1, err)
+		}
+		if step.cmd != "" {
+			step.line = n + 1
+			t.steps = append(t.steps, step)
+		}
+	}
+	if len(t.steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", name)
+	}
+	return t, nil
+}
+
+// selftestFileHeader returns the path of a "-- path --" line.
+func selftestFileHeader(line string) (string, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	rest, ok := strings.CutPrefix(line, "-- ")
+	if !ok {
+		return "", false
+	}
+	path, ok := strings.CutSuffix(rest, " --")
+	return strings.TrimSpace(path), ok
+}
+
+func parseSelftestStep(line string) (selftestStep, error) {
+	var s selftestStep
+	if line == "" || line[0] == '#' {
+		return s, nil
+	}
+	if rest, ok := strings.CutPrefix(line, "!"); ok {
+		s.neg = true
+		line = strings.TrimSpace(rest)
+	}
+	s.cmd, line, _ = strings.Cut(line, " ")
+	line = strings.TrimSpace(line)
+	if s.cmd == "sh" {
+		if line == "" {
+			return s, errors.New("sh: no command")
+		}
+		s.args = []string{line}
+		return s, nil
+	}
+	args, err := splitSelftestArgs(line)
+	if err != nil {
+		return s, err
+	}
+	s.args = args
+
+	want := -1 // any number of arguments
+	switch s.cmd {
+	case "mk":
+	case "exists":
+		if len(args) == 0 {
+			return s, errors.New("exists: no files")
+		}
+	case "status":
+		want = 1
+		if len(args) == 1 {
+			if _, err := strconv.Atoi(args[0]); err != nil {
+				return s, fmt.Errorf("status %s: not a number", args[0])
+			}
+		}
+	case "stdout", "stderr":
+		want = 1
+		if len(args) == 1 {
+			if _, err := regexp.Compile(args[0]); err != nil {
+				return s, fmt.Errorf("%s: %w", s.cmd, err)
+			}
+		}
+	case "cmp":
+		want = 2
+	default:
+		return s, fmt.Errorf("unknown step %q", s.cmd)
+	}
+	if want >= 0 && len(args) != want {
+		return s, fmt.Errorf("%s: want %d arguments, got %d", s.cmd, want, len(args))
+	}
+	if s.neg && s.cmd != "mk" && s.cmd != "stdout" && s.cmd != "stderr" && s.cmd != "exists" {
+		return s, fmt.Errorf("%s can't be negated", s.cmd)
+	}
+	return s, nil
+}
+
+// splitSelftestArgs splits line at spaces outside quotes.
+func splitSelftestArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// SelftestFiles returns the .mktest files in the tests directory of the
+// workspace of the mkfile at path.
+func SelftestFiles(dir, path string) ([]string, error) {
+	return filepath.Glob(filepath.Join(mkfileWorkspace(dir, path).path(SelftestDir), "*.mktest"))
+}
+
+// Run runs the test in a new temporary workspace, with bin the mk
+// command, and returns a log of its steps and the output of its mk runs.
+// The directory of the project under test is $MKTEST_ROOT, so its
+// mkfile can include the project's rules, and the shared action cache
+// is the test's own. The error says which step failed, if one did.
+func (t *Selftest) Run(ctx context.Context, bin, root string) (log string, err error) {
+	tmp, err := os.MkdirTemp("", "mktest-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	work := filepath.Join(tmp, "work")
+	for _, f := range t.files {
+		path := filepath.Join(work, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(path, f.data, 0o644); err != nil {
+			return "", err
+		}
+	}
+	if err := os.MkdirAll(work, 0o755); err != nil {
+		return "", err
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return "", err
+	}
+	env := append(os.Environ(), "MKTEST_ROOT="+root, "XDG_CACHE_HOME="+filepath.Join(tmp, "cache"))
+	if os.Getenv("GOCACHE") == "" {
+		// Go's build cache also defaults to under XDG_CACHE_HOME.
+		if d, err := os.UserCacheDir(); err == nil {
+			env = append(env, "GOCACHE="+filepath.Join(d, "go-build"))
+		}
+	}
+
+	r := &selftestRun{work: work, bin: bin, env: env, status: -1}
+	for _, s := range t.steps {
+		fmt.Fprintf(&r.log, "> %s\n", s)
+		if err := r.step(ctx, s); err != nil {
+			return r.log.String(), fmt.Errorf("%s:%d: %s: %w", t.Name, s.line, s, err)
+		}
+	}
+	return r.log.String(), nil
+}
+
+// selftestRun is the state of a Selftest as it runs.
+type selftestRun struct {
+	work, bin      string
+	env            []string
+	log            bytes.Buffer
+	stdout, stderr string // of the last mk
+	status         int    // the last mk's exit status; -1 before one has run
+}
+
+func (r *selftestRun) step(ctx context.Context, s selftestStep) error {
+	var err error
+	switch s.cmd {
+	case "mk", "sh":
+		var cmd *exec.Cmd
+		if s.cmd == "mk" {
+			cmd = exec.CommandContext(ctx, r.bin, s.args...)
+		} else {
+			cmd = exec.CommandContext(ctx, "sh", "-c", s.args[0])
+		}
+		var out, errOut bytes.Buffer
+		cmd.Dir, cmd.Env, cmd.Stdout, cmd.Stderr = r.work, r.env, &out, &errOut
+		runErr := cmd.Run()
+		if out.Len() > 0 {
+			fmt.Fprintf(&r.log, "[stdout]\n%s", out.String())
+		}
+		if errOut.Len() > 0 {
+			fmt.Fprintf(&r.log, "[stderr]\n%s", errOut.String())
+		}
+		var exit *exec.ExitError
+		if runErr != nil && !errors.As(runErr, &exit) {
+			return runErr
+		}
+		code := 0
+		if exit != nil {
+			code = exit.ExitCode()
+		}
+		if s.cmd == "sh" {
+			if code != 0 {
+				err = fmt.Errorf("exit status %d", code)
+			}
+			return err
+		}
+		r.stdout, r.stderr, r.status = out.String(), errOut.String(), code
+		switch {
+		case s.neg && code == 0:
+			err = errors.New("succeeded unexpectedly")
+		case !s.neg && code != 0:
+			err = fmt.Errorf("exit status %d", code)
+		}
+	case "status":
+		want, _ := strconv.Atoi(s.args[0])
+		switch {
+		case r.status < 0:
+			err = errors.New("no mk has run")
+		case r.status != want:
+			err = fmt.Errorf("mk exited with status %d", r.status)
+		}
+	case "stdout", "stderr":
+		out := r.stdout
+		if s.cmd == "stderr" {
+			out = r.stderr
+		}
+		matched := regexp.MustCompile("(?m)" + s.args[0]).MatchString(out)
+		switch {
+		case r.status < 0:
+			err = errors.New("no mk has run")
+		case matched && s.neg:
+			err = errors.New("matches")
+		case !matched && !s.neg:
+			err = errors.New("no match")
+		}
+	case "exists":
+		for _, p := range s.args {
+			_, statErr := os.Stat(filepath.Join(r.work, p))
+			switch {
+			case statErr == nil && s.neg:
+				err = fmt.Errorf("%s exists", p)
+			case statErr != nil && !s.neg:
+				err = fmt.Errorf("%s doesn't exist", p)
+			}
+			if err != nil {
+				break
+			}
+		}
+	case "cmp":
+		a, errA := os.ReadFile(filepath.Join(r.work, s.args[0]))
+		b, errB := os.ReadFile(filepath.Join(r.work, s.args[1]))
+		switch {
+		case errA != nil:
+			err = errA
+		case errB != nil:
+			err = errB
+		case !bytes.Equal(a, b):
+			err = fmt.Errorf("%s and %s differ", s.args[0], s.args[1])
+		}
+	}
+	return err
+}
+
+// String returns the step as written, give or take quoting.
+func (s selftestStep) String() string {
+	var b strings.Builder
+	if s.neg {
+		b.WriteString("! ")
+	}
+	b.WriteString(s.cmd)
+	for _, a := range s.args {
+		b.WriteByte(' ')
+		if a == "" || strings.ContainsAny(a, " \t") && s.cmd != "sh" {
+			a = strconv.Quote(a)
+		}
+		b.WriteString(a)
+	}
+	return b.String()
+}
@@ -0,0 +1,109 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseSelftest(t *testing.T) {
+	st, err := ParseSelftest("t.mktest", []byte(`# Builds out.
+mk -j1 'a b' "c"
+! stderr warning
+sh echo x >> in
+-- mkfile --
+out: in
+    cp $input $target
+-- sub/in --
+-- in --
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []string
+	for _, s := range st.steps {
+		steps = append(steps, s.String())
+	}
+	want := []string{`mk -j1 "a b" c`, "! stderr warning", "sh echo x >> in"}
+	if !slices.Equal(steps, want) {
+		t.Errorf("steps = %q, want %q", steps, want)
+	}
+	if len(st.files) != 3 || st.files[0].path != "mkfile" || string(st.files[0].data) != "out: in\n    cp $input $target\n" || st.files[1].path != "sub/in" {
+		t.Errorf("files = %+v", st.files)
+	}
+
+	for _, bad := range []string{
+		"",                      // no steps
+		"frobnicate\n",          // unknown step
+		"! cmp a b\n",           // can't be negated
+		"status x\n",            // not a number
+		"stdout (\n",            // bad regexp
+		"mk 'a\n",               // unterminated quote
+		"mk\n-- ../escape --\n", // outside the workspace
+		"cmp a\n",               // too few arguments
+	} {
+		if _, err := ParseSelftest("t.mktest", []byte(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestSelftestRun(t *testing.T) {
+	// A stand-in for mk: it copies its first argument's file to its
+	// second, or exits with the status given by --exit.
+	bin := filepath.Join(t.TempDir(), "fake-mk")
+	os.WriteFile(bin, []byte(`#!/bin/sh
+if [ "$1" = --exit ]; then echo "failing with $2" >&2; exit $2; fi
+cp "$1" "$2" && echo "copied $1 from $MKTEST_ROOT"
+`), 0o755)
+	root := t.TempDir()
+
+	run := func(script string) (string, error) {
+		t.Helper()
+		st, err := ParseSelftest("t.mktest", []byte(script))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Run(context.Background(), bin, root)
+	}
+
+	log, err := run(`mk in out
+stdout 'copied in from ` + root + `'
+! stderr .
+cmp in out
+exists in out
+! exists missing
+! mk --exit 3
+status 3
+stderr 'failing with 3'
+sh test -f out && rm out
+! exists out
+-- in --
+hello
+`)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, log)
+	}
+	if !strings.Contains(log, "> mk in out\n[stdout]\ncopied in") {
+		t.Errorf("log doesn't show the mk run:\n%s", log)
+	}
+
+	for script, want := range map[string]string{
+		"mk --exit 1\n":                       "t.mktest:1: mk --exit 1: exit status 1",
+		"mk in out\nstdout nope\n-- in --\n":  "t.mktest:2: stdout nope: no match",
+		"mk in out\n! mk in out2\n-- in --\n": "t.mktest:2: ! mk in out2: succeeded unexpectedly",
+		"stderr x\n":                          "t.mktest:1: stderr x: no mk has run",
+		"sh false\n":                          "t.mktest:1: sh false: exit status 1",
+		"cmp a b\n-- a --\nA\n-- b --\nB\n":   "t.mktest:1: cmp a b: a and b differ",
+	} {
+		if _, err := run(script); err == nil || err.Error() != want {
+			t.Errorf("%q: err = %v, want %s", script, err, want)
+		}
+	}
+}
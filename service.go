@@ -0,0 +1,162 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceDir holds a pidfile and a log for each [service] task mk has
+// started.
+var serviceDir = filepath.Join(stateDir, "services")
+
+// serviceStopTimeout is how long a service has to exit after SIGTERM
+// before it is killed.
+const serviceStopTimeout = 5 * time.Second
+
+func (w workspace) servicePath(task, ext string) string {
+	return w.path(filepath.Join(serviceDir, url.PathEscape(task)+ext))
+}
+
+// readService returns the pid of the running service task and the
+// digest of the recipe and inputs it was started with. ok is false if it
+// isn't running.
+func (w workspace) readService(task string) (pid int, digest string, ok bool) {
+	data, err := os.ReadFile(w.servicePath(task, ".pid"))
+	if err != nil {
+		return 0, "", false
+	}
+	pidStr, digest, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	pid, err = strconv.Atoi(pidStr)
+	if err != nil || !processAlive(pid) {
+		return 0, "", false
+	}
+	return pid, digest, true
+}
+
+// runService starts a [service] task's recipe in the background, unless
+// it is already running with the same recipe and inputs. A service whose
+// inputs changed is stopped and started again.
+func (e *Executor) runService(ctx context.Context, rule *resolvedRule, recipeText, hashText string) error {
+	digest := actionDigest(rule.targets, rule.prereqs, hashText, e.cache)
+	pid, running, ok := e.dir.readService(rule.target)
+	if ok && digest != "" && running == digest {
+		if e.verbose {
+			e.outputMu.Lock()
+			e.console.printf("mk: service %q is running (pid %d)\n", rule.target, pid)
+			e.outputMu.Unlock()
+		}
+		e.emit(Event{Kind: TargetSkipped, Target: rule.target, Targets: rule.targets, Rule: rule.pos})
+		return nil
+	}
+
+	verb := "starting"
+	if ok {
+		verb = "restarting"
+	}
+	var banner strings.Builder
+	fmt.Fprintf(&banner, "mk: %s service %q\n", verb, rule.target)
+	if e.verbose || e.dryRun {
+		for _, line := range strings.Split(recipeText, "\n") {
+			fmt.Fprintf(&banner, "  %s\n", line)
+		}
+	}
+	e.outputMu.Lock()
+	e.console.banner(banner.String())
+	e.outputMu.Unlock()
+	if e.dryRun {
+		return nil
+	}
+	sh := e.shellFor(rule)
+	if err := e.checkSyntax(ctx, rule, sh, sh.script(recipeText)); err != nil {
+		return err
+	}
+
+	e.emit(Event{Kind: TargetStarted, Target: rule.target, Targets: rule.targets, Rule: rule.pos})
+	if ok {
+		if err := e.dir.stopService(rule.target); err != nil {
+			err = fmt.Errorf("restarting service %q: %w", rule.target, err)
+			e.failed(err)
+			e.emit(Event{Kind: TargetFailed, Target: rule.target, Targets: rule.targets, Rule: rule.pos, Err: err})
+			return err
+		}
+	}
+	if err := e.dir.startService(rule.target, rule.workdir(e.vars), sh, sh.script(recipeText), e.recipeEnv(rule), digest); err != nil {
+		err = fmt.Errorf("starting service %q: %w", rule.target, err)
+		e.failed(err)
+		e.emit(Event{Kind: TargetFailed, Target: rule.target, Targets: rule.targets, Rule: rule.pos, Err: err})
+		return err
+	}
+	e.emit(Event{Kind: TargetFinished, Target: rule.target, Targets: rule.targets, Rule: rule.pos})
+	return nil
+}
+
+// startService runs script with sh in cwd, detached from mk, in its own
+// process group, with output appended to the task's log, and records its
+// pidfile.
+func (w workspace) startService(task, cwd string, sh interpreter, script string, env []string, digest string) error {
+	if err := os.MkdirAll(w.path(serviceDir), 0o755); err != nil {
+		return err
+	}
+	log, err := os.OpenFile(w.servicePath(task, ".log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	args := sh.command(script)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = w.path(cwd)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	cmd.Env = env
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return writeFileAtomic(w.servicePath(task, ".pid"), fmt.Appendf(nil, "%d\n%s\n", pid, digest))
+}
+
+// StopService stops the [service] task started by an earlier build, if
+// it is running, and removes its pidfile.
+func StopService(task string) error {
+	return workspace("").stopService(task)
+}
+
+func (w workspace) stopService(task string) error {
+	if pid, _, ok := w.readService(task); ok {
+		if err := stopProcess(pid, serviceStopTimeout); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(w.servicePath(task, ".pid")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Services returns the [service] tasks that are running, sorted.
+func Services() []string {
+	matches, _ := filepath.Glob(filepath.Join(serviceDir, "*.pid"))
+	var tasks []string
+	for _, m := range matches {
+		task, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(m), ".pid"))
+		if err != nil {
+			continue
+		}
+		if _, _, ok := workspace("").readService(task); ok {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks
+}
@@ -0,0 +1,86 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestService(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+!dev [service]: server.conf
+    echo started >> starts
+    exec sleep 60
+`), 0o644)
+	os.WriteFile("server.conf", []byte("port 8080"), 0o644)
+	defer StopService("dev")
+
+	starts := func() int {
+		data, _ := os.ReadFile("starts")
+		return strings.Count(string(data), "started")
+	}
+	build := func() {
+		t.Helper()
+		mustBuild(t, Options{Stdout: io.Discard, Stderr: io.Discard}, "dev")
+	}
+	// The recipe runs in the background, so wait for it to start.
+	waitStarts := func(n int) {
+		t.Helper()
+		for i := 0; i < 200 && starts() < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := starts(); got != n {
+			t.Fatalf("service started %d times, want %d", got, n)
+		}
+	}
+
+	build()
+	waitStarts(1)
+	pid, _, ok := workspace("").readService("dev")
+	if !ok {
+		t.Fatal("service not running after build")
+	}
+	if got := Services(); !slices.Equal(got, []string{"dev"}) {
+		t.Errorf("Services() = %q, want [dev]", got)
+	}
+
+	// Unchanged inputs leave it running; changed ones restart it.
+	build()
+	if p, _, _ := workspace("").readService("dev"); p != pid || starts() != 1 {
+		t.Errorf("service restarted with unchanged inputs")
+	}
+	os.WriteFile("server.conf", []byte("port 9090"), 0o644)
+	build()
+	waitStarts(2)
+	if p, _, ok := workspace("").readService("dev"); !ok || p == pid {
+		t.Errorf("service not restarted after its input changed")
+	}
+	if processAlive(pid) {
+		t.Errorf("old service process %d still running", pid)
+	}
+
+	if err := StopService("dev"); err != nil {
+		t.Fatal(err)
+	}
+	if got := Services(); len(got) != 0 {
+		t.Errorf("Services() after stop = %q, want none", got)
+	}
+}
+
+func TestServiceOnlyForTasks(t *testing.T) {
+	_, err := Parse(strings.NewReader("out [service]: in\n    cp in out\n"))
+	if err == nil || !strings.Contains(err.Error(), "[service] applies only to tasks") {
+		t.Errorf("Parse error = %v, want [service] applies only to tasks", err)
+	}
+}
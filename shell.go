@@ -0,0 +1,115 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// shellVar names the variable that chooses the interpreter recipes run
+// with (shell = bash -euo pipefail). A rule's [shell: ...] overrides it.
+const shellVar = "shell"
+
+// An interpreter is the command line a recipe runs with; mk appends -c
+// and the script. Empty means sh.
+type interpreter []string
+
+// shellFor returns the interpreter for rule's recipe: its [shell: ...]
+// command, or else $shell, expanded with the rule's variables.
+func (e *Executor) shellFor(rule *resolvedRule) interpreter {
+	return ruleShell(rule, rule.varsFor(e.vars))
+}
+
+func ruleShell(rule *resolvedRule, vars *Vars) interpreter {
+	s := vars.Get(shellVar)
+	if rule.shell != "" {
+		s = vars.Expand(rule.shell)
+	}
+	if s == "" {
+		return defaultInterpreter()
+	}
+	return interpreter(strings.Fields(s))
+}
+
+// name returns the interpreter's program name, lowercased and without
+// .exe, for recognizing it: bash for /bin/bash, cmd for
+// C:\Windows\System32\cmd.exe.
+func (i interpreter) name() string {
+	if len(i) == 0 {
+		return "sh"
+	}
+	base := path.Base(strings.ReplaceAll(i[0], `\`, "/"))
+	return strings.TrimSuffix(strings.ToLower(base), ".exe")
+}
+
+// posix reports whether the interpreter is a POSIX shell, which the
+// prelude, the - prefix and the set -e mk adds are written for.
+func (i interpreter) posix() bool {
+	switch i.name() {
+	case "sh", "bash", "dash", "ksh", "mksh", "zsh", "ash":
+		return true
+	}
+	return false
+}
+
+// script returns the script that runs recipe text, stopping at the
+// first failing line where the interpreter allows: a POSIX shell gets
+// set -e first, cmd.exe the lines joined with &&, and PowerShell told to
+// stop on errors, including failing programs (PowerShell 7.3 and later).
+// Other interpreters get the text as it is.
+func (i interpreter) script(text string) string {
+	switch {
+	case i.posix():
+		return "set -e\n" + text
+	case i.name() == "cmd":
+		return strings.ReplaceAll(text, "\n", " && ")
+	case i.powerShell():
+		return "$ErrorActionPreference = 'Stop'\n$PSNativeCommandUseErrorActionPreference = $true\n" + text
+	}
+	return text
+}
+
+func (i interpreter) powerShell() bool {
+	return i.name() == "powershell" || i.name() == "pwsh"
+}
+
+// command returns the command line that runs script: the interpreter's
+// with the flag that takes a program as an argument, -c but for cmd.exe
+// (/C) and PowerShell (-Command), and script.
+func (i interpreter) command(script string) []string {
+	if len(i) == 0 {
+		return []string{"sh", "-c", script}
+	}
+	flag := "-c"
+	switch {
+	case i.name() == "cmd":
+		flag = "/C"
+	case i.powerShell():
+		flag = "-Command"
+	}
+	return append(slices.Clone(i), flag, script)
+}
+
+// checkCommand returns the command line that parses script without
+// running it, or nil if the interpreter can't: only POSIX shells have
+// -n.
+func (i interpreter) checkCommand(script string) []string {
+	if !i.posix() {
+		return nil
+	}
+	args := i.command(script)
+	return slices.Insert(args, len(args)-2, "-n")
+}
+
+// hash returns what the interpreter adds to a recipe's hash, so that
+// changing it rebuilds the rule: nothing for sh, which every recipe
+// hashed before interpreters could be chosen ran with.
+func (i interpreter) hash() string {
+	if len(i) == 0 {
+		return ""
+	}
+	return "\x00shell " + strings.Join(i, " ")
+}
@@ -0,0 +1,12 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !windows
+
+package mk
+
+// defaultInterpreter returns the interpreter recipes run with when the
+// mkfile doesn't choose one: sh.
+func defaultInterpreter() interpreter {
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRecipeShell(t *testing.T) {
+	for _, tool := range []string{"bash", "python3"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+	dir := t.TempDir()
+	write := func(mkfile string) {
+		os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0o644)
+	}
+	build := func(targets ...string) error {
+		t.Helper()
+		_, err := loadAndBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, targets...)
+		return err
+	}
+	read := func(name string) string {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		return strings.TrimSpace(string(data))
+	}
+
+	write(`
+shell = bash -euo pipefail
+
+prelude:
+    greet() { echo "hello $1"; }
+
+piped.txt:
+    false | cat > /dev/null
+    echo ran > $target
+
+greeting.txt:
+    greet bash > $target
+
+squares.txt [shell: python3]:
+    with open("$target", "w") as f:
+        f.write(" ".join(str(i * i) for i in range(4)))
+`)
+	if err := build("piped.txt"); err == nil {
+		t.Errorf("a failing pipeline didn't fail under pipefail")
+	}
+	if err := build("greeting.txt", "squares.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("greeting.txt"); got != "hello bash" {
+		t.Errorf("greeting.txt = %q, want the prelude's function to run under bash", got)
+	}
+	if got := read("squares.txt"); got != "0 1 4 9" {
+		t.Errorf("squares.txt = %q, want %q", got, "0 1 4 9")
+	}
+
+	// Changing the interpreter rebuilds what it runs.
+	for i, shell := range []string{"", "", "shell = bash"} {
+		write(shell + `
+runs.txt:
+    echo run >> $target
+`)
+		if err := build("runs.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := strings.Count(read("runs.txt"), "run"), []int{1, 1, 2}[i]; got != want {
+			t.Errorf("build %d with %q: recipe has run %d times, want %d", i+1, shell, got, want)
+		}
+	}
+
+	write(`
+!task [shell: python3]:
+    -print("x")
+`)
+	if err := build("task"); err == nil || !strings.Contains(err.Error(), "needs a POSIX shell") {
+		t.Errorf("- prefix under python3: err = %v, want it rejected", err)
+	}
+}
+
+func TestInterpreterCommand(t *testing.T) {
+	for _, tt := range []struct {
+		shell string
+		want  []string
+		posix bool
+	}{
+		{"", []string{"sh", "-c", "set -e\na\nb"}, true},
+		{"/bin/bash -eu", []string{"/bin/bash", "-eu", "-c", "set -e\na\nb"}, true},
+		{"python3", []string{"python3", "-c", "a\nb"}, false},
+		{`C:\Windows\System32\cmd.exe`, []string{`C:\Windows\System32\cmd.exe`, "/C", "a && b"}, false},
+		{"pwsh -NoProfile", []string{"pwsh", "-NoProfile", "-Command", "$ErrorActionPreference = 'Stop'\n$PSNativeCommandUseErrorActionPreference = $true\na\nb"}, false},
+	} {
+		sh := interpreter(strings.Fields(tt.shell))
+		if got := sh.command(sh.script("a\nb")); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: command = %q, want %q", tt.shell, got, tt.want)
+		}
+		if sh.posix() != tt.posix {
+			t.Errorf("%q: posix = %t, want %t", tt.shell, sh.posix(), tt.posix)
+		}
+	}
+}
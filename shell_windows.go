@@ -0,0 +1,27 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build windows
+
+package mk
+
+import (
+	"os/exec"
+	"sync"
+)
+
+// defaultInterpreter returns the interpreter recipes run with when the
+// mkfile doesn't choose one: sh if there is one on PATH, as with Git for
+// Windows or MSYS2, so that mkfiles written for Unix work unchanged, and
+// otherwise PowerShell.
+var defaultInterpreter = sync.OnceValue(func() interpreter {
+	if _, err := exec.LookPath("sh"); err == nil {
+		return nil
+	}
+	for _, ps := range []string{"pwsh", "powershell"} {
+		if _, err := exec.LookPath(ps); err == nil {
+			return interpreter{ps, "-NoProfile", "-NonInteractive"}
+		}
+	}
+	return nil
+})
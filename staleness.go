@@ -0,0 +1,230 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+)
+
+// StaleKind classifies why a target is stale.
+type StaleKind int
+
+const (
+	StaleUnbuilt           StaleKind = iota // no previous build recorded
+	StaleRecipe                             // the expanded recipe changed
+	StaleFingerprint                        // the fingerprint command's output changed
+	StaleFingerprintFailed                  // the fingerprint command failed
+	StaleMissing                            // the target file does not exist
+	StaleModified                           // the target changed since mk built it
+	StalePrereqSet                          // prerequisites were added or removed
+	StalePrereq                             // a prerequisite's content changed
+	StalePrereqUnreadable                   // a prerequisite can't be hashed
+	StaleForced                             // the build was forced (-B)
+	StaleUpstream                           // a dry run would rebuild a prerequisite
+	StaleDiscovered                         // a file the rule's depfile listed changed or is gone
+)
+
+func (k StaleKind) String() string {
+	switch k {
+	case StaleUnbuilt:
+		return "unbuilt"
+	case StaleRecipe:
+		return "recipe"
+	case StaleFingerprint:
+		return "fingerprint"
+	case StaleFingerprintFailed:
+		return "fingerprint-failed"
+	case StaleMissing:
+		return "missing"
+	case StaleModified:
+		return "modified"
+	case StalePrereqSet:
+		return "prereq-set"
+	case StalePrereq:
+		return "prereq"
+	case StalePrereqUnreadable:
+		return "prereq-unreadable"
+	case StaleForced:
+		return "forced"
+	case StaleUpstream:
+		return "upstream"
+	case StaleDiscovered:
+		return "discovered"
+	default:
+		return "unknown"
+	}
+}
+
+// StaleReason is one reason a rule's targets need rebuilding.
+type StaleReason struct {
+	Kind   StaleKind
+	Target string // the target, for reasons about one target's record or file
+	Prereq string // the prerequisite, for StalePrereq, StalePrereqUnreadable, StaleUpstream and StaleDiscovered
+	Err    error  // for StaleFingerprintFailed and StalePrereqUnreadable
+}
+
+// String describes the reason as --why reports it.
+func (r StaleReason) String() string {
+	switch r.Kind {
+	case StaleUnbuilt:
+		return fmt.Sprintf("%s: no previous build recorded", r.Target)
+	case StaleRecipe:
+		return "recipe has changed"
+	case StaleFingerprint:
+		return fmt.Sprintf("%s: fingerprint has changed", r.Target)
+	case StaleFingerprintFailed:
+		return fmt.Sprintf("%s: fingerprint command failed: %v", r.Target, r.Err)
+	case StaleMissing:
+		return fmt.Sprintf("%s: target file does not exist", r.Target)
+	case StaleModified:
+		return fmt.Sprintf("%s: modified since mk built it", r.Target)
+	case StalePrereqSet:
+		return "prerequisite set has changed"
+	case StalePrereq:
+		return fmt.Sprintf("prerequisite %q has changed", r.Prereq)
+	case StalePrereqUnreadable:
+		return fmt.Sprintf("cannot hash prerequisite %q: %v", r.Prereq, r.Err)
+	case StaleForced:
+		return "rebuild forced"
+	case StaleUpstream:
+		return fmt.Sprintf("prerequisite %q would be rebuilt", r.Prereq)
+	case StaleDiscovered:
+		return fmt.Sprintf("dependency %q from the depfile has changed", r.Prereq)
+	default:
+		return r.Kind.String()
+	}
+}
+
+// StalenessReport is the outcome of evaluating a rule against the build
+// state. The targets are up to date if it has no reasons.
+type StalenessReport struct {
+	Reasons []StaleReason
+}
+
+// Stale reports whether the targets need rebuilding.
+func (r *StalenessReport) Stale() bool { return len(r.Reasons) > 0 }
+
+// Strings returns the reasons as --why reports them.
+func (r *StalenessReport) Strings() []string {
+	var s []string
+	for _, reason := range r.Reasons {
+		s = append(s, reason.String())
+	}
+	return s
+}
+
+// add appends a reason unless an equivalent one is already there, so a
+// rule-wide reason such as a changed recipe is reported once rather than
+// once per target.
+func (r *StalenessReport) add(reason StaleReason) {
+	if !slices.ContainsFunc(r.Reasons, func(o StaleReason) bool {
+		return o.Kind == reason.Kind && o.Target == reason.Target && o.Prereq == reason.Prereq
+	}) {
+		r.Reasons = append(r.Reasons, reason)
+	}
+}
+
+// Evaluate determines whether and why any of the targets need
+// rebuilding. Only normal prereqs (not order-only) affect staleness. If
+// fingerprint is non-empty, it is a shell command whose output replaces
+// the file checks for the targets; it runs at most once.
+func (s *BuildState) Evaluate(ctx context.Context, targets []string, prereqs []string, recipeText, fingerprint string, cache *HashCache) *StalenessReport {
+	// Snapshot state under read lock, then release before I/O
+	s.mu.RLock()
+	snapshots := make([]*TargetState, len(targets))
+	for i, t := range targets {
+		snapshots[i] = s.Targets[t]
+	}
+	s.mu.RUnlock()
+
+	report := &StalenessReport{}
+	rh := hashString(recipeText)
+	var fph string
+	var fpErr error
+	fpRun := false
+	var sortedPrereqs []string
+
+	for i, ts := range snapshots {
+		target := targets[i]
+		if ts == nil {
+			report.add(StaleReason{Kind: StaleUnbuilt, Target: target})
+			continue
+		}
+		if ts.RecipeHash != rh {
+			report.add(StaleReason{Kind: StaleRecipe})
+		}
+
+		if fingerprint != "" {
+			// Fingerprint mode: the fingerprint command output replaces
+			// both target-file and prerequisite-hash checks.
+			if !fpRun {
+				fph, fpErr = runFingerprint(ctx, s.dir, fingerprint)
+				fpRun = true
+			}
+			if fpErr != nil {
+				report.add(StaleReason{Kind: StaleFingerprintFailed, Target: target, Err: fpErr})
+			} else if ts.FingerprintHash != fph {
+				report.add(StaleReason{Kind: StaleFingerprint, Target: target})
+			}
+			continue
+		}
+
+		// File mode: check target exists and prereq hashes.
+		if _, err := os.Stat(s.dir.path(target)); os.IsNotExist(err) {
+			report.add(StaleReason{Kind: StaleMissing, Target: target})
+		} else if s.outputCheck == OutputsRebuild && ts.OutputHash != "" {
+			if h, err := cache.Hash(target); err == nil && h != ts.OutputHash {
+				report.add(StaleReason{Kind: StaleModified, Target: target})
+			}
+		}
+
+		for _, x := range slices.Sorted(maps.Keys(ts.Extra)) {
+			if _, err := os.Stat(s.dir.path(x)); os.IsNotExist(err) {
+				report.add(StaleReason{Kind: StaleMissing, Target: x})
+			} else if s.outputCheck == OutputsRebuild && ts.Extra[x] != "" {
+				if h, err := cache.Hash(x); err == nil && h != ts.Extra[x] {
+					report.add(StaleReason{Kind: StaleModified, Target: x})
+				}
+			}
+		}
+
+		if sortedPrereqs == nil {
+			sortedPrereqs = slices.Sorted(slices.Values(prereqs))
+		}
+		if !slices.Equal(sortedPrereqs, slices.Sorted(slices.Values(ts.Prereqs))) {
+			report.add(StaleReason{Kind: StalePrereqSet})
+		}
+
+		for _, p := range prereqs {
+			h, err := cache.Hash(p)
+			if err != nil {
+				report.add(StaleReason{Kind: StalePrereqUnreadable, Prereq: p, Err: err})
+			} else if ts.InputHashes[p] != h {
+				report.add(StaleReason{Kind: StalePrereq, Prereq: p})
+			}
+		}
+		for _, d := range ts.Discovered {
+			if h, err := cache.Hash(d); err != nil || ts.InputHashes[d] != h {
+				report.add(StaleReason{Kind: StaleDiscovered, Prereq: d})
+			}
+		}
+	}
+	return report
+}
+
+// IsStale determines if any of the targets need rebuilding. It is
+// Evaluate(...).Stale().
+func (s *BuildState) IsStale(ctx context.Context, targets []string, prereqs []string, recipeText, fingerprint string, cache *HashCache) bool {
+	return s.Evaluate(ctx, targets, prereqs, recipeText, fingerprint, cache).Stale()
+}
+
+// WhyStale returns human-readable reasons why any of the targets are
+// stale. It is Evaluate(...).Strings().
+func (s *BuildState) WhyStale(ctx context.Context, targets []string, prereqs []string, recipeText, fingerprint string, cache *HashCache) []string {
+	return s.Evaluate(ctx, targets, prereqs, recipeText, fingerprint, cache).Strings()
+}
@@ -0,0 +1,201 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEvaluateAgrees checks that IsStale, WhyStale and Evaluate give the
+// same answer in every situation Evaluate distinguishes.
+func TestEvaluateAgrees(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name        string
+		targets     []string
+		prereqs     []string
+		recipe      string
+		fingerprint string
+		change      func()
+		want        []StaleKind
+	}{
+		{name: "up to date"},
+		{name: "unbuilt", targets: []string{"out", "new"}, want: []StaleKind{StaleUnbuilt}},
+		{name: "recipe", recipe: "other", want: []StaleKind{StaleRecipe}},
+		{name: "missing", change: func() { os.Remove("out") }, want: []StaleKind{StaleMissing}},
+		{name: "modified", change: func() { os.WriteFile("out", []byte("edited"), 0o644) }, want: []StaleKind{StaleModified}},
+		{name: "prereq set", prereqs: []string{"in"}, want: []StaleKind{StalePrereqSet}},
+		{name: "prereq", change: func() { os.WriteFile("in", []byte("changed"), 0o644) }, want: []StaleKind{StalePrereq}},
+		{name: "unreadable", change: func() { os.Remove("in") }, want: []StaleKind{StalePrereqUnreadable}},
+		{name: "fingerprint", fingerprint: "echo other", want: []StaleKind{StaleFingerprint}},
+		{name: "fingerprint failed", fingerprint: "exit 1", want: []StaleKind{StaleFingerprintFailed}},
+		{name: "several", recipe: "other", change: func() { os.WriteFile("in", []byte("changed"), 0o644) }, want: []StaleKind{StaleRecipe, StalePrereq}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			oldDir, _ := os.Getwd()
+			os.Chdir(dir)
+			defer os.Chdir(oldDir)
+
+			os.WriteFile("in", []byte("data"), 0o644)
+			os.WriteFile("lib", []byte("data"), 0o644)
+			os.WriteFile("out", []byte("built"), 0o644)
+			fingerprint := ""
+			if tt.fingerprint != "" {
+				fingerprint = "echo same"
+			}
+			state := &BuildState{Targets: make(map[string]*TargetState)}
+			state.Record(ctx, []string{"out"}, []string{"in", "lib"}, "recipe", fingerprint, NewHashCache())
+
+			targets, prereqs, recipe := []string{"out"}, []string{"in", "lib"}, "recipe"
+			if tt.targets != nil {
+				targets = tt.targets
+			}
+			if tt.prereqs != nil {
+				prereqs = tt.prereqs
+			}
+			if tt.recipe != "" {
+				recipe = tt.recipe
+			}
+			if tt.fingerprint != "" {
+				fingerprint = tt.fingerprint
+			}
+			if tt.change != nil {
+				tt.change()
+			}
+
+			report := state.Evaluate(ctx, targets, prereqs, recipe, fingerprint, NewHashCache())
+			var kinds []StaleKind
+			for _, r := range report.Reasons {
+				kinds = append(kinds, r.Kind)
+			}
+			if !slices.Equal(kinds, tt.want) {
+				t.Errorf("Evaluate = %v, want kinds %v", report.Strings(), tt.want)
+			}
+			stale := state.IsStale(ctx, targets, prereqs, recipe, fingerprint, NewHashCache())
+			why := state.WhyStale(ctx, targets, prereqs, recipe, fingerprint, NewHashCache())
+			if stale != report.Stale() || stale != (len(why) > 0) {
+				t.Errorf("IsStale = %v, WhyStale = %v, Evaluate stale = %v", stale, why, report.Stale())
+			}
+			if !slices.Equal(why, report.Strings()) {
+				t.Errorf("WhyStale = %v, Evaluate = %v", why, report.Strings())
+			}
+		})
+	}
+}
+
+func TestEvaluateReportsOnce(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	ctx := context.Background()
+	targets := []string{"a", "b"}
+	state := &BuildState{Targets: make(map[string]*TargetState)}
+	state.Record(ctx, targets, nil, "recipe", "echo same", NewHashCache())
+
+	// The fingerprint runs once for all targets, and a changed recipe is
+	// one reason, not one per target.
+	fingerprint := "echo run >> runs; echo other"
+	report := state.Evaluate(ctx, targets, nil, "other", fingerprint, NewHashCache())
+	if got := report.Strings(); !slices.Equal(got, []string{"recipe has changed", "a: fingerprint has changed", "b: fingerprint has changed"}) {
+		t.Errorf("reasons = %q", got)
+	}
+	if data, _ := os.ReadFile("runs"); strings.Count(string(data), "run") != 1 {
+		t.Errorf("fingerprint ran %d times, want 1", strings.Count(string(data), "run"))
+	}
+}
+
+func TestCheckMtime(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+by-mtime.txt [check: mtime]: asset.bin
+    wc -c < $input > $target
+
+by-hash.txt: asset.bin
+    wc -c < $input > $target
+`), 0o644)
+	asset := filepath.Join(dir, "asset.bin")
+	os.WriteFile(asset, []byte("big"), 0o644)
+	build := func() Stats {
+		t.Helper()
+		return mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "by-mtime.txt", "by-hash.txt").Stats()
+	}
+
+	if s := build(); s.Built != 2 {
+		t.Fatalf("first build: %+v, want both built", s)
+	}
+	state := loadState(workspace(dir), "")
+	if ts := state.Targets["by-mtime.txt"]; !strings.HasPrefix(ts.InputHashes["asset.bin"], "mtime:") || ts.OutputHash != "" {
+		t.Errorf("by-mtime.txt state = %+v, want stamped input and no output hash", ts)
+	}
+
+	// Touching the asset rebuilds only the rule that checks mtimes.
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(asset, later, later)
+	if s := build(); s.Built != 1 {
+		t.Errorf("build after touch: %+v, want only by-mtime.txt rebuilt", s)
+	}
+	if s := build(); s.Built != 0 {
+		t.Errorf("third build: %+v, want up to date", s)
+	}
+}
+
+func TestParseCheck(t *testing.T) {
+	f, err := Parse(strings.NewReader("out [check: mtime]: in\n    cp in out\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := f.Stmts[0].(Rule); r.Check != "mtime" || strings.Join(r.Targets, " ") != "out" {
+		t.Errorf("rule = %#v, want out with [check: mtime]", r)
+	}
+	for _, src := range []string{
+		"out [check: size]: in\n",
+		"out [check: mtime] [fingerprint: date]: in\n",
+	} {
+		if _, err := Parse(strings.NewReader(src)); err == nil {
+			t.Errorf("Parse(%q): expected error", src)
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+out.txt: gen.h
+    cp $input $target
+
+gen.h [canonical: grep -v '^//' $target]: spec
+    echo "// generated from $(cat spec)" > $target
+    echo body >> $target
+`), 0o644)
+	spec := filepath.Join(dir, "spec")
+	build := func() Stats {
+		t.Helper()
+		return mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "out.txt").Stats()
+	}
+
+	os.WriteFile(spec, []byte("v1"), 0o644)
+	if s := build(); s.Built != 2 {
+		t.Fatalf("first build: %+v, want both built", s)
+	}
+	// Only gen.h's comment changes, so out.txt is up to date.
+	os.WriteFile(spec, []byte("v2"), 0o644)
+	if s := build(); s.Built != 1 {
+		t.Errorf("build after comment change: %+v, want only gen.h rebuilt", s)
+	}
+
+	if _, err := Parse(strings.NewReader("!t [canonical: cat]:\n")); err == nil {
+		t.Error("expected error for [canonical] on a task")
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build aix || dragonfly || linux || openbsd || solaris
+
+package mk
+
+import (
+	"syscall"
+	"time"
+)
+
+// statCtime returns the status change time from st.
+func statCtime(st *syscall.Stat_t) time.Time {
+	return time.Unix(st.Ctim.Unix())
+}
@@ -0,0 +1,17 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !unix
+
+package mk
+
+import (
+	"os"
+	"time"
+)
+
+// fileID returns zero values where inode numbers and ctimes aren't
+// available, leaving the hash cache keyed on mtime and size.
+func fileID(os.FileInfo) (ino uint64, ctime time.Time) {
+	return 0, time.Time{}
+}
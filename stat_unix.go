@@ -0,0 +1,22 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build unix
+
+package mk
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileID returns a file's inode number and status change time, which
+// change when a file is replaced or rewritten even if its mtime doesn't.
+func fileID(info os.FileInfo) (ino uint64, ctime time.Time) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, time.Time{}
+	}
+	return uint64(st.Ino), statCtime(st)
+}
@@ -5,15 +5,19 @@ package mk
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -29,10 +33,82 @@ func StateFile(configSuffix string) string {
 	return filepath.Join(stateDir, "state-"+configSuffix+".json")
 }
 
+// StateSuffixes returns the config suffixes that have state files: "", for
+// the base state file, first if it exists, then the rest sorted.
+func StateSuffixes() []string {
+	return workspace("").stateSuffixes()
+}
+
+func (w workspace) stateSuffixes() []string {
+	matches, _ := w.glob(filepath.Join(stateDir, "state*.json"))
+	var suffixes []string
+	for _, m := range matches {
+		name := filepath.Base(m)
+		if name == "state.json" {
+			suffixes = append([]string{""}, suffixes...)
+		} else if s, ok := strings.CutPrefix(strings.TrimSuffix(name, ".json"), "state-"); ok {
+			suffixes = append(suffixes, s)
+		}
+	}
+	return suffixes
+}
+
 // BuildState tracks build artifacts for content-based staleness detection.
 type BuildState struct {
-	mu      sync.RWMutex
-	Targets map[string]*TargetState `json:"targets"`
+	mu          sync.RWMutex
+	Targets     map[string]*TargetState `json:"targets"`
+	Shell       map[string]*ShellResult `json:"shell,omitempty"` // $[shell? ...] results by expanded command
+	shellUsed   map[string]bool         // Shell entries looked up or recorded since loading
+	outputCheck OutputCheck
+	dir         workspace // where the state file and targets are
+	keptPrev    bool      // the file the next Save replaces is already PrevStateFile
+	corrupt     error     // why the state file loaded from didn't parse, if it didn't
+}
+
+// OutputCheck says what staleness checks make of a target whose content
+// no longer matches what mk recorded when it built it — a generated file
+// edited by hand, say.
+type OutputCheck int
+
+const (
+	OutputsRebuild OutputCheck = iota // the target is stale
+	OutputsWarn                       // the target isn't stale; the executor warns
+	OutputsIgnore                     // targets aren't hashed
+)
+
+// ParseOutputCheck parses "rebuild", "warn" or "off".
+func ParseOutputCheck(s string) (OutputCheck, error) {
+	switch s {
+	case "rebuild":
+		return OutputsRebuild, nil
+	case "warn":
+		return OutputsWarn, nil
+	case "off":
+		return OutputsIgnore, nil
+	}
+	return 0, fmt.Errorf("unknown output check %q (want rebuild, warn or off)", s)
+}
+
+// SetOutputCheck sets how Evaluate treats modified targets.
+func (s *BuildState) SetOutputCheck(c OutputCheck) {
+	s.outputCheck = c
+}
+
+// ModifiedOutputs returns the targets whose content differs from the
+// content recorded when they were last built. Targets with a fingerprint,
+// and directories, have no recorded content and are never modified.
+func (s *BuildState) ModifiedOutputs(targets []string, cache *HashCache) []string {
+	var modified []string
+	for _, t := range targets {
+		ts := s.GetTarget(t)
+		if ts == nil || ts.OutputHash == "" || ts.FingerprintHash != "" {
+			continue
+		}
+		if h, err := cache.Hash(t); err == nil && h != ts.OutputHash {
+			modified = append(modified, t)
+		}
+	}
+	return modified
 }
 
 // TargetState records the state of a target at its last successful build.
@@ -42,169 +118,292 @@ type TargetState struct {
 	OutputHash      string            `json:"output_hash"`
 	FingerprintHash string            `json:"fingerprint_hash,omitempty"` // hash of fingerprint command output
 	Prereqs         []string          `json:"prereqs"`
+	Discovered      []string          `json:"discovered,omitempty"`    // further inputs listed by the rule's depfile; hashes in InputHashes
+	OutputSize      int64             `json:"output_size,omitempty"`   // bytes, for file targets
+	DurationMS      int64             `json:"duration_ms,omitempty"`   // recipe run time; 0 if restored from the action cache
+	Extra           map[string]string `json:"extra_outputs,omitempty"` // further files the recipe wrote under $outdir → content hash
+}
+
+// ShellResult is the recorded output of a $[shell? ...] command, valid
+// while its declared input files hash the same.
+type ShellResult struct {
+	Output string            `json:"output"`
+	Inputs map[string]string `json:"inputs,omitempty"` // file -> hash; "" if missing
+}
+
+// cachedShell returns the recorded output of cmd, if its inputs are the
+// same as when it ran.
+func (s *BuildState) cachedShell(cmd string, inputs map[string]string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.Shell[cmd]
+	if r == nil || len(r.Inputs) != len(inputs) {
+		return "", false
+	}
+	for f, h := range inputs {
+		if r.Inputs[f] != h {
+			return "", false
+		}
+	}
+	s.markShell(cmd)
+	return r.Output, true
+}
+
+// shellInputs returns the input files recorded with cmd's result, or nil
+// if there is none.
+func (s *BuildState) shellInputs(cmd string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.Shell[cmd]
+	if r == nil {
+		return nil
+	}
+	files := make([]string, 0, len(r.Inputs))
+	for f := range r.Inputs {
+		files = append(files, f)
+	}
+	return files
+}
+
+// markShell notes that cmd's result is still wanted. s.mu must be held.
+func (s *BuildState) markShell(cmd string) {
+	if s.shellUsed == nil {
+		s.shellUsed = make(map[string]bool)
+	}
+	s.shellUsed[cmd] = true
+}
+
+func (s *BuildState) recordShell(cmd string, inputs map[string]string, out string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Shell == nil {
+		s.Shell = make(map[string]*ShellResult)
+	}
+	if len(inputs) == 0 {
+		inputs = nil
+	}
+	s.Shell[cmd] = &ShellResult{Output: out, Inputs: inputs}
+	s.markShell(cmd)
 }
 
 func LoadState(configSuffix string) *BuildState {
-	s := &BuildState{Targets: make(map[string]*TargetState)}
-	data, err := os.ReadFile(StateFile(configSuffix))
+	return loadState("", configSuffix)
+}
+
+// loadState loads the state file for configSuffix in dir.
+func loadState(dir workspace, configSuffix string) *BuildState {
+	return loadStateFile(dir, StateFile(configSuffix))
+}
+
+func loadStateFile(dir workspace, path string) *BuildState {
+	s := &BuildState{Targets: make(map[string]*TargetState), dir: dir}
+	data, err := os.ReadFile(dir.path(path))
 	if err != nil {
 		return s
 	}
-	_ = json.Unmarshal(data, s)
+	if err := json.Unmarshal(data, s); err != nil {
+		s = &BuildState{dir: dir, corrupt: fmt.Errorf("%s is corrupt: %w", path, err)}
+	}
 	if s.Targets == nil {
 		s.Targets = make(map[string]*TargetState)
 	}
 	return s
 }
 
+// Save writes the state file for the given config suffix, first keeping
+// the one it replaces as PrevStateFile. $[shell? ...] results that
+// weren't used since the state was loaded are dropped.
 func (s *BuildState) Save(configSuffix string) error {
-	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+	if err := s.keepPrev(configSuffix); err != nil {
 		return err
 	}
+	s.mu.Lock()
+	for cmd := range s.Shell {
+		if !s.shellUsed[cmd] {
+			delete(s.Shell, cmd)
+		}
+	}
 	data, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(StateFile(configSuffix), data, 0o644)
+	if err := writeFileDurable(s.dir.path(StateFile(configSuffix)), data); err != nil {
+		return err
+	}
+	s.keptPrev = false
+	return nil
 }
 
-// GetTarget returns the recorded state for a target, or nil if not found.
-func (s *BuildState) GetTarget(name string) *TargetState {
+// checkpoint writes the state file part way through a build, so that a
+// build that is killed keeps the record of what it built. Unlike Save,
+// it keeps $[shell? ...] results not used yet, and only the first
+// checkpoint or Save of a build keeps the file it replaces as
+// PrevStateFile.
+func (s *BuildState) checkpoint(configSuffix string) error {
+	if err := s.keepPrev(configSuffix); err != nil {
+		return err
+	}
 	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return s.Targets[name]
+	data, err := json.MarshalIndent(s, "", "  ")
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeFileDurable(s.dir.path(StateFile(configSuffix)), data)
 }
 
-// IsStale determines if any of the targets need rebuilding.
-// Only normal prereqs (not order-only) affect staleness.
-// If fingerprint is non-empty, it is a shell command whose output replaces
-// the file-stat check for the target.
-func (s *BuildState) IsStale(targets []string, prereqs []string, recipeText, fingerprint string, cache *HashCache) bool {
-	// Snapshot state under read lock, then release before I/O
-	s.mu.RLock()
-	snapshots := make([]*TargetState, len(targets))
-	for i, t := range targets {
-		snapshots[i] = s.Targets[t]
+// keepPrev copies the state file to PrevStateFile, unless a checkpoint
+// since the last Save already has, first moving the backups already there
+// back one place. A corrupt state file is moved aside to its name with
+// .corrupt appended instead, so that it doesn't push a valid backup out.
+func (s *BuildState) keepPrev(configSuffix string) error {
+	if s.keptPrev {
+		return nil
 	}
-	s.mu.RUnlock()
-
-	for i, ts := range snapshots {
-		if ts == nil {
-			return true
+	if err := os.MkdirAll(s.dir.path(stateDir), 0o755); err != nil {
+		return err
+	}
+	file := s.dir.path(StateFile(configSuffix))
+	if prev, err := os.ReadFile(file); err == nil {
+		if !json.Valid(prev) {
+			if err := os.Rename(file, file+".corrupt"); err != nil {
+				return err
+			}
+			s.keptPrev = true
+			return nil
 		}
-
-		// Check recipe changed
-		rh := hashString(recipeText)
-		if ts.RecipeHash != rh {
-			return true
+		path := s.dir.path(PrevStateFile(configSuffix))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		for i := stateBackups - 1; i > 0; i-- {
+			os.Rename(s.dir.path(stateBackup(configSuffix, i-1)), s.dir.path(stateBackup(configSuffix, i)))
 		}
+		if err := writeFileDurable(path, prev); err != nil {
+			return err
+		}
+	}
+	s.keptPrev = true
+	return nil
+}
 
-		if fingerprint != "" {
-			// Fingerprint mode: the fingerprint command output replaces
-			// both target-file and prerequisite-hash checks.
-			fph, err := runFingerprint(fingerprint)
-			if err != nil {
-				return true
-			}
-			if ts.FingerprintHash != fph {
-				return true
-			}
-		} else {
-			// File mode: check target exists and prereq hashes.
-			if _, err := os.Stat(targets[i]); os.IsNotExist(err) {
-				return true
-			}
+// stateBackups is how many of the state files that builds replaced are
+// kept, newest first, for mk state restore.
+const stateBackups = 5
 
-			// Check prerequisite set changed
-			sortedPrereqs := make([]string, len(prereqs))
-			copy(sortedPrereqs, prereqs)
-			sort.Strings(sortedPrereqs)
-			sortedOld := make([]string, len(ts.Prereqs))
-			copy(sortedOld, ts.Prereqs)
-			sort.Strings(sortedOld)
-			if !stringSliceEqual(sortedPrereqs, sortedOld) {
-				return true
-			}
+// stateBackup returns the path of the nth newest state file a build
+// replaced: PrevStateFile for n = 0, with .n appended for the older ones.
+func stateBackup(configSuffix string, n int) string {
+	if n == 0 {
+		return PrevStateFile(configSuffix)
+	}
+	return PrevStateFile(configSuffix) + "." + strconv.Itoa(n)
+}
+
+// RestoreState replaces the state file for configSuffix with the newest
+// backup of it that is valid, keeping the file it replaces with .bak
+// appended to its name. It returns the backup it restored.
+func RestoreState(configSuffix string) (string, error) {
+	return workspace("").restoreState(configSuffix)
+}
 
-			// Check input content hashes
-			for _, p := range prereqs {
-				h, err := cache.Hash(p)
-				if err != nil {
-					return true
-				}
-				if ts.InputHashes[p] != h {
-					return true
-				}
+func (w workspace) restoreState(configSuffix string) (string, error) {
+	for n := range stateBackups {
+		backup := stateBackup(configSuffix, n)
+		data, err := os.ReadFile(w.path(backup))
+		if err != nil {
+			continue
+		}
+		var s BuildState
+		if json.Unmarshal(data, &s) != nil {
+			continue
+		}
+		file := w.path(StateFile(configSuffix))
+		if _, err := os.Stat(file); err == nil {
+			if err := os.Rename(file, file+".bak"); err != nil {
+				return "", err
 			}
 		}
+		return backup, writeFileDurable(file, data)
 	}
+	return "", fmt.Errorf("no valid backup of %s", StateFile(configSuffix))
+}
 
-	return false
+// InvalidateState invalidates the records in the state file for
+// configSuffix that match patterns, as BuildState.Invalidate does, and
+// writes the file back. It returns the targets whose records were
+// removed, sorted.
+func InvalidateState(configSuffix string, patterns []string) ([]string, error) {
+	return workspace("").invalidateState(configSuffix, patterns)
 }
 
-// WhyStale returns human-readable reasons why any of the targets are stale.
-func (s *BuildState) WhyStale(targets []string, prereqs []string, recipeText, fingerprint string, cache *HashCache) []string {
-	s.mu.RLock()
-	snapshots := make([]*TargetState, len(targets))
-	for i, t := range targets {
-		snapshots[i] = s.Targets[t]
+func (w workspace) invalidateState(configSuffix string, patterns []string) ([]string, error) {
+	s := loadState(w, configSuffix)
+	if s.corrupt != nil {
+		return nil, s.corrupt
 	}
-	s.mu.RUnlock()
+	removed, err := s.Invalidate(patterns)
+	if err != nil || len(removed) == 0 {
+		return nil, err
+	}
+	// Unlike Save, checkpoint keeps the $[shell? ...] results, which no
+	// build has looked up.
+	return removed, s.checkpoint(configSuffix)
+}
 
-	var reasons []string
+// GetTarget returns the recorded state for a target, or nil if not found.
+func (s *BuildState) GetTarget(name string) *TargetState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Targets[name]
+}
 
-	for i, ts := range snapshots {
-		target := targets[i]
-		if ts == nil {
-			reasons = append(reasons, fmt.Sprintf("%s: no previous build recorded", target))
-			continue
-		}
+// Forget removes the records for the given paths and for every target that
+// lists one of them as a prerequisite, so they rebuild on the next build.
+// It returns the targets whose records were removed, sorted.
+func (s *BuildState) Forget(paths []string) []string {
+	drop := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		drop[p] = true
+	}
+	return s.forget(func(name string) bool { return drop[name] })
+}
 
-		rh := hashString(recipeText)
-		if ts.RecipeHash != rh {
-			reasons = append(reasons, "recipe has changed")
+// Invalidate is Forget for paths that match any of patterns, as
+// path.Match does or by name.
+func (s *BuildState) Invalidate(patterns []string) ([]string, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("%q: %w", p, err)
 		}
+	}
+	return s.forget(func(name string) bool {
+		return slices.ContainsFunc(patterns, func(p string) bool {
+			ok, _ := path.Match(p, name)
+			return ok || p == name
+		})
+	}), nil
+}
 
-		if fingerprint != "" {
-			fph, err := runFingerprint(fingerprint)
-			if err != nil {
-				reasons = append(reasons, fmt.Sprintf("%s: fingerprint command failed: %v", target, err))
-			} else if ts.FingerprintHash != fph {
-				reasons = append(reasons, fmt.Sprintf("%s: fingerprint has changed", target))
-			}
-		} else {
-			if _, err := os.Stat(target); os.IsNotExist(err) {
-				reasons = append(reasons, fmt.Sprintf("%s: target file does not exist", target))
-			}
-
-			sortedPrereqs := make([]string, len(prereqs))
-			copy(sortedPrereqs, prereqs)
-			sort.Strings(sortedPrereqs)
-			sortedOld := make([]string, len(ts.Prereqs))
-			copy(sortedOld, ts.Prereqs)
-			sort.Strings(sortedOld)
-			if !stringSliceEqual(sortedPrereqs, sortedOld) {
-				reasons = append(reasons, "prerequisite set has changed")
-			}
-
-			for _, p := range prereqs {
-				h, err := cache.Hash(p)
-				if err != nil {
-					reasons = append(reasons, fmt.Sprintf("cannot hash prerequisite %q: %v", p, err))
-					continue
-				}
-				if ts.InputHashes[p] != h {
-					reasons = append(reasons, fmt.Sprintf("prerequisite %q has changed", p))
-				}
-			}
+// forget removes the records of the targets that match and of those
+// with a matching prerequisite, and returns their names, sorted.
+func (s *BuildState) forget(match func(name string) bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var forgotten []string
+	for target, ts := range s.Targets {
+		if match(target) || slices.ContainsFunc(ts.Prereqs, match) || slices.ContainsFunc(ts.Discovered, match) {
+			delete(s.Targets, target)
+			forgotten = append(forgotten, target)
 		}
 	}
-
-	return reasons
+	sort.Strings(forgotten)
+	return forgotten
 }
 
 // Record records a successful build for all targets.
-func (s *BuildState) Record(targets []string, prereqs []string, recipeText, fingerprint string, cache *HashCache) {
+func (s *BuildState) Record(ctx context.Context, targets []string, prereqs []string, recipeText, fingerprint string, cache *HashCache) {
 	// Build TargetState objects (I/O: hashing) without holding the lock.
 	states := make(map[string]*TargetState, len(targets))
 	for _, target := range targets {
@@ -220,13 +419,16 @@ func (s *BuildState) Record(targets []string, prereqs []string, recipeText, fing
 			}
 		}
 		if fingerprint != "" {
-			if fph, err := runFingerprint(fingerprint); err == nil {
+			if fph, err := runFingerprint(ctx, s.dir, fingerprint); err == nil {
 				ts.FingerprintHash = fph
 			}
 		} else {
-			if h, err := cache.Hash(target); err == nil {
+			if h, err := cache.Hash(target); err == nil && !cache.stamps {
 				ts.OutputHash = h
 			}
+			if info, err := os.Stat(s.dir.path(target)); err == nil && info.Mode().IsRegular() {
+				ts.OutputSize = info.Size()
+			}
 		}
 		states[target] = ts
 	}
@@ -239,64 +441,236 @@ func (s *BuildState) Record(targets []string, prereqs []string, recipeText, fing
 	s.mu.Unlock()
 }
 
-// runFingerprint executes the fingerprint command and returns the hash of its output.
-func runFingerprint(command string) (string, error) {
-	cmd := exec.Command("sh", "-c", command)
-	var out bytes.Buffer
+// recordDiscovered records deps, which the depfile of the rule that built
+// targets listed, as further inputs of each target. A dep that can't be
+// hashed is left out, as a prerequisite would be.
+func (s *BuildState) recordDiscovered(targets, deps []string, cache *HashCache) {
+	hashes := make(map[string]string, len(deps))
+	var found []string
+	for _, d := range deps {
+		if h, err := cache.Hash(d); err == nil {
+			hashes[d] = h
+			found = append(found, d)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range targets {
+		ts := s.Targets[t]
+		if ts == nil {
+			continue
+		}
+		ts.Discovered = found
+		for d, h := range hashes {
+			ts.InputHashes[d] = h
+		}
+	}
+}
+
+// recordExtra records outputs, files the recipe that built targets wrote
+// under $outdir, as further outputs of each target.
+func (s *BuildState) recordExtra(targets, outputs []string, cache *HashCache) {
+	if len(outputs) == 0 {
+		return
+	}
+	hashes := make(map[string]string, len(outputs))
+	for _, o := range outputs {
+		if h, err := cache.Hash(o); err == nil && !cache.stamps {
+			hashes[o] = h
+		} else {
+			hashes[o] = "" // checked only for existence
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range targets {
+		if ts := s.Targets[t]; ts != nil {
+			ts.Extra = hashes
+		}
+	}
+}
+
+// setDuration records how long the recipe that built targets ran.
+func (s *BuildState) setDuration(targets []string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range targets {
+		if ts := s.Targets[t]; ts != nil {
+			ts.DurationMS = d.Milliseconds()
+		}
+	}
+}
+
+// runFingerprint executes the fingerprint command in dir and returns the
+// hash of its output. A failure's error includes what the command wrote
+// to stderr.
+func runFingerprint(ctx context.Context, dir workspace, command string) (string, error) {
+	h, err := hashOutput(ctx, dir, command)
+	if err != nil {
+		return "", fmt.Errorf("fingerprint command %q: %w", command, err)
+	}
+	return h, nil
+}
+
+// hashOutput runs command in dir and returns the hash of its output.
+func hashOutput(ctx context.Context, dir workspace, command string) (string, error) {
+	cmd := dir.shellCommand(ctx, command)
+	killOnCancel(cmd)
+	var out, stderr bytes.Buffer
 	cmd.Stdout = &out
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = &stderr
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("fingerprint command %q: %w", command, err)
+		if stderr.Len() > 0 {
+			line, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+			err = fmt.Errorf("%w: %s", err, line)
+		}
+		return "", err
 	}
 	return hashString(out.String()), nil
 }
 
-// HashCache caches file content hashes using (path, mtime, size) as cache key.
-// Thread-safe for concurrent use.
+// HashCache caches file content hashes using (path, mtime, size, inode,
+// ctime) as cache key. Thread-safe for concurrent use.
 type HashCache struct {
 	mu      sync.Mutex
 	entries map[string]cacheEntry
+
+	// coarse distrusts modification times, for file systems that store
+	// them at one-second granularity or coarser (see SetCoarseMtime).
+	coarse      bool
+	rehashBelow int64 // in coarse mode, files smaller than this are always re-hashed
+
+	dir workspace // relative paths are hashed from here
+
+	// stamps makes Hash return a stamp of a file's mtime and size rather
+	// than a hash of its content, for rules with [check: mtime]. mtime is
+	// such a cache, sharing dir, for forRule to return.
+	stamps bool
+	mtime  *HashCache
+
+	// canonical maps files to the command whose output is hashed in
+	// their place ([canonical: ...]), with $target expanded.
+	canonical map[string]string
 }
 
 type cacheEntry struct {
-	mtime time.Time
-	size  int64
-	hash  string
+	mtime    time.Time
+	size     int64
+	ino      uint64    // 0 where unavailable
+	ctime    time.Time // zero where unavailable
+	hash     string
+	hashedAt time.Time
 }
 
+// mtimeSlack is the coarsest timestamp granularity that coarse mode
+// allows for (FAT's is two seconds).
+const mtimeSlack = 2 * time.Second
+
 func NewHashCache() *HashCache {
-	return &HashCache{entries: make(map[string]cacheEntry)}
+	return newHashCache("")
+}
+
+// newHashCache returns a cache for files in dir.
+func newHashCache(dir workspace) *HashCache {
+	return &HashCache{entries: make(map[string]cacheEntry), dir: dir, mtime: &HashCache{stamps: true, dir: dir}}
+}
+
+// hashCache returns a cache for the graph's files, which hashes those
+// with [canonical: ...] by their command's output.
+func (g *Graph) hashCache() *HashCache {
+	c := newHashCache(g.dir)
+	c.canonical = g.canonical
+	return c
+}
+
+// forRule returns the cache that checks rule's files: c, or, if the rule
+// has [check: mtime], one that stamps them with their mtime and size
+// instead of hashing what may be gigabytes.
+func (c *HashCache) forRule(rule *resolvedRule) *HashCache {
+	if rule.checkMtime && c.mtime != nil {
+		return c.mtime
+	}
+	return c
+}
+
+// SetCoarseMtime makes the cache distrust modification times, as on NFS
+// and container bind mounts with one-second timestamps, where a file
+// rewritten within the same second at the same size looks unchanged. A
+// cached hash is then reused only if the file's mtime was already
+// mtimeSlack old when it was hashed, and files smaller than rehashBelow
+// bytes are re-hashed every time.
+func (c *HashCache) SetCoarseMtime(rehashBelow int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.coarse = true
+	c.rehashBelow = rehashBelow
 }
 
 // Hash returns the content hash of the file at path, using the cache
-// when the file's mtime and size haven't changed.
+// when the file's mtime, size, inode and ctime haven't changed.
 func (c *HashCache) Hash(path string) (string, error) {
-	info, err := os.Stat(path)
+	info, err := os.Stat(c.dir.path(path))
 	if err != nil {
 		return "", err
 	}
-	mtime := info.ModTime()
-	size := info.Size()
+	if c.stamps {
+		return fmt.Sprintf("mtime:%d:%d", info.ModTime().UnixNano(), info.Size()), nil
+	}
+	ino, ctime := fileID(info)
+	key := cacheEntry{mtime: info.ModTime(), size: info.Size(), ino: ino, ctime: ctime}
 
 	c.mu.Lock()
-	if e, ok := c.entries[path]; ok && e.mtime.Equal(mtime) && e.size == size {
+	if e, ok := c.entries[path]; ok && c.trust(e, key) {
 		c.mu.Unlock()
 		return e.hash, nil
 	}
 	c.mu.Unlock()
 
-	h, err := hashFile(path)
+	hashedAt := time.Now()
+	var h string
+	if cmd, ok := c.canonical[path]; ok {
+		h, err = runCanonical(c.dir, path, cmd)
+	} else {
+		h, err = hashFile(c.dir.path(path))
+	}
 	if err != nil {
 		return "", err
 	}
 
+	key.hash = h
+	key.hashedAt = hashedAt
 	c.mu.Lock()
-	c.entries[path] = cacheEntry{mtime: mtime, size: size, hash: h}
+	c.entries[path] = key
 	c.mu.Unlock()
 
 	return h, nil
 }
 
+// trust reports whether cached entry e still describes a file whose
+// current stat is cur. c.mu must be held.
+func (c *HashCache) trust(e, cur cacheEntry) bool {
+	if !e.mtime.Equal(cur.mtime) || e.size != cur.size || e.ino != cur.ino || !e.ctime.Equal(cur.ctime) {
+		return false
+	}
+	if !c.coarse {
+		return true
+	}
+	// A file modified within mtimeSlack of being hashed may have been
+	// modified again since without its timestamp changing.
+	return cur.size >= c.rehashBelow && e.mtime.Before(e.hashedAt.Add(-mtimeSlack))
+}
+
+// runCanonical hashes the output of file's [canonical: ...] command. The
+// command runs only when the file's metadata changes, so it needs no
+// cancellation.
+func runCanonical(dir workspace, file, command string) (string, error) {
+	h, err := hashOutput(context.Background(), dir, command)
+	if err != nil {
+		return "", fmt.Errorf("canonical command %q for %s: %w", command, file, err)
+	}
+	return "canonical:" + h, nil
+}
+
 func hashFile(path string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -315,18 +689,6 @@ func hashString(s string) string {
 	return hex.EncodeToString(h[:])
 }
 
-func stringSliceEqual(a, b []string) bool {
-	if len(a) != len(b) {
-		return false
-	}
-	for i := range a {
-		if a[i] != b[i] {
-			return false
-		}
-	}
-	return true
-}
-
 // CleanPath normalizes paths for consistent state tracking.
 func CleanPath(p string) string {
 	return filepath.Clean(p)
@@ -0,0 +1,84 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// PrevStateFile returns where Save keeps the state file it replaces, so
+// the last build can be compared with the one before it.
+func PrevStateFile(configSuffix string) string {
+	return filepath.Join(stateDir, "prev", filepath.Base(StateFile(configSuffix)))
+}
+
+// LoadPrevState loads the build state as it was before the last save.
+func LoadPrevState(configSuffix string) *BuildState {
+	return loadStateFile("", PrevStateFile(configSuffix))
+}
+
+// OutputChange is a target whose recorded output differs between two
+// build states.
+type OutputChange struct {
+	Kind   ChangeKind // RuleAdded: newly recorded; RuleRemoved: no longer recorded
+	Target string
+	Old    *TargetState // nil for RuleAdded
+	New    *TargetState // nil for RuleRemoved
+}
+
+func (c OutputChange) String() string {
+	s := []string{"+", "-", "~"}[c.Kind] + " " + c.Target
+	switch c.Kind {
+	case RuleAdded:
+		return s + describeOutput(c.New, "")
+	case RuleRemoved:
+		return s + describeOutput(c.Old, "")
+	}
+	var was string
+	if c.Old.OutputSize != c.New.OutputSize {
+		was = fmt.Sprintf("%d -> ", c.Old.OutputSize)
+	}
+	return s + describeOutput(c.New, was)
+}
+
+// describeOutput formats a target's size and build time, with was
+// preceding the size.
+func describeOutput(ts *TargetState, was string) string {
+	s := fmt.Sprintf(" (%s%d bytes", was, ts.OutputSize)
+	if ts.DurationMS > 0 {
+		s += ", built in " + (time.Duration(ts.DurationMS) * time.Millisecond).String()
+	}
+	return s + ")"
+}
+
+// DiffStates lists the targets whose output hash (or fingerprint, for
+// fingerprinted targets) differs between old and new, sorted by target.
+// Targets recorded in only one of them are added or removed.
+func DiffStates(old, new *BuildState) []OutputChange {
+	keys := slices.Collect(maps.Keys(old.Targets))
+	for k := range new.Targets {
+		if _, ok := old.Targets[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	var changes []OutputChange
+	for _, k := range keys {
+		o, n := old.Targets[k], new.Targets[k]
+		switch {
+		case o == nil:
+			changes = append(changes, OutputChange{Kind: RuleAdded, Target: k, New: n})
+		case n == nil:
+			changes = append(changes, OutputChange{Kind: RuleRemoved, Target: k, Old: o})
+		case o.OutputHash != n.OutputHash || o.FingerprintHash != n.FingerprintHash:
+			changes = append(changes, OutputChange{Kind: RuleChanged, Target: k, Old: o, New: n})
+		}
+	}
+	return changes
+}
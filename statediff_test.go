@@ -0,0 +1,202 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffStates(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.WriteFile("mkfile", []byte(`
+out.txt: src.txt
+    cp $input $target
+
+copy.txt: same.txt
+    cp $input $target
+`), 0o644)
+	os.WriteFile("src.txt", []byte("one"), 0o644)
+	os.WriteFile("same.txt", []byte("same"), 0o644)
+
+	build := func(targets ...string) {
+		t.Helper()
+		mustBuild(t, Options{LocalState: true, Jobs: 1, Stdout: io.Discard, Stderr: io.Discard}, targets...)
+	}
+
+	build("out.txt")
+	if _, err := os.Stat(PrevStateFile("")); err == nil {
+		t.Fatal("first build left a previous state file")
+	}
+
+	os.WriteFile("src.txt", []byte("three"), 0o644)
+	build("out.txt", "copy.txt")
+	changes := DiffStates(LoadPrevState(""), LoadState(""))
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	if len(changes) != 2 || changes[0].Kind != RuleAdded || changes[0].Target != "copy.txt" ||
+		changes[1].Kind != RuleChanged || changes[1].Target != "out.txt" {
+		t.Fatalf("changes = %q, want copy.txt added and out.txt changed", got)
+	}
+	if !strings.HasPrefix(got[1], "~ out.txt (3 -> 5 bytes, built in ") {
+		t.Errorf("change = %q, want sizes and build time", got[1])
+	}
+
+	// A rebuild that changes nothing leaves nothing to report.
+	build("out.txt", "copy.txt")
+	if changes := DiffStates(LoadPrevState(""), LoadState("")); len(changes) != 0 {
+		t.Errorf("no-op build changes = %v, want none", changes)
+	}
+}
+
+func TestStateCorruptionRecovery(t *testing.T) {
+	dir := t.TempDir()
+	w := workspace(dir)
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte("out.txt: src.txt\n    cp $input $target\n"), 0o644)
+	build := func(stderr io.Writer) Stats {
+		t.Helper()
+		return mustBuild(t, Options{Dir: dir, LocalState: true, Jobs: 1, Stdout: io.Discard, Stderr: stderr}).Stats()
+	}
+
+	// Each build keeps the state it replaces, up to stateBackups of them.
+	for i := range stateBackups + 2 {
+		os.WriteFile(filepath.Join(dir, "src.txt"), []byte(strings.Repeat("x", i)), 0o644)
+		build(io.Discard)
+	}
+	if _, err := os.Stat(w.path(stateBackup("", stateBackups-1))); err != nil {
+		t.Errorf("oldest backup missing: %v", err)
+	}
+	if _, err := os.Stat(w.path(stateBackup("", stateBackups))); err == nil {
+		t.Errorf("%s kept, want only %d backups", stateBackup("", stateBackups), stateBackups)
+	}
+
+	// A corrupt state file is reported, and moved aside rather than
+	// becoming a backup.
+	good, _ := os.ReadFile(w.path(PrevStateFile("")))
+	os.WriteFile(w.path(StateFile("")), []byte(`{"targets": {"out.txt"`), 0o644)
+	var stderr bytes.Buffer
+	if s := build(&stderr); s.Built+s.Restored != 1 {
+		t.Errorf("build with corrupt state: %+v, want out.txt rebuilt", s)
+	}
+	if got := stderr.String(); !strings.Contains(got, "mk: warning: .mk/state.json is corrupt") || !strings.Contains(got, "mk state restore") {
+		t.Errorf("stderr = %q, want the corruption reported", got)
+	}
+	if _, err := os.Stat(w.path(StateFile("") + ".corrupt")); err != nil {
+		t.Errorf("corrupt state not kept: %v", err)
+	}
+	if prev, _ := os.ReadFile(w.path(PrevStateFile(""))); !bytes.Equal(prev, good) {
+		t.Error("newest backup replaced")
+	}
+
+	from, err := w.restoreState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != PrevStateFile("") {
+		t.Errorf("restored from %s, want %s", from, PrevStateFile(""))
+	}
+	if got, _ := os.ReadFile(w.path(StateFile(""))); !bytes.Equal(got, good) {
+		t.Error("restored state isn't the newest backup")
+	}
+	if _, err := os.Stat(w.path(StateFile("") + ".bak")); err != nil {
+		t.Errorf("replaced state not kept: %v", err)
+	}
+}
+
+func TestInvalidateState(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+!all: gen/a.txt gen/b.txt out.txt
+gen/{name}.txt:
+    echo $stem > $target
+out.txt:
+    echo out > $target
+`), 0o644)
+	mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "all")
+	w := workspace(dir)
+	// Save the $[shell? ...] result: a build since would have dropped it.
+	s := loadState(w, "")
+	s.recordShell("date", nil, "today")
+	s.checkpoint("")
+
+	removed, err := w.invalidateState("", []string{"gen/*", "out.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(removed, " "); got != "gen/a.txt gen/b.txt out.txt" {
+		t.Errorf("invalidated %q, want gen/a.txt gen/b.txt out.txt", got)
+	}
+	s = loadState(w, "")
+	if len(s.Targets) != 0 {
+		t.Errorf("records left: %v", s.Targets)
+	}
+	if s.Shell["date"] == nil {
+		t.Error("$[shell? ...] results dropped")
+	}
+
+	if removed, err := w.invalidateState("", []string{"nothing*"}); err != nil || len(removed) != 0 {
+		t.Errorf("invalidating nothing = %v, %v", removed, err)
+	}
+	if _, err := w.invalidateState("", []string{"[bad"}); err == nil {
+		t.Error("bad pattern: want error")
+	}
+}
+
+func TestInvalidateCLIAndRPCAgree(t *testing.T) {
+	setup := func() workspace {
+		dir := t.TempDir()
+		os.MkdirAll(filepath.Join(dir, "src"), 0o755)
+		os.WriteFile(filepath.Join(dir, "src", "a.c"), []byte("a"), 0o644)
+		os.WriteFile(filepath.Join(dir, "src", "b.c"), []byte("b"), 0o644)
+		os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+app: gen/a.o gen/b.o
+    cat $inputs > $target
+gen/{name}.o: src/{name}.c
+    mkdir -p gen && cp $input $target
+`), 0o644)
+		mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "app")
+		w := workspace(dir)
+		s := loadState(w, "")
+		s.recordShell("date", nil, "today")
+		s.checkpoint("")
+		return w
+	}
+	patterns := []string{"src/a.c", "gen/b*"}
+
+	cli := setup()
+	viaCLI, err := cli.invalidateState("", patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc := setup()
+	conn := &rpcConn{srv: NewServer("mkfile", Options{Dir: string(rpc)}, "test")}
+	resp, err := conn.invalidate(rpcParams{Paths: patterns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	viaRPC := resp.(map[string][]string)["forgotten"]
+
+	// A matching target, one with a matching prerequisite, and their
+	// dependent.
+	want := []string{"app", "gen/a.o", "gen/b.o"}
+	if !slices.Equal(viaCLI, want) || !slices.Equal(viaRPC, want) {
+		t.Errorf("CLI invalidated %q and RPC %q, want %q", viaCLI, viaRPC, want)
+	}
+	for _, w := range []workspace{cli, rpc} {
+		if s := loadState(w, ""); len(s.Targets) != 0 || s.Shell["date"] == nil {
+			t.Errorf("%s: records %v and $[shell? ...] results %v; want none and date kept", w, s.Targets, s.Shell)
+		}
+	}
+}
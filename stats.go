@@ -0,0 +1,178 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// launcherVar names the variable holding a compiler launcher such as
+// ccache. It is prepended to compile commands by the standard library and
+// left out of recipe hashes.
+const launcherVar = "compiler_launcher"
+
+// Stats summarizes a build.
+type Stats struct {
+	Built    int           // recipes that ran successfully
+	UpToDate int           // targets skipped as up to date
+	Restored int           // targets restored from the action cache
+	Failed   int           // recipes that failed
+	Ignored  int           // failures of recipe lines marked -, which didn't stop their recipes
+	Elapsed  time.Duration // wall-clock time of the build
+
+	// Time spent in each phase: parsing the mkfile and building the
+	// graph when the project was loaded, then checking staleness and
+	// running recipes during the build. StaleTime and ExecTime are
+	// summed across parallel jobs, so they can exceed Elapsed.
+	ParseTime, GraphTime, StaleTime, ExecTime time.Duration
+
+	// Stale counts the rules rebuilt or restored for each kind of
+	// reason; a rule stale for several reasons counts under each.
+	Stale map[StaleKind]int
+
+	// Compiler launcher cache statistics for this build, when
+	// $compiler_launcher is ccache or sccache.
+	Launcher    string
+	CacheHits   int
+	CacheMisses int
+}
+
+// Print writes a human-readable summary to w.
+func (s *Stats) Print(w io.Writer) {
+	restored := ""
+	if s.Restored > 0 {
+		restored = fmt.Sprintf(", %d restored from cache", s.Restored)
+	}
+	ignored := ""
+	if s.Ignored > 0 {
+		ignored = fmt.Sprintf(" (%d ignored)", s.Ignored)
+	}
+	fmt.Fprintf(w, "mk: %d built%s, %d up to date, %d failed%s in %s\n",
+		s.Built, restored, s.UpToDate, s.Failed, ignored, s.Elapsed.Round(time.Millisecond))
+	if s.ParseTime+s.GraphTime+s.StaleTime+s.ExecTime > 0 {
+		fmt.Fprintf(w, "mk: phases: parse %s, graph %s, stale %s, exec %s\n",
+			roundDuration(s.ParseTime), roundDuration(s.GraphTime), roundDuration(s.StaleTime), roundDuration(s.ExecTime))
+	}
+	if len(s.Stale) > 0 {
+		var parts []string
+		for _, k := range slices.Sorted(maps.Keys(s.Stale)) {
+			parts = append(parts, fmt.Sprintf("%d %s", s.Stale[k], k))
+		}
+		fmt.Fprintf(w, "mk: stale: %s\n", strings.Join(parts, ", "))
+	}
+	if s.Launcher != "" {
+		total := s.CacheHits + s.CacheMisses
+		rate := 0.0
+		if total > 0 {
+			rate = 100 * float64(s.CacheHits) / float64(total)
+		}
+		fmt.Fprintf(w, "mk: %s: %d hits, %d misses (%.0f%% hit rate)\n",
+			s.Launcher, s.CacheHits, s.CacheMisses, rate)
+	}
+}
+
+// roundDuration rounds d for display, keeping sub-millisecond phases
+// from showing as 0s.
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
+
+// statsCollector counts build events.
+type statsCollector struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+func (c *statsCollector) observe(ev Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ev.Kind == TargetStarted || ev.Kind == TargetRestored {
+		var seen []StaleKind
+		for _, r := range ev.Reasons {
+			if !slices.Contains(seen, r.Kind) {
+				seen = append(seen, r.Kind)
+				if c.stats.Stale == nil {
+					c.stats.Stale = map[StaleKind]int{}
+				}
+				c.stats.Stale[r.Kind]++
+			}
+		}
+	}
+	switch ev.Kind {
+	case TargetFinished:
+		c.stats.Built++
+	case TargetSkipped:
+		c.stats.UpToDate++
+	case TargetRestored:
+		c.stats.Restored++
+	case TargetFailed:
+		c.stats.Failed++
+	}
+}
+
+// launcherStats returns the cumulative hit and miss counters of a ccache
+// or sccache launcher. ok is false for other launchers or if the counters
+// can't be read.
+func launcherStats(ctx context.Context, launcher string) (name string, hits, misses int, ok bool) {
+	fields := strings.Fields(launcher)
+	if len(fields) == 0 {
+		return "", 0, 0, false
+	}
+	name = filepath.Base(fields[0])
+	switch name {
+	case "ccache":
+		out, err := exec.CommandContext(ctx, fields[0], "--print-stats").Output()
+		if err != nil {
+			return name, 0, 0, false
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			key, val, _ := strings.Cut(line, "\t")
+			n, _ := strconv.Atoi(strings.TrimSpace(val))
+			switch key {
+			case "direct_cache_hit", "preprocessed_cache_hit":
+				hits += n
+			case "cache_miss":
+				misses += n
+			}
+		}
+		return name, hits, misses, true
+
+	case "sccache":
+		out, err := exec.CommandContext(ctx, fields[0], "--show-stats", "--stats-format=json").Output()
+		if err != nil {
+			return name, 0, 0, false
+		}
+		var s struct {
+			Stats struct {
+				CacheHits   struct{ Counts map[string]int } `json:"cache_hits"`
+				CacheMisses struct{ Counts map[string]int } `json:"cache_misses"`
+			} `json:"stats"`
+		}
+		if json.Unmarshal(out, &s) != nil {
+			return name, 0, 0, false
+		}
+		for _, n := range s.Stats.CacheHits.Counts {
+			hits += n
+		}
+		for _, n := range s.Stats.CacheMisses.Counts {
+			misses += n
+		}
+		return name, hits, misses, true
+	}
+	return name, 0, 0, false
+}
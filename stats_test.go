@@ -0,0 +1,55 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestCompilerLauncher(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	// A fake ccache that counts every compile as a hit.
+	os.Mkdir("bin", 0o755)
+	os.WriteFile("bin/ccache", []byte(`#!/bin/sh
+n=$(cat hits 2>/dev/null || echo 0)
+if [ "$1" = --print-stats ]; then
+    printf 'direct_cache_hit\t%s\ncache_miss\t0\n' "$n"
+    exit 0
+fi
+echo $((n + 1)) > hits
+exec "$@"
+`), 0o755)
+	os.WriteFile("mkfile", []byte(`
+compiler_launcher ?=
+
+out.txt: in.txt
+    $compiler_launcher cp $input $target
+`), 0o644)
+	os.WriteFile("in.txt", []byte("data"), 0o644)
+
+	build := func(launcher string) Stats {
+		t.Helper()
+		p := mustBuild(t, Options{
+			Vars:   map[string]string{"compiler_launcher": launcher},
+			Jobs:   1,
+			Stats:  true,
+			Stderr: io.Discard,
+		}, "out.txt")
+		return p.Stats()
+	}
+
+	if s := build(dir + "/bin/ccache"); s.Built != 1 || s.Launcher != "ccache" || s.CacheHits != 1 {
+		t.Errorf("first build stats = %+v, want 1 built and 1 ccache hit", s)
+	}
+	// Dropping the launcher must not change the recipe hash.
+	if s := build(""); s.Built != 0 || s.UpToDate != 1 {
+		t.Errorf("stats without launcher = %+v, want up to date", s)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// StatusFile is where every build that isn't a dry run writes its
+// BuildStatus.
+var StatusFile = filepath.Join(stateDir, "status.json")
+
+// BuildStatus summarizes the last build in a workspace, so that shell
+// prompts, editors and dashboards can show it without running mk.
+type BuildStatus struct {
+	Result     string         `json:"result"` // "ok", "failed" or "interrupted"
+	Time       time.Time      `json:"time"`   // when the build ended
+	Targets    []string       `json:"targets"`
+	Configs    []string       `json:"configs,omitempty"`
+	DurationMS int64          `json:"duration_ms"`
+	Built      int            `json:"built"`
+	UpToDate   int            `json:"up_to_date"`
+	Restored   int            `json:"restored"`
+	Failed     int            `json:"failed"`
+	Stale      map[string]int `json:"stale,omitempty"`          // rules rebuilt or restored for each kind of reason
+	FailedOn   []string       `json:"failed_targets,omitempty"` // the targets whose recipes failed
+	Error      string         `json:"error,omitempty"`
+}
+
+// ReadStatus returns the status of the last build in the workspace dir
+// ("" for the current directory).
+func ReadStatus(dir string) (*BuildStatus, error) {
+	data, err := os.ReadFile(workspace(dir).path(StatusFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errors.New("no build recorded")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s BuildStatus
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", StatusFile, err)
+	}
+	return &s, nil
+}
+
+// writeStatus records the outcome of a build of targets that ended with
+// err, and its statistics, in StatusFile.
+func (p *Project) writeStatus(ctx context.Context, targets, failed []string, err error) error {
+	s := BuildStatus{
+		Result:     "ok",
+		Time:       time.Now(),
+		Targets:    targets,
+		Configs:    p.opts.Configs,
+		DurationMS: p.stats.Elapsed.Milliseconds(),
+		Built:      p.stats.Built,
+		UpToDate:   p.stats.UpToDate,
+		Restored:   p.stats.Restored,
+		Failed:     p.stats.Failed,
+		FailedOn:   failed,
+	}
+	for k, n := range p.stats.Stale {
+		if s.Stale == nil {
+			s.Stale = map[string]int{}
+		}
+		s.Stale[k.String()] = n
+	}
+	if err != nil {
+		s.Result, s.Error = "failed", err.Error()
+		if ctx.Err() != nil {
+			s.Result = "interrupted"
+		}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p.dir().path(StatusFile), append(data, '\n'))
+}
+
+// Print writes a summary of the status to w, with its age relative to
+// now.
+func (s *BuildStatus) Print(w io.Writer, now time.Time) {
+	what := "mk"
+	if len(s.Targets) > 0 {
+		what += " " + strings.Join(s.Targets, " ")
+	}
+	if len(s.Configs) > 0 {
+		what += " (" + strings.Join(s.Configs, "+") + ")"
+	}
+	fmt.Fprintf(w, "%s: %s %s ago, at %s\n", what, s.Result, now.Sub(s.Time).Round(time.Second), s.Time.Local().Format(time.DateTime))
+	restored := ""
+	if s.Restored > 0 {
+		restored = fmt.Sprintf(", %d restored from cache", s.Restored)
+	}
+	fmt.Fprintf(w, "%d built%s, %d up to date, %d failed in %s\n",
+		s.Built, restored, s.UpToDate, s.Failed, (time.Duration(s.DurationMS) * time.Millisecond).String())
+	if len(s.Stale) > 0 {
+		var parts []string
+		for _, k := range slices.Sorted(maps.Keys(s.Stale)) {
+			parts = append(parts, fmt.Sprintf("%d %s", s.Stale[k], k))
+		}
+		fmt.Fprintf(w, "stale: %s\n", strings.Join(parts, ", "))
+	}
+	if len(s.FailedOn) > 0 {
+		fmt.Fprintf(w, "failed: %s\n", strings.Join(s.FailedOn, " "))
+	}
+	if s.Error != "" {
+		fmt.Fprintf(w, "error: %s\n", s.Error)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildStatus(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "in"), []byte("x\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+out: in
+    cp $input $target
+
+!bad:
+    exit 1
+`), 0o644)
+	ctx := context.Background()
+	opts := Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}
+	if _, err := ReadStatus(dir); err == nil {
+		t.Fatal("ReadStatus before any build: want error")
+	}
+
+	p := mustBuild(t, opts, "out")
+	s, err := ReadStatus(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Result != "ok" || s.Built != 1 || s.Failed != 0 || !slices.Equal(s.Targets, []string{"out"}) {
+		t.Errorf("status = %+v, want ok with 1 built", s)
+	}
+	if s.Stale["unbuilt"] != 1 {
+		t.Errorf("stale = %v, want 1 unbuilt", s.Stale)
+	}
+
+	if err := p.Build(ctx, "bad"); err == nil {
+		t.Fatal("bad: want error")
+	}
+	if s, err = ReadStatus(dir); err != nil {
+		t.Fatal(err)
+	}
+	if s.Result != "failed" || s.Error == "" || !slices.Equal(s.FailedOn, []string{"bad"}) {
+		t.Errorf("status = %+v, want bad failed", s)
+	}
+	var out bytes.Buffer
+	s.Print(&out, s.Time.Add(3*time.Second))
+	for _, want := range []string{"mk bad: failed 3s ago", "failed: bad\n", "error: "} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Print output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	// A dry run leaves the status alone.
+	dry := opts
+	dry.DryRun = true
+	loadAndBuild(t, dry, "out")
+	if s, err = ReadStatus(dir); err != nil || s.Result != "failed" {
+		t.Errorf("after dry run: status = %+v, %v; want the failed build's", s, err)
+	}
+}
@@ -1,8 +1,14 @@
+include std/cross.mk
+
 cc ?= cc
 cflags ?= -Wall
 ldflags ?=
+pkgs ?=
 ar ?= ar
-ccache ?= $[shell command -v ccache 2>/dev/null]
+ccache ?= $[shell command -v ccache 2>/dev/null || command -v sccache 2>/dev/null]
+compiler_launcher ?= $ccache
+lazy pkg_cflags = $[if $pkgs,$[pkg-config --cflags $pkgs]]
+lazy pkg_libs = $[if $pkgs,$[pkg-config --libs $pkgs]]
 
 {name}.o: {name}.c
-    $ccache $cc $cflags -c $input -o $target
+    $compiler_launcher $cc $cflags $pkg_cflags -c $input -o $target
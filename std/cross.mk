@@ -0,0 +1,9 @@
+target_triple ?=
+cross_triples ?= x86_64-linux-gnu aarch64-linux-gnu arm-linux-gnueabihf riscv64-linux-gnu i686-linux-gnu x86_64-w64-mingw32
+
+fn cross(triple):
+    return config $[subst cross-linux-,cross-,cross-$[goos $triple]-$[goarch $triple]]:\n    target_triple = $triple\n    cc = ${triple}-gcc\n    cxx = ${triple}-g++\n    ar = ${triple}-ar\n    goos = $[goos $triple]\n    goarch = $[goarch $triple]\n    builddir ?= build\n
+
+for triple in $cross_triples:
+    eval $[cross $triple]
+end
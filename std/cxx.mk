@@ -1,7 +1,13 @@
+include std/cross.mk
+
 cxx ?= c++
 cxxflags ?= -Wall
 ldflags ?=
-ccache ?= $[shell command -v ccache 2>/dev/null]
+pkgs ?=
+ccache ?= $[shell command -v ccache 2>/dev/null || command -v sccache 2>/dev/null]
+compiler_launcher ?= $ccache
+lazy pkg_cflags = $[if $pkgs,$[pkg-config --cflags $pkgs]]
+lazy pkg_libs = $[if $pkgs,$[pkg-config --libs $pkgs]]
 
 {name}.o: {name}.cc
-    $ccache $cxx $cxxflags -c $input -o $target
+    $compiler_launcher $cxx $cxxflags $pkg_cflags -c $input -o $target
@@ -1,11 +1,15 @@
+include std/cross.mk
+
 go ?= go
 goflags ?=
+goos ?=
+goarch ?=
 
 !build:
-    $go build $goflags ./...
+    $[if $goos,GOOS=$goos GOARCH=$goarch] $go build $goflags $[if $target_triple,-o $builddir/] ./...
 
 !test:
     $go test $goflags ./...
 
 !vet:
-    $go vet ./...
+    $[if $goos,GOOS=$goos GOARCH=$goarch] $go vet ./...
@@ -0,0 +1,96 @@
+git ?= git
+go ?= go
+dist ?= dist
+release_name ?= $[notdir $[shell pwd]]
+release_pkg ?= .
+release_platforms ?= darwin/arm64 linux/amd64 linux/arm64
+release_ldflags ?= -s -w
+release_extra ?=
+
+# Shell snippets shared by the release tasks. Recipe-time settings
+# (release_bump, release_version, git) are read from the environment so
+# they can be overridden on the command line after the include.
+
+# Sets $last to the most recent v* tag, or empty if there is none.
+release_last_tag_sh ?= last=$$($${git:-git} describe --tags --abbrev=0 --match 'v[0-9]*' 2>/dev/null || true)
+
+# Sets $next to the next semver (without the v). release_bump selects
+# major, minor or patch; auto (the default) inspects conventional commit
+# subjects since the last tag: "type!:" or "BREAKING CHANGE" bumps major,
+# "feat:" bumps minor, anything else bumps patch.
+release_next_sh ?= $release_last_tag_sh; \
+    range=$${last:+$$last..}HEAD; \
+    base=$${last#v}; base=$${base:-0.0.0}; base=$${base%%[-+]*}; \
+    major=$${base%%.*}; minor=$${base#*.}; minor=$${minor%%.*}; patch=$${base##*.}; \
+    bump=$${release_bump:-auto}; \
+    if [ "$$bump" = auto ]; then \
+        log=$$($${git:-git} log --format='%s%n%b' $$range); \
+        if printf '%s\n' "$$log" | grep -Eq '^[a-z]+(\(.*\))?!:|^BREAKING CHANGE'; then bump=major; \
+        elif printf '%s\n' "$$log" | grep -Eq '^feat(\(.*\))?:'; then bump=minor; \
+        else bump=patch; fi; \
+    fi; \
+    case $$bump in \
+        major) next=$$((major + 1)).0.0 ;; \
+        minor) next=$$major.$$((minor + 1)).0 ;; \
+        patch) next=$$major.$$minor.$$((patch + 1)) ;; \
+        *) echo "release_bump must be auto, major, minor or patch (got $$bump)" >&2; exit 1 ;; \
+    esac
+
+# Sets $version (without the v): release_version if given, else the tag
+# at HEAD, else git describe output.
+release_version_sh ?= version=$${release_version:-}; \
+    [ -n "$$version" ] || version=$$($${git:-git} describe --tags --exact-match --match 'v[0-9]*' 2>/dev/null || $${git:-git} describe --tags --always --dirty 2>/dev/null || echo 0.0.0-dev); \
+    version=$${version#v}
+
+!release-version:
+    $release_last_tag_sh
+    echo "$${last:-none}"
+
+!release-next:
+    $release_next_sh
+    echo "v$$next"
+
+!release-changelog:
+    $release_next_sh
+    log=$$($git log --no-merges --format='%s (%h)' $$range)
+    pick() { printf '%s\n' "$$log" | grep -E $$1 "$$2" || true; }
+    section() {
+        [ -z "$$2" ] || printf '\n### %s\n\n%s\n' "$$1" "$$(printf '%s\n' "$$2" | sed 's/^/- /')"
+    }
+    mkdir -p $dist
+    {
+        printf '## v%s (%s)\n' "$$next" "$$(date +%Y-%m-%d)"
+        section "Breaking changes" "$$(pick -e '^[a-z]+(\(.*\))?!:')"
+        section "Features" "$$(pick -e '^feat(\(.*\))?:')"
+        section "Fixes" "$$(pick -e '^fix(\(.*\))?:')"
+        section "Other" "$$(pick -v '^(feat|fix)(\(.*\))?:|^[a-z]+(\(.*\))?!:')"
+    } > $dist/CHANGELOG.md
+    cat $dist/CHANGELOG.md
+
+!release-dist:
+    $release_version_sh
+    rm -rf $dist/bin
+    for platform in $release_platforms; do
+        os=$${platform%/*}; arch=$${platform#*/}
+        name=$release_name-$$version-$$os-$$arch
+        out=$dist/bin/$$name
+        ext=
+        if [ "$$os" = windows ]; then ext=.exe; fi
+        mkdir -p $$out
+        GOOS=$$os GOARCH=$$arch CGO_ENABLED=0 $go build -trimpath -ldflags "$release_ldflags -X main.version=v$$version" -o $$out/$release_name$$ext $release_pkg
+        if [ -n "$release_extra" ]; then cp -R $release_extra $$out/; fi
+        tar -czf $dist/$$name.tar.gz -C $dist/bin $$name
+    done
+
+!release-checksums: release-dist
+    cd $dist
+    if command -v sha256sum >/dev/null 2>&1; then sum=sha256sum; else sum="shasum -a 256"; fi
+    $$sum *.tar.gz > SHA256SUMS
+    cat SHA256SUMS
+
+!release-tag: release-changelog
+    $release_next_sh
+    $git tag -a "v$$next" -F $dist/CHANGELOG.md
+    echo "tagged v$$next; push with: $git push origin v$$next"
+
+!release: release-changelog release-checksums
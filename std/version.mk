@@ -0,0 +1,27 @@
+git ?= git
+version ?= $[shell $git describe --tags --always --dirty 2>/dev/null || echo 0.0.0-dev]
+version_macro ?= VERSION
+version_package ?=
+
+# Version files embed $version in their recipes, so they are rebuilt when
+# it changes. Each recipe writes a temporary file and replaces the target
+# only if the content differs, so an unchanged version never touches the
+# file, even when something else makes the recipe run.
+version_swap ?= @if cmp -s $${target}.tmp $$target; then rm $${target}.tmp; else mv $${target}.tmp $$target; fi
+
+# The Go package a version file at path belongs to: version_package if
+# set, else the directory's name, or main at the top level.
+fn version-package(path):
+    return $[if $version_package,$version_package,$[if $[filter ./,$[dir $path]],main,$[notdir $[patsubst %/,%,$[dir $path]]]]]
+
+# A rule writing a C header that defines version_macro as $version.
+fn version-h(path):
+    return ${path}:\n    @mkdir -p $[dir $path]\n    @echo '#define $version_macro "$version"' > $${target}.tmp\n    $version_swap\n
+
+# A rule writing a Go file that declares const Version = $version.
+fn version-go(path):
+    return ${path}:\n    @mkdir -p $[dir $path]\n    @echo '// Code generated by mk from std/version.mk. DO NOT EDIT.' > $${target}.tmp\n    @echo >> $${target}.tmp\n    @echo 'package $[version-package $path]' >> $${target}.tmp\n    @echo >> $${target}.tmp\n    @echo 'const Version = "$version"' >> $${target}.tmp\n    $version_swap\n
+
+# A rule writing $version on a line of its own.
+fn version-txt(path):
+    return ${path}:\n    @mkdir -p $[dir $path]\n    @echo '$version' > $${target}.tmp\n    $version_swap\n
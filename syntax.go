@@ -0,0 +1,73 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// syntaxCache remembers the result of parse-checking recipe scripts,
+// keyed by the hash of the interpreter and script, so each distinct
+// script is checked once.
+type syntaxCache struct {
+	mu      sync.Mutex
+	results map[string]error
+}
+
+// check runs script through sh -n, or the POSIX shell sh, which parses
+// it without running anything, and returns the shell's complaint if it
+// doesn't parse. Other interpreters' scripts aren't checked.
+func (c *syntaxCache) check(ctx context.Context, sh interpreter, script string) error {
+	args := sh.checkCommand(script)
+	if args == nil {
+		return nil
+	}
+	key := hashString(script + sh.hash())
+	c.mu.Lock()
+	err, ok := c.results[key]
+	c.mu.Unlock()
+	if ok {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err() // not a verdict on the script; don't cache
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return err
+		}
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			err = errors.New(msg)
+		}
+	}
+
+	c.mu.Lock()
+	if c.results == nil {
+		c.results = make(map[string]error)
+	}
+	c.results[key] = err
+	c.mu.Unlock()
+	return err
+}
+
+// checkSyntax reports a recipe that the shell can't parse, pointing at
+// the rule that defined it, before anything in the recipe has run.
+func (e *Executor) checkSyntax(ctx context.Context, rule *resolvedRule, sh interpreter, script string) error {
+	if err := e.syntax.check(ctx, sh, script); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return fmt.Errorf("%s: syntax error in recipe for %q: %w", rule.pos, rule.target, err)
+	}
+	return nil
+}
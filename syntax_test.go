@@ -0,0 +1,45 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRecipeSyntaxCheck(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(oldDir)
+
+	os.Mkdir("lib", 0o755)
+	os.WriteFile("mkfile", []byte(`
+include lib/mkfile as lib
+
+!all: lib/bad.txt
+`), 0o644)
+	os.WriteFile("lib/mkfile", []byte(`
+ok.txt:
+    echo ok > $target
+
+bad.txt: ok.txt
+    touch ran
+    if true; then
+        echo unterminated > $target
+`), 0o644)
+
+	_, err := loadAndBuild(t, Options{Jobs: 1, Stderr: io.Discard}, "all")
+	if err == nil || !strings.Contains(err.Error(), `lib/mkfile:5: syntax error in recipe for "lib/bad.txt"`) {
+		t.Fatalf("Build = %v, want syntax error at lib/mkfile:5", err)
+	}
+	if fileExists("ran") {
+		t.Error("recipe ran despite the syntax error")
+	}
+	if !fileExists("lib/ok.txt") {
+		t.Error("lib/ok.txt was not built")
+	}
+}
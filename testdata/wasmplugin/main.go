@@ -0,0 +1,47 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+// Command wasmplugin is a WASI plugin used by the plugin tests. Build with
+// GOOS=wasip1 GOARCH=wasm.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+func main() {
+	var req struct {
+		Function string `json:"function"`
+		Args     string `json:"args"`
+	}
+	resp := map[string]any{}
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		resp["error"] = err.Error()
+	}
+	switch req.Function {
+	case "upper":
+		resp["result"] = strings.ToUpper(req.Args)
+	case "cat":
+		data, err := os.ReadFile(req.Args)
+		if err != nil {
+			resp["error"] = err.Error()
+		} else {
+			resp["result"] = strings.TrimSpace(string(data))
+		}
+	case "rules":
+		var rules strings.Builder
+		for _, target := range strings.Fields(req.Args) {
+			rules.WriteString(target + ":\n    echo generated > $target\n")
+		}
+		resp["result"] = rules.String()
+	case "touch":
+		if err := os.WriteFile(req.Args, nil, 0o644); err != nil {
+			resp["error"] = err.Error()
+		}
+	default:
+		resp["error"] = "unknown function " + req.Function
+	}
+	json.NewEncoder(os.Stdout).Encode(resp)
+}
@@ -0,0 +1,168 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// toolDecl is a tool declaration, kept unexpanded so that configs can
+// change which file a tool is.
+type toolDecl struct {
+	name, path  string
+	scopePrefix string // of the scoped include that declared it
+	vars        *Vars
+	pos         string
+}
+
+// tool is a declared tool and the file it is.
+type tool struct {
+	name, path string
+}
+
+// declareTool records a tool declaration. A name can be declared once.
+func (g *Graph) declareTool(n ToolDef) error {
+	pos := srcPos(g.file, n.Line)
+	for _, t := range g.tools {
+		if t.name == n.Name {
+			return fmt.Errorf("%s: tool %q already declared at %s", pos, n.Name, t.pos)
+		}
+	}
+	g.tools = append(g.tools, toolDecl{name: n.Name, path: n.Path, scopePrefix: g.scopePrefix, vars: g.vars, pos: pos})
+	return nil
+}
+
+// toolFiles returns the declared tools, sorted by name.
+func (g *Graph) toolFiles() []tool {
+	tools := make([]tool, 0, len(g.tools))
+	for _, t := range g.tools {
+		path := strings.TrimSpace(t.vars.Expand(t.path))
+		if t.scopePrefix != "" && !filepath.IsAbs(path) {
+			path = filepath.Clean(filepath.Join(t.scopePrefix, path))
+		}
+		tools = append(tools, tool{t.name, path})
+	}
+	slices.SortFunc(tools, func(a, b tool) int { return strings.Compare(a.name, b.name) })
+	return tools
+}
+
+// toolDigest returns the text appended to every hashed recipe when tools
+// are declared: each tool's name and content hash, so that changing a
+// tool rebuilds what it built. It is "" if no tools are declared.
+func (g *Graph) toolDigest(cache *HashCache) (string, error) {
+	tools := g.toolFiles()
+	if len(tools) == 0 {
+		return "", nil
+	}
+	var b strings.Builder
+	b.WriteString("\n# tools:")
+	for _, t := range tools {
+		h, err := cache.Hash(t.path)
+		if err != nil {
+			return "", fmt.Errorf("tool %s: %w", t.name, err)
+		}
+		fmt.Fprintf(&b, " %s=%s", t.name, h)
+	}
+	return b.String(), nil
+}
+
+// prepareTools builds the declared tools, once, before anything else,
+// and sets up the PATH that recipes run with from then on.
+func (e *Executor) prepareTools(ctx context.Context) error {
+	e.toolsOnce.Do(func() { e.toolsErr = e.buildTools(ctx) })
+	return e.toolsErr
+}
+
+// buildTools builds each declared tool with the ordinary PATH, then
+// links them into a directory that becomes recipes' entire PATH.
+func (e *Executor) buildTools(ctx context.Context) error {
+	tools := e.graph.toolFiles()
+	if len(tools) == 0 {
+		return nil
+	}
+	for _, t := range tools {
+		if err := e.build(ctx, t.path, nil); err != nil {
+			return fmt.Errorf("building tool %s: %w", t.name, err)
+		}
+	}
+	digest, err := e.graph.toolDigest(e.cache)
+	if err != nil {
+		if e.dryRun {
+			return nil // not built yet
+		}
+		return err
+	}
+	dir, err := e.linkTools(tools, digest)
+	if err != nil {
+		return fmt.Errorf("tools: %w", err)
+	}
+	e.toolHash, e.toolPath = digest, dir
+	return nil
+}
+
+// linkTools makes a directory, named for the tool set, holding a symlink
+// to each tool, and returns its absolute path.
+func (e *Executor) linkTools(tools []tool, digest string) (string, error) {
+	dir, err := filepath.Abs(e.dir.path(filepath.Join(stateDir, "tools", hashString(digest)[:16])))
+	if err != nil {
+		return "", err
+	}
+	if e.dryRun {
+		return dir, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	for _, t := range tools {
+		target, err := filepath.Abs(e.dir.path(t.path))
+		if err != nil {
+			return "", err
+		}
+		link := filepath.Join(dir, t.name)
+		if old, err := os.Readlink(link); err == nil && old == target {
+			continue
+		}
+		os.Remove(link)
+		if err := os.Symlink(target, link); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// recipeEnv returns the environment rule's recipe runs with: its
+// variables, with PATH holding only the declared tools, if there are any,
+// and MAKEFLAGS naming the jobserver, if there is one.
+func (e *Executor) recipeEnv(rule *resolvedRule) []string {
+	env := rule.varsFor(e.vars).Environ()
+	if e.toolPath != "" {
+		env = setEnv(env, "PATH", e.toolPath)
+	}
+	if e.jobserver != nil {
+		var flags string
+		for _, kv := range env {
+			if v, ok := strings.CutPrefix(kv, "MAKEFLAGS="); ok {
+				flags = v
+			}
+		}
+		env = setEnv(env, "MAKEFLAGS", e.jobserver.makeflags(flags))
+	}
+	return env
+}
+
+// setEnv sets name to value in env.
+func setEnv(env []string, name, value string) []string {
+	for i, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			env[i] = name + "=" + value
+			return env
+		}
+	}
+	return append(env, name+"="+value)
+}
@@ -0,0 +1,90 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTool(t *testing.T) {
+	f, err := Parse(strings.NewReader("tool protoc = third_party/bin/protoc\ntool = not a tool\ntool g++ = $cxx\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if td, ok := f.Stmts[0].(ToolDef); !ok || td.Name != "protoc" || td.Path != "third_party/bin/protoc" {
+		t.Errorf("stmt 0 = %#v, want tool protoc", f.Stmts[0])
+	}
+	if va, ok := f.Stmts[1].(VarAssign); !ok || va.Name != "tool" {
+		t.Errorf("stmt 1 = %#v, want an assignment to tool", f.Stmts[1])
+	}
+	if td, ok := f.Stmts[2].(ToolDef); !ok || td.Name != "g++" || td.Path != "$cxx" {
+		t.Errorf("stmt 2 = %#v, want tool g++", f.Stmts[2])
+	}
+
+	if _, err := Parse(strings.NewReader("tool protoc =")); err == nil {
+		t.Error("expected error for tool without a path")
+	}
+}
+
+func TestTools(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mkfile"), []byte(`
+tool greet = bin/greet
+
+bin/greet: greet.sh
+    cp $input $target
+    chmod +x $target
+
+out.txt:
+    greet > $target
+    if command -v cat >/dev/null; then echo cat on PATH >> $target; fi
+`), 0o644)
+	writeGreet := func(msg string) {
+		os.WriteFile(filepath.Join(dir, "greet.sh"), []byte("#!/bin/sh\necho "+msg+"\n"), 0o755)
+	}
+	build := func() Stats {
+		t.Helper()
+		return mustBuild(t, Options{Dir: dir, Jobs: 1, LocalState: true, Stdout: io.Discard, Stderr: io.Discard}, "out.txt").Stats()
+	}
+	out := func() string {
+		data, _ := os.ReadFile(filepath.Join(dir, "out.txt"))
+		return string(data)
+	}
+
+	writeGreet("hello")
+	if s := build(); s.Built != 2 {
+		t.Errorf("first build: %+v, want the tool and out.txt built", s)
+	}
+	if got := out(); got != "hello\n" {
+		t.Errorf("out.txt = %q, want only the declared tool's output", got)
+	}
+	if s := build(); s.Built != 0 {
+		t.Errorf("second build: %+v, want up to date", s)
+	}
+
+	// Changing the tool rebuilds what it built.
+	writeGreet("bonjour")
+	if s := build(); s.Built != 2 {
+		t.Errorf("build after changing the tool: %+v, want both rebuilt", s)
+	}
+	if got := out(); got != "bonjour\n" {
+		t.Errorf("out.txt = %q, want %q", got, "bonjour\n")
+	}
+}
+
+func TestToolRedeclared(t *testing.T) {
+	f, err := Parse(strings.NewReader("tool cc = /usr/bin/cc\ntool cc = /usr/bin/gcc\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Path = "mkfile"
+	_, err = BuildGraph(f, NewVars(), &BuildState{Targets: make(map[string]*TargetState)}, nil)
+	if err == nil || !strings.Contains(err.Error(), `mkfile:2: tool "cc" already declared at mkfile:1`) {
+		t.Errorf("err = %v, want redeclaration error", err)
+	}
+}
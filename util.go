@@ -4,27 +4,50 @@
 package mk
 
 import (
-	"os/exec"
-	"path/filepath"
-	"strings"
+	"cmp"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
 )
 
-func wildcardGlob(pattern string) ([]string, error) {
-	// Support space-separated patterns
-	patterns := strings.Fields(pattern)
-	var all []string
-	for _, p := range patterns {
-		matches, err := filepath.Glob(p)
-		if err != nil {
-			return nil, err
+// sortPaths sorts paths in place and removes duplicates. key selects the
+// order: "" or "name" (lexical), "mtime" (oldest first) or "size"
+// (smallest first); ties are broken by name.
+func (w workspace) sortPaths(paths []string, key string) ([]string, error) {
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+	var stat func(fs.FileInfo) int64
+	switch key {
+	case "", "name":
+		return paths, nil
+	case "mtime":
+		stat = func(fi fs.FileInfo) int64 { return fi.ModTime().UnixNano() }
+	case "size":
+		stat = func(fi fs.FileInfo) int64 { return fi.Size() }
+	default:
+		return nil, fmt.Errorf("unknown ordering key %q (want name, mtime or size)", key)
+	}
+	vals := make(map[string]int64, len(paths))
+	for _, p := range paths {
+		if fi, err := os.Stat(w.path(p)); err == nil {
+			vals[p] = stat(fi)
 		}
-		all = append(all, matches...)
 	}
-	return all, nil
+	slices.SortStableFunc(paths, func(a, b string) int { return cmp.Compare(vals[a], vals[b]) })
+	return paths, nil
 }
 
-func runShellCapture(cmd string) (string, error) {
-	out, err := exec.Command("sh", "-c", cmd).Output()
+// waitDelay is how long a cancelled command may keep its output pipes open
+// before mk stops waiting for it.
+const waitDelay = time.Second
+
+func runShellCapture(ctx context.Context, dir workspace, cmd string) (string, error) {
+	c := dir.shellCommand(ctx, cmd)
+	killOnCancel(c)
+	out, err := c.Output()
 	if err != nil {
 		return "", err
 	}
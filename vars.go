@@ -4,25 +4,92 @@
 package mk
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Vars is a variable store. All variables are also environment variables.
+//
+// Scoped includes get their own Vars, nested in the includer's (see
+// Scope). A scope reads names it doesn't define from the scopes that
+// enclose it, and the scope that included it reads the scope's own
+// variables and functions as alias.name.
 type Vars struct {
-	vals  map[string]string
-	lazy  map[string]string   // unevaluated lazy expressions
-	funcs map[string]*FuncDef // user-defined functions
+	parent  *Vars            // enclosing scope; nil at top level
+	scopes  map[string]*Vars // scoped includes nested here, by alias
+	caller  *Vars            // for a call to alias.fn, the caller's scope
+	vals    map[string]string
+	lazy    map[string]string   // unevaluated lazy expressions
+	mu      sync.RWMutex        // guards vals, lazy and bound, which reading a lazy variable changes
+	funcs   map[string]*FuncDef // user-defined functions
+	plugins map[string]*Plugin  // plugin-provided functions by name
+	fixed   map[string]bool     // command-line overrides; mkfile assignments are ignored
+	ctx     context.Context     // cancels $[shell] and plugin calls; nil = background
+
+	// sources returns the first prerequisite pattern of the pattern rule
+	// with the given target pattern, for $[outputs]. Set on the top-level
+	// scope by BuildGraph.
+	sources func(target string) (Pattern, bool)
+
+	// derivable returns the names the pattern rules with the given
+	// target pattern can build from existing files, for $[all]. Set on
+	// the top-level scope by BuildGraph.
+	derivable func(target string) ([]string, bool)
+
+	// globbed records the patterns $[wildcard] matches while the mkfile
+	// is evaluated, for [provides: ...]. Set on the top-level scope by
+	// BuildGraph and cleared when it returns; not cloned.
+	globbed func(pattern string)
+
+	// globs caches the matches of $[wildcard] and the functions that
+	// match files by pattern while the mkfile is evaluated. Set on the
+	// top-level scope by BuildGraph and cleared when it returns; not
+	// cloned.
+	globs *globCache
+
+	// mk builds targets for $[mk], in the build whose recipe is being
+	// expanded, and returns their names. Set by the executor on the
+	// variables it expands a recipe with; not cloned.
+	mk func(targets []string) []string
+
+	// shellCache keeps $[shell? ...] results between runs. Set on the
+	// top-level scope by Load; nil means $[shell?] always runs.
+	shellCache *BuildState
+
+	// git memoizes the git commands behind $[git-changed], $[git-sha]
+	// and $[git-dirty] for the life of the top-level scope.
+	gitOut *gitCache
+
+	// stderr receives messages about functions that fail. Set on the
+	// top-level scope by Load; nil means os.Stderr.
+	stderr io.Writer
+
+	// dir is the workspace that file functions and $[shell ...] resolve
+	// paths against. Set on the top-level scope by Load.
+	dir workspace
+
+	reproducible bool // strip nondeterministic environment
+	bound        int  // active Bind calls; lazy values aren't memoized while > 0
 }
 
 func NewVars() *Vars {
 	v := &Vars{
-		vals:  make(map[string]string),
-		lazy:  make(map[string]string),
-		funcs: make(map[string]*FuncDef),
+		vals:    make(map[string]string),
+		lazy:    make(map[string]string),
+		funcs:   make(map[string]*FuncDef),
+		plugins: make(map[string]*Plugin),
+		fixed:   make(map[string]bool),
+		scopes:  make(map[string]*Vars),
+		gitOut:  &gitCache{},
 	}
 	// Import environment
 	for _, env := range os.Environ() {
@@ -36,17 +103,123 @@ func NewVars() *Vars {
 
 // Set sets a variable immediately.
 func (v *Vars) Set(name, value string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
 	v.vals[name] = value
 	delete(v.lazy, name)
 }
 
+// Override sets a variable that mkfile assignments cannot change, as for
+// name=value on the command line.
+func (v *Vars) Override(name, value string) {
+	v.Set(name, value)
+	v.fixed[name] = true
+}
+
+// IsOverridden reports whether name was set by Override, in this scope
+// or an enclosing one.
+func (v *Vars) IsOverridden(name string) bool {
+	for s := v; s != nil; s = s.parent {
+		if s.fixed[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Scope returns a new scope nested in v for a scoped include under
+// alias. The scope reads names it doesn't define from v; its
+// assignments and functions stay in it, and v sees them as alias.name,
+// evaluated in the scope: lazy variables stay lazy, and a function called
+// as alias.fn sees the scope's variables ahead of its caller's.
+func (v *Vars) Scope(alias string) *Vars {
+	s := v.child()
+	v.scopes[alias] = s
+	return s
+}
+
+// child returns a new, empty scope nested in v.
+func (v *Vars) child() *Vars {
+	return &Vars{
+		parent:  v,
+		scopes:  make(map[string]*Vars),
+		vals:    make(map[string]string),
+		lazy:    make(map[string]string),
+		funcs:   make(map[string]*FuncDef),
+		plugins: make(map[string]*Plugin),
+		fixed:   make(map[string]bool),
+
+		reproducible: v.reproducible,
+	}
+}
+
+// SetContext sets the context that bounds commands run during expansion,
+// such as $[shell ...] and plugin calls.
+func (v *Vars) SetContext(ctx context.Context) {
+	v.ctx = ctx
+}
+
+func (v *Vars) context() context.Context {
+	if v.ctx == nil {
+		if v.parent != nil {
+			return v.parent.context()
+		}
+		return context.Background()
+	}
+	return v.ctx
+}
+
+// SetReproducible turns reproducible-build mode on or off. In this mode
+// Environ omits variables that vary between machines and sessions (see
+// nondeterministicEnv).
+func (v *Vars) SetReproducible(on bool) {
+	v.reproducible = on
+}
+
 // SetFunc registers a user-defined function.
 func (v *Vars) SetFunc(def *FuncDef) {
 	v.funcs[def.Name] = def
 }
 
+// SetPlugin registers the functions provided by an external plugin.
+func (v *Vars) SetPlugin(p *Plugin) {
+	for _, name := range p.Funcs {
+		v.plugins[name] = p
+	}
+}
+
+// Bind sets name to value until the returned function is called, which
+// restores the previous value, lazy or not. Loops use it to give their
+// variable a binding that doesn't outlive the loop. Lazy variables read
+// while a binding is in place are not memoized, since their value may
+// depend on it.
+func (v *Vars) Bind(name, value string) (restore func()) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	oldVal, hadVal := v.vals[name]
+	oldLazy, hadLazy := v.lazy[name]
+	v.vals[name] = value
+	delete(v.lazy, name)
+	v.bound++
+	return func() {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		v.bound--
+		delete(v.vals, name)
+		delete(v.lazy, name)
+		if hadVal {
+			v.vals[name] = oldVal
+		}
+		if hadLazy {
+			v.lazy[name] = oldLazy
+		}
+	}
+}
+
 // SetLazy sets a variable for deferred evaluation.
 func (v *Vars) SetLazy(name, expr string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
 	v.lazy[name] = expr
 	delete(v.vals, name)
 }
@@ -62,19 +235,161 @@ func (v *Vars) Append(name, value string) {
 }
 
 // Get retrieves a variable's value, evaluating lazy variables on demand.
+// Names not set in this scope are looked up as alias.name in the scoped
+// includes nested here, then in the enclosing scopes. A name prefixed
+// with ^ is looked up starting from the enclosing scope (^^ from the one
+// enclosing that, and so on), and one prefixed with :: from the top-level
+// scope.
 func (v *Vars) Get(name string) string {
-	if expr, ok := v.lazy[name]; ok {
-		val := v.Expand(expr)
-		v.vals[name] = val
-		delete(v.lazy, name)
-		return val
+	s, name := v.scopeFor(name)
+	if s == nil {
+		return ""
 	}
-	return v.vals[name]
+	val, _ := s.lookup(name)
+	return val
+}
+
+// scopeFor resolves the ^ and :: prefixes of a variable name to the
+// scope to look the rest up in, or nil if name climbs above the top.
+func (v *Vars) scopeFor(name string) (*Vars, string) {
+	s := v
+	if rest, ok := strings.CutPrefix(name, "::"); ok {
+		for s.parent != nil {
+			s = s.parent
+		}
+		return s, rest
+	}
+	for len(name) > 0 && name[0] == '^' {
+		if s = s.parent; s == nil {
+			return nil, ""
+		}
+		name = name[1:]
+	}
+	return s, name
+}
+
+func (v *Vars) lookup(name string) (string, bool) {
+	if val, ok := v.local(name); ok {
+		return val, true
+	}
+	if alias, rest, ok := strings.Cut(name, "."); ok {
+		if s := v.scopes[alias]; s != nil {
+			if val, ok := s.exported(rest); ok {
+				return val, true
+			}
+		}
+	}
+	if v.parent != nil {
+		if val, ok := v.parent.lookup(name); ok {
+			return val, true
+		}
+	}
+	if v.caller != nil {
+		return v.caller.lookup(name)
+	}
+	return "", false
+}
+
+// local returns a variable set in this scope itself. Lazy variables are
+// evaluated here, so they see this scope's variables, and without the
+// lock, since they may read other variables here: recipes expanded in
+// parallel may both evaluate one, and the first value stored is the one
+// kept.
+func (v *Vars) local(name string) (string, bool) {
+	v.mu.RLock()
+	expr, lazy := v.lazy[name]
+	val, ok := v.vals[name]
+	v.mu.RUnlock()
+	if !lazy {
+		return val, ok
+	}
+	val = v.Expand(expr)
+	if v.binding() {
+		return val, true
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if cur, ok := v.lazy[name]; ok {
+		if cur == expr {
+			v.vals[name] = val
+			delete(v.lazy, name)
+		}
+		return val, true
+	}
+	if memo, ok := v.vals[name]; ok {
+		return memo, true // stored while this evaluated
+	}
+	return val, true
+}
+
+// binding reports whether a Bind is in place in this scope or an
+// enclosing one.
+func (v *Vars) binding() bool {
+	for s := v; s != nil; s = s.parent {
+		s.mu.RLock()
+		bound := s.bound
+		s.mu.RUnlock()
+		if bound > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// exported returns what a scope shows its includer as name: its own
+// variables and, as alias.name, those of scopes nested in it.
+func (v *Vars) exported(name string) (string, bool) {
+	if val, ok := v.local(name); ok {
+		return val, true
+	}
+	if alias, rest, ok := strings.Cut(name, "."); ok {
+		if s := v.scopes[alias]; s != nil {
+			return s.exported(rest)
+		}
+	}
+	return "", false
+}
+
+// lookupFunc finds a user-defined function or plugin the way lookup
+// finds variables. scope is set for an alias.fn exported by a scoped
+// include: the scope that defined it.
+func (v *Vars) lookupFunc(name string) (fn *FuncDef, p *Plugin, scope *Vars) {
+	for s := v; s != nil; s = s.parent {
+		if fn, ok := s.funcs[name]; ok {
+			return fn, nil, nil
+		}
+		if p, ok := s.plugins[name]; ok {
+			return nil, p, nil
+		}
+		if fn, p, scope := s.exportedFunc(name); fn != nil || p != nil {
+			return fn, p, scope
+		}
+	}
+	if v.caller != nil {
+		return v.caller.lookupFunc(name)
+	}
+	return nil, nil, nil
+}
+
+func (v *Vars) exportedFunc(name string) (*FuncDef, *Plugin, *Vars) {
+	alias, rest, ok := strings.Cut(name, ".")
+	s := v.scopes[alias]
+	if !ok || s == nil {
+		return nil, nil, nil
+	}
+	if fn, ok := s.funcs[rest]; ok {
+		return fn, nil, s
+	}
+	if p, ok := s.plugins[rest]; ok {
+		return nil, p, s
+	}
+	return s.exportedFunc(rest)
 }
 
 // Expand expands variable references in a string.
 // $name expands to the value of name.
 // ${name} also works for delimiting.
+// $^name / $::name — name in the enclosing / top-level scope (see Get).
 // $name.dir / $name.file — path property access.
 // $[func args] — built-in mk functions.
 // $$ expands to a literal $.
@@ -125,9 +440,10 @@ func (v *Vars) Expand(s string) string {
 				i += end + 1
 			}
 
-		case isIdentStart(s[i]):
+		case isIdentStart(s[i]) || scopePrefixLen(s[i:]) > 0:
 			// $name, $name.scope, $name.prop, or $name:old=new (substitution reference)
 			start := i
+			i += scopePrefixLen(s[i:])
 			for i < len(s) && isIdentCont(s[i]) {
 				i++
 			}
@@ -211,7 +527,7 @@ func (v *Vars) Expand(s string) string {
 func varProperty(val, prop string) string {
 	switch prop {
 	case "dir":
-		return filepath.Dir(val)
+		return dirName(val)
 	case "file":
 		return filepath.Base(val)
 	default:
@@ -219,22 +535,49 @@ func varProperty(val, prop string) string {
 	}
 }
 
-// Environ returns the variables as environment strings for exec.
+// Environ returns the variables as environment strings for exec. A
+// scope's variables hide those of the same name in enclosing scopes.
 func (v *Vars) Environ() []string {
+	vals := map[string]string{}
+	v.collect(vals)
 	var env []string
-	for k, val := range v.vals {
+	for k, val := range vals {
+		if v.reproducible && nondeterministicEnv[k] {
+			continue
+		}
 		env = append(env, k+"="+val)
 	}
+	sort.Strings(env)
 	return env
 }
 
-// Snapshot returns a copy of all current variable values (resolving lazy ones).
+// collect adds the evaluated variables of v and its enclosing scopes to
+// vals, innermost last.
+func (v *Vars) collect(vals map[string]string) {
+	if v.parent != nil {
+		v.parent.collect(vals)
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for k, val := range v.vals {
+		vals[k] = val
+	}
+}
+
+// Snapshot returns a copy of all current variable values, including
+// those of enclosing scopes (resolving lazy ones).
 func (v *Vars) Snapshot() map[string]string {
-	snap := make(map[string]string, len(v.vals)+len(v.lazy))
+	snap := map[string]string{}
+	if v.parent != nil {
+		snap = v.parent.Snapshot()
+	}
+	v.mu.RLock()
 	for k, val := range v.vals {
 		snap[k] = val
 	}
-	for k := range v.lazy {
+	lazy := slices.Collect(maps.Keys(v.lazy))
+	v.mu.RUnlock()
+	for _, k := range lazy {
 		snap[k] = v.Get(k)
 	}
 	return snap
@@ -242,10 +585,27 @@ func (v *Vars) Snapshot() map[string]string {
 
 // Clone creates a copy of the variable store.
 func (v *Vars) Clone() *Vars {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
 	c := &Vars{
-		vals:  make(map[string]string, len(v.vals)),
-		lazy:  make(map[string]string, len(v.lazy)),
-		funcs: make(map[string]*FuncDef, len(v.funcs)),
+		parent:  v.parent,
+		scopes:  make(map[string]*Vars, len(v.scopes)),
+		caller:  v.caller,
+		vals:    make(map[string]string, len(v.vals)),
+		lazy:    make(map[string]string, len(v.lazy)),
+		funcs:   make(map[string]*FuncDef, len(v.funcs)),
+		plugins: make(map[string]*Plugin, len(v.plugins)),
+		fixed:   make(map[string]bool, len(v.fixed)),
+		ctx:     v.ctx,
+		sources: v.sources,
+
+		derivable:    v.derivable,
+		shellCache:   v.shellCache,
+		gitOut:       v.gitOut,
+		stderr:       v.stderr,
+		dir:          v.dir,
+		reproducible: v.reproducible,
+		bound:        v.bound,
 	}
 	for k, val := range v.vals {
 		c.vals[k] = val
@@ -256,6 +616,15 @@ func (v *Vars) Clone() *Vars {
 	for k, val := range v.funcs {
 		c.funcs[k] = val
 	}
+	for k, val := range v.plugins {
+		c.plugins[k] = val
+	}
+	for k, val := range v.fixed {
+		c.fixed[k] = val
+	}
+	for k, s := range v.scopes {
+		c.scopes[k] = s
+	}
 	return c
 }
 
@@ -266,6 +635,16 @@ func (v *Vars) evalFunc(inner string) string {
 		return v.funcWildcard(strings.TrimSpace(args))
 	case "shell":
 		return v.funcShell(strings.TrimSpace(args))
+	case "shell?":
+		return v.funcCachedShell(strings.TrimSpace(args))
+	case "pkg-config":
+		return v.funcPkgConfig(strings.TrimSpace(args))
+	case "git-changed":
+		return v.funcGitChanged(strings.TrimSpace(args))
+	case "git-sha":
+		return v.funcGitSha(strings.TrimSpace(args))
+	case "git-dirty":
+		return v.funcGitDirty()
 	case "patsubst":
 		return v.funcPatsubst(strings.TrimSpace(args))
 	case "subst":
@@ -298,24 +677,61 @@ func (v *Vars) evalFunc(inner string) string {
 		return v.funcFindstring(strings.TrimSpace(args))
 	case "if":
 		return v.funcIf(strings.TrimSpace(args))
+	case "foreach":
+		return v.funcForeach(strings.TrimSpace(args))
+	case "match":
+		return v.funcMatch(strings.TrimSpace(args))
+	case "captures":
+		return v.funcCaptures(strings.TrimSpace(args))
+	case "targets-of":
+		return v.funcTargetsOf(strings.TrimSpace(args))
+	case "all":
+		return v.funcAll(args)
+	case "outputs":
+		return v.funcOutputs(strings.TrimSpace(args))
+	case "artifact":
+		return v.funcArtifact(strings.TrimSpace(args))
+	case "mk":
+		return v.funcMk(args)
+	case "goos":
+		return tripleGOOS(strings.TrimSpace(v.Expand(args)))
+	case "goarch":
+		return tripleGOARCH(strings.TrimSpace(v.Expand(args)))
 	default:
-		// Check user-defined functions
-		if fn, ok := v.funcs[name]; ok {
-			return v.callUserFunc(fn, strings.TrimSpace(args))
+		// Check user-defined functions and plugins
+		fn, p, scope := v.lookupFunc(name)
+		switch {
+		case fn != nil:
+			return v.callUserFunc(fn, scope, strings.TrimSpace(args))
+		case p != nil:
+			if scope != nil {
+				name = name[strings.LastIndexByte(name, '.')+1:]
+			}
+			return v.callPlugin(p, name, strings.TrimSpace(args))
 		}
 		return ""
 	}
 }
 
-func (v *Vars) callUserFunc(fn *FuncDef, args string) string {
+// callUserFunc calls fn. Its body is expanded in the caller's scope, or,
+// for a function exported by a scoped include, in the scope that
+// defined it, falling back to the caller's.
+func (v *Vars) callUserFunc(fn *FuncDef, scope *Vars, args string) string {
 	// Expand arguments before binding to parameters
 	expanded := v.Expand(args)
 
 	// Split expanded args into words, one per parameter
 	words := strings.Fields(expanded)
 
-	// Create a child scope with parameters bound
-	child := v.Clone()
+	// Bind the parameters in a scope of their own, nested in the caller's
+	// or the defining scope's, so $^name reads past a parameter.
+	var child *Vars
+	if scope != nil {
+		child = scope.child()
+		child.caller = v
+	} else {
+		child = v.child()
+	}
 	for i, param := range fn.Params {
 		if i < len(words) {
 			child.Set(param, words[i])
@@ -332,23 +748,343 @@ func (v *Vars) callUserFunc(fn *FuncDef, args string) string {
 	return child.Expand(fn.Body)
 }
 
-func (v *Vars) funcWildcard(pattern string) string {
-	pattern = v.Expand(pattern)
-	matches, err := wildcardGlob(pattern)
+func (v *Vars) callPlugin(p *Plugin, name, args string) string {
+	out, err := p.Call(v.context(), name, v.Expand(args))
+	if err != nil {
+		v.warnf("%v\n", err)
+		return ""
+	}
+	return out
+}
+
+// funcWildcard implements $[wildcard patterns] and $[wildcard patterns,key],
+// where key orders the matches (name, mtime or size; default name).
+func (v *Vars) funcWildcard(args string) string {
+	pattern, key, _ := strings.Cut(v.Expand(args), ",")
+	root := v
+	for root.parent != nil {
+		root = root.parent
+	}
+	if root.globbed != nil {
+		root.globbed(pattern)
+	}
+	matches, err := v.wildcardGlob(pattern, strings.TrimSpace(key))
 	if err != nil {
+		v.warnf("wildcard: %v\n", err)
 		return ""
 	}
 	return strings.Join(matches, " ")
 }
 
-func (v *Vars) funcShell(cmd string) string {
-	cmd = v.Expand(cmd)
-	out, err := runShellCapture(cmd)
+// funcMatch implements $[match pattern,text]: the captures of each word
+// of text that pattern matches (see Pattern.Stem), in order.
+func (v *Vars) funcMatch(args string) string {
+	pat, text, ok := cutPatternArg(v.Expand(args))
+	if !ok {
+		return ""
+	}
+	p, err := v.parseFuncPattern("match", pat)
 	if err != nil {
 		return ""
 	}
+	var result []string
+	for _, w := range strings.Fields(text) {
+		if captures, ok := p.Match(w); ok {
+			result = append(result, p.Stem(captures))
+		}
+	}
+	return strings.Join(result, " ")
+}
+
+// funcCaptures implements $[captures pattern]: the captures of each
+// existing file pattern matches, sorted and deduplicated.
+func (v *Vars) funcCaptures(args string) string {
+	p, err := v.parseFuncPattern("captures", strings.TrimSpace(v.Expand(args)))
+	if err != nil {
+		return ""
+	}
+	return v.mapFiles("captures", p, p.Stem)
+}
+
+// funcTargetsOf implements $[targets-of source -> target]: target, with
+// the captures of each existing file source matches, sorted and
+// deduplicated. The arrow may also be written →.
+func (v *Vars) funcTargetsOf(args string) string {
+	args = v.Expand(args)
+	src, tgt, ok := cutOutsideBraces(args, "->")
+	if !ok {
+		src, tgt, ok = cutOutsideBraces(args, "→")
+	}
+	if !ok {
+		v.warnf("targets-of: want source -> target, got %q\n", args)
+		return ""
+	}
+	srcPat, err := v.parseFuncPattern("targets-of", src)
+	if err != nil {
+		return ""
+	}
+	tgtPat, _, err := ParsePattern(strings.TrimSpace(tgt))
+	if err == nil {
+		err = checkCapturesBound(srcPat, tgtPat)
+	}
+	if err != nil {
+		v.warnf("targets-of: %v\n", err)
+		return ""
+	}
+	return v.mapFiles("targets-of", srcPat, tgtPat.Expand)
+}
+
+// funcOutputs implements $[outputs target]: the targets the pattern rule
+// for target can build from existing files, as $[targets-of] would with
+// the rule's first prerequisite pattern as the source.
+func (v *Vars) funcOutputs(args string) string {
+	tgt := strings.TrimSpace(v.Expand(args))
+	root := v
+	for root.parent != nil {
+		root = root.parent
+	}
+	var src Pattern
+	ok := false
+	if root.sources != nil {
+		src, ok = root.sources(tgt)
+	}
+	if !ok {
+		v.warnf("outputs: no pattern rule with a prerequisite pattern builds %s\n", tgt)
+		return ""
+	}
+	tgtPat, _, _ := ParsePattern(tgt) // parsed when the rule was added
+	if err := checkCapturesBound(src, tgtPat); err != nil {
+		v.warnf("outputs: %v\n", err)
+		return ""
+	}
+	return v.mapFiles("outputs", src, tgtPat.Expand)
+}
+
+// funcAll implements $[all target]: every name matching the target
+// pattern that the pattern rules for it can build from existing files,
+// following chains of pattern rules back to the files, sorted.
+func (v *Vars) funcAll(args string) string {
+	tgt := strings.TrimSpace(v.Expand(args))
+	root := v
+	for root.parent != nil {
+		root = root.parent
+	}
+	var names []string
+	ok := false
+	if root.derivable != nil {
+		names, ok = root.derivable(tgt)
+	}
+	if !ok {
+		v.warnf("all: no pattern rule builds %s\n", tgt)
+		return ""
+	}
+	return strings.Join(names, " ")
+}
+
+// funcArtifact implements $[artifact target]: the SHA-256 of target's
+// content, as recorded in the build manifest. In a recipe, which is
+// expanded once its prerequisites are built, that's the hash of the
+// freshly built file, so a rule that references it reruns whenever the
+// artifact changes.
+func (v *Vars) funcArtifact(args string) string {
+	target := strings.TrimSpace(v.Expand(args))
+	h, err := hashFile(v.workspace().path(target))
+	if err != nil {
+		v.warnf("artifact: %v\n", err)
+		return ""
+	}
+	return h
+}
+
+// funcMk implements $[mk targets]: it builds targets in the running
+// build, as though they were prerequisites of the rule whose recipe is
+// expanded, and returns their names. Outside a recipe, as for --why,
+// which expands recipes to hash them, the names are returned without
+// building anything.
+func (v *Vars) funcMk(args string) string {
+	targets := strings.Fields(v.Expand(args))
+	if build := v.builder(); build != nil {
+		return strings.Join(build(targets), " ")
+	}
+	root := v
+	for root.parent != nil {
+		root = root.parent
+	}
+	if root.globbed != nil {
+		v.warnf("mk: can't build %s while the mkfile is evaluated; use $[mk] in a recipe or a lazy variable\n", strings.Join(targets, " "))
+	}
+	return strings.Join(targets, " ")
+}
+
+// builder returns the mk function of this scope or the nearest that
+// encloses or calls it, or nil.
+func (v *Vars) builder() func([]string) []string {
+	if v.mk != nil {
+		return v.mk
+	}
+	if v.parent != nil {
+		if b := v.parent.builder(); b != nil {
+			return b
+		}
+	}
+	if v.caller != nil {
+		return v.caller.builder()
+	}
+	return nil
+}
+
+// mapFiles returns f of the captures of each existing file p matches,
+// sorted and deduplicated. fn names the calling function in errors.
+func (v *Vars) mapFiles(fn string, p Pattern, f func(map[string]string) string) string {
+	matches, err := v.glob(p.Glob())
+	if err != nil {
+		v.warnf("%s: %v\n", fn, err)
+		return ""
+	}
+	var result []string
+	for _, m := range matches {
+		if captures, ok := p.Match(filepath.ToSlash(m)); ok {
+			result = append(result, f(captures))
+		}
+	}
+	slices.Sort(result)
+	return strings.Join(slices.Compact(result), " ")
+}
+
+// checkCapturesBound reports a capture of tgt that src doesn't bind.
+func checkCapturesBound(src, tgt Pattern) error {
+	for _, c := range tgt.Captures {
+		if !slices.Contains(src.Captures, c) {
+			return fmt.Errorf("%s captures no {%s} for %s", src.Raw, c, tgt.Raw)
+		}
+	}
+	return nil
+}
+
+// parseFuncPattern parses the pattern argument of $[match], $[captures]
+// or $[targets-of], reporting a malformed or capture-less one.
+func (v *Vars) parseFuncPattern(fn, s string) (Pattern, error) {
+	p, ok, err := ParsePattern(s)
+	if err == nil && !ok {
+		err = fmt.Errorf("pattern %q has no {captures}", s)
+	}
+	if err != nil {
+		v.warnf("%s: %v\n", fn, err)
+	}
+	return p, err
+}
+
+// cutPatternArg splits args at the first comma outside braces, so a
+// pattern's {ext:c,cc} or {n/\d{1,3}} stays whole.
+func cutPatternArg(args string) (pattern, rest string, ok bool) {
+	return cutOutsideBraces(args, ",")
+}
+
+// cutOutsideBraces splits s at the first sep outside braces, trimming
+// space from the part before it.
+func cutOutsideBraces(s, sep string) (before, after string, ok bool) {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '{':
+			depth++
+		case s[i] == '}':
+			depth--
+		case depth == 0 && strings.HasPrefix(s[i:], sep):
+			return strings.TrimSpace(s[:i]), s[i+len(sep):], true
+		}
+	}
+	return "", "", false
+}
+
+// workspace returns the workspace of the top-level scope.
+// glob is the workspace's glob, through the cache while the graph is
+// built.
+func (v *Vars) glob(pattern string) ([]string, error) {
+	root := v
+	for root.parent != nil {
+		root = root.parent
+	}
+	if root.globs != nil {
+		return root.globs.glob(root.dir, pattern)
+	}
+	return root.dir.glob(pattern)
+}
+
+// wildcardGlob expands space-separated glob patterns. Matches are
+// deduplicated and ordered by key (see sortPaths) so that results don't
+// depend on pattern order or the filesystem.
+func (v *Vars) wildcardGlob(pattern, key string) ([]string, error) {
+	var all []string
+	for _, p := range strings.Fields(pattern) {
+		matches, err := v.glob(p)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, matches...)
+	}
+	return v.workspace().sortPaths(all, key)
+}
+
+func (v *Vars) workspace() workspace {
+	root := v
+	for root.parent != nil {
+		root = root.parent
+	}
+	return root.dir
+}
+
+// warnf reports a problem evaluating a function, prefixed "mk: ".
+func (v *Vars) warnf(format string, args ...any) {
+	root := v
+	for root.parent != nil {
+		root = root.parent
+	}
+	w := root.stderr
+	if w == nil {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, "mk: "+format, args...)
+}
+
+func (v *Vars) funcShell(cmd string) string {
+	out, _ := v.shell(v.Expand(cmd))
+	return out
+}
+
+// shell runs cmd and returns its output on one line.
+func (v *Vars) shell(cmd string) (string, error) {
+	out, err := runShellCapture(v.context(), v.workspace(), cmd)
+	if err != nil {
+		return "", err
+	}
 	// Replace newlines with spaces, trim
-	out = strings.ReplaceAll(strings.TrimSpace(out), "\n", " ")
+	return strings.ReplaceAll(strings.TrimSpace(out), "\n", " "), nil
+}
+
+// funcCachedShell implements $[shell? cmd] and $[shell? cmd ;; file...]:
+// $[shell cmd], but with the output kept in the build state and reused
+// while the expanded command and the content of the listed files stay
+// the same. Failed commands aren't cached.
+func (v *Vars) funcCachedShell(args string) string {
+	cmd, files, _ := strings.Cut(v.Expand(args), ";;")
+	cmd = strings.TrimSpace(cmd)
+	root := v
+	for root.parent != nil {
+		root = root.parent
+	}
+	if root.shellCache == nil {
+		return v.funcShell(cmd)
+	}
+	inputs := v.workspace().hashInputs(strings.Fields(files))
+	if out, ok := root.shellCache.cachedShell(cmd, inputs); ok {
+		return out
+	}
+	out, err := v.shell(cmd)
+	if err != nil {
+		return ""
+	}
+	root.shellCache.recordShell(cmd, inputs, out)
 	return out
 }
 
@@ -422,7 +1158,7 @@ func (v *Vars) funcDir(args string) string {
 	words := strings.Fields(text)
 	var result []string
 	for _, w := range words {
-		d := filepath.Dir(w)
+		d := dirName(w)
 		if d == "." {
 			result = append(result, "./")
 		} else {
@@ -562,7 +1298,7 @@ func (v *Vars) funcFindstring(args string) string {
 
 func (v *Vars) funcIf(args string) string {
 	// $[if condition,then-val,else-val]
-	parts := strings.SplitN(args, ",", 3)
+	parts := splitArgs(args, 3)
 	if len(parts) < 2 {
 		return ""
 	}
@@ -576,6 +1312,47 @@ func (v *Vars) funcIf(args string) string {
 	return ""
 }
 
+func (v *Vars) funcForeach(args string) string {
+	// $[foreach var,list,text]: text, expanded with var bound to each
+	// word of list in turn, joined by spaces
+	parts := splitArgs(args, 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	name := strings.TrimSpace(parts[0])
+	child := v.child()
+	var out []string
+	for _, w := range strings.Fields(v.Expand(parts[1])) {
+		child.Set(name, w)
+		if s := strings.TrimSpace(child.Expand(parts[2])); s != "" {
+			out = append(out, s)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// splitArgs splits a function's unexpanded arguments at up to n-1 commas
+// that aren't inside a nested $[...], $(...) or ${...}, so that
+// $[if $[filter a,$x],y,z] sees three arguments.
+func splitArgs(args string, n int) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case '[', '(', '{':
+			depth++
+		case ']', ')', '}':
+			depth--
+		case ',':
+			if depth == 0 && len(parts) < n-1 {
+				parts = append(parts, args[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, args[start:])
+}
+
 func patsubstWord(pattern, replacement, word string) string {
 	// Simple % substitution
 	if !strings.Contains(pattern, "%") {
@@ -617,6 +1394,23 @@ func findMatchingBracket(s string) int {
 	return -1
 }
 
+// scopePrefixLen returns the length of the ^ or :: prefix of the
+// variable reference at the start of s, if a name follows it.
+func scopePrefixLen(s string) int {
+	n := 0
+	if strings.HasPrefix(s, "::") {
+		n = 2
+	} else {
+		for n < len(s) && s[n] == '^' {
+			n++
+		}
+	}
+	if n == 0 || n >= len(s) || !isIdentStart(s[n]) {
+		return 0
+	}
+	return n
+}
+
 func isIdentStart(c byte) bool {
 	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
 }
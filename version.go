@@ -0,0 +1,111 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is the running mk's version, such as "v0.8.0", or "dev" for a
+// build that doesn't know its version. The mk command sets it from its
+// linker flags or module version; embedders may set it too.
+var Version = "dev"
+
+// CheckVersion reports whether Version satisfies constraint, as written
+// after mk-version: an operator (>=, >, <=, < or =) and a version such as
+// 0.5 or v0.8.1. Development builds satisfy every constraint.
+func CheckVersion(constraint string) error {
+	op, want, err := parseVersionConstraint(constraint)
+	if err != nil {
+		return err
+	}
+	have, ok := parseVersion(Version)
+	if !ok {
+		return nil // dev build
+	}
+	c := compareVersions(have, want)
+	satisfied := false
+	switch op {
+	case ">=":
+		satisfied = c >= 0
+	case ">":
+		satisfied = c > 0
+	case "<=":
+		satisfied = c <= 0
+	case "<":
+		satisfied = c < 0
+	case "=":
+		satisfied = c == 0
+	}
+	if !satisfied {
+		return fmt.Errorf("this mkfile requires mk %s; this is mk %s", strings.TrimSpace(constraint), Version)
+	}
+	return nil
+}
+
+func parseVersionConstraint(constraint string) (op string, v version, err error) {
+	s := strings.TrimSpace(constraint)
+	for _, o := range []string{">=", "<=", ">", "<", "="} {
+		if rest, ok := strings.CutPrefix(s, o); ok {
+			v, ok := parseVersion(strings.TrimSpace(rest))
+			if !ok {
+				return "", version{}, fmt.Errorf("mk-version: bad version %q", strings.TrimSpace(rest))
+			}
+			return o, v, nil
+		}
+	}
+	return "", version{}, fmt.Errorf("mk-version: want an operator (>=, >, <=, < or =) and a version, got %q", s)
+}
+
+// version is a parsed semantic version. A missing minor or patch number
+// is zero.
+type version struct {
+	nums [3]int
+	pre  string // prerelease, e.g. "rc.1" or a pseudo-version's suffix
+}
+
+func parseVersion(s string) (version, bool) {
+	s = strings.TrimPrefix(s, "v")
+	s, _, _ = strings.Cut(s, "+") // build metadata doesn't order
+	core, pre, _ := strings.Cut(s, "-")
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return version{}, false
+	}
+	var v version
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return version{}, false
+		}
+		v.nums[i] = n
+	}
+	v.pre = pre
+	return v, true
+}
+
+// compareVersions orders a and b; a prerelease comes before its release.
+func compareVersions(a, b version) int {
+	for i := range a.nums {
+		if a.nums[i] != b.nums[i] {
+			if a.nums[i] < b.nums[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case a.pre == b.pre:
+		return 0
+	case a.pre == "":
+		return 1
+	case b.pre == "":
+		return -1
+	case a.pre < b.pre:
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,69 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckVersion(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+
+	Version = "v0.8.1"
+	for constraint, want := range map[string]bool{
+		">= 0.5":       true,
+		">= 0.8.1":     true,
+		">=v0.9":       false,
+		"> 0.8.1":      false,
+		"< 1":          true,
+		"<= 0.8":       false,
+		"= 0.8.1":      true,
+		">= 0.8.1-rc1": true,
+	} {
+		if err := CheckVersion(constraint); (err == nil) != want {
+			t.Errorf("CheckVersion(%q) = %v, want ok=%v", constraint, err, want)
+		}
+	}
+	for _, bad := range []string{"0.5", ">= five", ">= 1.2.3.4"} {
+		if err := CheckVersion(bad); err == nil {
+			t.Errorf("CheckVersion(%q) accepted a malformed constraint", bad)
+		}
+	}
+
+	Version = "v0.8.0-rc.1"
+	if err := CheckVersion(">= 0.8"); err == nil {
+		t.Error("a prerelease satisfied >= its release")
+	}
+	Version = "dev"
+	if err := CheckVersion(">= 99"); err != nil {
+		t.Errorf("dev build: %v", err)
+	}
+}
+
+func TestParseMKVersion(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "v0.4.2"
+
+	// The version check comes before syntax this mk doesn't know.
+	_, err := Parse(strings.NewReader("x = 1\nmk-version >= 0.5  # needs newer syntax\nsome future ::: syntax\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2: this mkfile requires mk >= 0.5; this is mk v0.4.2") {
+		t.Errorf("err = %v, want the version requirement", err)
+	}
+
+	f, err := Parse(strings.NewReader("mk-version >= 0.4\nx = 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.MKVersion != ">= 0.4" {
+		t.Errorf("MKVersion = %q", f.MKVersion)
+	}
+	if len(f.Stmts) != 1 {
+		t.Errorf("stmts = %v, want just the assignment", f.Stmts)
+	}
+
+	if _, err := Parse(strings.NewReader("mk-version >= 0.4\nmk-version >= 0.3\n")); err == nil {
+		t.Error("two mk-version directives accepted")
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// wasmModule runs a WASI (preview 1) plugin module in-process.
+//
+// The module speaks the same stdin/stdout JSON protocol as executable
+// plugins. It sees the workspace read-only as its
+// root filesystem and nothing else: no host environment, no network and
+// no writable files, so a plugin cannot escape or modify the workspace.
+type wasmModule struct {
+	path   string
+	args   []string  // argv, including the module name
+	dir    workspace // mounted read-only as the module's root
+	stderr io.Writer
+
+	once     sync.Once
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	err      error
+}
+
+func newWasmModule(dir workspace, stderr io.Writer, path string, args []string) *wasmModule {
+	return &wasmModule{path: path, args: append([]string{filepath.Base(path)}, args...), dir: dir, stderr: stderr}
+}
+
+func (m *wasmModule) load() error {
+	m.once.Do(func() {
+		ctx := context.Background()
+		code, err := os.ReadFile(m.dir.path(m.path))
+		if err != nil {
+			m.err = err
+			return
+		}
+		// Close modules when the calling context is cancelled.
+		m.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, m.runtime); err != nil {
+			m.err = err
+			return
+		}
+		m.compiled, m.err = m.runtime.CompileModule(ctx, code)
+	})
+	return m.err
+}
+
+// close releases the module's runtime. A module that was never loaded
+// won't be afterwards; calls fail instead.
+func (m *wasmModule) close() error {
+	m.once.Do(func() { m.err = errors.New("plugin closed") })
+	if m.runtime == nil {
+		return nil
+	}
+	return m.runtime.Close(context.Background())
+}
+
+// run instantiates a fresh copy of the module with req on stdin and
+// returns what it wrote to stdout.
+func (m *wasmModule) run(ctx context.Context, req []byte) ([]byte, error) {
+	if err := m.load(); err != nil {
+		return nil, fmt.Errorf("loading %s: %w", m.path, err)
+	}
+	var out bytes.Buffer
+	cfg := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(m.args...).
+		WithStdin(bytes.NewReader(req)).
+		WithStdout(&out).
+		WithStderr(m.stderr).
+		WithFSConfig(wazero.NewFSConfig().WithReadOnlyDirMount(m.dir.path("."), "/"))
+	mod, err := m.runtime.InstantiateModule(ctx, m.compiled, cfg)
+	if mod != nil {
+		mod.Close(context.Background())
+	}
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
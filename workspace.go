@@ -0,0 +1,107 @@
+// Copyright 2026 The mk Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package mk
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A workspace is the directory that a project's relative paths — targets,
+// prerequisites, includes, globs, the .mk state directory — are resolved
+// against, and that recipes and shell commands run in. The empty
+// workspace is the current directory, so a Project never needs the
+// process to change directory and several can build at once.
+type workspace string
+
+// mkfileWorkspace returns the workspace of the mkfile at path, relative
+// to dir: the directory the mkfile is in, so that a project's paths, and
+// the target names its state records, don't depend on where mk was run
+// from.
+func mkfileWorkspace(dir, path string) workspace {
+	root := workspace(dir).path(filepath.Dir(path))
+	if root == "." {
+		return ""
+	}
+	return workspace(root)
+}
+
+// path returns p resolved against the workspace.
+func (w workspace) path(p string) string {
+	if w == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(string(w), p)
+}
+
+// glob is filepath.Glob for a pattern relative to the workspace. Matches
+// are relative to it too, spelled as the pattern spells them, with
+// forward slashes.
+func (w workspace) glob(pattern string) ([]string, error) {
+	matches, _, err := w.countGlob(pattern)
+	return matches, err
+}
+
+// countGlob is glob, also returning the number of file system calls
+// it made.
+func (w workspace) countGlob(pattern string) ([]string, int, error) {
+	stats := 0
+	if w == "" || filepath.IsAbs(pattern) {
+		matches, err := countGlob(pattern, &stats)
+		for i, m := range matches {
+			matches[i] = filepath.ToSlash(m)
+		}
+		return matches, stats, err
+	}
+	prefix := filepath.Clean(string(w)) + string(filepath.Separator)
+	matches, err := countGlob(globEscape(prefix)+pattern, &stats)
+	for i, m := range matches {
+		matches[i] = filepath.ToSlash(strings.TrimPrefix(m, prefix))
+	}
+	return matches, stats, err
+}
+
+// joinName joins name to dir and cleans it, as the name of a file in
+// the graph. Such names use forward slashes on every platform, so that
+// a mkfile, and the state and cache that record its targets, mean the
+// same on Windows; the file system accepts them as they are.
+func joinName(dir, name string) string {
+	return filepath.ToSlash(filepath.Clean(filepath.Join(dir, name)))
+}
+
+// relName returns name, a file in the graph, relative to dir, another,
+// as a recipe running in dir names it. Absolute names are kept, as is
+// every name if dir is "", the workspace root.
+func relName(dir, name string) string {
+	if dir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	rel, err := filepath.Rel(dir, name)
+	if err != nil {
+		return name
+	}
+	return filepath.ToSlash(rel)
+}
+
+// dirName returns the directory of the file name, with forward slashes.
+func dirName(name string) string {
+	return filepath.ToSlash(filepath.Dir(name))
+}
+
+// command returns a command that runs in the workspace.
+func (w workspace) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = string(w)
+	return cmd
+}
+
+// shellCommand returns a command that runs script in the workspace with
+// the default interpreter, for $[shell ...], fingerprints and plugins:
+// sh, or PowerShell on Windows without one.
+func (w workspace) shellCommand(ctx context.Context, script string) *exec.Cmd {
+	args := defaultInterpreter().command(script)
+	return w.command(ctx, args[0], args[1:]...)
+}